@@ -1,6 +1,7 @@
 package apiserver
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/pprof"
 
@@ -13,25 +14,34 @@ import (
 // A Server defines parameters for running an apiserver http server.
 type Server struct {
 	simpleserver.Server
+	mux *http.ServeMux
 }
 
 const name = "apiserver"
 
 // New allocates a new apiserver Server.
 func New(addr string, logger *slog.Logger, defaultLogLevel slog.Level) *Server {
+	mux := Handler(logger, defaultLogLevel)
+
 	return &Server{
 		Server: simpleserver.Server{
 			Name:    name,
 			Logger:  logger,
 			Addr:    addr,
-			Handler: Handler(logger, defaultLogLevel),
+			Handler: mux,
 		},
+		mux: mux,
 	}
 }
 
-// Handler returns an http.Handler that responds properly to all apiserver
+// Handle registers an additional route with the apiserver.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Handler returns an http.ServeMux that responds properly to all apiserver
 // routes.
-func Handler(logger *slog.Logger, defaultLogLevel slog.Level) http.Handler {
+func Handler(logger *slog.Logger, defaultLogLevel slog.Level) *http.ServeMux {
 	ret := http.NewServeMux()
 
 	ret.HandleFunc("/debug/pprof/", pprof.Index)
@@ -50,6 +60,21 @@ func Handler(logger *slog.Logger, defaultLogLevel slog.Level) http.Handler {
 	return ret
 }
 
+// JSONHandler returns an http.Handler that responds with the json encoding of
+// the value returned by fn.
+func JSONHandler(fn func() interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(fn()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
 func reqLeveler(prefix string, defaultLogLevel slog.Level) LevelerFunc {
 	return func(req *http.Request) slog.Level {
 		return slog.ParseLevel(req.URL.Path[len(prefix):], defaultLogLevel)
@@ -6,7 +6,9 @@ import (
 )
 
 type Blocker interface {
-	parser.HostAdder
+	parser.DomainAdder
 	dnsserver.Blocker
+	dnsserver.SourceBlocker
 	Len() int
+	Sources() map[string]int
 }
@@ -18,6 +18,9 @@ func TestBlocker(t *testing.T) {
 			t.AddHost("another source", "www.example.com")
 			So(t.Len(), ShouldEqual, 1)
 			So(t.Block("www.example.com"), ShouldBeTrue)
+			So(t.BlockSources("www.example.com"), ShouldResemble, []string{"another source", "the source"})
+			So(t.BlockSources("example.com"), ShouldBeEmpty)
+			So(t.Sources(), ShouldResemble, map[string]int{"another source": 1, "the source": 1})
 
 			So(t.Block("example.com"), ShouldBeFalse)
 			So(t.Block("sub.www.example.com"), ShouldBeFalse)
@@ -31,4 +34,48 @@ func TestBlocker(t *testing.T) {
 			So(t.Block("www.example.com"), ShouldBeFalse)
 		}
 	})
+
+	Convey("blockers should find any of many hosts", t, func() {
+		hosts := []string{"d.com", "b.com", "e.com", "a.com", "c.com"}
+
+		for _, t := range []Blocker{&RadixBlocker{}, &HashBlocker{}, &SliceBlocker{}} {
+			for _, host := range hosts {
+				t.AddHost("the source", host)
+			}
+
+			So(t.Len(), ShouldEqual, len(hosts))
+
+			for _, host := range hosts {
+				So(t.Block(host), ShouldBeTrue)
+			}
+
+			So(t.Block("f.com"), ShouldBeFalse)
+		}
+	})
+
+	Convey("blockers should block subdomains of domains", t, func() {
+		for _, t := range []Blocker{&RadixBlocker{}, &HashBlocker{}, &SliceBlocker{}} {
+			t.AddDomain("the source", "example.com")
+			t.AddHost("another source", "www.example.com")
+			t.AddHost("another source", "example.org")
+			So(t.Len(), ShouldEqual, 3)
+
+			So(t.Block("example.com"), ShouldBeTrue)
+			So(t.Block("sub.www.example.com"), ShouldBeTrue)
+			So(t.Block("com"), ShouldBeFalse)
+			So(t.Block("notexample.com"), ShouldBeFalse)
+			So(t.Block("example.com.au"), ShouldBeFalse)
+			So(t.Block("example.org"), ShouldBeTrue)
+			So(t.Block("www.example.org"), ShouldBeFalse)
+
+			So(t.BlockSources("example.com"), ShouldResemble, []string{"the source"})
+			So(t.BlockSources("www.example.com"), ShouldResemble, []string{"another source", "the source"})
+			So(t.BlockSources("www.example.org"), ShouldBeEmpty)
+			So(t.Sources(), ShouldResemble, map[string]int{"another source": 2, "the source": 1})
+
+			t.Reset("the source")
+			So(t.Block("sub.www.example.com"), ShouldBeFalse)
+			So(t.Block("www.example.com"), ShouldBeTrue)
+		}
+	})
 }
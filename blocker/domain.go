@@ -0,0 +1,22 @@
+package blocker
+
+import "strings"
+
+// domainKey returns the key that domain, which includes its subdomains, is
+// stored with. The leading dot keeps it from matching a host of the same name.
+func domainKey(domain string) string {
+	return "." + domain
+}
+
+// domainKeys returns the keys of the domains that include host, i.e. host and
+// each of its parents
+func domainKeys(host string) []string {
+	ret := []string{domainKey(host)}
+
+	for i := strings.IndexByte(host, '.'); i != -1; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		ret = append(ret, domainKey(host))
+	}
+
+	return ret
+}
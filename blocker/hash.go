@@ -25,6 +25,11 @@ func (b *HashBlocker) AddHost(source, host string) {
 	s.Add(source)
 }
 
+// AddDomain blocks domain and all of its subdomains
+func (b *HashBlocker) AddDomain(source, domain string) {
+	b.AddHost(source, domainKey(domain))
+}
+
 func (b *HashBlocker) Block(host string) bool {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
@@ -33,8 +38,37 @@ func (b *HashBlocker) Block(host string) bool {
 		return false
 	}
 
-	_, ok := b.m[host]
-	return ok
+	if _, ok := b.m[host]; ok {
+		return true
+	}
+
+	for _, key := range domainKeys(host) {
+		if _, ok := b.m[key]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BlockSources returns the sources that block host
+func (b *HashBlocker) BlockSources(host string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var ret sources
+
+	b.m[host].merge(&ret)
+
+	for _, key := range domainKeys(host) {
+		b.m[key].merge(&ret)
+	}
+
+	if len(ret) == 0 {
+		return nil
+	}
+
+	return ret
 }
 
 func (b *HashBlocker) Len() int {
@@ -44,6 +78,19 @@ func (b *HashBlocker) Len() int {
 	return len(b.m)
 }
 
+// Sources returns the number of hosts from each source
+func (b *HashBlocker) Sources() map[string]int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	ret := map[string]int{}
+	for _, s := range b.m {
+		s.count(ret)
+	}
+
+	return ret
+}
+
 func (b *HashBlocker) Reset(source string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -1,6 +1,7 @@
 package blocker
 
 import (
+	"strings"
 	"sync"
 
 	"jrubin.io/blamedns/parser"
@@ -14,11 +15,20 @@ type RadixBlocker struct {
 }
 
 func (b *RadixBlocker) AddHost(source, host string) {
+	b.add(source, parser.ReverseHostName(host))
+}
+
+// AddDomain blocks domain and all of its subdomains. Its key has a trailing dot
+// so that it is a prefix of the keys of its subdomains, but not of hosts
+// sharing its name as a prefix.
+func (b *RadixBlocker) AddDomain(source, domain string) {
+	b.add(source, parser.ReverseHostName(domain)+".")
+}
+
+func (b *RadixBlocker) add(source, key string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	key := parser.ReverseHostName(host)
-
 	if b.data == nil {
 		b.data = radix.New()
 		b.data.Insert(key, newSources(source))
@@ -40,6 +50,19 @@ func (b *RadixBlocker) AddHost(source, host string) {
 	s.Add(source)
 }
 
+// walk calls fn with the value of host and of each domain that includes it
+func (b *RadixBlocker) walk(host string, fn func(value interface{}) bool) {
+	key := parser.ReverseHostName(host)
+
+	if value, ok := b.data.Get(key); ok && fn(value) {
+		return
+	}
+
+	b.data.WalkPath(key+".", func(k string, value interface{}) bool {
+		return strings.HasSuffix(k, ".") && fn(value)
+	})
+}
+
 func (b *RadixBlocker) Block(host string) bool {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
@@ -48,10 +71,37 @@ func (b *RadixBlocker) Block(host string) bool {
 		return false
 	}
 
-	key := parser.ReverseHostName(host)
+	found := false
+	b.walk(host, func(interface{}) bool {
+		found = true
+		return true
+	})
+
+	return found
+}
+
+// BlockSources returns the sources that block host
+func (b *RadixBlocker) BlockSources(host string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.data == nil {
+		return nil
+	}
+
+	var ret sources
+	b.walk(host, func(value interface{}) bool {
+		if s, ok := value.(*sources); ok {
+			s.merge(&ret)
+		}
+		return false
+	})
 
-	_, ok := b.data.Get(key)
-	return ok
+	if len(ret) == 0 {
+		return nil
+	}
+
+	return ret
 }
 
 func (b *RadixBlocker) Len() int {
@@ -65,6 +115,27 @@ func (b *RadixBlocker) Len() int {
 	return b.data.Len()
 }
 
+// Sources returns the number of hosts from each source
+func (b *RadixBlocker) Sources() map[string]int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	ret := map[string]int{}
+
+	if b.data == nil {
+		return ret
+	}
+
+	b.data.Walk(func(key string, value interface{}) bool {
+		if s, ok := value.(*sources); ok {
+			s.count(ret)
+		}
+		return false
+	})
+
+	return ret
+}
+
 func (b *RadixBlocker) Reset(source string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -17,7 +17,7 @@ type SliceBlocker struct {
 
 func (b *SliceBlocker) search(host string) int {
 	return sort.Search(len(b.hosts), func(i int) bool {
-		return b.hosts[i].Host == host
+		return b.hosts[i].Host >= host
 	})
 }
 
@@ -51,12 +51,46 @@ func (b *SliceBlocker) AddHost(source, host string) {
 	}
 }
 
+// AddDomain blocks domain and all of its subdomains
+func (b *SliceBlocker) AddDomain(source, domain string) {
+	b.AddHost(source, domainKey(domain))
+}
+
 func (b *SliceBlocker) Block(host string) bool {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	_, exist := b.has(host)
-	return exist
+	if _, exist := b.has(host); exist {
+		return true
+	}
+
+	for _, key := range domainKeys(host) {
+		if _, exist := b.has(key); exist {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BlockSources returns the sources that block host
+func (b *SliceBlocker) BlockSources(host string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var ret sources
+
+	for _, key := range append([]string{host}, domainKeys(host)...) {
+		if n, exist := b.has(key); exist {
+			b.hosts[n].Sources.merge(&ret)
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil
+	}
+
+	return ret
 }
 
 func (b *SliceBlocker) Len() int {
@@ -66,6 +100,19 @@ func (b *SliceBlocker) Len() int {
 	return len(b.hosts)
 }
 
+// Sources returns the number of hosts from each source
+func (b *SliceBlocker) Sources() map[string]int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	ret := map[string]int{}
+	for _, hd := range b.hosts {
+		hd.Sources.count(ret)
+	}
+
+	return ret
+}
+
 func (b *SliceBlocker) Reset(source string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
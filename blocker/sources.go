@@ -51,6 +51,28 @@ func (s *sources) Len() int {
 	return len(*s)
 }
 
+// count adds one to the number of hosts of each of s in m
+func (s *sources) count(m map[string]int) {
+	if s == nil {
+		return
+	}
+
+	for _, source := range *s {
+		m[source]++
+	}
+}
+
+// merge adds each of s to ret
+func (s *sources) merge(ret *sources) {
+	if s == nil {
+		return
+	}
+
+	for _, source := range *s {
+		ret.Add(source)
+	}
+}
+
 func newSources(s ...string) *sources {
 	ret := sources(s)
 	return &ret
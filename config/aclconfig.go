@@ -0,0 +1,59 @@
+package config
+
+import (
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+// loopback, private and link local ranges
+var defaultACLAllow = StringSlice{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+type ACLConfig struct {
+	Allow  StringSlice `toml:"allow"`
+	Deny   StringSlice `toml:"deny"`
+	Action string      `toml:"action"`
+}
+
+func NewACLConfig() *ACLConfig {
+	ret := &ACLConfig{
+		Allow:  make(StringSlice, len(defaultACLAllow)),
+		Action: "refuse",
+	}
+
+	copy(ret.Allow, defaultACLAllow)
+
+	return ret
+}
+
+func (c *ACLConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "allow"),
+			EnvVar: envName(prefix, "ALLOW"),
+			Usage:  "clients (ip addresses or networks) that may query any listener, empty allows everyone; override per listener with ?allow= on the listen url",
+			Value:  &c.Allow,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "deny"),
+			EnvVar: envName(prefix, "DENY"),
+			Usage:  "clients (ip addresses or networks) that may never query any listener; override per listener with ?deny= on the listen url",
+			Value:  &c.Deny,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "action"),
+			EnvVar:      envName(prefix, "ACTION"),
+			Usage:       "how to answer clients that are not allowed: refuse or drop",
+			Value:       c.Action,
+			Destination: &c.Action,
+		}),
+	}
+}
@@ -17,10 +17,12 @@ var (
 )
 
 type BlockConfig struct {
-	IPv4      IP          `toml:"ipv4"`
-	IPv6      IP          `toml:"ipv6"`
-	TTL       Duration    `toml:"ttl"`
-	WhiteList StringSlice `toml:"whitelist"`
+	IPv4      IP             `toml:"ipv4"`
+	IPv6      IP             `toml:"ipv6"`
+	TTL       Duration       `toml:"ttl"`
+	WhiteList StringSlice    `toml:"whitelist"`
+	Schedule  BlockSchedules `toml:"schedule"`
+	NonSink   string         `toml:"non_sink"`
 }
 
 func NewBlockConfig() *BlockConfig {
@@ -29,6 +31,7 @@ func NewBlockConfig() *BlockConfig {
 		IPv6:      ParseIP("::1"),
 		TTL:       Duration(1 * time.Hour),
 		WhiteList: make(StringSlice, len(defaultDNSBlockWhiteList)),
+		NonSink:   "ignore",
 	}
 
 	copy(ret.WhiteList, defaultDNSBlockWhiteList)
@@ -62,5 +65,17 @@ func (c *BlockConfig) Flags(prefix string) []cli.Flag {
 			Usage:  "domains to never block",
 			Value:  &c.WhiteList,
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "non-sink"),
+			EnvVar:      envName(prefix, "NON_SINK"),
+			Usage:       "what to do with hosts in hosts files whose address isn't 0.0.0.0, 127.0.0.1, :: or ::1 (ignore, block or override, which only applies to local file:// sources)",
+			Value:       c.NonSink,
+			Destination: &c.NonSink,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "schedule"),
+			Value:  &c.Schedule,
+			Hidden: true,
+		}),
 	}
 }
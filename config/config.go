@@ -11,12 +11,13 @@ import (
 )
 
 type Config struct {
-	CacheDir        string     `toml:"cache_dir"`
-	ListenPixelserv string     `toml:"listen_pixelserv"`
-	ListenAPIServer string     `toml:"listen_apiserver"`
-	Log             *LogConfig `toml:"log"`
-	DL              *DLConfig  `toml:"dl"`
-	DNS             *DNSConfig `toml:"dns"`
+	CacheDir        string      `toml:"cache_dir"`
+	ListenPixelserv string      `toml:"listen_pixelserv"`
+	ListenAPIServer string      `toml:"listen_apiserver"`
+	Log             *LogConfig  `toml:"log"`
+	DL              *DLConfig   `toml:"dl"`
+	DNS             *DNSConfig  `toml:"dns"`
+	DHCP            *DHCPConfig `toml:"dhcp"`
 }
 
 func defaultCacheDir(name string) string {
@@ -33,6 +34,7 @@ func New() *Config {
 		Log:      NewLogConfig(),
 		DL:       NewDLConfig(),
 		DNS:      NewDNSConfig(),
+		DHCP:     NewDHCPConfig(),
 	}
 }
 
@@ -64,6 +66,7 @@ func (c *Config) Flags() []cli.Flag {
 	ret = append(ret, c.Log.Flags("log")...)
 	ret = append(ret, c.DL.Flags("dl")...)
 	ret = append(ret, c.DNS.Flags("dns")...)
+	ret = append(ret, c.DHCP.Flags("dhcp")...)
 
 	return ret
 }
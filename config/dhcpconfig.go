@@ -0,0 +1,94 @@
+package config
+
+import (
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+type DHCPConfig struct {
+	Enable      bool             `toml:"enable"`
+	Listen      string           `toml:"listen"`
+	ServerIP    IP               `toml:"server_ip"`
+	RangeStart  IP               `toml:"range_start"`
+	RangeEnd    IP               `toml:"range_end"`
+	Netmask     IP               `toml:"netmask"`
+	Gateway     IP               `toml:"gateway"`
+	DNS         StringSlice      `toml:"dns"`
+	LeaseTime   Duration         `toml:"lease_time"`
+	Reservation DHCPReservations `toml:"reservation"`
+}
+
+func NewDHCPConfig() *DHCPConfig {
+	return &DHCPConfig{
+		Listen:    ":67",
+		Netmask:   ParseIP("255.255.255.0"),
+		LeaseTime: Duration(24 * time.Hour),
+	}
+}
+
+func (c *DHCPConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        flagName(prefix, "enable"),
+			EnvVar:      envName(prefix, "ENABLE"),
+			Usage:       "run a dhcpv4 server",
+			Destination: &c.Enable,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "listen"),
+			EnvVar:      envName(prefix, "LISTEN"),
+			Usage:       "address to run the dhcp server on",
+			Value:       c.Listen,
+			Destination: &c.Listen,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "server-ip"),
+			EnvVar: envName(prefix, "SERVER_IP"),
+			Usage:  "ip address of this host, used as the dhcp server identifier and, by default, the dns server given to clients",
+			Value:  &c.ServerIP,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "range-start"),
+			EnvVar: envName(prefix, "RANGE_START"),
+			Usage:  "first ip address to lease to clients",
+			Value:  &c.RangeStart,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "range-end"),
+			EnvVar: envName(prefix, "RANGE_END"),
+			Usage:  "last ip address to lease to clients",
+			Value:  &c.RangeEnd,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "netmask"),
+			EnvVar: envName(prefix, "NETMASK"),
+			Usage:  "subnet mask to give to clients",
+			Value:  &c.Netmask,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "gateway"),
+			EnvVar: envName(prefix, "GATEWAY"),
+			Usage:  "default gateway to give to clients",
+			Value:  &c.Gateway,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "dns"),
+			EnvVar: envName(prefix, "DNS"),
+			Usage:  "dns servers to give to clients, defaults to the server ip",
+			Value:  &c.DNS,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "lease-time"),
+			EnvVar: envName(prefix, "LEASE_TIME"),
+			Usage:  "how long leases are valid for",
+			Value:  &c.LeaseTime,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "reservation"),
+			Value:  &c.Reservation,
+			Hidden: true,
+		}),
+	}
+}
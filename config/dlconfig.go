@@ -29,6 +29,15 @@ type DLConfig struct {
 	Hosts          StringSlice `toml:"hosts"`
 	Domains        StringSlice `toml:"domains"`
 	DebugHTTP      bool        `toml:"debug_http"`
+	MinLines       int         `toml:"min_lines"`
+	MaxSize        int         `toml:"max_size"`
+	MinValidRatio  float64     `toml:"min_valid_ratio"`
+	Checksum       bool        `toml:"checksum"`
+	MinisignKey    string      `toml:"minisign_key"`
+	RetryMin       Duration    `toml:"retry_min"`
+	RetryMax       Duration    `toml:"retry_max"`
+	Mirror         DLMirrors   `toml:"mirror"`
+	Source         DLSources   `toml:"source"`
 }
 
 func NewDLConfig() *DLConfig {
@@ -36,6 +45,11 @@ func NewDLConfig() *DLConfig {
 		UpdateInterval: Duration(24 * time.Hour),
 		Hosts:          make(StringSlice, len(defaultDLHosts)),
 		Domains:        make(StringSlice, len(defaultDLDomains)),
+		MinLines:       1,
+		MaxSize:        64 << 20,
+		MinValidRatio:  0.5,
+		RetryMin:       Duration(time.Minute),
+		RetryMax:       Duration(time.Hour),
 	}
 
 	copy(ret.Hosts, defaultDLHosts)
@@ -56,13 +70,13 @@ func (c *DLConfig) Flags(prefix string) []cli.Flag {
 			Name:   flagName(prefix, "hosts"),
 			EnvVar: envName(prefix, "HOSTS"),
 			Value:  &c.Hosts,
-			Usage:  "files to download in \"/etc/hosts\" format from which to derive blocked hostnames",
+			Usage:  "files to download in \"/etc/hosts\" format from which to derive blocked hostnames, file:// urls of local files or directories are watched in place",
 		}),
 		altsrc.NewGenericFlag(cli.GenericFlag{
 			Name:   flagName(prefix, "domains"),
 			EnvVar: envName(prefix, "DOMAINS"),
 			Value:  &c.Domains,
-			Usage:  "files to download with one domain per line to block",
+			Usage:  "files to download with one domain per line to block, file:// urls of local files or directories are watched in place",
 		}),
 		altsrc.NewBoolFlag(cli.BoolFlag{
 			Name:        flagName(prefix, "debug-http"),
@@ -70,5 +84,61 @@ func (c *DLConfig) Flags(prefix string) []cli.Flag {
 			Usage:       "log http headers",
 			Destination: &c.DebugHTTP,
 		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "min-lines"),
+			EnvVar:      envName(prefix, "MIN_LINES"),
+			Usage:       "downloaded files with fewer lines than this are rejected",
+			Value:       c.MinLines,
+			Destination: &c.MinLines,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "max-size"),
+			EnvVar:      envName(prefix, "MAX_SIZE"),
+			Usage:       "downloaded files larger than this many bytes are rejected, 0 for no limit",
+			Value:       c.MaxSize,
+			Destination: &c.MaxSize,
+		}),
+		altsrc.NewFloat64Flag(cli.Float64Flag{
+			Name:        flagName(prefix, "min-valid-ratio"),
+			EnvVar:      envName(prefix, "MIN_VALID_RATIO"),
+			Usage:       "downloaded files with a smaller ratio of valid lines than this are rejected",
+			Value:       c.MinValidRatio,
+			Destination: &c.MinValidRatio,
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        flagName(prefix, "checksum"),
+			EnvVar:      envName(prefix, "CHECKSUM"),
+			Usage:       "require downloaded files to match the sha256 sum at their url with \".sha256\" appended",
+			Destination: &c.Checksum,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "minisign-key"),
+			EnvVar:      envName(prefix, "MINISIGN_KEY"),
+			Usage:       "minisign public key that downloaded files must be signed with, the signature is at their url with \".minisig\" appended",
+			Value:       c.MinisignKey,
+			Destination: &c.MinisignKey,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "retry-min"),
+			EnvVar: envName(prefix, "RETRY_MIN"),
+			Usage:  "wait at least this long before retrying a failed download, doubling for each further failure",
+			Value:  &c.RetryMin,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "retry-max"),
+			EnvVar: envName(prefix, "RETRY_MAX"),
+			Usage:  "wait at most this long before retrying a failed download",
+			Value:  &c.RetryMax,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "mirror"),
+			Value:  &c.Mirror,
+			Hidden: true,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "source"),
+			Value:  &c.Source,
+			Hidden: true,
+		}),
 	}
 }
@@ -37,11 +37,23 @@ type DNSConfig struct {
 	ServerTimeout  Duration             `toml:"server_timeout"`
 	DialTimeout    Duration             `toml:"dial_timeout"`
 	LookupInterval Duration             `toml:"lookup_interval"`
+	UDPSize        int                  `toml:"udp_size"`
 	Cache          *DNSCacheConfig      `toml:"cache"`
 	Forward        StringSlice          `toml:"forward"`
+	Strategy       string               `toml:"strategy"`
+	Recursive      bool                 `toml:"recursive"`
 	Zone           DNSZones             `toml:"zone"`
 	Override       StringMapStringSlice `toml:"override"`
 	OverrideTTL    Duration             `toml:"override_ttl"`
+	LocalHosts     *LocalHostsConfig    `toml:"local_hosts"`
+	Leases         *LeasesConfig        `toml:"leases"`
+	Health         *HealthConfig        `toml:"health"`
+	EDNS           *EDNSConfig          `toml:"edns"`
+	DNSSEC         *DNSSECConfig        `toml:"dnssec"`
+	Recursor       *RecursorConfig      `toml:"recursor"`
+	RateLimit      *RateLimitConfig     `toml:"rate_limit"`
+	ACL            *ACLConfig           `toml:"acl"`
+	RPZ            *RPZConfig           `toml:"rpz"`
 	HTTP           DNSHTTPConfig
 }
 
@@ -53,9 +65,20 @@ func NewDNSConfig() *DNSConfig {
 		ServerTimeout:  Duration(2 * time.Second),
 		DialTimeout:    Duration(2 * time.Second),
 		LookupInterval: Duration(200 * time.Millisecond),
+		UDPSize:        1232,
 		Cache:          NewDNSCacheConfig(),
 		Forward:        make(StringSlice, len(defaultDNSForward)),
+		Strategy:       "ordered",
 		OverrideTTL:    Duration(1 * time.Hour),
+		LocalHosts:     NewLocalHostsConfig(),
+		Leases:         NewLeasesConfig(),
+		Health:         NewHealthConfig(),
+		EDNS:           NewEDNSConfig(),
+		DNSSEC:         NewDNSSECConfig(),
+		Recursor:       NewRecursorConfig(),
+		RateLimit:      NewRateLimitConfig(),
+		ACL:            NewACLConfig(),
+		RPZ:            NewRPZConfig(),
 		HTTP: DNSHTTPConfig{
 			KeepAlive:             Duration(24 * time.Hour),
 			MaxIdleConns:          100,
@@ -76,7 +99,7 @@ func (c *DNSConfig) Flags(prefix string) []cli.Flag {
 		altsrc.NewGenericFlag(cli.GenericFlag{
 			Name:   flagName(prefix, "listen"),
 			EnvVar: envName(prefix, "LISTEN"),
-			Usage:  "url(s) to listen for dns requests on",
+			Usage:  "url(s) to listen for dns requests on, optionally with allow, deny and acl-action query parameters",
 			Value:  &c.Listen,
 		}),
 		altsrc.NewGenericFlag(cli.GenericFlag{
@@ -103,12 +126,32 @@ func (c *DNSConfig) Flags(prefix string) []cli.Flag {
 			Value:  &c.LookupInterval,
 			Usage:  "concurrency interval for lookups in miliseconds",
 		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "udp-size"),
+			EnvVar:      envName(prefix, "UDP_SIZE"),
+			Usage:       "edns0 udp buffer size to advertise to remote servers. truncated responses are retried over tcp",
+			Value:       c.UDPSize,
+			Destination: &c.UDPSize,
+		}),
 		altsrc.NewGenericFlag(cli.GenericFlag{
 			Name:   flagName(prefix, "forward"),
 			EnvVar: envName(prefix, "FORWARD"),
 			Value:  &c.Forward,
 			Usage:  "default dns server(s) to forward requests to",
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "strategy"),
+			EnvVar:      envName(prefix, "STRATEGY"),
+			Usage:       "order in which to query the default dns servers: ordered, round-robin, random, lowest-latency (requires health tracking) or parallel",
+			Value:       c.Strategy,
+			Destination: &c.Strategy,
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        flagName(prefix, "recursive"),
+			EnvVar:      envName(prefix, "RECURSIVE"),
+			Usage:       "resolve requests iteratively from the root servers instead of forwarding them",
+			Destination: &c.Recursive,
+		}),
 		altsrc.NewGenericFlag(cli.GenericFlag{
 			Name:   flagName(prefix, "override-ttl"),
 			EnvVar: envName(prefix, "OVERRIDE_TTL"),
@@ -172,7 +215,7 @@ func (c *DNSConfig) Flags(prefix string) []cli.Flag {
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:        flagName(prefix, "http-edns-client-subnet"),
 			EnvVar:      envName(prefix, "HTTP_EDNS_CLIENT_SUBNET"),
-			Usage:       "if you are using dns-over-https because of privacy concerns, and do not want any part of your ip address to be sent to authoritative name servers for geographic location accuracy, use 0.0.0.0/0",
+			Usage:       "deprecated, use edns-ecs and edns-ecs-subnet. if set and edns-ecs-subnet is not, equivalent to edns-ecs=replace with this subnet",
 			Value:       c.HTTP.EDNSClientSubnet,
 			Destination: &c.HTTP.EDNSClientSubnet,
 		}),
@@ -186,6 +229,15 @@ func (c *DNSConfig) Flags(prefix string) []cli.Flag {
 
 	ret = append(ret, c.Block.Flags(flagName(prefix, "block"))...)
 	ret = append(ret, c.Cache.Flags(flagName(prefix, "cache"))...)
+	ret = append(ret, c.LocalHosts.Flags(flagName(prefix, "local-hosts"))...)
+	ret = append(ret, c.Leases.Flags(flagName(prefix, "leases"))...)
+	ret = append(ret, c.Health.Flags(flagName(prefix, "health"))...)
+	ret = append(ret, c.EDNS.Flags(flagName(prefix, "edns"))...)
+	ret = append(ret, c.DNSSEC.Flags(flagName(prefix, "dnssec"))...)
+	ret = append(ret, c.Recursor.Flags(flagName(prefix, "recursor"))...)
+	ret = append(ret, c.RateLimit.Flags(flagName(prefix, "rate-limit"))...)
+	ret = append(ret, c.ACL.Flags(flagName(prefix, "acl"))...)
+	ret = append(ret, c.RPZ.Flags(flagName(prefix, "rpz"))...)
 
 	return ret
 }
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+type DNSSECConfig struct {
+	Validate             bool        `toml:"validate"`
+	TrustAnchors         StringSlice `toml:"trust_anchors"`
+	NegativeTrustAnchors StringSlice `toml:"negative_trust_anchors"`
+	KeyCacheSize         int         `toml:"key_cache_size"`
+}
+
+func NewDNSSECConfig() *DNSSECConfig {
+	return &DNSSECConfig{
+		KeyCacheSize: 4096,
+	}
+}
+
+func (c *DNSSECConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        flagName(prefix, "validate"),
+			EnvVar:      envName(prefix, "VALIDATE"),
+			Usage:       "validate dnssec signatures of responses from udp, tcp and tls remote servers",
+			Destination: &c.Validate,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "trust-anchors"),
+			EnvVar: envName(prefix, "TRUST_ANCHORS"),
+			Usage:  "DS records to trust, defaults to the root zone key signing keys",
+			Value:  &c.TrustAnchors,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "negative-trust-anchors"),
+			EnvVar: envName(prefix, "NEGATIVE_TRUST_ANCHORS"),
+			Usage:  "zones to treat as insecure even if their validation fails",
+			Value:  &c.NegativeTrustAnchors,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "key-cache-size"),
+			EnvVar:      envName(prefix, "KEY_CACHE_SIZE"),
+			Usage:       "maximum number of validated DNSKEY and DS records to cache",
+			Value:       c.KeyCacheSize,
+			Destination: &c.KeyCacheSize,
+		}),
+	}
+}
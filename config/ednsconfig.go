@@ -0,0 +1,43 @@
+package config
+
+import (
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+type EDNSConfig struct {
+	ECS       string `toml:"ecs"`
+	ECSSubnet string `toml:"ecs_subnet"`
+	NoCookies bool   `toml:"no_cookies"`
+}
+
+func NewEDNSConfig() *EDNSConfig {
+	return &EDNSConfig{
+		ECS: "strip",
+	}
+}
+
+func (c *EDNSConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "ecs"),
+			EnvVar:      envName(prefix, "ECS"),
+			Usage:       "edns client subnet to send to remote servers: strip (never send one), pass (forward the client's) or replace (send ecs-subnet)",
+			Value:       c.ECS,
+			Destination: &c.ECS,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "ecs-subnet"),
+			EnvVar:      envName(prefix, "ECS_SUBNET"),
+			Usage:       "subnet to send to remote servers when ecs is replace",
+			Value:       c.ECSSubnet,
+			Destination: &c.ECSSubnet,
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        flagName(prefix, "no-cookies"),
+			EnvVar:      envName(prefix, "NO_COOKIES"),
+			Usage:       "disable dns cookies (rfc 7873) with both clients and remote servers",
+			Destination: &c.NoCookies,
+		}),
+	}
+}
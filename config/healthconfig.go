@@ -0,0 +1,63 @@
+package config
+
+import (
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+type HealthConfig struct {
+	Window         int      `toml:"window"`
+	MinSuccessRate float64  `toml:"min_success_rate"`
+	ProbeInterval  Duration `toml:"probe_interval"`
+	ProbeName      string   `toml:"probe_name"`
+	Disable        bool     `toml:"disable"`
+}
+
+func NewHealthConfig() *HealthConfig {
+	return &HealthConfig{
+		Window:         20,
+		MinSuccessRate: 0.5,
+		ProbeInterval:  Duration(30 * time.Second),
+		ProbeName:      ".",
+	}
+}
+
+func (c *HealthConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "window"),
+			EnvVar:      envName(prefix, "WINDOW"),
+			Usage:       "number of recent queries used to calculate the success rate of each upstream nameserver",
+			Value:       c.Window,
+			Destination: &c.Window,
+		}),
+		altsrc.NewFloat64Flag(cli.Float64Flag{
+			Name:        flagName(prefix, "min-success-rate"),
+			EnvVar:      envName(prefix, "MIN_SUCCESS_RATE"),
+			Usage:       "upstream nameservers with a lower success rate are tried last",
+			Value:       c.MinSuccessRate,
+			Destination: &c.MinSuccessRate,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "probe-interval"),
+			EnvVar: envName(prefix, "PROBE_INTERVAL"),
+			Usage:  "how often to probe unhealthy or idle upstream nameservers. zero disables probing",
+			Value:  &c.ProbeInterval,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "probe-name"),
+			EnvVar:      envName(prefix, "PROBE_NAME"),
+			Usage:       "name whose NS records are queried to probe upstream nameservers",
+			Value:       c.ProbeName,
+			Destination: &c.ProbeName,
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        flagName(prefix, "disable"),
+			EnvVar:      envName(prefix, "DISABLE"),
+			Usage:       "do not track the health of upstream nameservers",
+			Destination: &c.Disable,
+		}),
+	}
+}
@@ -8,8 +8,11 @@ import (
 )
 
 type DNSZone struct {
-	Name string   `toml:"name" json:"name"`
-	Addr []string `toml:"addr" json:"addr"`
+	Name      string   `toml:"name" json:"name"`
+	Addr      []string `toml:"addr" json:"addr"`
+	Clients   []string `toml:"clients" json:"clients"`
+	Strategy  string   `toml:"strategy" json:"strategy"`
+	Recursive bool     `toml:"recursive" json:"recursive"`
 }
 
 type DNSZones []DNSZone
@@ -30,6 +33,109 @@ func (z DNSZones) Generic() cli.Generic {
 	return &z
 }
 
+type BlockSchedule struct {
+	Name     string   `toml:"name" json:"name"`
+	Days     []string `toml:"days" json:"days"`
+	Start    string   `toml:"start" json:"start"`
+	End      string   `toml:"end" json:"end"`
+	TimeZone string   `toml:"time_zone" json:"time_zone"`
+	Clients  []string `toml:"clients" json:"clients"`
+	Domains  []string `toml:"domains" json:"domains"`
+	Sources  []string `toml:"sources" json:"sources"`
+}
+
+type BlockSchedules []BlockSchedule
+
+func (s *BlockSchedules) Set(value string) error {
+	if err := json.Unmarshal([]byte(value), s); err != nil {
+		return errors.Wrapf(err, "config.BlockSchedules: error unmarshaling json: %s", value)
+	}
+	return nil
+}
+
+func (s BlockSchedules) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func (s BlockSchedules) Generic() cli.Generic {
+	return &s
+}
+
+type RPZZone struct {
+	Name    string `toml:"name" json:"name"`
+	File    string `toml:"file" json:"file"`
+	Primary string `toml:"primary" json:"primary"`
+}
+
+type RPZZones []RPZZone
+
+func (z *RPZZones) Set(value string) error {
+	if err := json.Unmarshal([]byte(value), z); err != nil {
+		return errors.Wrapf(err, "config.RPZZones: error unmarshaling json: %s", value)
+	}
+	return nil
+}
+
+func (z RPZZones) String() string {
+	b, _ := json.Marshal(z)
+	return string(b)
+}
+
+func (z RPZZones) Generic() cli.Generic {
+	return &z
+}
+
+// DLMirror lists the urls that the file at URL, one of the hosts or domains to
+// download, can also be downloaded from
+type DLMirror struct {
+	URL     string   `toml:"url" json:"url"`
+	Mirrors []string `toml:"mirrors" json:"mirrors"`
+}
+
+type DLMirrors []DLMirror
+
+func (m *DLMirrors) Set(value string) error {
+	if err := json.Unmarshal([]byte(value), m); err != nil {
+		return errors.Wrapf(err, "config.DLMirrors: error unmarshaling json: %s", value)
+	}
+	return nil
+}
+
+func (m DLMirrors) String() string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+func (m DLMirrors) Generic() cli.Generic {
+	return &m
+}
+
+// DLSource is a list to download, or the file:// url of a local one to watch,
+// in the "hosts", "domains", "dnsmasq", "unbound" or "bind" Format
+type DLSource struct {
+	URL    string `toml:"url" json:"url"`
+	Format string `toml:"format" json:"format"`
+}
+
+type DLSources []DLSource
+
+func (s *DLSources) Set(value string) error {
+	if err := json.Unmarshal([]byte(value), s); err != nil {
+		return errors.Wrapf(err, "config.DLSources: error unmarshaling json: %s", value)
+	}
+	return nil
+}
+
+func (s DLSources) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func (s DLSources) Generic() cli.Generic {
+	return &s
+}
+
 type StringMapStringSlice map[string][]string
 
 func (m *StringMapStringSlice) Set(value string) error {
@@ -47,3 +153,27 @@ func (m StringMapStringSlice) String() string {
 func (m StringMapStringSlice) Generic() cli.Generic {
 	return &m
 }
+
+type DHCPReservation struct {
+	MAC  string `toml:"mac" json:"mac"`
+	IP   string `toml:"ip" json:"ip"`
+	Host string `toml:"host" json:"host"`
+}
+
+type DHCPReservations []DHCPReservation
+
+func (r *DHCPReservations) Set(value string) error {
+	if err := json.Unmarshal([]byte(value), r); err != nil {
+		return errors.Wrapf(err, "config.DHCPReservations: error unmarshaling json: %s", value)
+	}
+	return nil
+}
+
+func (r DHCPReservations) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+func (r DHCPReservations) Generic() cli.Generic {
+	return &r
+}
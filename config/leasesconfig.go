@@ -0,0 +1,44 @@
+package config
+
+import (
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+const defaultLeasesDomain = "lan"
+
+type LeasesConfig struct {
+	Dnsmasq StringSlice `toml:"dnsmasq"`
+	ISC     StringSlice `toml:"isc"`
+	Domain  string      `toml:"domain"`
+}
+
+func NewLeasesConfig() *LeasesConfig {
+	return &LeasesConfig{
+		Domain: defaultLeasesDomain,
+	}
+}
+
+func (c *LeasesConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "dnsmasq"),
+			EnvVar: envName(prefix, "DNSMASQ"),
+			Usage:  "dnsmasq lease files (dnsmasq.leases) to resolve local hostnames from",
+			Value:  &c.Dnsmasq,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "isc"),
+			EnvVar: envName(prefix, "ISC"),
+			Usage:  "isc dhcpd lease files (dhcpd.leases) to resolve local hostnames from",
+			Value:  &c.ISC,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "domain"),
+			EnvVar:      envName(prefix, "DOMAIN"),
+			Usage:       "domain under which leased hostnames are resolved",
+			Value:       c.Domain,
+			Destination: &c.Domain,
+		}),
+	}
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+var defaultLocalHostsFiles = StringSlice{
+	"/etc/hosts",
+}
+
+type LocalHostsConfig struct {
+	Files   StringSlice `toml:"files"`
+	TTL     Duration    `toml:"ttl"`
+	Disable bool        `toml:"disable"`
+}
+
+func NewLocalHostsConfig() *LocalHostsConfig {
+	ret := &LocalHostsConfig{
+		Files: make(StringSlice, len(defaultLocalHostsFiles)),
+		TTL:   Duration(5 * time.Minute),
+	}
+
+	copy(ret.Files, defaultLocalHostsFiles)
+
+	return ret
+}
+
+func (c *LocalHostsConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "files"),
+			EnvVar: envName(prefix, "FILES"),
+			Usage:  "files in \"/etc/hosts\" format to resolve local hostnames from",
+			Value:  &c.Files,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "ttl"),
+			EnvVar: envName(prefix, "TTL"),
+			Usage:  "ttl to return for local hostnames",
+			Value:  &c.TTL,
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        flagName(prefix, "disable"),
+			EnvVar:      envName(prefix, "DISABLE"),
+			Usage:       "do not resolve hostnames from local hosts files",
+			Destination: &c.Disable,
+		}),
+	}
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+var defaultRateLimitExempt = StringSlice{
+	"127.0.0.0/8",
+	"::1",
+}
+
+type RateLimitConfig struct {
+	QPS           float64     `toml:"qps"`
+	Burst         int         `toml:"burst"`
+	GlobalQPS     float64     `toml:"global_qps"`
+	GlobalBurst   int         `toml:"global_burst"`
+	IPv4Prefix    int         `toml:"ipv4_prefix"`
+	IPv6Prefix    int         `toml:"ipv6_prefix"`
+	Mode          string      `toml:"mode"`
+	Exempt        StringSlice `toml:"exempt"`
+	ResponseQPS   float64     `toml:"response_qps"`
+	ResponseBurst int         `toml:"response_burst"`
+	Slip          int         `toml:"slip"`
+}
+
+func NewRateLimitConfig() *RateLimitConfig {
+	ret := &RateLimitConfig{
+		IPv4Prefix: 32,
+		IPv6Prefix: 56,
+		Mode:       "refuse",
+		Exempt:     make(StringSlice, len(defaultRateLimitExempt)),
+		Slip:       2,
+	}
+
+	copy(ret.Exempt, defaultRateLimitExempt)
+
+	return ret
+}
+
+func (c *RateLimitConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewFloat64Flag(cli.Float64Flag{
+			Name:        flagName(prefix, "qps"),
+			EnvVar:      envName(prefix, "QPS"),
+			Usage:       "queries per second allowed from each client, 0 is unlimited",
+			Value:       c.QPS,
+			Destination: &c.QPS,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "burst"),
+			EnvVar:      envName(prefix, "BURST"),
+			Usage:       "queries each client may send at once above qps, defaults to qps",
+			Value:       c.Burst,
+			Destination: &c.Burst,
+		}),
+		altsrc.NewFloat64Flag(cli.Float64Flag{
+			Name:        flagName(prefix, "global-qps"),
+			EnvVar:      envName(prefix, "GLOBAL_QPS"),
+			Usage:       "queries per second allowed from all clients together, 0 is unlimited",
+			Value:       c.GlobalQPS,
+			Destination: &c.GlobalQPS,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "global-burst"),
+			EnvVar:      envName(prefix, "GLOBAL_BURST"),
+			Usage:       "queries all clients may send at once above global-qps, defaults to global-qps",
+			Value:       c.GlobalBurst,
+			Destination: &c.GlobalBurst,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "ipv4-prefix"),
+			EnvVar:      envName(prefix, "IPV4_PREFIX"),
+			Usage:       "ipv4 clients in the same network of this size are limited together",
+			Value:       c.IPv4Prefix,
+			Destination: &c.IPv4Prefix,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "ipv6-prefix"),
+			EnvVar:      envName(prefix, "IPV6_PREFIX"),
+			Usage:       "ipv6 clients in the same network of this size are limited together",
+			Value:       c.IPv6Prefix,
+			Destination: &c.IPv6Prefix,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        flagName(prefix, "mode"),
+			EnvVar:      envName(prefix, "MODE"),
+			Usage:       "how to answer limited queries: drop, refuse or truncate (to force udp clients to retry over tcp)",
+			Value:       c.Mode,
+			Destination: &c.Mode,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "exempt"),
+			EnvVar: envName(prefix, "EXEMPT"),
+			Usage:  "clients (ip addresses or networks) that are never limited",
+			Value:  &c.Exempt,
+		}),
+		altsrc.NewFloat64Flag(cli.Float64Flag{
+			Name:        flagName(prefix, "response-qps"),
+			EnvVar:      envName(prefix, "RESPONSE_QPS"),
+			Usage:       "identical udp responses per second allowed to each client (response rate limiting), 0 is unlimited",
+			Value:       c.ResponseQPS,
+			Destination: &c.ResponseQPS,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "response-burst"),
+			EnvVar:      envName(prefix, "RESPONSE_BURST"),
+			Usage:       "identical responses that may be sent at once above response-qps, defaults to response-qps",
+			Value:       c.ResponseBurst,
+			Destination: &c.ResponseBurst,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "slip"),
+			EnvVar:      envName(prefix, "SLIP"),
+			Usage:       "send every nth response over response-qps truncated rather than dropping it, 0 drops all of them",
+			Value:       c.Slip,
+			Destination: &c.Slip,
+		}),
+	}
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+type RecursorConfig struct {
+	RootHints           StringSlice `toml:"root_hints"`
+	NoQNAMEMinimisation bool        `toml:"no_qname_minimisation"`
+	CacheSize           int         `toml:"cache_size"`
+}
+
+func NewRecursorConfig() *RecursorConfig {
+	return &RecursorConfig{
+		CacheSize: 16384,
+	}
+}
+
+func (c *RecursorConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "root-hints"),
+			EnvVar: envName(prefix, "ROOT_HINTS"),
+			Usage:  "NS, A and AAAA records of the root servers to start recursion from, defaults to the internic root hints",
+			Value:  &c.RootHints,
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        flagName(prefix, "no-qname-minimisation"),
+			EnvVar:      envName(prefix, "NO_QNAME_MINIMISATION"),
+			Usage:       "send the full query name to every nameserver instead of only what each needs to know (rfc 7816)",
+			Destination: &c.NoQNAMEMinimisation,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        flagName(prefix, "cache-size"),
+			EnvVar:      envName(prefix, "CACHE_SIZE"),
+			Usage:       "maximum number of delegation records (NS and glue) to cache",
+			Value:       c.CacheSize,
+			Destination: &c.CacheSize,
+		}),
+	}
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+type RPZConfig struct {
+	Zone    RPZZones `toml:"zone"`
+	Refresh Duration `toml:"refresh"`
+}
+
+func NewRPZConfig() *RPZConfig {
+	return &RPZConfig{
+		Refresh: Duration(1 * time.Minute),
+	}
+}
+
+func (c *RPZConfig) Flags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "zone"),
+			Value:  &c.Zone,
+			Hidden: true,
+		}),
+		altsrc.NewGenericFlag(cli.GenericFlag{
+			Name:   flagName(prefix, "refresh"),
+			EnvVar: envName(prefix, "REFRESH"),
+			Value:  &c.Refresh,
+			Usage:  "how often to check response policy zones for changes, by file modification time or primary soa serial",
+		}),
+	}
+}
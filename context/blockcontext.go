@@ -1,10 +1,22 @@
 package context
 
 import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/pkg/errors"
+
+	"jrubin.io/blamedns/apiserver"
 	"jrubin.io/blamedns/blocker"
 	"jrubin.io/blamedns/config"
+	"jrubin.io/blamedns/dl"
+	"jrubin.io/blamedns/dnscache"
 	"jrubin.io/blamedns/dnsserver"
 	"jrubin.io/blamedns/parser"
 	"jrubin.io/blamedns/watcher"
@@ -15,61 +27,457 @@ import (
 type BlockContext struct {
 	Watchers []*watcher.Watcher
 	Block    dnsserver.Block
+	Blocker  blocker.Blocker
+	Stats    *parser.FileStats
+
+	// Cache has the answers for scheduled hosts removed whenever a
+	// schedule starts or ends, and blocked answers removed when blocking is
+	// paused
+	Cache *dnscache.Memory
+
+	logger slog.Interface
+	stopCh chan struct{}
+	// parsers of local sources, which may override hosts
+	parsers map[string]parser.Parser
+
+	mu      sync.Mutex
+	local   map[string]*watcher.Watcher
+	started bool
 }
 
-func NewBlockContext(logger slog.Interface, cfg *config.Config) (*BlockContext, error) {
-	hostsDir := path.Join(cfg.CacheDir, "hosts")
-	domainsDir := path.Join(cfg.CacheDir, "domains")
+// NewBlockContext returns a BlockContext that adds hosts overridden by local
+// hosts files to localHosts
+func NewBlockContext(logger slog.Interface, cfg *config.Config, localHosts parser.LocalHostAdder) (*BlockContext, error) {
+	dirs := sourceDirs(cfg)
 
 	blocker := &blocker.RadixBlocker{}
 
+	nonSink, err := parser.ParseNonSink(cfg.DNS.Block.NonSink)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules, err := newScheduledBlocks(cfg, dirs)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx := &BlockContext{
 		Block: dnsserver.Block{
-			IPv4:    cfg.DNS.Block.IPv4.Value(),
-			IPv6:    cfg.DNS.Block.IPv6.Value(),
-			TTL:     cfg.DNS.Block.TTL.Value(),
-			Blocker: blocker,
-			Passer:  whitelist.New(cfg.DNS.Block.WhiteList...),
-			Logger:  logger,
+			IPv4:      cfg.DNS.Block.IPv4.Value(),
+			IPv6:      cfg.DNS.Block.IPv6.Value(),
+			TTL:       cfg.DNS.Block.TTL.Value(),
+			Blocker:   blocker,
+			Passer:    whitelist.New(cfg.DNS.Block.WhiteList...),
+			Logger:    logger,
+			Schedules: schedules,
+			Pause:     &dnsserver.Pause{},
 		},
+		Blocker: blocker,
+		Stats:   &parser.FileStats{},
+		logger:  logger,
+	}
+
+	ctx.parsers = newParsers(logger, blocker, localHosts, nonSink, ctx.Stats)
+
+	// downloaded lists are from third parties, who mustn't be able to
+	// override local answers, so non-sink hosts in them are ignored instead
+	downloaded := newParsers(logger, blocker, nil, nonSink, ctx.Stats)
+
+	for _, format := range sourceFormats {
+		w, err := watcher.New(logger, downloaded[format], dirs[format])
+		if err != nil {
+			return nil, err
+		}
+
+		ctx.Watchers = append(ctx.Watchers, w)
 	}
 
-	hostsFileParser := parser.HostsFileParser{
-		HostAdder: blocker,
-		Logger:    logger,
+	return ctx, nil
+}
+
+// newParsers returns the parser of each source format
+func newParsers(logger slog.Interface, adder parser.DomainAdder, localHosts parser.LocalHostAdder, nonSink parser.NonSink, stats *parser.FileStats) map[string]parser.Parser {
+	return map[string]parser.Parser{
+		SourceHosts: parser.HostsFileParser{
+			HostAdder:      adder,
+			LocalHostAdder: localHosts,
+			NonSink:        nonSink,
+			Stats:          stats,
+			Logger:         logger,
+		},
+		SourceDomains: parser.DomainParser{
+			HostAdder: adder,
+			Stats:     stats,
+			Logger:    logger,
+		},
+		SourceDnsmasq: parser.DnsmasqParser{
+			HostAdder: adder,
+			Stats:     stats,
+			Logger:    logger,
+		},
+		SourceUnbound: parser.UnboundParser{
+			HostAdder: adder,
+			Stats:     stats,
+			Logger:    logger,
+		},
+		SourceBind: parser.BindParser{
+			HostAdder: adder,
+			Stats:     stats,
+			Logger:    logger,
+		},
 	}
+}
 
-	hostsWatcher, err := watcher.New(logger, hostsFileParser, hostsDir)
+// localPath returns the path of file:// urls. Their host must be empty or
+// localhost, file://etc/hosts is a mistake for file:///etc/hosts rather than
+// etc/hosts on a host called etc.
+func localPath(source string) (string, bool, error) {
+	u, err := url.Parse(source)
 	if err != nil {
-		return nil, err
+		return "", false, errors.Wrapf(err, "error parsing url for dl file: %s", source)
+	}
+
+	if u.Scheme != "file" {
+		return "", false, nil
+	}
+
+	if len(u.Host) > 0 && !strings.EqualFold(u.Host, "localhost") {
+		return "", false, errors.Errorf("file url with a remote host: %s", source)
 	}
 
-	domainParser := parser.DomainParser{
-		HostAdder: blocker,
-		Logger:    logger,
+	if len(u.Path) == 0 {
+		return "", false, errors.Errorf("file url without a path: %s", source)
 	}
 
-	domainsWatcher, err := watcher.New(logger, domainParser, domainsDir)
+	return path.Clean(u.Path), true, nil
+}
+
+// AddLocal watches the file or directory of the file:// url source, with
+// every file in directories parsed, as a list in format. Files don't need to
+// exist yet, but the directories they are in do.
+func (ctx *BlockContext) AddLocal(format, source string) error {
+	name, ok, err := localPath(source)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	ctx.Watchers = []*watcher.Watcher{
-		hostsWatcher,
-		domainsWatcher,
+	if !ok {
+		return errors.Errorf("not a file url: %s", source)
 	}
 
-	return ctx, nil
+	p, ok := ctx.parsers[format]
+	if !ok {
+		return errors.Errorf("invalid source format: %s", format)
+	}
+
+	var w *watcher.Watcher
+	if info, serr := os.Stat(name); serr == nil && info.IsDir() {
+		w, err = watcher.New(ctx.logger, p, name)
+	} else {
+		w, err = watcher.NewFiles(ctx.logger, p, name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.local == nil {
+		ctx.local = map[string]*watcher.Watcher{}
+	}
+
+	ctx.local[source] = w
+
+	if ctx.started {
+		w.Start()
+	}
+
+	return nil
+}
+
+// RemoveLocal stops watching the file:// url source and removes its hosts
+func (ctx *BlockContext) RemoveLocal(source string) {
+	ctx.mu.Lock()
+	w, ok := ctx.local[source]
+	delete(ctx.local, source)
+	ctx.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	w.Stop()
+
+	name, _, _ := localPath(source)
+	for _, n := range ctx.LocalSources(name) {
+		ctx.ResetSource(n)
+	}
+}
+
+// RefreshLocal parses the files of the file:// url source again
+func (ctx *BlockContext) RefreshLocal(source string) {
+	ctx.mu.Lock()
+	w, ok := ctx.local[source]
+	ctx.mu.Unlock()
+
+	if ok {
+		w.Refresh()
+	}
+}
+
+// LocalSources returns name, and the names of the files in it that were parsed
+// if it is a directory
+func (ctx *BlockContext) LocalSources(name string) []string {
+	ret := []string{name}
+	for _, source := range ctx.Stats.Files() {
+		if strings.HasPrefix(source, name+"/") {
+			ret = append(ret, source)
+		}
+	}
+	return ret
+}
+
+// ResetSource removes the hosts from source, and then any cached blocked
+// answers that may no longer be blocked. They are evicted afterwards so that a
+// query answered while the hosts are being removed can't cache a blocked
+// answer again, but which names are blocked is only known beforehand.
+func (ctx *BlockContext) ResetSource(source string) {
+	blocked := map[string]bool{}
+	if ctx.Cache != nil {
+		ctx.Cache.RemoveFunc(func(name string) bool {
+			if ctx.Block.Blocked(name) {
+				blocked[name] = true
+			}
+			return false
+		})
+	}
+
+	for _, p := range ctx.parsers {
+		p.Reset(source)
+	}
+
+	var n int
+	if ctx.Cache != nil {
+		n = ctx.Cache.RemoveFunc(func(name string) bool {
+			return blocked[name]
+		})
+	}
+
+	ctx.logger.WithFields(slog.Fields{
+		"source":  source,
+		"removed": n,
+	}).Info("removed block source")
+}
+
+// newScheduledBlocks returns the block schedules. Their sources are the urls
+// of downloaded lists, which are identified by the name of the file they are
+// downloaded to in the directory of their format, or local files and
+// directories, which are identified by their path.
+func newScheduledBlocks(cfg *config.Config, dirs map[string]string) ([]*dnsserver.ScheduledBlock, error) {
+	var ret []*dnsserver.ScheduledBlock
+
+	for _, s := range cfg.DNS.Block.Schedule {
+		schedule, err := dnsserver.ParseSchedule(s.Days, s.Start, s.End, s.TimeZone)
+		if err != nil {
+			return nil, errors.Wrapf(err, "block schedule %s", s.Name)
+		}
+
+		clients, err := dnsserver.ParseCIDRs(s.Clients)
+		if err != nil {
+			return nil, errors.Wrapf(err, "block schedule %s", s.Name)
+		}
+
+		sb := &dnsserver.ScheduledBlock{
+			Name:     s.Name,
+			Schedule: schedule,
+			Clients:  clients,
+		}
+
+		for _, domain := range s.Domains {
+			sb.Domains = append(sb.Domains, strings.ToLower(strings.TrimSuffix(domain, ".")))
+		}
+
+		for _, source := range s.Sources {
+			format, ok := sourceFormat(cfg, source)
+			if !ok {
+				return nil, errors.Errorf("block schedule %s: %s is not a configured url", s.Name, source)
+			}
+
+			name, ok, err := localPath(source)
+			if err != nil {
+				return nil, errors.Wrapf(err, "block schedule %s", s.Name)
+			}
+
+			if ok {
+				sb.Sources = append(sb.Sources, name)
+				continue
+			}
+
+			u, err := url.Parse(source)
+			if err != nil {
+				return nil, errors.Wrapf(err, "block schedule %s", s.Name)
+			}
+
+			dir, ok := dirs[format]
+			if !ok {
+				return nil, errors.Errorf("block schedule %s: invalid source format: %s", s.Name, format)
+			}
+
+			sb.Sources = append(sb.Sources, dl.FileName(u, dir))
+		}
+
+		ret = append(ret, sb)
+	}
+
+	return ret, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 func (ctx *BlockContext) Start() {
 	for _, w := range ctx.Watchers {
 		w.Start()
 	}
+
+	ctx.mu.Lock()
+	for _, w := range ctx.local {
+		w.Start()
+	}
+	ctx.started = true
+	ctx.mu.Unlock()
+
+	if len(ctx.Block.Schedules) > 0 && ctx.stopCh == nil {
+		ctx.stopCh = make(chan struct{})
+		go ctx.watchSchedules()
+	}
+}
+
+// watchSchedules removes cached answers for the hosts that schedules apply to
+// whenever one of them starts or ends, so that the change takes effect
+// immediately
+func (ctx *BlockContext) watchSchedules() {
+	for {
+		var change <-chan time.Time
+
+		next := ctx.Block.NextChange(time.Now())
+		if !next.IsZero() {
+			change = time.After(next.Sub(time.Now()))
+		}
+
+		select {
+		case <-change:
+			var n int
+			if ctx.Cache != nil {
+				n = ctx.Cache.RemoveFunc(ctx.Block.Scheduled)
+			}
+
+			ctx.logger.WithField("removed", n).Info("block schedule changed")
+		case <-ctx.stopCh:
+			close(ctx.stopCh)
+			return
+		}
+	}
+}
+
+// Pause disables blocking for client, or everyone if client is nil, for d. Any
+// cached blocked answers are removed so that they aren't served in the
+// meantime.
+func (ctx *BlockContext) Pause(client net.IP, d time.Duration) time.Time {
+	until := ctx.Block.Pause.Pause(client, d)
+
+	var n int
+	if ctx.Cache != nil {
+		n = ctx.Cache.RemoveFunc(ctx.Block.Blocked)
+	}
+
+	ctx.logger.WithFields(slog.Fields{
+		"client":  client,
+		"for":     d,
+		"removed": n,
+	}).Warn("paused blocking")
+
+	return until
+}
+
+// Resume blocking for client, or everyone if client is nil
+func (ctx *BlockContext) Resume(client net.IP) {
+	ctx.Block.Pause.Resume(client)
+	ctx.logger.WithField("client", client).Warn("resumed blocking")
+}
+
+type pauseStatus struct {
+	All     *dnsserver.PauseStatus           `json:"all"`
+	Clients map[string]dnsserver.PauseStatus `json:"clients"`
+}
+
+// PauseHandler returns an http.Handler that reports how long blocking is
+// paused for. POST requests pause blocking for the duration in the "for"
+// parameter (e.g. 5m) and DELETE requests resume it, both for the client in
+// the "client" parameter, or everyone if it is empty.
+func (ctx *BlockContext) PauseHandler() http.Handler {
+	status := apiserver.JSONHandler(func() interface{} {
+		all, clients := ctx.Block.Pause.Status(time.Now())
+		return pauseStatus{
+			All:     all,
+			Clients: clients,
+		}
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var client net.IP
+		if v := r.FormValue("client"); len(v) > 0 {
+			if client = net.ParseIP(v); client == nil {
+				http.Error(w, "invalid client: "+v, http.StatusBadRequest)
+				return
+			}
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost:
+			d, err := time.ParseDuration(r.FormValue("for"))
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid duration: "+r.FormValue("for"), http.StatusBadRequest)
+				return
+			}
+			ctx.Pause(client, d)
+		case http.MethodDelete:
+			ctx.Resume(client)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		status.ServeHTTP(w, r)
+	})
 }
 
 func (ctx *BlockContext) Shutdown() {
 	for _, w := range ctx.Watchers {
 		w.Stop()
 	}
+
+	ctx.mu.Lock()
+	for _, w := range ctx.local {
+		w.Stop()
+	}
+	ctx.started = false
+	ctx.mu.Unlock()
+
+	if ctx.stopCh != nil {
+		ctx.stopCh <- struct{}{}
+		<-ctx.stopCh
+		ctx.stopCh = nil
+	}
 }
@@ -0,0 +1,242 @@
+package context
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"jrubin.io/blamedns/config"
+	"jrubin.io/blamedns/dnscache"
+	"jrubin.io/blamedns/localhosts"
+	"jrubin.io/blamedns/parser"
+	"jrubin.io/slog"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testConfig returns a config that keeps its cache in a new temporary
+// directory, which the returned function removes
+func testConfig() (*config.Config, func()) {
+	dir, err := ioutil.TempDir("", "context")
+	So(err, ShouldBeNil)
+
+	cfg := config.New()
+	cfg.CacheDir = dir
+
+	return cfg, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestPauseHandler(t *testing.T) {
+	Convey("the pause api should work", t, func() {
+		cfg, cleanup := testConfig()
+		defer cleanup()
+
+		ctx, err := NewBlockContext(slog.New(), cfg, localhosts.New())
+		So(err, ShouldBeNil)
+		defer ctx.Shutdown()
+
+		h := ctx.PauseHandler()
+
+		do := func(method string, values url.Values) (int, pauseStatus) {
+			r := httptest.NewRequest(method, "/dns/pause?"+values.Encode(), nil)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			var status pauseStatus
+			if w.Code == http.StatusOK {
+				So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+				So(json.NewDecoder(w.Body).Decode(&status), ShouldBeNil)
+			}
+
+			return w.Code, status
+		}
+
+		code, status := do(http.MethodGet, nil)
+		So(code, ShouldEqual, http.StatusOK)
+		So(status.All, ShouldBeNil)
+		So(status.Clients, ShouldBeEmpty)
+
+		code, status = do(http.MethodPost, url.Values{"for": {"5m"}, "client": {"192.168.1.2"}})
+		So(code, ShouldEqual, http.StatusOK)
+		So(status.All, ShouldBeNil)
+		So(status.Clients["192.168.1.2"].Remaining, ShouldBeGreaterThan, 0)
+
+		code, status = do(http.MethodPost, url.Values{"for": {"1h"}})
+		So(code, ShouldEqual, http.StatusOK)
+		So(status.All, ShouldNotBeNil)
+		So(status.All.Remaining, ShouldBeGreaterThan, 3500)
+
+		code, status = do(http.MethodDelete, url.Values{"client": {"192.168.1.2"}})
+		So(code, ShouldEqual, http.StatusOK)
+		So(status.All, ShouldNotBeNil)
+		So(status.Clients, ShouldBeEmpty)
+
+		code, status = do(http.MethodDelete, nil)
+		So(code, ShouldEqual, http.StatusOK)
+		So(status.All, ShouldBeNil)
+
+		code, _ = do(http.MethodPost, url.Values{"for": {"forever"}})
+		So(code, ShouldEqual, http.StatusBadRequest)
+
+		code, _ = do(http.MethodPost, url.Values{"for": {"-5m"}})
+		So(code, ShouldEqual, http.StatusBadRequest)
+
+		code, _ = do(http.MethodPost, url.Values{"for": {"5m"}, "client": {"nobody"}})
+		So(code, ShouldEqual, http.StatusBadRequest)
+
+		code, _ = do(http.MethodPut, nil)
+		So(code, ShouldEqual, http.StatusMethodNotAllowed)
+
+		// a second context can be created, its pause isn't registered again
+		other, err := NewBlockContext(slog.New(), cfg, localhosts.New())
+		So(err, ShouldBeNil)
+		other.Shutdown()
+	})
+}
+
+func TestLocalPath(t *testing.T) {
+	Convey("file urls should be parsed", t, func() {
+		for source, name := range map[string]string{
+			"file:///etc/hosts":          "/etc/hosts",
+			"file://localhost/etc/hosts": "/etc/hosts",
+			"file:///etc/hosts.d/":       "/etc/hosts.d",
+			"file:///etc/../etc/hosts":   "/etc/hosts",
+		} {
+			n, ok, err := localPath(source)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(n, ShouldEqual, name)
+		}
+
+		_, ok, err := localPath("https://example.com/hosts")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		for _, source := range []string{
+			"file://etc/hosts",
+			"file://example.com/etc/hosts",
+			"file:etc/hosts",
+			"file://",
+		} {
+			_, _, err = localPath(source)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestAddLocal(t *testing.T) {
+	Convey("local sources should be watched", t, func() {
+		cfg, cleanup := testConfig()
+		defer cleanup()
+
+		ctx, err := NewBlockContext(slog.New(), cfg, localhosts.New())
+		So(err, ShouldBeNil)
+		defer ctx.Shutdown()
+
+		file := path.Join(cfg.CacheDir, "local")
+		So(ioutil.WriteFile(file, []byte("0.0.0.0 example.com\n"), 0600), ShouldBeNil)
+
+		dir := path.Join(cfg.CacheDir, "local.d")
+		So(os.Mkdir(dir, 0700), ShouldBeNil)
+
+		Convey("files are watched on their own", func() {
+			So(ctx.AddLocal(SourceHosts, "file://"+file), ShouldBeNil)
+
+			w := ctx.local["file://"+file]
+			So(w, ShouldNotBeNil)
+			So(w.Files, ShouldResemble, []string{file})
+			So(w.Dir, ShouldBeEmpty)
+		})
+
+		Convey("every file in directories is watched", func() {
+			So(ctx.AddLocal(SourceHosts, "file://"+dir), ShouldBeNil)
+
+			w := ctx.local["file://"+dir]
+			So(w, ShouldNotBeNil)
+			So(w.Files, ShouldBeEmpty)
+			So(w.Dir, ShouldResemble, []string{dir})
+		})
+
+		Convey("files that don't exist yet are watched", func() {
+			missing := path.Join(dir, "missing")
+			So(ctx.AddLocal(SourceHosts, "file://"+missing), ShouldBeNil)
+
+			w := ctx.local["file://"+missing]
+			So(w, ShouldNotBeNil)
+			So(w.Files, ShouldResemble, []string{missing})
+		})
+
+		Convey("files in directories that don't exist are rejected", func() {
+			source := "file://" + path.Join(cfg.CacheDir, "missing", "hosts")
+			So(ctx.AddLocal(SourceHosts, source), ShouldNotBeNil)
+			So(ctx.local, ShouldNotContainKey, source)
+		})
+
+		Convey("invalid sources are rejected", func() {
+			So(ctx.AddLocal(SourceHosts, "https://example.com/hosts"), ShouldNotBeNil)
+			So(ctx.AddLocal(SourceHosts, "file://etc/hosts"), ShouldNotBeNil)
+			So(ctx.AddLocal("nope", "file://"+file), ShouldNotBeNil)
+		})
+
+		Convey("removed sources are no longer watched", func() {
+			So(ctx.AddLocal(SourceHosts, "file://"+file), ShouldBeNil)
+			ctx.RemoveLocal("file://" + file)
+			So(ctx.local, ShouldNotContainKey, "file://"+file)
+		})
+	})
+}
+
+// resettingParser calls reset whenever the hosts of a source are reset, before
+// they are
+type resettingParser struct {
+	parser.Parser
+	reset func()
+}
+
+func (p resettingParser) Reset(fileName string) {
+	p.reset()
+	p.Parser.Reset(fileName)
+}
+
+func TestResetSource(t *testing.T) {
+	Convey("blocked answers should not outlive their source", t, func() {
+		cfg, cleanup := testConfig()
+		defer cleanup()
+
+		ctx, err := NewBlockContext(slog.New(), cfg, localhosts.New())
+		So(err, ShouldBeNil)
+		defer ctx.Shutdown()
+
+		ctx.Cache = dnscache.NewMemory(64, nil)
+
+		req := &dns.Msg{}
+		req.SetQuestion("ads.example.com.", dns.TypeA)
+
+		p := ctx.parsers[SourceHosts]
+		So(p.Parse("list", 1, "0.0.0.0 ads.example.com"), ShouldBeTrue)
+		So(ctx.Block.Blocked(req.Question[0].Name), ShouldBeTrue)
+
+		// a query answered while the source is being removed
+		ctx.parsers[SourceHosts] = resettingParser{
+			Parser: p,
+			reset: func() {
+				ctx.Cache.Set(ctx.Block.NewReply(req))
+			},
+		}
+
+		ctx.Cache.Set(ctx.Block.NewReply(req))
+		So(ctx.Cache.Get(stdcontext.Background(), req), ShouldNotBeNil)
+
+		ctx.ResetSource("list")
+		So(ctx.Block.Blocked(req.Question[0].Name), ShouldBeFalse)
+		So(ctx.Cache.Get(stdcontext.Background(), req), ShouldBeNil)
+	})
+}
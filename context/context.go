@@ -12,6 +12,8 @@ type Context struct {
 	Log        *LogContext
 	DL         *DLContext
 	DNS        *DNSContext
+	Sources    *SourcesContext
+	API        *apiserver.Server
 	servers    []server
 }
 
@@ -33,11 +35,12 @@ func New(appName, appVersion string, cfg *config.Config) (*Context, error) {
 		AppName:    appName,
 		AppVersion: appVersion,
 		Log:        logCtx,
+		API:        apiserver.New(cfg.ListenAPIServer, logCtx.Logger, logCtx.Level),
 	}
 
 	ctx.servers = []server{
 		pixelserv.New(cfg.ListenPixelserv, ctx.Log.Logger),
-		apiserver.New(cfg.ListenAPIServer, ctx.Log.Logger, ctx.Log.Level),
+		ctx.API,
 	}
 
 	for _, server := range ctx.servers {
@@ -54,6 +57,39 @@ func New(appName, appVersion string, cfg *config.Config) (*Context, error) {
 		return nil, err
 	}
 
+	if ctx.Sources, err = NewSourcesContext(ctx.Log.Logger, cfg, ctx.DL, ctx.DNS.Block); err != nil {
+		return nil, err
+	}
+
+	ctx.API.Handle("/dns/upstreams", apiserver.JSONHandler(func() interface{} {
+		return ctx.DNS.Server.Health.Status()
+	}))
+
+	ctx.API.Handle("/dns/pause", ctx.DNS.Block.PauseHandler())
+
+	ctx.API.Handle("/dl/status", apiserver.JSONHandler(func() interface{} {
+		return ctx.DL.Status()
+	}))
+
+	sources := ctx.Sources.Handler("/dl/sources")
+	ctx.API.Handle("/dl/sources", sources)
+	ctx.API.Handle("/dl/sources/", sources)
+
+	if cfg.DHCP.Enable {
+		// the dhcp server registers leased hostnames with dns, so it can only
+		// be created after it
+		dhcp, err := NewDHCPServer(ctx.Log.Logger, cfg, ctx.DNS.LocalHosts.LocalHosts)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = dhcp.Init(); err != nil {
+			return nil, err
+		}
+
+		ctx.servers = append(ctx.servers, dhcp)
+	}
+
 	return ctx, nil
 }
 
@@ -0,0 +1,59 @@
+package context
+
+import (
+	"net"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"jrubin.io/blamedns/config"
+	"jrubin.io/blamedns/dhcpserver"
+	"jrubin.io/slog"
+)
+
+func NewDHCPServer(logger slog.Interface, cfg *config.Config, hostAdder dhcpserver.HostAdder) (*dhcpserver.Server, error) {
+	s := &dhcpserver.Server{
+		Addr:       cfg.DHCP.Listen,
+		ServerIP:   cfg.DHCP.ServerIP.Value(),
+		RangeStart: cfg.DHCP.RangeStart.Value(),
+		RangeEnd:   cfg.DHCP.RangeEnd.Value(),
+		Gateway:    cfg.DHCP.Gateway.Value(),
+		Domain:     cfg.DNS.Leases.Domain,
+		LeaseTime:  cfg.DHCP.LeaseTime.Value(),
+		LeaseFile:  path.Join(cfg.CacheDir, "dhcp", "leases.json"),
+		HostAdder:  hostAdder,
+		Logger:     logger.WithField("system", "dhcp"),
+	}
+
+	if mask := cfg.DHCP.Netmask.Value().To4(); mask != nil {
+		s.Netmask = net.IPMask(mask)
+	}
+
+	for _, addr := range cfg.DHCP.DNS {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, errors.Errorf("invalid dhcp dns server ip address: %s", addr)
+		}
+		s.DNS = append(s.DNS, ip)
+	}
+
+	for _, r := range cfg.DHCP.Reservation {
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid dhcp reservation mac address: %s", r.MAC)
+		}
+
+		ip := net.ParseIP(r.IP)
+		if ip == nil {
+			return nil, errors.Errorf("invalid dhcp reservation ip address: %s", r.IP)
+		}
+
+		s.Reservations = append(s.Reservations, dhcpserver.Reservation{
+			MAC:  mac,
+			IP:   ip,
+			Host: r.Host,
+		})
+	}
+
+	return s, nil
+}
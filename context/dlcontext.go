@@ -1,69 +1,248 @@
 package context
 
 import (
+	"io/ioutil"
 	"net/url"
+	"os"
 	"path"
+	"sync"
 
 	"github.com/pkg/errors"
 
 	"jrubin.io/blamedns/config"
 	"jrubin.io/blamedns/dl"
+	"jrubin.io/blamedns/parser"
+	"jrubin.io/slog"
 )
 
 type DLContext struct {
-	dl []*dl.DL
+	root    *Context
+	cfg     *config.Config
+	key     *dl.MinisignKey
+	mirrors map[string][]*url.URL
+	dirs    map[string]string
+	parsers map[string]parser.Parser
+
+	mu      sync.Mutex
+	dl      []*dl.DL
+	started bool
 }
 
+// NewDLContext returns a DLContext without any files to download, they are
+// added by the sources context
 func NewDLContext(rootCtx *Context, cfg *config.Config) (*DLContext, error) {
-	ctx := &DLContext{}
-	hostsDir := path.Join(cfg.CacheDir, "hosts")
-	domainsDir := path.Join(cfg.CacheDir, "domains")
-
-	for _, t := range []struct {
-		Values  []string
-		BaseDir string
-	}{{
-		Values:  cfg.DL.Hosts,
-		BaseDir: hostsDir,
-	}, {
-		Values:  cfg.DL.Domains,
-		BaseDir: domainsDir,
-	}} {
-		for _, u := range t.Values {
-			p, err := url.Parse(u)
+	ctx := &DLContext{
+		root: rootCtx,
+		cfg:  cfg,
+		dirs: sourceDirs(cfg),
+	}
+
+	if len(cfg.DL.MinisignKey) > 0 {
+		var err error
+		if ctx.key, err = dl.ParseMinisignKey(cfg.DL.MinisignKey); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if ctx.mirrors, err = newMirrors(cfg); err != nil {
+		return nil, err
+	}
+
+	// lines are validated without logging, the watcher logs invalid lines
+	// when the file is parsed
+	quiet := slog.New()
+
+	ctx.parsers = newParsers(quiet, parser.Discard, nil, parser.NonSinkIgnore, nil)
+
+	return ctx, nil
+}
+
+// Add downloads the file at u as a list in format, starting immediately if the
+// context has already been started
+func (ctx *DLContext) Add(format, u string) (*dl.DL, error) {
+	baseDir, ok := ctx.dirs[format]
+	if !ok {
+		return nil, errors.Errorf("invalid source format: %s", format)
+	}
+
+	p, err := url.Parse(u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing url for dl file: %s", u)
+	}
+
+	if p.Scheme != "http" && p.Scheme != "https" {
+		return nil, errors.Errorf("unsupported url for dl file: %s", u)
+	}
+
+	cfg := ctx.cfg
+
+	d := &dl.DL{
+		URL:            p,
+		BaseDir:        baseDir,
+		UpdateInterval: cfg.DL.UpdateInterval.Value(),
+		Logger:         ctx.root.Log.Logger,
+		AppName:        ctx.root.AppName,
+		AppVersion:     ctx.root.AppVersion,
+		DebugHTTP:      cfg.DL.DebugHTTP,
+		Mirrors:        ctx.mirrors[u],
+		RetryMin:       cfg.DL.RetryMin.Value(),
+		RetryMax:       cfg.DL.RetryMax.Value(),
+		Validation: &dl.Validation{
+			MinLines:      cfg.DL.MinLines,
+			MaxSize:       int64(cfg.DL.MaxSize),
+			MinValidRatio: cfg.DL.MinValidRatio,
+			Parser:        ctx.parsers[format],
+			Checksum:      cfg.DL.Checksum,
+			MinisignKey:   ctx.key,
+		},
+	}
+
+	if err = d.Init(); err != nil {
+		return nil, err
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.dl = append(ctx.dl, d)
+
+	if ctx.started {
+		d.Start()
+	}
+
+	return d, nil
+}
+
+func sameURL(u *url.URL, s string) bool {
+	p, err := url.Parse(s)
+	return err == nil && p.String() == u.String()
+}
+
+// Get returns the downloader of the file at u
+func (ctx *DLContext) Get(u string) *dl.DL {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	for _, d := range ctx.dl {
+		if sameURL(d.URL, u) {
+			return d
+		}
+	}
+
+	return nil
+}
+
+// Remove stops downloading the file at u and returns its downloader, or nil if
+// it wasn't being downloaded
+func (ctx *DLContext) Remove(u string) *dl.DL {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	for i, d := range ctx.dl {
+		if !sameURL(d.URL, u) {
+			continue
+		}
+
+		ctx.dl = append(ctx.dl[:i], ctx.dl[i+1:]...)
+		d.Stop()
+
+		return d
+	}
+
+	return nil
+}
+
+// newMirrors returns the parsed mirrors of each of the configured urls
+func newMirrors(cfg *config.Config) (map[string][]*url.URL, error) {
+	ret := map[string][]*url.URL{}
+
+	for _, m := range cfg.DL.Mirror {
+		if _, ok := sourceFormat(cfg, m.URL); !ok {
+			return nil, errors.Errorf("dl mirror: %s is not a configured url", m.URL)
+		}
+
+		for _, v := range m.Mirrors {
+			u, err := url.Parse(v)
 			if err != nil {
-				return nil, errors.Wrapf(err, "error parsing url for dl file: %s", u)
+				return nil, errors.Wrapf(err, "error parsing mirror url for dl file: %s", v)
+			}
+
+			ret[m.URL] = append(ret[m.URL], u)
+		}
+	}
+
+	return ret, nil
+}
+
+// Cleanup removes the files in the download directories that don't belong to
+// any of the files being downloaded, e.g. because their source was removed
+// from the config
+func (ctx *DLContext) Cleanup(logger slog.Interface) {
+	ctx.mu.Lock()
+	keep := map[string]bool{}
+	for _, d := range ctx.dl {
+		for _, f := range d.Files() {
+			keep[f] = true
+		}
+	}
+	ctx.mu.Unlock()
+
+	for _, dir := range ctx.dirs {
+		fi, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.WithError(err).WithField("dir", dir).Warn("error reading dir")
 			}
+			continue
+		}
 
-			d := &dl.DL{
-				URL:            p,
-				BaseDir:        t.BaseDir,
-				UpdateInterval: cfg.DL.UpdateInterval.Value(),
-				Logger:         rootCtx.Log.Logger,
-				AppName:        rootCtx.AppName,
-				AppVersion:     rootCtx.AppVersion,
-				DebugHTTP:      cfg.DL.DebugHTTP,
+		for _, info := range fi {
+			name := path.Join(dir, info.Name())
+			if info.IsDir() || keep[name] {
+				continue
 			}
 
-			if err = d.Init(); err != nil {
-				return nil, err
+			if err = os.Remove(name); err != nil {
+				logger.WithError(err).WithField("file", name).Warn("error removing stale file")
+				continue
 			}
 
-			ctx.dl = append(ctx.dl, d)
+			logger.WithField("file", name).Info("removed stale file")
 		}
 	}
+}
 
-	return ctx, nil
+// Status returns the state of the updates of each downloaded file
+func (ctx *DLContext) Status() []dl.Status {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ret := make([]dl.Status, len(ctx.dl))
+	for i, d := range ctx.dl {
+		ret[i] = d.Status()
+	}
+	return ret
 }
 
 func (ctx *DLContext) Start() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
 	for _, d := range ctx.dl {
 		d.Start()
 	}
+
+	ctx.started = true
 }
 
 func (ctx *DLContext) Shutdown() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
 	for _, d := range ctx.dl {
 		d.Stop()
 	}
+
+	ctx.started = false
 }
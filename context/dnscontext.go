@@ -1,27 +1,51 @@
 package context
 
 import (
+	"net"
+
+	"github.com/pkg/errors"
+
 	"jrubin.io/blamedns/config"
+	"jrubin.io/blamedns/dnscache"
+	"jrubin.io/blamedns/dnssec"
 	"jrubin.io/blamedns/dnsserver"
 	"jrubin.io/blamedns/override"
+	"jrubin.io/blamedns/recursor"
+	"jrubin.io/blamedns/rpz"
 	"jrubin.io/slog"
 )
 
 type DNSContext struct {
-	Server *dnsserver.DNSServer
-	Block  *BlockContext
-	Cache  *DNSCacheContext
+	Server     *dnsserver.DNSServer
+	Block      *BlockContext
+	Cache      *DNSCacheContext
+	DNSSECKeys *DNSCacheContext
+	Referrals  *DNSCacheContext
+	LocalHosts *LocalHostsContext
 }
 
 func NewDNSContext(logger slog.Interface, cfg *config.Config, onStart func()) (*DNSContext, error) {
-	blockContext, err := NewBlockContext(logger, cfg)
+	localHostsContext, err := NewLocalHostsContext(logger, cfg.DNS)
+	if err != nil {
+		return nil, err
+	}
+
+	blockContext, err := NewBlockContext(logger, cfg, localHostsContext.LocalHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	ecs, ecsSubnet, err := parseECS(cfg.DNS)
 	if err != nil {
 		return nil, err
 	}
 
 	ctx := &DNSContext{
-		Block: blockContext,
-		Cache: NewDNSCacheContext(logger, cfg.DNS.Cache),
+		Block:      blockContext,
+		Cache:      NewDNSCacheContext(logger, cfg.DNS.Cache),
+		DNSSECKeys: &DNSCacheContext{PruneInterval: cfg.DNS.Cache.PruneInterval.Value()},
+		Referrals:  &DNSCacheContext{PruneInterval: cfg.DNS.Cache.PruneInterval.Value()},
+		LocalHosts: localHostsContext,
 	}
 
 	ctx.Server = &dnsserver.DNSServer{
@@ -31,18 +55,30 @@ func NewDNSContext(logger slog.Interface, cfg *config.Config, onStart func()) (*
 		ServerTimeout:  cfg.DNS.ServerTimeout.Value(),
 		DialTimeout:    cfg.DNS.DialTimeout.Value(),
 		LookupInterval: cfg.DNS.LookupInterval.Value(),
+		UDPSize:        uint16(cfg.DNS.UDPSize),
 		Logger:         logger.WithField("system", "dns"),
 		NotifyStartedFunc: func() error {
 			ctx.Cache.Start()
+			ctx.DNSSECKeys.Start()
+			ctx.Referrals.Start()
 			if onStart != nil {
 				onStart()
 			}
 			ctx.Block.Start()
+			ctx.LocalHosts.Start()
+			ctx.Server.Health.Start()
+			ctx.Server.RPZ.Start()
 			return nil
 		},
-		Zones:       map[string][]string{},
-		OverrideTTL: cfg.DNS.OverrideTTL.Value(),
-		Override:    override.New(override.Parse(cfg.DNS.Override)),
+		OverrideTTL:   cfg.DNS.OverrideTTL.Value(),
+		Override:      override.New(override.Parse(cfg.DNS.Override)),
+		LocalHosts:    localHostsContext.LocalHosts,
+		LocalHostsTTL: cfg.DNS.LocalHosts.TTL.Value(),
+		EDNS: dnsserver.EDNS{
+			ECS:       ecs,
+			ECSSubnet: ecsSubnet,
+			NoCookies: cfg.DNS.EDNS.NoCookies,
+		},
 		HTTP: dnsserver.DNSHTTP{
 			KeepAlive:             cfg.DNS.HTTP.KeepAlive.Value(),
 			MaxIdleConns:          cfg.DNS.HTTP.MaxIdleConns,
@@ -51,26 +87,279 @@ func NewDNSContext(logger slog.Interface, cfg *config.Config, onStart func()) (*
 			TLSHandshakeTimeout:   cfg.DNS.HTTP.TLSHandshakeTimeout.Value(),
 			ExpectContinueTimeout: cfg.DNS.HTTP.ExpectContinueTimeout.Value(),
 			NoDNSSEC:              cfg.DNS.HTTP.NoDNSSEC,
-			EDNSClientSubnet:      cfg.DNS.HTTP.EDNSClientSubnet,
 			NoRandomPadding:       cfg.DNS.HTTP.NoRandomPadding,
 		},
 	}
 
 	if ctx.Cache.Cache != nil {
 		ctx.Server.Cache = ctx.Cache.Cache
+		ctx.Block.Cache = ctx.Cache.Cache
+	}
+
+	if !cfg.DNS.Health.Disable {
+		ctx.Server.Health = &dnsserver.Health{
+			Window:         cfg.DNS.Health.Window,
+			MinSuccessRate: cfg.DNS.Health.MinSuccessRate,
+			ProbeInterval:  cfg.DNS.Health.ProbeInterval.Value(),
+			ProbeName:      cfg.DNS.Health.ProbeName,
+			Logger:         logger.WithField("system", "health"),
+		}
 	}
 
-	if len(cfg.DNS.Forward) > 0 {
-		ctx.Server.Zones["."] = cfg.DNS.Forward
+	if cfg.DNS.DNSSEC.Validate {
+		ctx.DNSSECKeys.Cache = dnscache.NewMemory(cfg.DNS.DNSSEC.KeyCacheSize, logger)
+
+		if ctx.Server.DNSSEC, err = newValidator(cfg.DNS.DNSSEC, ctx.DNSSECKeys.Cache); err != nil {
+			return nil, err
+		}
+	}
+
+	if recursive(cfg.DNS) {
+		ctx.Referrals.Cache = dnscache.NewMemory(cfg.DNS.Recursor.CacheSize, logger)
+
+		if ctx.Server.Recursor, err = newRecursor(cfg.DNS, ctx.Referrals.Cache); err != nil {
+			return nil, err
+		}
+		ctx.Server.Recursor.Logger = logger.WithField("system", "recursor")
 	}
 
+	if rl := cfg.DNS.RateLimit; rl.QPS > 0 || rl.GlobalQPS > 0 || rl.ResponseQPS > 0 {
+		if ctx.Server.RateLimit, err = newRateLimit(cfg.DNS.RateLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	if ctx.Server.ACL, err = newACL(cfg.DNS.ACL); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.DNS.RPZ.Zone) > 0 {
+		if ctx.Server.RPZ, err = newRPZ(cfg.DNS); err != nil {
+			return nil, err
+		}
+		ctx.Server.RPZ.Logger = logger.WithField("system", "rpz")
+	}
+
+	// zones are matched in order, so the default forwarders must come after
+	// any client specific root zones
 	for _, zone := range cfg.DNS.Zone {
-		ctx.Server.Zones[zone.Name] = zone.Addr
+		clients, err := dnsserver.ParseCIDRs(zone.Clients)
+		if err != nil {
+			return nil, err
+		}
+
+		strategy, err := parseStrategy(cfg.DNS, zone.Strategy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "zone %s", zone.Name)
+		}
+
+		ctx.Server.Zones = append(ctx.Server.Zones, dnsserver.Zone{
+			Name:      zone.Name,
+			Clients:   clients,
+			Addr:      zone.Addr,
+			Strategy:  strategy,
+			Recursive: zone.Recursive,
+		})
+	}
+
+	if cfg.DNS.Recursive {
+		ctx.Server.Zones = append(ctx.Server.Zones, dnsserver.Zone{
+			Name:      ".",
+			Recursive: true,
+		})
+	} else if len(cfg.DNS.Forward) > 0 {
+		strategy, err := parseStrategy(cfg.DNS, cfg.DNS.Strategy)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx.Server.Zones = append(ctx.Server.Zones, dnsserver.Zone{
+			Name:     ".",
+			Addr:     cfg.DNS.Forward,
+			Strategy: strategy,
+		})
 	}
 
 	return ctx, nil
 }
 
+// parseStrategy returns the Strategy named by s. The latency of upstreams is
+// only measured when their health is tracked, so lowest-latency can't be used
+// without it.
+func parseStrategy(cfg *config.DNSConfig, s string) (dnsserver.Strategy, error) {
+	strategy, err := dnsserver.ParseStrategy(s)
+	if err != nil {
+		return "", err
+	}
+
+	if strategy == dnsserver.StrategyLowestLatency && cfg.Health.Disable {
+		return "", errors.Errorf("upstream strategy %s requires upstream health tracking", strategy)
+	}
+
+	return strategy, nil
+}
+
+// newValidator returns a dnssec validator that caches validated keys in keys
+func newValidator(cfg *config.DNSSECConfig, keys dnscache.Cache) (*dnssec.Validator, error) {
+	values := []string(cfg.TrustAnchors)
+	if len(values) == 0 {
+		values = dnssec.RootAnchors
+	}
+
+	anchors, err := dnssec.ParseAnchors(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnssec.Validator{
+		Anchors:         anchors,
+		NegativeAnchors: cfg.NegativeTrustAnchors,
+		Keys:            keys,
+	}, nil
+}
+
+// recursive returns whether any zone is resolved iteratively
+func recursive(cfg *config.DNSConfig) bool {
+	if cfg.Recursive {
+		return true
+	}
+
+	for _, zone := range cfg.Zone {
+		if zone.Recursive {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newRecursor returns an iterative resolver that caches referrals in cache
+func newRecursor(cfg *config.DNSConfig, cache dnscache.Cache) (*recursor.Resolver, error) {
+	values := []string(cfg.Recursor.RootHints)
+	if len(values) == 0 {
+		values = recursor.RootHints
+	}
+
+	hints, err := recursor.ParseHints(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recursor.Resolver{
+		Hints:      hints,
+		Cache:      cache,
+		NoMinimise: cfg.Recursor.NoQNAMEMinimisation,
+		DNSSECOK:   cfg.DNSSEC.Validate,
+		Timeout:    cfg.ClientTimeout.Value(),
+		UDPSize:    uint16(cfg.UDPSize),
+	}, nil
+}
+
+// newRateLimit returns the query and response rate limits
+func newRateLimit(cfg *config.RateLimitConfig) (*dnsserver.RateLimit, error) {
+	mode, err := dnsserver.ParseRateLimitMode(cfg.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	exempt, err := dnsserver.ParseCIDRs(cfg.Exempt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsserver.RateLimit{
+		QPS:           cfg.QPS,
+		Burst:         cfg.Burst,
+		GlobalQPS:     cfg.GlobalQPS,
+		GlobalBurst:   cfg.GlobalBurst,
+		IPv4Prefix:    cfg.IPv4Prefix,
+		IPv6Prefix:    cfg.IPv6Prefix,
+		Mode:          mode,
+		Exempt:        exempt,
+		ResponseQPS:   cfg.ResponseQPS,
+		ResponseBurst: cfg.ResponseBurst,
+		Slip:          cfg.Slip,
+	}, nil
+}
+
+// newACL returns the default access control list of the dns listeners
+func newACL(cfg *config.ACLConfig) (*dnsserver.ACL, error) {
+	action, err := dnsserver.ParseACLAction(cfg.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	allow, err := dnsserver.ParseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := dnsserver.ParseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsserver.ACL{
+		Allow:  allow,
+		Deny:   deny,
+		Action: action,
+	}, nil
+}
+
+// newRPZ returns the response policy zones, which are loaded once the server
+// starts
+func newRPZ(cfg *config.DNSConfig) (*rpz.Engine, error) {
+	ret := &rpz.Engine{Refresh: cfg.RPZ.Refresh.Value()}
+
+	for _, zone := range cfg.RPZ.Zone {
+		if len(zone.Name) == 0 {
+			return nil, errors.New("rpz zone has no name")
+		}
+
+		if (len(zone.File) == 0) == (len(zone.Primary) == 0) {
+			return nil, errors.Errorf("rpz zone %s needs either a file or a primary", zone.Name)
+		}
+
+		ret.Zones = append(ret.Zones, &rpz.Zone{
+			Name:    zone.Name,
+			File:    zone.File,
+			Primary: zone.Primary,
+			Timeout: cfg.ClientTimeout.Value(),
+		})
+	}
+
+	return ret, nil
+}
+
+// parseECS returns the edns client subnet policy and subnet
+func parseECS(cfg *config.DNSConfig) (dnsserver.ECSPolicy, *net.IPNet, error) {
+	policy, subnet := cfg.EDNS.ECS, cfg.EDNS.ECSSubnet
+
+	// support the older dns-over-https specific setting
+	if len(subnet) == 0 && len(cfg.HTTP.EDNSClientSubnet) > 0 {
+		policy, subnet = string(dnsserver.ECSReplace), cfg.HTTP.EDNSClientSubnet
+	}
+
+	ecs, err := dnsserver.ParseECSPolicy(policy)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(subnet) == 0 {
+		if ecs == dnsserver.ECSReplace {
+			return "", nil, errors.New("edns client subnet policy replace requires a subnet")
+		}
+		return ecs, nil, nil
+	}
+
+	nets, err := dnsserver.ParseCIDRs([]string{subnet})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return ecs, nets[0], nil
+}
+
 func (ctx DNSContext) Start() error {
 	// ctx.Block and ctx.Cache are started by DNSServer.NotifyStartedFunc
 	return ctx.Server.ListenAndServe()
@@ -78,10 +367,17 @@ func (ctx DNSContext) Start() error {
 
 func (ctx DNSContext) SIGUSR1() {
 	ctx.Cache.SIGUSR1()
+	ctx.DNSSECKeys.SIGUSR1()
+	ctx.Referrals.SIGUSR1()
 }
 
 func (ctx DNSContext) Shutdown() {
 	ctx.Cache.Shutdown()
+	ctx.DNSSECKeys.Shutdown()
+	ctx.Referrals.Shutdown()
 	ctx.Block.Shutdown()
+	ctx.LocalHosts.Shutdown()
+	ctx.Server.Health.Stop()
+	ctx.Server.RPZ.Stop()
 	ctx.Server.Shutdown()
 }
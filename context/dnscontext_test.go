@@ -0,0 +1,32 @@
+package context
+
+import (
+	"testing"
+
+	"jrubin.io/blamedns/config"
+	"jrubin.io/blamedns/dnsserver"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseStrategy(t *testing.T) {
+	Convey("lowest-latency should require health tracking", t, func() {
+		cfg := config.New()
+
+		strategy, err := parseStrategy(cfg.DNS, "lowest-latency")
+		So(err, ShouldBeNil)
+		So(strategy, ShouldEqual, dnsserver.StrategyLowestLatency)
+
+		cfg.DNS.Health.Disable = true
+
+		_, err = parseStrategy(cfg.DNS, "lowest-latency")
+		So(err, ShouldNotBeNil)
+
+		strategy, err = parseStrategy(cfg.DNS, "round-robin")
+		So(err, ShouldBeNil)
+		So(strategy, ShouldEqual, dnsserver.StrategyRoundRobin)
+
+		_, err = parseStrategy(cfg.DNS, "nope")
+		So(err, ShouldNotBeNil)
+	})
+}
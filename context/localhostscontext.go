@@ -0,0 +1,80 @@
+package context
+
+import (
+	"jrubin.io/blamedns/config"
+	"jrubin.io/blamedns/localhosts"
+	"jrubin.io/blamedns/parser"
+	"jrubin.io/blamedns/watcher"
+	"jrubin.io/slog"
+)
+
+type watchedFiles struct {
+	Files  []string
+	Parser parser.Parser
+}
+
+type LocalHostsContext struct {
+	LocalHosts *localhosts.LocalHosts
+	Watchers   []*watcher.Watcher
+}
+
+func NewLocalHostsContext(logger slog.Interface, cfg *config.DNSConfig) (*LocalHostsContext, error) {
+	ctx := &LocalHostsContext{
+		LocalHosts: localhosts.New(),
+	}
+
+	var files []watchedFiles
+
+	if !cfg.LocalHosts.Disable {
+		files = append(files, watchedFiles{
+			Files: cfg.LocalHosts.Files,
+			Parser: parser.LocalHostsParser{
+				HostAdder: ctx.LocalHosts,
+				Logger:    logger,
+			},
+		})
+	}
+
+	files = append(files, []watchedFiles{{
+		Files: cfg.Leases.Dnsmasq,
+		Parser: parser.DnsmasqLeasesParser{
+			HostAdder: ctx.LocalHosts,
+			Domain:    cfg.Leases.Domain,
+			Logger:    logger,
+		},
+	}, {
+		Files: cfg.Leases.ISC,
+		Parser: &parser.ISCLeasesParser{
+			HostAdder: ctx.LocalHosts,
+			Domain:    cfg.Leases.Domain,
+			Logger:    logger,
+		},
+	}}...)
+
+	for _, f := range files {
+		if len(f.Files) == 0 {
+			continue
+		}
+
+		w, err := watcher.NewFiles(logger, f.Parser, f.Files...)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx.Watchers = append(ctx.Watchers, w)
+	}
+
+	return ctx, nil
+}
+
+func (ctx *LocalHostsContext) Start() {
+	for _, w := range ctx.Watchers {
+		w.Start()
+	}
+}
+
+func (ctx *LocalHostsContext) Shutdown() {
+	for _, w := range ctx.Watchers {
+		w.Stop()
+	}
+}
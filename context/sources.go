@@ -0,0 +1,533 @@
+package context
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"jrubin.io/blamedns/apiserver"
+	"jrubin.io/blamedns/config"
+	"jrubin.io/blamedns/dl"
+	"jrubin.io/blamedns/parser"
+	"jrubin.io/slog"
+)
+
+// the formats of lists that sources can be
+const (
+	SourceHosts   = "hosts"
+	SourceDomains = "domains"
+	SourceDnsmasq = "dnsmasq"
+	SourceUnbound = "unbound"
+	SourceBind    = "bind"
+)
+
+var sourceFormats = []string{
+	SourceHosts,
+	SourceDomains,
+	SourceDnsmasq,
+	SourceUnbound,
+	SourceBind,
+}
+
+// sourceDirs returns the directory that lists of each format are downloaded to
+func sourceDirs(cfg *config.Config) map[string]string {
+	ret := map[string]string{}
+	for _, format := range sourceFormats {
+		ret[format] = path.Join(cfg.CacheDir, format)
+	}
+	return ret
+}
+
+var (
+	errSourceNotFound = errors.New("no such source")
+	errSourceExists   = errors.New("source already exists")
+)
+
+type source struct {
+	Format  string
+	URL     string
+	Enabled bool
+}
+
+func (s *source) local() bool {
+	return strings.HasPrefix(s.URL, "file:")
+}
+
+type sourceURL struct {
+	Format string `json:"format"`
+	URL    string `json:"url"`
+
+	// Type is what Format was called before there were other formats than
+	// hosts and domains
+	Type string `json:"type,omitempty"`
+}
+
+// configuredSources returns the sources in the hosts, domains and source lists
+// of the config
+func configuredSources(cfg *config.Config) []sourceURL {
+	var ret []sourceURL
+
+	for _, u := range cfg.DL.Hosts {
+		ret = append(ret, sourceURL{Format: SourceHosts, URL: u})
+	}
+
+	for _, u := range cfg.DL.Domains {
+		ret = append(ret, sourceURL{Format: SourceDomains, URL: u})
+	}
+
+	for _, s := range cfg.DL.Source {
+		ret = append(ret, sourceURL{Format: s.Format, URL: s.URL})
+	}
+
+	return ret
+}
+
+// sourceFormat returns the format of u if it is configured
+func sourceFormat(cfg *config.Config, u string) (string, bool) {
+	for _, s := range configuredSources(cfg) {
+		if s.URL == u {
+			return s.Format, true
+		}
+	}
+	return "", false
+}
+
+// sourceState is how the configured sources have been changed at runtime. It is
+// persisted so that the changes survive restarts.
+type sourceState struct {
+	Added    []sourceURL `json:"added,omitempty"`
+	Removed  []string    `json:"removed,omitempty"`
+	Disabled []string    `json:"disabled,omitempty"`
+}
+
+func without(values []string, value string) []string {
+	var ret []string
+	for _, v := range values {
+		if v != value {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// SourcesContext manages the hosts and domains lists that are downloaded or
+// watched in place
+type SourcesContext struct {
+	DL     *DLContext
+	Block  *BlockContext
+	logger slog.Interface
+	file   string
+
+	mu         sync.Mutex
+	sources    []*source
+	configured map[string]bool
+	state      sourceState
+}
+
+// SourceStatus is the state of a source
+type SourceStatus struct {
+	Format   string     `json:"format"`
+	URL      string     `json:"url"`
+	Enabled  bool       `json:"enabled"`
+	Entries  int        `json:"entries"`
+	Modified time.Time  `json:"modified,omitempty"`
+	Download *dl.Status `json:"download,omitempty"`
+
+	// Parsed is how the hosts in the files of the source were handled
+	Parsed *parser.Stats `json:"parsed,omitempty"`
+}
+
+func (s *SourceStatus) addStats(fs *parser.FileStats, name string) {
+	stats, ok := fs.Get(name)
+	if !ok {
+		return
+	}
+
+	if s.Parsed == nil {
+		s.Parsed = &parser.Stats{}
+	}
+
+	s.Parsed.Add(stats)
+}
+
+// NewSourcesContext adds the configured sources, as changed at runtime, to the
+// dl and block contexts
+func NewSourcesContext(logger slog.Interface, cfg *config.Config, dlCtx *DLContext, blockCtx *BlockContext) (*SourcesContext, error) {
+	ctx := &SourcesContext{
+		DL:         dlCtx,
+		Block:      blockCtx,
+		logger:     logger,
+		file:       path.Join(cfg.CacheDir, "sources.json"),
+		configured: map[string]bool{},
+	}
+
+	if err := ctx.load(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range configuredSources(cfg) {
+		ctx.configured[c.URL] = true
+
+		if !contains(ctx.state.Removed, c.URL) {
+			ctx.sources = append(ctx.sources, &source{Format: c.Format, URL: c.URL})
+		}
+	}
+
+	for _, a := range ctx.state.Added {
+		ctx.sources = append(ctx.sources, &source{Format: a.Format, URL: a.URL})
+	}
+
+	for _, s := range ctx.sources {
+		if contains(ctx.state.Disabled, s.URL) {
+			continue
+		}
+
+		if err := ctx.start(s); err != nil {
+			return nil, err
+		}
+	}
+
+	// before the watchers parse files that are no longer downloaded
+	dlCtx.Cleanup(logger)
+
+	return ctx, nil
+}
+
+func (ctx *SourcesContext) load() error {
+	b, err := ioutil.ReadFile(ctx.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(b, &ctx.state); err != nil {
+		return errors.Wrapf(err, "error parsing %s", ctx.file)
+	}
+
+	for i, a := range ctx.state.Added {
+		if len(a.Format) == 0 {
+			ctx.state.Added[i] = sourceURL{Format: a.Type, URL: a.URL}
+		}
+	}
+
+	return nil
+}
+
+// save writes the state atomically so that a crash can't lose it
+func (ctx *SourcesContext) save() error {
+	b, err := json.MarshalIndent(ctx.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := ctx.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ctx.file)
+}
+
+func (ctx *SourcesContext) start(s *source) error {
+	if s.local() {
+		if err := ctx.Block.AddLocal(s.Format, s.URL); err != nil {
+			return err
+		}
+	} else if _, err := ctx.DL.Add(s.Format, s.URL); err != nil {
+		return err
+	}
+
+	s.Enabled = true
+	return nil
+}
+
+// stop stops updating s and removes its hosts. Downloaded files are deleted so
+// that they aren't parsed again on restart.
+func (ctx *SourcesContext) stop(s *source) error {
+	s.Enabled = false
+
+	if s.local() {
+		ctx.Block.RemoveLocal(s.URL)
+		return nil
+	}
+
+	d := ctx.DL.Remove(s.URL)
+	if d == nil {
+		return nil
+	}
+
+	err := d.Remove()
+	ctx.Block.ResetSource(d.Status().File)
+
+	return err
+}
+
+func (ctx *SourcesContext) find(u string) (int, *source) {
+	for i, s := range ctx.sources {
+		if s.URL == u {
+			return i, s
+		}
+	}
+	return -1, nil
+}
+
+// Status returns the state of each source
+func (ctx *SourcesContext) Status() []SourceStatus {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	counts := ctx.Block.Blocker.Sources()
+
+	ret := make([]SourceStatus, len(ctx.sources))
+	for i, s := range ctx.sources {
+		ret[i] = SourceStatus{
+			Format:  s.Format,
+			URL:     s.URL,
+			Enabled: s.Enabled,
+		}
+
+		if !s.Enabled {
+			continue
+		}
+
+		if s.local() {
+			name, _, _ := localPath(s.URL)
+			for _, n := range ctx.Block.LocalSources(name) {
+				ret[i].Entries += counts[n]
+				ret[i].addStats(ctx.Block.Stats, n)
+			}
+
+			if info, err := os.Stat(name); err == nil {
+				ret[i].Modified = info.ModTime()
+			}
+
+			continue
+		}
+
+		if d := ctx.DL.Get(s.URL); d != nil {
+			status := d.Status()
+			ret[i].Download = &status
+			ret[i].Entries = counts[status.File]
+			ret[i].addStats(ctx.Block.Stats, status.File)
+		}
+	}
+
+	return ret
+}
+
+// Add starts using the list in format at u
+func (ctx *SourcesContext) Add(format, u string) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if _, s := ctx.find(u); s != nil {
+		return errSourceExists
+	}
+
+	s := &source{Format: format, URL: u}
+	if err := ctx.start(s); err != nil {
+		return err
+	}
+
+	ctx.sources = append(ctx.sources, s)
+
+	if ctx.configured[u] {
+		ctx.state.Removed = without(ctx.state.Removed, u)
+	} else {
+		ctx.state.Added = append(ctx.state.Added, sourceURL{Format: format, URL: u})
+	}
+
+	ctx.logger.WithFields(slog.Fields{
+		"format": format,
+		"url":    u,
+	}).Info("added block source")
+
+	return ctx.save()
+}
+
+// Remove stops using the list at u
+func (ctx *SourcesContext) Remove(u string) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	i, s := ctx.find(u)
+	if s == nil {
+		return errSourceNotFound
+	}
+
+	if s.Enabled {
+		if err := ctx.stop(s); err != nil {
+			ctx.logger.WithError(err).WithField("url", u).Warn("error removing block source")
+		}
+	}
+
+	ctx.sources = append(ctx.sources[:i], ctx.sources[i+1:]...)
+
+	if ctx.configured[u] {
+		ctx.state.Removed = append(ctx.state.Removed, u)
+	} else {
+		var added []sourceURL
+		for _, a := range ctx.state.Added {
+			if a.URL != u {
+				added = append(added, a)
+			}
+		}
+		ctx.state.Added = added
+	}
+
+	ctx.state.Disabled = without(ctx.state.Disabled, u)
+
+	return ctx.save()
+}
+
+// SetEnabled starts or stops using the list at u without forgetting about it
+func (ctx *SourcesContext) SetEnabled(u string, enabled bool) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	_, s := ctx.find(u)
+	if s == nil {
+		return errSourceNotFound
+	}
+
+	if s.Enabled == enabled {
+		return nil
+	}
+
+	if enabled {
+		if err := ctx.start(s); err != nil {
+			return err
+		}
+		ctx.state.Disabled = without(ctx.state.Disabled, u)
+	} else {
+		if err := ctx.stop(s); err != nil {
+			ctx.logger.WithError(err).WithField("url", u).Warn("error disabling block source")
+		}
+		ctx.state.Disabled = append(ctx.state.Disabled, u)
+	}
+
+	ctx.logger.WithFields(slog.Fields{
+		"url":     u,
+		"enabled": enabled,
+	}).Info("changed block source")
+
+	return ctx.save()
+}
+
+// Refresh updates the list at u, or every enabled list if u is empty, in the
+// background, regardless of when it was last updated
+func (ctx *SourcesContext) Refresh(u string) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	found := false
+
+	for _, s := range ctx.sources {
+		if len(u) > 0 && s.URL != u {
+			continue
+		}
+
+		found = true
+
+		if !s.Enabled {
+			continue
+		}
+
+		if s.local() {
+			ctx.Block.RefreshLocal(s.URL)
+			continue
+		}
+
+		if d := ctx.DL.Get(s.URL); d != nil {
+			go func() { _, _ = d.Refresh() }()
+		}
+	}
+
+	if len(u) > 0 && !found {
+		return errSourceNotFound
+	}
+
+	return nil
+}
+
+// sourceFormatValue returns the format parameter of r, which used to be called
+// type
+func sourceFormatValue(r *http.Request) string {
+	if format := r.FormValue("format"); len(format) > 0 {
+		return format
+	}
+	return r.FormValue("type")
+}
+
+func sourceError(w http.ResponseWriter, err error) {
+	switch err {
+	case errSourceNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errSourceExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// Handler returns an http.Handler that manages sources. GET requests list
+// them, POST requests with "format" and "url" parameters add one and DELETE
+// requests with a "url" parameter remove it. POST requests to /enable,
+// /disable and /refresh, with a "url" parameter, do so to that source; refresh
+// updates every source when it is empty.
+func (ctx *SourcesContext) Handler(prefix string) http.Handler {
+	status := apiserver.JSONHandler(func() interface{} {
+		return ctx.Status()
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := r.FormValue("url")
+
+		var err error
+
+		switch action := strings.TrimPrefix(r.URL.Path, prefix); {
+		case action == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		case action == "" && r.Method == http.MethodPost:
+			err = ctx.Add(sourceFormatValue(r), u)
+		case action == "" && r.Method == http.MethodDelete:
+			err = ctx.Remove(u)
+		case action == "/enable" && r.Method == http.MethodPost:
+			err = ctx.SetEnabled(u, true)
+		case action == "/disable" && r.Method == http.MethodPost:
+			err = ctx.SetEnabled(u, false)
+		case action == "/refresh" && r.Method == http.MethodPost:
+			if err = ctx.Refresh(u); err == nil {
+				// headers can't be set by status after they are written
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+			}
+		case action == "" || action == "/enable" || action == "/disable" || action == "/refresh":
+			if action == "" {
+				w.Header().Set("Allow", "GET, POST, DELETE")
+			} else {
+				w.Header().Set("Allow", "POST")
+			}
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		if err != nil {
+			sourceError(w, err)
+			return
+		}
+
+		status.ServeHTTP(w, r)
+	})
+}
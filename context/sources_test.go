@@ -0,0 +1,215 @@
+package context
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"jrubin.io/blamedns/config"
+	"jrubin.io/blamedns/localhosts"
+	"jrubin.io/slog"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testSources struct {
+	*SourcesContext
+	handler http.Handler
+}
+
+// newTestSources creates the contexts that sources are managed with from cfg,
+// as on startup
+func newTestSources(cfg *config.Config) *testSources {
+	root := &Context{
+		AppName:    "blamedns",
+		AppVersion: "test",
+		Log:        &LogContext{Logger: slog.New()},
+	}
+
+	dlCtx, err := NewDLContext(root, cfg)
+	So(err, ShouldBeNil)
+
+	blockCtx, err := NewBlockContext(slog.New(), cfg, localhosts.New())
+	So(err, ShouldBeNil)
+
+	ctx, err := NewSourcesContext(slog.New(), cfg, dlCtx, blockCtx)
+	So(err, ShouldBeNil)
+
+	return &testSources{
+		SourcesContext: ctx,
+		handler:        ctx.Handler("/dl/sources"),
+	}
+}
+
+func (s *testSources) Shutdown() {
+	s.DL.Shutdown()
+	s.Block.Shutdown()
+}
+
+func (s *testSources) do(method, action string, values url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/dl/sources"+action+"?"+values.Encode(), nil)
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	return w
+}
+
+// list returns the sources by url
+func (s *testSources) list() map[string]SourceStatus {
+	w := s.do(http.MethodGet, "", nil)
+	So(w.Code, ShouldEqual, http.StatusOK)
+	So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+	var status []SourceStatus
+	So(json.NewDecoder(w.Body).Decode(&status), ShouldBeNil)
+
+	ret := map[string]SourceStatus{}
+	for _, st := range status {
+		ret[st.URL] = st
+	}
+	return ret
+}
+
+func TestSourcesHandler(t *testing.T) {
+	Convey("the sources api should work", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("0.0.0.0 a.example.com\n0.0.0.0 b.example.com\n"))
+		}))
+		defer ts.Close()
+
+		cfg, cleanup := testConfig()
+		defer cleanup()
+
+		configured := ts.URL + "/configured"
+		added := ts.URL + "/added"
+
+		cfg.DL.Hosts = []string{configured}
+		cfg.DL.Domains = nil
+		cfg.DL.Source = nil
+
+		s := newTestSources(cfg)
+
+		sources := s.list()
+		So(sources, ShouldHaveLength, 1)
+		So(sources[configured].Format, ShouldEqual, SourceHosts)
+		So(sources[configured].Enabled, ShouldBeTrue)
+
+		Convey("sources can be added and removed", func() {
+			defer func() { s.Shutdown() }()
+
+			w := s.do(http.MethodPost, "", url.Values{"format": {SourceDomains}, "url": {added}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			sources = s.list()
+			So(sources, ShouldHaveLength, 2)
+			So(sources[added].Format, ShouldEqual, SourceDomains)
+			So(sources[added].Enabled, ShouldBeTrue)
+			So(s.DL.Get(added), ShouldNotBeNil)
+
+			w = s.do(http.MethodPost, "", url.Values{"format": {SourceHosts}, "url": {added}})
+			So(w.Code, ShouldEqual, http.StatusConflict)
+
+			w = s.do(http.MethodPost, "", url.Values{"format": {"nope"}, "url": {ts.URL + "/other"}})
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+
+			w = s.do(http.MethodDelete, "", url.Values{"url": {configured}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(s.list(), ShouldNotContainKey, configured)
+			So(s.DL.Get(configured), ShouldBeNil)
+
+			w = s.do(http.MethodDelete, "", url.Values{"url": {configured}})
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+
+			Convey("and that survives restarts", func() {
+				s.Shutdown()
+				s = newTestSources(cfg)
+
+				sources = s.list()
+				So(sources, ShouldHaveLength, 1)
+				So(sources[added].Format, ShouldEqual, SourceDomains)
+				So(sources[added].Enabled, ShouldBeTrue)
+				So(s.DL.Get(configured), ShouldBeNil)
+
+				// configured sources that were removed can be added back
+				w = s.do(http.MethodPost, "", url.Values{"format": {SourceHosts}, "url": {configured}})
+				So(w.Code, ShouldEqual, http.StatusOK)
+
+				w = s.do(http.MethodDelete, "", url.Values{"url": {added}})
+				So(w.Code, ShouldEqual, http.StatusOK)
+
+				s.Shutdown()
+				s = newTestSources(cfg)
+
+				sources = s.list()
+				So(sources, ShouldHaveLength, 1)
+				So(sources[configured].Enabled, ShouldBeTrue)
+			})
+		})
+
+		Convey("sources can be disabled and enabled", func() {
+			defer func() { s.Shutdown() }()
+
+			w := s.do(http.MethodPost, "/disable", url.Values{"url": {configured}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(s.list()[configured].Enabled, ShouldBeFalse)
+			So(s.DL.Get(configured), ShouldBeNil)
+
+			w = s.do(http.MethodPost, "/disable", url.Values{"url": {added}})
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+
+			s.Shutdown()
+			s = newTestSources(cfg)
+
+			sources = s.list()
+			So(sources, ShouldHaveLength, 1)
+			So(sources[configured].Enabled, ShouldBeFalse)
+			So(s.DL.Get(configured), ShouldBeNil)
+
+			w = s.do(http.MethodPost, "/enable", url.Values{"url": {configured}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(s.list()[configured].Enabled, ShouldBeTrue)
+			So(s.DL.Get(configured), ShouldNotBeNil)
+
+			w = s.do(http.MethodPost, "/enable", url.Values{"url": {added}})
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+
+			s.Shutdown()
+			s = newTestSources(cfg)
+
+			So(s.list()[configured].Enabled, ShouldBeTrue)
+		})
+
+		Convey("sources can be refreshed", func() {
+			defer func() { s.Shutdown() }()
+
+			w := s.do(http.MethodPost, "/refresh", url.Values{"url": {configured}})
+			So(w.Code, ShouldEqual, http.StatusAccepted)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+			var status []SourceStatus
+			So(json.NewDecoder(w.Body).Decode(&status), ShouldBeNil)
+			So(status, ShouldHaveLength, 1)
+
+			// the refresh happens in the background
+			d := s.DL.Get(configured)
+			deadline := time.Now().Add(5 * time.Second)
+			for d.Status().LastSuccess.IsZero() && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(d.Status().LastSuccess.IsZero(), ShouldBeFalse)
+
+			w = s.do(http.MethodPost, "/refresh", url.Values{"url": {added}})
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("invalid requests should be rejected", func() {
+			defer func() { s.Shutdown() }()
+
+			So(s.do(http.MethodPut, "", nil).Code, ShouldEqual, http.StatusMethodNotAllowed)
+			So(s.do(http.MethodGet, "/enable", nil).Code, ShouldEqual, http.StatusMethodNotAllowed)
+			So(s.do(http.MethodGet, "/nope", nil).Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -0,0 +1,124 @@
+package dhcpserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Lease is an ip address assigned to a client
+type Lease struct {
+	MAC     string    `json:"mac"`
+	IP      net.IP    `json:"ip"`
+	Host    string    `json:"host,omitempty"`
+	Expires time.Time `json:"expires"`
+
+	// Offered leases have been offered to, but not yet requested by, the
+	// client. They are not persisted.
+	Offered bool `json:"-"`
+}
+
+func (l Lease) Expired(now time.Time) bool {
+	return !l.Expires.After(now)
+}
+
+type leases struct {
+	file string
+	data map[string]*Lease // keyed by ip address
+}
+
+func newLeases(file string) *leases {
+	return &leases{
+		file: file,
+		data: map[string]*Lease{},
+	}
+}
+
+func (l *leases) load() error {
+	if len(l.file) == 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(l.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "error reading dhcp lease file: %s", l.file)
+	}
+
+	var list []*Lease
+	if err = json.Unmarshal(data, &list); err != nil {
+		return errors.Wrapf(err, "error parsing dhcp lease file: %s", l.file)
+	}
+
+	for _, lease := range list {
+		if lease.IP = lease.IP.To4(); lease.IP != nil {
+			l.data[lease.IP.String()] = lease
+		}
+	}
+
+	return nil
+}
+
+// save writes all of the leases, except for offers, to the lease file. The file
+// is replaced atomically so that a crash never leaves a partially written file.
+func (l *leases) save() error {
+	if len(l.file) == 0 {
+		return nil
+	}
+
+	list := []*Lease{}
+	for _, lease := range l.data {
+		if !lease.Offered {
+			list = append(list, lease)
+		}
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error encoding dhcp leases")
+	}
+
+	if err = os.MkdirAll(path.Dir(l.file), 0700); err != nil {
+		return err
+	}
+
+	tmp := l.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "error writing dhcp lease file: %s", tmp)
+	}
+
+	if err = os.Rename(tmp, l.file); err != nil {
+		return errors.Wrapf(err, "error renaming dhcp lease file: %s", l.file)
+	}
+
+	return nil
+}
+
+func (l *leases) byIP(ip net.IP) *Lease {
+	return l.data[ip.String()]
+}
+
+func (l *leases) byMAC(mac net.HardwareAddr) *Lease {
+	m := mac.String()
+	for _, lease := range l.data {
+		if lease.MAC == m {
+			return lease
+		}
+	}
+	return nil
+}
+
+func (l *leases) set(lease *Lease) {
+	l.data[lease.IP.String()] = lease
+}
+
+func (l *leases) remove(lease *Lease) {
+	delete(l.data, lease.IP.String())
+}
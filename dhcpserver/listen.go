@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package dhcpserver
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// listen creates a udp socket that is permitted to send to the broadcast
+// address, which is required to reply to clients that do not yet have an ip
+// address.
+func listen(addr string) (net.PacketConn, error) {
+	uaddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error resolving dhcp server address: %s", addr)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating dhcp server socket")
+	}
+
+	for _, opt := range []int{syscall.SO_REUSEADDR, syscall.SO_BROADCAST} {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, 1); err != nil {
+			_ = syscall.Close(fd)
+			return nil, errors.Wrap(err, "error setting dhcp server socket option")
+		}
+	}
+
+	sa := &syscall.SockaddrInet4{Port: uaddr.Port}
+	if uaddr.IP != nil {
+		copy(sa.Addr[:], uaddr.IP.To4())
+	}
+
+	if err = syscall.Bind(fd, sa); err != nil {
+		_ = syscall.Close(fd)
+		return nil, errors.Wrapf(err, "error binding dhcp server socket: %s", addr)
+	}
+
+	f := os.NewFile(uintptr(fd), "dhcpserver")
+	defer func() { _ = f.Close() }()
+
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating dhcp server connection")
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,15 @@
+package dhcpserver
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+func listen(addr string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating dhcp server listener: %s", addr)
+	}
+	return conn, nil
+}
@@ -0,0 +1,321 @@
+package dhcpserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	opRequest = 1
+	opReply   = 2
+
+	htypeEthernet = 1
+
+	flagBroadcast = 0x8000
+
+	// fixed length portion of the packet, excluding the magic cookie
+	headerLen = 236
+
+	// bootp requires packets to be at least this long
+	minPacketLen = 300
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// MessageType is the value of the dhcp message type option (53)
+type MessageType byte
+
+const (
+	Discover MessageType = iota + 1
+	Offer
+	Request
+	Decline
+	Ack
+	Nak
+	Release
+	Inform
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case Discover:
+		return "DISCOVER"
+	case Offer:
+		return "OFFER"
+	case Request:
+		return "REQUEST"
+	case Decline:
+		return "DECLINE"
+	case Ack:
+		return "ACK"
+	case Nak:
+		return "NAK"
+	case Release:
+		return "RELEASE"
+	case Inform:
+		return "INFORM"
+	}
+	return "UNKNOWN"
+}
+
+// option codes
+const (
+	optPad           = 0
+	optSubnetMask    = 1
+	optRouter        = 3
+	optDNSServer     = 6
+	optHostName      = 12
+	optDomainName    = 15
+	optRequestedIP   = 50
+	optLeaseTime     = 51
+	optMessageType   = 53
+	optServerID      = 54
+	optRenewalTime   = 58
+	optRebindingTime = 59
+	optClientID      = 61
+	optEnd           = 255
+)
+
+// A Packet is a decoded dhcpv4 (bootp) packet.
+type Packet struct {
+	Op      byte
+	HType   byte
+	HLen    byte
+	Hops    byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options map[byte][]byte
+}
+
+var (
+	errShortPacket  = errors.New("dhcp packet too short")
+	errMagicCookie  = errors.New("dhcp packet has invalid magic cookie")
+	errShortOptions = errors.New("dhcp packet options truncated")
+)
+
+func ip4(b []byte) net.IP {
+	return net.IPv4(b[0], b[1], b[2], b[3]).To4()
+}
+
+// ParsePacket decodes a dhcp packet
+func ParsePacket(data []byte) (*Packet, error) {
+	if len(data) < headerLen+len(magicCookie) {
+		return nil, errShortPacket
+	}
+
+	if !bytes.Equal(data[headerLen:headerLen+len(magicCookie)], magicCookie) {
+		return nil, errMagicCookie
+	}
+
+	p := &Packet{
+		Op:      data[0],
+		HType:   data[1],
+		HLen:    data[2],
+		Hops:    data[3],
+		XID:     binary.BigEndian.Uint32(data[4:8]),
+		Secs:    binary.BigEndian.Uint16(data[8:10]),
+		Flags:   binary.BigEndian.Uint16(data[10:12]),
+		CIAddr:  ip4(data[12:16]),
+		YIAddr:  ip4(data[16:20]),
+		SIAddr:  ip4(data[20:24]),
+		GIAddr:  ip4(data[24:28]),
+		Options: map[byte][]byte{},
+	}
+
+	hlen := int(p.HLen)
+	if hlen > 16 {
+		hlen = 16
+	}
+
+	p.CHAddr = make(net.HardwareAddr, hlen)
+	copy(p.CHAddr, data[28:28+hlen])
+
+	opts := data[headerLen+len(magicCookie):]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		i++
+
+		if code == optPad {
+			continue
+		}
+
+		if code == optEnd {
+			break
+		}
+
+		if i >= len(opts) {
+			return nil, errShortOptions
+		}
+
+		l := int(opts[i])
+		i++
+
+		if i+l > len(opts) {
+			return nil, errShortOptions
+		}
+
+		// options may be split across multiple instances and must be
+		// concatenated (rfc 3396)
+		p.Options[code] = append(p.Options[code], opts[i:i+l]...)
+		i += l
+	}
+
+	return p, nil
+}
+
+func putIP(b []byte, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(b, ip4)
+	}
+}
+
+// Marshal encodes the packet
+func (p *Packet) Marshal() []byte {
+	data := make([]byte, headerLen, minPacketLen)
+
+	data[0] = p.Op
+	data[1] = p.HType
+	data[2] = p.HLen
+	data[3] = p.Hops
+	binary.BigEndian.PutUint32(data[4:8], p.XID)
+	binary.BigEndian.PutUint16(data[8:10], p.Secs)
+	binary.BigEndian.PutUint16(data[10:12], p.Flags)
+	putIP(data[12:16], p.CIAddr)
+	putIP(data[16:20], p.YIAddr)
+	putIP(data[20:24], p.SIAddr)
+	putIP(data[24:28], p.GIAddr)
+	copy(data[28:44], p.CHAddr)
+
+	data = append(data, magicCookie...)
+
+	// message type must be first
+	if v, ok := p.Options[optMessageType]; ok {
+		data = appendOption(data, optMessageType, v)
+	}
+
+	for code := 1; code < optEnd; code++ {
+		if code == optMessageType {
+			continue
+		}
+
+		if v, ok := p.Options[byte(code)]; ok {
+			data = appendOption(data, byte(code), v)
+		}
+	}
+
+	data = append(data, optEnd)
+
+	for len(data) < minPacketLen {
+		data = append(data, optPad)
+	}
+
+	return data
+}
+
+func appendOption(data []byte, code byte, value []byte) []byte {
+	// values longer than 255 bytes are split across multiple options
+	for {
+		l := len(value)
+		if l > 255 {
+			l = 255
+		}
+
+		data = append(data, code, byte(l))
+		data = append(data, value[:l]...)
+		value = value[l:]
+
+		if len(value) == 0 {
+			return data
+		}
+	}
+}
+
+// MessageType returns the value of the message type option, or 0 if it is not
+// set.
+func (p *Packet) MessageType() MessageType {
+	if v := p.Options[optMessageType]; len(v) == 1 {
+		return MessageType(v[0])
+	}
+	return 0
+}
+
+func (p *Packet) optionIP(code byte) net.IP {
+	if v := p.Options[code]; len(v) == net.IPv4len {
+		return ip4(v)
+	}
+	return nil
+}
+
+func (p *Packet) SetOptionIP(code byte, ips ...net.IP) {
+	var v []byte
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			v = append(v, ip4...)
+		}
+	}
+
+	if len(v) > 0 {
+		p.Options[code] = v
+	}
+}
+
+func (p *Packet) SetOptionDuration(code byte, sec uint32) {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, sec)
+	p.Options[code] = v
+}
+
+// RequestedIP returns the ip address that the client requested, either via the
+// requested ip address option or ciaddr.
+func (p *Packet) RequestedIP() net.IP {
+	if ip := p.optionIP(optRequestedIP); ip != nil {
+		return ip
+	}
+
+	if !p.CIAddr.Equal(net.IPv4zero) {
+		return p.CIAddr
+	}
+
+	return nil
+}
+
+// ServerID returns the value of the server identifier option
+func (p *Packet) ServerID() net.IP {
+	return p.optionIP(optServerID)
+}
+
+// HostName returns the value of the host name option
+func (p *Packet) HostName() string {
+	return string(bytes.TrimRight(p.Options[optHostName], "\x00"))
+}
+
+// Reply creates a new reply packet for the request of the given message type
+func (p *Packet) Reply(t MessageType) *Packet {
+	chaddr := make(net.HardwareAddr, len(p.CHAddr))
+	copy(chaddr, p.CHAddr)
+
+	return &Packet{
+		Op:     opReply,
+		HType:  p.HType,
+		HLen:   p.HLen,
+		XID:    p.XID,
+		Flags:  p.Flags,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: p.GIAddr,
+		CHAddr: chaddr,
+		Options: map[byte][]byte{
+			optMessageType: {byte(t)},
+		},
+	}
+}
@@ -0,0 +1,558 @@
+package dhcpserver
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"jrubin.io/blamedns/parser"
+	"jrubin.io/slog"
+	"jrubin.io/slog/handlers/text"
+)
+
+// HostAdder is notified of the hostname of each lease so that it may be
+// resolved by dns.
+type HostAdder interface {
+	AddLease(source, host string, ip net.IP, expires time.Time)
+}
+
+// A Reservation always assigns IP to the client with MAC.
+type Reservation struct {
+	MAC  net.HardwareAddr
+	IP   net.IP
+	Host string
+}
+
+// A Server defines parameters for running a dhcpv4 server.
+type Server struct {
+	Addr          string
+	BroadcastAddr string
+	ServerIP      net.IP
+	RangeStart    net.IP
+	RangeEnd      net.IP
+	Netmask       net.IPMask
+	Gateway       net.IP
+	DNS           []net.IP
+	Domain        string
+	LeaseTime     time.Duration
+	Reservations  []Reservation
+	LeaseFile     string
+	HostAdder     HostAdder
+	Logger        slog.Interface
+	mu            sync.Mutex
+	conn          net.PacketConn
+	leases        *leases
+	doneCh        chan struct{}
+}
+
+const (
+	name = "dhcpserver"
+
+	// LeaseSource is the source that leases are added to the HostAdder with
+	LeaseSource = name
+
+	DefaultAddr          = ":67"
+	DefaultBroadcastAddr = "255.255.255.255:68"
+	DefaultLeaseTime     = 24 * time.Hour
+
+	// offered addresses are held for a client for this long before they may
+	// be offered to another one
+	offerTimeout = 1 * time.Minute
+
+	clientPort = 68
+	serverPort = 67
+)
+
+var (
+	errNoServerIP = errors.New("dhcp server ip is required")
+	errNoRange    = errors.New("dhcp range start and end are required")
+)
+
+// ServerName returns the server name.
+func (s *Server) ServerName() string {
+	return name
+}
+
+// ServerAddr returns the address the server is listening on.
+func (s *Server) ServerAddr() string {
+	if s.conn != nil {
+		return s.conn.LocalAddr().String()
+	}
+	return s.Addr
+}
+
+// Init prepares the Server to Start. It loads any persisted leases and creates
+// the listener. If it does not return an error, then Start will not return one
+// either.
+func (s *Server) Init() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	if s.Logger == nil {
+		s.Logger = text.Logger(slog.InfoLevel)
+	}
+
+	if len(s.Addr) == 0 {
+		s.Addr = DefaultAddr
+	}
+
+	if len(s.BroadcastAddr) == 0 {
+		s.BroadcastAddr = DefaultBroadcastAddr
+	}
+
+	if s.LeaseTime == 0 {
+		s.LeaseTime = DefaultLeaseTime
+	}
+
+	if s.ServerIP = s.ServerIP.To4(); s.ServerIP == nil {
+		return errNoServerIP
+	}
+
+	s.RangeStart = s.RangeStart.To4()
+	s.RangeEnd = s.RangeEnd.To4()
+
+	if s.RangeStart == nil || s.RangeEnd == nil || bytes.Compare(s.RangeStart, s.RangeEnd) > 0 {
+		return errNoRange
+	}
+
+	if s.Netmask == nil {
+		s.Netmask = s.ServerIP.DefaultMask()
+	}
+
+	if len(s.DNS) == 0 {
+		s.DNS = []net.IP{s.ServerIP}
+	}
+
+	s.leases = newLeases(s.LeaseFile)
+	if err := s.leases.load(); err != nil {
+		return err
+	}
+
+	if s.HostAdder != nil {
+		now := time.Now()
+		for _, lease := range s.leases.data {
+			if !lease.Expired(now) && len(lease.Host) > 0 {
+				s.HostAdder.AddLease(LeaseSource, lease.Host, lease.IP, lease.Expires)
+			}
+		}
+	}
+
+	conn, err := listen(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+
+	return nil
+}
+
+// Start the server in a background goroutine. It only returns initialization
+// errors. It will not return an error if Init didn't.
+func (s *Server) Start() error {
+	if err := s.Init(); err != nil {
+		return err
+	}
+
+	s.Logger.WithFields(slog.Fields{
+		"server": s.ServerName(),
+		"addr":   s.ServerAddr(),
+	}).Info("starting")
+
+	s.doneCh = make(chan struct{})
+	go s.serve(s.conn, s.doneCh)
+
+	return nil
+}
+
+// Close shuts down the server.
+func (s *Server) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	s.Logger.WithFields(slog.Fields{
+		"server": s.ServerName(),
+		"addr":   s.ServerAddr(),
+	}).Info("stopping")
+
+	err := s.conn.Close()
+
+	if s.doneCh != nil {
+		<-s.doneCh
+		s.doneCh = nil
+	}
+
+	s.conn = nil
+
+	return err
+}
+
+func (s *Server) serve(conn net.PacketConn, doneCh chan<- struct{}) {
+	defer close(doneCh)
+
+	buf := make([]byte, 1500)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return
+		}
+
+		req, err := ParsePacket(buf[:n])
+		if err != nil {
+			s.Logger.WithError(err).WithField("addr", addr).Debug("invalid dhcp packet")
+			continue
+		}
+
+		if req.Op != opRequest || req.HType != htypeEthernet || len(req.CHAddr) != 6 {
+			continue
+		}
+
+		resp := s.Handle(req)
+		if resp == nil {
+			continue
+		}
+
+		dst, err := s.replyAddr(req, resp)
+		if err != nil {
+			s.Logger.WithError(err).Warn("error determining dhcp reply address")
+			continue
+		}
+
+		if _, err = conn.WriteTo(resp.Marshal(), dst); err != nil {
+			s.Logger.WithError(err).WithField("addr", dst).Warn("error writing dhcp reply")
+		}
+	}
+}
+
+// replyAddr determines where to send resp according to rfc 2131 section 4.1
+func (s *Server) replyAddr(req, resp *Packet) (net.Addr, error) {
+	if !req.GIAddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: req.GIAddr, Port: serverPort}, nil
+	}
+
+	if resp.MessageType() != Nak && !req.CIAddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: req.CIAddr, Port: clientPort}, nil
+	}
+
+	// the client doesn't have an address yet, and without being able to
+	// update the arp cache, broadcasting is the only way to reach it
+	return net.ResolveUDPAddr("udp4", s.BroadcastAddr)
+}
+
+// Handle processes a dhcp request and returns the reply to send to the client,
+// if any.
+func (s *Server) Handle(req *Packet) *Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := req.MessageType()
+
+	ctxLog := s.Logger.WithFields(slog.Fields{
+		"type": t.String(),
+		"mac":  req.CHAddr.String(),
+	})
+
+	var resp *Packet
+
+	switch t {
+	case Discover:
+		resp = s.discover(req)
+	case Request:
+		resp = s.request(req)
+	case Release:
+		s.release(req)
+	case Decline:
+		s.decline(req)
+	case Inform:
+		resp = s.inform(req)
+	default:
+		ctxLog.Debug("ignoring dhcp message")
+		return nil
+	}
+
+	if resp == nil {
+		ctxLog.Debug("dhcp request handled")
+		return nil
+	}
+
+	ctxLog.WithFields(slog.Fields{
+		"reply": resp.MessageType().String(),
+		"ip":    resp.YIAddr.String(),
+	}).Info("dhcp request handled")
+
+	return resp
+}
+
+func (s *Server) reservation(mac net.HardwareAddr) *Reservation {
+	for i, r := range s.Reservations {
+		if bytes.Equal(r.MAC, mac) {
+			return &s.Reservations[i]
+		}
+	}
+	return nil
+}
+
+func (s *Server) reservedFor(ip net.IP) net.HardwareAddr {
+	for _, r := range s.Reservations {
+		if r.IP.Equal(ip) {
+			return r.MAC
+		}
+	}
+	return nil
+}
+
+func (s *Server) inRange(ip net.IP) bool {
+	ip = ip.To4()
+	return ip != nil && bytes.Compare(ip, s.RangeStart) >= 0 && bytes.Compare(ip, s.RangeEnd) <= 0
+}
+
+// available returns whether ip may be assigned to the client with mac
+func (s *Server) available(ip net.IP, mac net.HardwareAddr, now time.Time) bool {
+	if !s.inRange(ip) || ip.Equal(s.ServerIP) || ip.Equal(s.Gateway) {
+		return false
+	}
+
+	if r := s.reservedFor(ip); r != nil && !bytes.Equal(r, mac) {
+		return false
+	}
+
+	lease := s.leases.byIP(ip)
+	return lease == nil || lease.MAC == mac.String() || lease.Expired(now)
+}
+
+func nextIP(ip net.IP) net.IP {
+	ret := make(net.IP, len(ip))
+	copy(ret, ip)
+
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i]++
+		if ret[i] != 0 {
+			break
+		}
+	}
+
+	return ret
+}
+
+// allocate determines the ip address that should be assigned to the client
+// with mac. Reservations take precedence, followed by the client's existing
+// lease, the address it requested and finally the first available address in
+// the range.
+func (s *Server) allocate(mac net.HardwareAddr, requested net.IP, now time.Time) net.IP {
+	if r := s.reservation(mac); r != nil {
+		return r.IP.To4()
+	}
+
+	if lease := s.leases.byMAC(mac); lease != nil && s.available(lease.IP, mac, now) {
+		return lease.IP
+	}
+
+	if requested != nil && s.available(requested, mac, now) {
+		return requested.To4()
+	}
+
+	for ip := s.RangeStart; bytes.Compare(ip, s.RangeEnd) <= 0; ip = nextIP(ip) {
+		if s.available(ip, mac, now) {
+			return ip
+		}
+
+		if ip.Equal(s.RangeEnd) {
+			// prevent wrapping around at 255.255.255.255
+			break
+		}
+	}
+
+	return nil
+}
+
+// hostName determines the fully qualified hostname for the client
+func (s *Server) hostName(req *Packet) string {
+	host := req.HostName()
+	if r := s.reservation(req.CHAddr); r != nil && len(r.Host) > 0 {
+		host = r.Host
+	}
+
+	return parser.LeaseHost(s.Logger, LeaseSource, 0, host, s.Domain)
+}
+
+func (s *Server) setOptions(resp *Packet, lease bool) {
+	resp.SetOptionIP(optServerID, s.ServerIP)
+	resp.SetOptionIP(optSubnetMask, net.IP(s.Netmask))
+	resp.SetOptionIP(optDNSServer, s.DNS...)
+
+	if s.Gateway != nil {
+		resp.SetOptionIP(optRouter, s.Gateway)
+	}
+
+	if len(s.Domain) > 0 {
+		resp.Options[optDomainName] = []byte(strings.Trim(s.Domain, "."))
+	}
+
+	if lease {
+		sec := uint32(s.LeaseTime / time.Second)
+		resp.SetOptionDuration(optLeaseTime, sec)
+		resp.SetOptionDuration(optRenewalTime, sec/2)
+		resp.SetOptionDuration(optRebindingTime, sec/8*7)
+	}
+}
+
+func (s *Server) save() {
+	if err := s.leases.save(); err != nil {
+		s.Logger.WithError(err).Error("error saving dhcp leases")
+	}
+}
+
+func (s *Server) discover(req *Packet) *Packet {
+	now := time.Now()
+
+	ip := s.allocate(req.CHAddr, req.RequestedIP(), now)
+	if ip == nil {
+		s.Logger.WithField("mac", req.CHAddr.String()).Warn("no dhcp addresses available")
+		return nil
+	}
+
+	// don't replace a bound lease with an offer
+	if lease := s.leases.byIP(ip); lease == nil || lease.MAC != req.CHAddr.String() || lease.Expired(now) {
+		s.leases.set(&Lease{
+			MAC:     req.CHAddr.String(),
+			IP:      ip,
+			Host:    s.hostName(req),
+			Expires: now.Add(offerTimeout),
+			Offered: true,
+		})
+	}
+
+	resp := req.Reply(Offer)
+	resp.YIAddr = ip
+	s.setOptions(resp, true)
+
+	return resp
+}
+
+func (s *Server) nak(req *Packet) *Packet {
+	resp := req.Reply(Nak)
+	resp.SetOptionIP(optServerID, s.ServerIP)
+	return resp
+}
+
+func (s *Server) request(req *Packet) *Packet {
+	now := time.Now()
+	mac := req.CHAddr.String()
+
+	if id := req.ServerID(); id != nil && !id.Equal(s.ServerIP) {
+		// the client accepted an offer from another server
+		if lease := s.leases.byMAC(req.CHAddr); lease != nil && lease.Offered {
+			s.leases.remove(lease)
+		}
+		return nil
+	}
+
+	ip := req.RequestedIP()
+	if ip == nil {
+		return s.nak(req)
+	}
+
+	if expected := s.allocate(req.CHAddr, ip, now); !ip.Equal(expected) {
+		return s.nak(req)
+	}
+
+	// the client may have moved to a different address (e.g. because a
+	// reservation was added)
+	if lease := s.leases.byMAC(req.CHAddr); lease != nil && !lease.IP.Equal(ip) {
+		s.leases.remove(lease)
+		s.addHost("", lease.IP, time.Time{})
+	}
+
+	lease := &Lease{
+		MAC:     mac,
+		IP:      ip.To4(),
+		Host:    s.hostName(req),
+		Expires: now.Add(s.LeaseTime),
+	}
+
+	s.leases.set(lease)
+	s.save()
+	s.addHost(lease.Host, lease.IP, lease.Expires)
+
+	resp := req.Reply(Ack)
+	resp.YIAddr = lease.IP
+	s.setOptions(resp, true)
+
+	return resp
+}
+
+func (s *Server) release(req *Packet) {
+	lease := s.leases.byIP(req.CIAddr)
+	if lease == nil || lease.MAC != req.CHAddr.String() {
+		return
+	}
+
+	s.leases.remove(lease)
+	s.save()
+	s.addHost("", lease.IP, time.Time{})
+}
+
+func (s *Server) decline(req *Packet) {
+	ip := req.RequestedIP()
+	if ip == nil {
+		return
+	}
+
+	lease := s.leases.byIP(ip)
+	if lease == nil || lease.MAC != req.CHAddr.String() {
+		return
+	}
+
+	s.Logger.WithFields(slog.Fields{
+		"mac": lease.MAC,
+		"ip":  lease.IP.String(),
+	}).Warn("dhcp client declined address, it is likely in use by another host")
+
+	// hold the address so that it isn't offered to anyone else for a while
+	s.leases.set(&Lease{
+		IP:      lease.IP,
+		Expires: time.Now().Add(s.LeaseTime),
+	})
+	s.save()
+	s.addHost("", lease.IP, time.Time{})
+}
+
+func (s *Server) inform(req *Packet) *Packet {
+	resp := req.Reply(Ack)
+	resp.CIAddr = req.CIAddr
+	s.setOptions(resp, false)
+	return resp
+}
+
+func (s *Server) addHost(host string, ip net.IP, expires time.Time) {
+	if s.HostAdder != nil {
+		s.HostAdder.AddLease(LeaseSource, host, ip, expires)
+	}
+}
+
+// Leases returns a copy of all current leases, including offers.
+func (s *Server) Leases() []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.leases == nil {
+		return nil
+	}
+
+	ret := make([]Lease, 0, len(s.leases.data))
+	for _, lease := range s.leases.data {
+		ret = append(ret, *lease)
+	}
+
+	return ret
+}
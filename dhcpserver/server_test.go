@@ -0,0 +1,272 @@
+package dhcpserver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"jrubin.io/slog"
+	"jrubin.io/slog/handlers/text"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testLease struct {
+	Host    string
+	Expires time.Time
+}
+
+// testHostAdder records the leases added by the server, which does so from
+// its own goroutine
+type testHostAdder struct {
+	mu     sync.Mutex
+	leases map[string]testLease
+}
+
+func (a *testHostAdder) AddLease(source, host string, ip net.IP, expires time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.leases == nil {
+		a.leases = map[string]testLease{}
+	}
+
+	if len(host) == 0 {
+		delete(a.leases, ip.String())
+		return
+	}
+	a.leases[ip.String()] = testLease{Host: host, Expires: expires}
+}
+
+// host returns the hostname leased ip
+func (a *testHostAdder) host(ip string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.leases[ip].Host
+}
+
+func (a *testHostAdder) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.leases)
+}
+
+type testClient struct {
+	conn   net.PacketConn
+	server net.Addr
+	mac    net.HardwareAddr
+}
+
+func (c *testClient) exchange(t MessageType, opts map[byte][]byte) *Packet {
+	req := &Packet{
+		Op:      opRequest,
+		HType:   htypeEthernet,
+		HLen:    6,
+		XID:     0x12345678,
+		Flags:   flagBroadcast,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  net.IPv4zero,
+		CHAddr:  c.mac,
+		Options: map[byte][]byte{optMessageType: {byte(t)}},
+	}
+
+	for code, v := range opts {
+		req.Options[code] = v
+	}
+
+	if _, err := c.conn.WriteTo(req.Marshal(), c.server); err != nil {
+		return nil
+	}
+
+	if t == Release || t == Decline {
+		return nil
+	}
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	buf := make([]byte, 1500)
+	n, _, err := c.conn.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+
+	resp, err := ParsePacket(buf[:n])
+	if err != nil {
+		return nil
+	}
+
+	return resp
+}
+
+func newTestServer(leaseFile string, hosts *testHostAdder, client net.PacketConn) *Server {
+	return &Server{
+		Addr:          "127.0.0.1:0",
+		BroadcastAddr: client.LocalAddr().String(),
+		ServerIP:      net.ParseIP("192.168.1.1"),
+		RangeStart:    net.ParseIP("192.168.1.100"),
+		RangeEnd:      net.ParseIP("192.168.1.101"),
+		Gateway:       net.ParseIP("192.168.1.1"),
+		Domain:        "lan",
+		LeaseTime:     time.Hour,
+		LeaseFile:     leaseFile,
+		HostAdder:     hosts,
+		Logger:        text.Logger(slog.ErrorLevel),
+		Reservations: []Reservation{{
+			MAC:  net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x99},
+			IP:   net.ParseIP("192.168.1.50"),
+			Host: "printer",
+		}},
+	}
+}
+
+func TestPacket(t *testing.T) {
+	Convey("packets should round trip", t, func() {
+		p := &Packet{
+			Op:     opReply,
+			HType:  htypeEthernet,
+			HLen:   6,
+			XID:    42,
+			CIAddr: net.IPv4zero,
+			YIAddr: net.ParseIP("192.168.1.100"),
+			SIAddr: net.IPv4zero,
+			GIAddr: net.IPv4zero,
+			CHAddr: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55},
+			Options: map[byte][]byte{
+				optMessageType: {byte(Offer)},
+				optHostName:    []byte("laptop"),
+			},
+		}
+
+		data := p.Marshal()
+		So(len(data), ShouldBeGreaterThanOrEqualTo, minPacketLen)
+
+		q, err := ParsePacket(data)
+		So(err, ShouldBeNil)
+		So(q.MessageType(), ShouldEqual, Offer)
+		So(q.XID, ShouldEqual, 42)
+		So(q.YIAddr.Equal(p.YIAddr), ShouldBeTrue)
+		So(q.CHAddr, ShouldResemble, p.CHAddr)
+		So(q.HostName(), ShouldEqual, "laptop")
+
+		_, err = ParsePacket(data[:100])
+		So(err, ShouldEqual, errShortPacket)
+	})
+}
+
+func TestServer(t *testing.T) {
+	Convey("dhcp server should work", t, func() {
+		dir, err := ioutil.TempDir("", "dhcpserver")
+		So(err, ShouldBeNil)
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		leaseFile := path.Join(dir, "leases.json")
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer func() { _ = conn.Close() }()
+
+		hosts := &testHostAdder{}
+		s := newTestServer(leaseFile, hosts, conn)
+		So(s.Start(), ShouldBeNil)
+
+		addr, err := net.ResolveUDPAddr("udp4", s.ServerAddr())
+		So(err, ShouldBeNil)
+
+		client := &testClient{
+			conn:   conn,
+			server: addr,
+			mac:    net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55},
+		}
+
+		offer := client.exchange(Discover, map[byte][]byte{
+			optHostName: []byte("Laptop"),
+		})
+		So(offer, ShouldNotBeNil)
+		So(offer.MessageType(), ShouldEqual, Offer)
+		So(offer.YIAddr.Equal(net.ParseIP("192.168.1.100")), ShouldBeTrue)
+		So(offer.ServerID().Equal(s.ServerIP), ShouldBeTrue)
+		So(offer.optionIP(optDNSServer).Equal(s.ServerIP), ShouldBeTrue)
+		So(offer.optionIP(optSubnetMask).Equal(net.ParseIP("255.255.255.0")), ShouldBeTrue)
+		So(hosts.len(), ShouldEqual, 0)
+
+		ack := client.exchange(Request, map[byte][]byte{
+			optHostName:    []byte("Laptop"),
+			optRequestedIP: offer.YIAddr,
+			optServerID:    offer.ServerID(),
+		})
+		So(ack, ShouldNotBeNil)
+		So(ack.MessageType(), ShouldEqual, Ack)
+		So(ack.YIAddr.Equal(offer.YIAddr), ShouldBeTrue)
+		So(hosts.host("192.168.1.100"), ShouldEqual, "laptop.lan")
+
+		// requesting an address that belongs to another client is refused
+		other := &testClient{
+			conn:   conn,
+			server: addr,
+			mac:    net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66},
+		}
+
+		nak := other.exchange(Request, map[byte][]byte{
+			optRequestedIP: offer.YIAddr,
+		})
+		So(nak, ShouldNotBeNil)
+		So(nak.MessageType(), ShouldEqual, Nak)
+
+		offer = other.exchange(Discover, nil)
+		So(offer, ShouldNotBeNil)
+		So(offer.YIAddr.Equal(net.ParseIP("192.168.1.101")), ShouldBeTrue)
+
+		// hostnames already in the domain aren't qualified again
+		ack = other.exchange(Request, map[byte][]byte{
+			optHostName:    []byte("Büro.LAN"),
+			optRequestedIP: offer.YIAddr,
+			optServerID:    offer.ServerID(),
+		})
+		So(ack, ShouldNotBeNil)
+		So(ack.MessageType(), ShouldEqual, Ack)
+		So(hosts.host("192.168.1.101"), ShouldEqual, "xn--bro-hoa.lan")
+
+		// the range is exhausted
+		third := &testClient{
+			conn:   conn,
+			server: addr,
+			mac:    net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x77},
+		}
+
+		So(third.exchange(Discover, nil), ShouldBeNil)
+
+		// reservations are always honored
+		printer := &testClient{
+			conn:   conn,
+			server: addr,
+			mac:    net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x99},
+		}
+
+		ack = printer.exchange(Request, map[byte][]byte{
+			optRequestedIP: net.ParseIP("192.168.1.50").To4(),
+		})
+		So(ack, ShouldNotBeNil)
+		So(ack.MessageType(), ShouldEqual, Ack)
+		So(hosts.host("192.168.1.50"), ShouldEqual, "printer.lan")
+
+		So(s.Close(), ShouldBeNil)
+
+		Convey("leases should be persisted", func() {
+			hosts := &testHostAdder{}
+			s := newTestServer(leaseFile, hosts, conn)
+			So(s.Init(), ShouldBeNil)
+			defer func() { _ = s.Close() }()
+
+			So(len(s.Leases()), ShouldEqual, 3)
+			So(hosts.host("192.168.1.100"), ShouldEqual, "laptop.lan")
+			So(hosts.host("192.168.1.101"), ShouldEqual, "xn--bro-hoa.lan")
+			So(hosts.host("192.168.1.50"), ShouldEqual, "printer.lan")
+		})
+	})
+}
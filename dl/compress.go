@@ -0,0 +1,209 @@
+package dl
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+type compression int
+
+const (
+	uncompressed compression = iota
+	compressedGzip
+	compressedBzip2
+	compressedXz
+	compressedZip
+)
+
+var compressionNames = map[compression]string{
+	uncompressed:    "uncompressed",
+	compressedGzip:  "gzip",
+	compressedBzip2: "bzip2",
+	compressedXz:    "xz",
+	compressedZip:   "zip",
+}
+
+func (c compression) String() string {
+	return compressionNames[c]
+}
+
+var compressionMagic = []struct {
+	magic       []byte
+	compression compression
+}{
+	{[]byte{0x1f, 0x8b}, compressedGzip},
+	{[]byte("BZh"), compressedBzip2},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, compressedXz},
+	{[]byte("PK\x03\x04"), compressedZip},
+}
+
+var compressionExts = map[string]compression{
+	".gz":  compressedGzip,
+	".tgz": compressedGzip,
+	".bz2": compressedBzip2,
+	".xz":  compressedXz,
+	".zip": compressedZip,
+}
+
+var compressionTypes = map[string]compression{
+	"application/gzip":             compressedGzip,
+	"application/x-gzip":           compressedGzip,
+	"application/x-bzip2":          compressedBzip2,
+	"application/x-xz":             compressedXz,
+	"application/zip":              compressedZip,
+	"application/x-zip-compressed": compressedZip,
+}
+
+// detectCompression returns the compression of file by its magic bytes. The
+// content type and extension of the url it was downloaded from are only hints;
+// if either says the file is compressed but it isn't, an error is returned,
+// since that usually means an error page was served instead.
+func detectCompression(file, urlPath, contentType string) (compression, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return uncompressed, err
+	}
+	defer func() { _ = f.Close() }()
+
+	head := make([]byte, 6)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return uncompressed, err
+	}
+	head = head[:n]
+
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression, nil
+		}
+	}
+
+	hint, ok := compressionExts[strings.ToLower(path.Ext(urlPath))]
+	if !ok {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		hint, ok = compressionTypes[mediaType]
+	}
+
+	if ok {
+		return uncompressed, errors.Errorf("expected %s compressed file", hint)
+	}
+
+	return uncompressed, nil
+}
+
+// decompress returns the name of a temporary file with the decompressed
+// contents of file, or file itself if it isn't compressed. Every file in zip
+// archives is concatenated.
+func (d *DL) decompress(file, urlPath, contentType string) (string, error) {
+	c, err := detectCompression(file, urlPath, contentType)
+	if err != nil || c == uncompressed {
+		return file, err
+	}
+
+	out, err := d.tempFile()
+	if err != nil {
+		return "", err
+	}
+
+	if c == compressedZip {
+		err = d.unzip(out, file)
+	} else {
+		err = d.uncompress(out, file, c)
+	}
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return "", errors.Wrapf(err, "error decompressing %s file", c)
+	}
+
+	return out.Name(), nil
+}
+
+func (d *DL) uncompress(w io.Writer, file string, c compression) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	var r io.Reader
+
+	switch c {
+	case compressedGzip:
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(f); err != nil {
+			return err
+		}
+		r = gz
+	case compressedBzip2:
+		r = bzip2.NewReader(bufio.NewReader(f))
+	case compressedXz:
+		if r, err = xz.NewReader(bufio.NewReader(f)); err != nil {
+			return err
+		}
+	}
+
+	_, err = copyMax(w, r, d.maxSize())
+	return err
+}
+
+func (d *DL) unzip(w io.Writer, file string) error {
+	z, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = z.Close() }()
+
+	max := d.maxSize()
+
+	var total int64
+	for _, zf := range z.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+
+		var limit int64
+		if max > 0 {
+			if limit = max - total; limit <= 0 {
+				_ = r.Close()
+				return errors.Errorf("file is larger than %d bytes", max)
+			}
+		}
+
+		n, err := copyMax(w, r, limit)
+		_ = r.Close()
+		total += n
+
+		if err != nil {
+			return err
+		}
+
+		// files may not end with a newline, which would join their last
+		// and first lines
+		if _, err = w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
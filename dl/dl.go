@@ -2,7 +2,6 @@ package dl
 
 import (
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"os"
@@ -11,6 +10,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"jrubin.io/slog"
 	"jrubin.io/slog/handlers/text"
 )
@@ -31,12 +32,28 @@ type DL struct {
 	AppName        string
 	AppVersion     string
 	DebugHTTP      bool
+	Validation     *Validation
+
+	// Mirrors are tried in order when the file can't be downloaded from URL.
+	// The file is named after URL regardless of where it was downloaded
+	// from.
+	Mirrors []*url.URL
+
+	// RetryMin and RetryMax bound the jittered exponential backoff between
+	// attempts to update the file after failures
+	RetryMin time.Duration
+	RetryMax time.Duration
+
+	statusMu sync.Mutex
+	status   Status
 }
 
 const (
 	DefaultUpdateInterval = 24 * time.Hour
 	DefaultAppName        = "DL"
 	DefaultAppVersion     = "1.0"
+	DefaultRetryMin       = time.Minute
+	DefaultRetryMax       = time.Hour
 )
 
 func New(u *url.URL, baseDir string) *DL {
@@ -46,13 +63,9 @@ func New(u *url.URL, baseDir string) *DL {
 	}
 }
 
-func (d *DL) Init() error {
-	err := os.MkdirAll(d.BaseDir, 0700)
-	if err != nil {
-		return err
-	}
-
-	file := d.URL.Path
+// FileName returns the name of the file in baseDir that u is downloaded to
+func FileName(u *url.URL, baseDir string) string {
+	file := u.Path
 
 	// strip leading '/'
 	if len(file) > 0 && file[0] == '/' {
@@ -60,11 +73,24 @@ func (d *DL) Init() error {
 	}
 
 	// join host and path
-	file = strings.Join([]string{d.URL.Host, file}, "__")
+	file = strings.Join([]string{u.Host, file}, "__")
 
 	// replace '/' with '__'
 	file = strings.Replace(file, "/", "__", -1)
 
+	return path.Join(baseDir, file)
+}
+
+func (d *DL) base() string {
+	return path.Base(d.fileName)
+}
+
+func (d *DL) Init() error {
+	err := os.MkdirAll(d.BaseDir, 0700)
+	if err != nil {
+		return err
+	}
+
 	if d.UpdateInterval == 0 {
 		d.UpdateInterval = DefaultUpdateInterval
 	}
@@ -85,7 +111,24 @@ func (d *DL) Init() error {
 		d.AppVersion = DefaultAppVersion
 	}
 
-	d.fileName = path.Join(d.BaseDir, file)
+	if d.RetryMin == 0 {
+		d.RetryMin = DefaultRetryMin
+	}
+
+	if d.RetryMax == 0 {
+		d.RetryMax = DefaultRetryMax
+	}
+
+	d.fileName = FileName(d.URL, d.BaseDir)
+
+	d.status = Status{
+		URL:  d.URL.String(),
+		File: d.fileName,
+	}
+
+	if info, err := os.Stat(d.fileName); err == nil {
+		d.status.LastSuccess = info.ModTime()
+	}
 
 	return nil
 }
@@ -100,27 +143,85 @@ func (d *DL) Start() {
 
 	d.stopCh = make(chan struct{})
 
-	go func() { _, _ = d.Update() }()
-
-	ticker := time.NewTicker(d.UpdateInterval)
-	defer ticker.Stop()
+	go d.run(d.stopCh)
+}
 
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				go func() { _, _ = d.Update() }()
-			case <-d.stopCh:
-				close(d.stopCh)
-				return
+// run updates the file immediately and then every UpdateInterval, retrying
+// failed updates with backoff
+func (d *DL) run(stopCh chan struct{}) {
+	done := make(chan error, 1)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			go func() {
+				_, err := d.Update()
+				done <- err
+			}()
+		case err := <-done:
+			next := d.nextAttempt(err)
+			timer.Reset(next)
+
+			if err != nil {
+				d.Logger.WithError(err).WithFields(slog.Fields{
+					"fileName": d.fileName,
+					"URL":      d.URL,
+					"retryIn":  next,
+				}).Warn("error updating file, will retry")
 			}
+		case <-stopCh:
+			close(stopCh)
+			return
 		}
-	}()
+	}
+}
+
+// urls returns the url of the file followed by its mirrors, in the order they
+// are tried
+func (d *DL) urls() []*url.URL {
+	return append([]*url.URL{d.URL}, d.Mirrors...)
+}
+
+// Update downloads the file if it doesn't exist or is older than
+// UpdateInterval
+func (d *DL) Update() (bool, error) {
+	return d.update(false)
+}
+
+// Refresh downloads the file, if it has changed, regardless of its age
+func (d *DL) Refresh() (bool, error) {
+	return d.update(true)
+}
+
+// Files returns the names of the downloaded file and of the file that its
+// metadata is kept in
+func (d *DL) Files() []string {
+	return []string{d.fileName, metaFileName(d.fileName)}
+}
+
+// Remove deletes the downloaded file and what is known about it
+func (d *DL) Remove() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := os.Remove(metaFileName(d.fileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(d.fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
 }
 
-func (d *DL) Update() (updated bool, err error) {
+func (d *DL) update(force bool) (updated bool, err error) {
 	info, err := os.Stat(d.fileName)
 	if err != nil && !os.IsNotExist(err) {
+		d.failed(err)
 		return false, err
 	}
 
@@ -130,12 +231,29 @@ func (d *DL) Update() (updated bool, err error) {
 		"interval": d.UpdateInterval,
 	})
 
+	m := &meta{}
+	now := time.Now()
+
 	if !os.IsNotExist(err) {
 		if info.IsDir() {
-			return false, fmt.Errorf("%s is a directory", d.fileName)
+			err = fmt.Errorf("%s is a directory", d.fileName)
+			d.failed(err)
+			return false, err
+		}
+
+		if m, err = readMeta(d.fileName); err != nil {
+			d.failed(err)
+			return false, err
 		}
 
-		if info.ModTime().After(time.Now().Add(-d.UpdateInterval)) {
+		// metadata written before the interval was shortened may expire
+		// later than update allows
+		expires := m.Expires
+		if max := info.ModTime().Add(maxAgeIntervals * d.UpdateInterval); expires.After(max) {
+			expires = max
+		}
+
+		if !force && (info.ModTime().After(now.Add(-d.UpdateInterval)) || now.Before(expires)) {
 			// file exists and does not need to be updated
 			ctxLog.Debug("file does not need to be updated yet")
 			return false, nil
@@ -144,10 +262,33 @@ func (d *DL) Update() (updated bool, err error) {
 
 	// file doesn't exist or needs to be updated
 
+	for _, u := range d.urls() {
+		if updated, err = d.get(u, m, now); err == nil {
+			d.succeeded(u, now)
+			return updated, nil
+		}
+
+		ctxLog.WithError(err).WithField("source", u).Warn("error updating file")
+	}
+
+	d.failed(err)
+	return false, err
+}
+
+// get conditionally downloads the file from u, replacing the existing file if
+// it has changed
+func (d *DL) get(u *url.URL, m *meta, now time.Time) (updated bool, err error) {
+	ctxLog := d.Logger.WithFields(slog.Fields{
+		"fileName": d.fileName,
+		"URL":      u,
+	})
+
 	ctxLog.Debug("downloading file")
 
-	req, _ := http.NewRequest("GET", d.URL.String(), nil)
+	req, _ := http.NewRequest("GET", u.String(), nil)
 	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", d.AppName, d.AppVersion))
+	req.Header.Set("Accept-Encoding", "gzip")
+	m.setRequest(req)
 	d.debugRequestOut(req, false)
 
 	res, err := d.Client.Do(req)
@@ -159,27 +300,61 @@ func (d *DL) Update() (updated bool, err error) {
 
 	d.debugResponse(res, false)
 
-	if res.StatusCode != http.StatusOK {
-		err = NewErrStatusCode(res.StatusCode)
-		ctxLog.WithError(err).Warn("error updating file")
-		return false, err
-	}
-
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	// open the file and truncate it if it already exists
-	f, err := os.Create(d.fileName)
-	if err != nil {
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		// the file is still current, make sure it isn't downloaded again
+		// until the next interval
+		m.update(res, now, d.UpdateInterval)
+		if err = os.Chtimes(d.fileName, now, now); err != nil {
+			return false, err
+		}
+
+		if err = m.write(d.fileName); err != nil {
+			ctxLog.WithError(err).Warn("error writing file metadata")
+		}
+
+		ctxLog.Debug("file not modified")
 		return false, nil
+	default:
+		return false, NewErrStatusCode(res.StatusCode)
 	}
-	defer func() { _ = f.Close() }()
 
-	_, err = io.Copy(f, res.Body)
+	// download to a temporary file that only replaces the existing one once
+	// it is complete and valid, so that the watcher never parses a partial
+	// file and a bad download doesn't replace a good one
+	raw, err := d.download(res)
 	if err != nil {
-		ctxLog.WithError(err).Warn("error updating file")
 		return false, err
 	}
+	defer func() { _ = os.Remove(raw) }()
+
+	if err = d.verify(u, raw); err != nil {
+		return false, errors.Wrap(err, "invalid download, keeping the existing file")
+	}
+
+	// compressed files are stored decompressed so that they can be parsed
+	tmp, err := d.decompress(raw, u.Path, res.Header.Get("Content-Type"))
+	if err != nil {
+		return false, errors.Wrap(err, "invalid download, keeping the existing file")
+	}
+	defer func() { _ = os.Remove(tmp) }()
+
+	if err = d.validate(tmp); err != nil {
+		return false, errors.Wrap(err, "invalid download, keeping the existing file")
+	}
+
+	if err = os.Rename(tmp, d.fileName); err != nil {
+		return false, err
+	}
+
+	m.update(res, now, d.UpdateInterval)
+	if err = m.write(d.fileName); err != nil {
+		ctxLog.WithError(err).Warn("error writing file metadata")
+	}
 
 	ctxLog.Debug("successfully updated file")
 	return true, nil
@@ -1,12 +1,396 @@
 package dl
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/blake2b"
+
+	"jrubin.io/blamedns/parser"
+	"jrubin.io/slog"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// minisign returns the public key and signature of data in the formats of
+// minisign.pub and .minisig files
+func minisign(data []byte) (string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	id := []byte("keyid123")
+	key := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id...), pub...))
+
+	hash := blake2b.Sum512(data)
+	sig := ed25519.Sign(priv, hash[:])
+	trusted := "timestamp:0"
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), trusted...))
+
+	return key, "untrusted comment: test\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("ED"), id...), sig...)) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+}
+
 func TestDL(t *testing.T) {
 	Convey("dl should work", t, func() {
 	})
+
+	Convey("downloads should be conditional", t, func() {
+		var requests, downloads int
+		maxAge := "0"
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("Cache-Control", "public, max-age="+maxAge)
+
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			downloads++
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			_, _ = w.Write([]byte("0.0.0.0 example.com\n"))
+		}))
+		defer ts.Close()
+
+		dir, err := ioutil.TempDir("", "dl")
+		So(err, ShouldBeNil)
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		u, err := url.Parse(ts.URL + "/hosts")
+		So(err, ShouldBeNil)
+
+		d := New(u, dir)
+		d.UpdateInterval = 30 * time.Minute
+		So(d.Init(), ShouldBeNil)
+
+		updated, err := d.Update()
+		So(err, ShouldBeNil)
+		So(updated, ShouldBeTrue)
+		So(downloads, ShouldEqual, 1)
+
+		m, err := readMeta(d.fileName)
+		So(err, ShouldBeNil)
+		So(m.ETag, ShouldEqual, `"v1"`)
+		So(m.LastModified, ShouldEqual, "Mon, 02 Jan 2006 15:04:05 GMT")
+		So(m.Expires.IsZero(), ShouldBeTrue)
+
+		old := time.Now().Add(-time.Hour)
+		So(os.Chtimes(d.fileName, old, old), ShouldBeNil)
+
+		// not modified responses count as a refresh
+		maxAge = "3600"
+		updated, err = d.Update()
+		So(err, ShouldBeNil)
+		So(updated, ShouldBeFalse)
+		So(requests, ShouldEqual, 2)
+		So(downloads, ShouldEqual, 1)
+
+		info, err := os.Stat(d.fileName)
+		So(err, ShouldBeNil)
+		So(info.ModTime().After(old), ShouldBeTrue)
+
+		m, err = readMeta(d.fileName)
+		So(err, ShouldBeNil)
+		So(m.ETag, ShouldEqual, `"v1"`)
+		So(m.Expires.After(time.Now().Add(59*time.Minute)), ShouldBeTrue)
+
+		// max-age holds off updates
+		So(os.Chtimes(d.fileName, old, old), ShouldBeNil)
+		updated, err = d.Update()
+		So(err, ShouldBeNil)
+		So(updated, ShouldBeFalse)
+		So(requests, ShouldEqual, 2)
+
+		// but only for a few update intervals
+		maxAge = "31536000"
+		_, err = d.Refresh()
+		So(err, ShouldBeNil)
+		So(requests, ShouldEqual, 3)
+
+		m, err = readMeta(d.fileName)
+		So(err, ShouldBeNil)
+		So(m.Expires.After(time.Now().Add(maxAgeIntervals*d.UpdateInterval)), ShouldBeFalse)
+
+		old = time.Now().Add(-maxAgeIntervals * d.UpdateInterval)
+		So(os.Chtimes(d.fileName, old, old), ShouldBeNil)
+		_, err = d.Update()
+		So(err, ShouldBeNil)
+		So(requests, ShouldEqual, 4)
+
+		// including when the metadata is from a longer interval
+		m.Expires = time.Now().Add(24 * time.Hour)
+		So(m.write(d.fileName), ShouldBeNil)
+		So(os.Chtimes(d.fileName, old, old), ShouldBeNil)
+		_, err = d.Update()
+		So(err, ShouldBeNil)
+		So(requests, ShouldEqual, 5)
+	})
+
+	Convey("max-age should be parsed from cache-control", t, func() {
+		So(maxAge("max-age=60"), ShouldEqual, time.Minute)
+		So(maxAge(`no-transform, MAX-AGE="120"`), ShouldEqual, 2*time.Minute)
+		So(maxAge("no-cache"), ShouldEqual, 0)
+		So(maxAge("max-age=bogus"), ShouldEqual, 0)
+	})
+	Convey("invalid downloads should not replace the existing file", t, func() {
+		good := "0.0.0.0 a.example.com\n0.0.0.0 b.example.com\n"
+		files := map[string]string{"/hosts": good}
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, ok := files[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write([]byte(body))
+		}))
+		defer ts.Close()
+
+		dir, err := ioutil.TempDir("", "dl")
+		So(err, ShouldBeNil)
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		u, err := url.Parse(ts.URL + "/hosts")
+		So(err, ShouldBeNil)
+
+		d := New(u, dir)
+		d.UpdateInterval = time.Nanosecond
+		d.Validation = &Validation{
+			MinLines:      2,
+			MaxSize:       1024,
+			MinValidRatio: 0.5,
+			Parser:        parser.HostsFileParser{HostAdder: parser.Discard, Logger: slog.New()},
+		}
+		So(d.Init(), ShouldBeNil)
+
+		update := func() error {
+			old := time.Now().Add(-time.Hour)
+			_ = os.Chtimes(d.fileName, old, old)
+			_, err := d.Update()
+			return err
+		}
+
+		So(update(), ShouldBeNil)
+
+		for _, bad := range []string{
+			"0.0.0.0 a.example.com\n",
+			"<html>\n<body>\n<h1>Not Found</h1>\n</body>\n</html>\n",
+			strings.Repeat("0.0.0.0 a.example.com\n", 100),
+		} {
+			files["/hosts"] = bad
+			So(update(), ShouldNotBeNil)
+
+			b, err := ioutil.ReadFile(d.fileName)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, good)
+		}
+
+		// only the file and its metadata are left behind
+		fi, err := ioutil.ReadDir(dir)
+		So(err, ShouldBeNil)
+		So(len(fi), ShouldEqual, 2)
+
+		// checksums
+		d.Validation.Checksum = true
+		files["/hosts"] = "0.0.0.0 c.example.com\n0.0.0.0 d.example.com\n"
+		So(update(), ShouldNotBeNil)
+
+		sum := sha256.Sum256([]byte(files["/hosts"]))
+		files["/hosts.sha256"] = hex.EncodeToString(sum[:]) + "  hosts\n"
+		So(update(), ShouldBeNil)
+
+		// mirrors can't vouch for their own files
+		mirror, err := url.Parse(ts.URL + "/mirror/hosts")
+		So(err, ShouldBeNil)
+		d.Mirrors = []*url.URL{mirror}
+
+		mirrored := files["/hosts"]
+		delete(files, "/hosts")
+		files["/mirror/hosts"] = "0.0.0.0 e.example.com\n0.0.0.0 f.example.com\n"
+		msum := sha256.Sum256([]byte(files["/mirror/hosts"]))
+		files["/mirror/hosts.sha256"] = hex.EncodeToString(msum[:]) + "  hosts\n"
+		So(update(), ShouldNotBeNil)
+
+		files["/mirror/hosts"] = mirrored
+		So(update(), ShouldBeNil)
+		So(d.Status().LastSource, ShouldEqual, mirror.String())
+
+		d.Mirrors = nil
+
+		files["/hosts"] = good
+		So(update(), ShouldNotBeNil)
+
+		// signatures
+		d.Validation.Checksum = false
+		key, sig := minisign([]byte(good))
+		d.Validation.MinisignKey, err = ParseMinisignKey(key)
+		So(err, ShouldBeNil)
+
+		files["/hosts.minisig"] = sig
+		So(update(), ShouldBeNil)
+
+		files["/hosts"] = good + "0.0.0.0 e.example.com\n"
+		So(update(), ShouldNotBeNil)
+
+		b, err := ioutil.ReadFile(d.fileName)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, good)
+	})
+	Convey("mirrors should be tried in order and failures retried with backoff", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/mirror/hosts" {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte("0.0.0.0 a.example.com\n"))
+		}))
+		defer ts.Close()
+
+		dir, err := ioutil.TempDir("", "dl")
+		So(err, ShouldBeNil)
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		u, err := url.Parse(ts.URL + "/hosts")
+		So(err, ShouldBeNil)
+
+		down, err := url.Parse(ts.URL + "/down/hosts")
+		So(err, ShouldBeNil)
+
+		d := New(u, dir)
+		d.RetryMin = time.Minute
+		d.RetryMax = 4 * time.Minute
+		So(d.Init(), ShouldBeNil)
+
+		_, err = d.Update()
+		So(err, ShouldNotBeNil)
+
+		s := d.Status()
+		So(s.Failures, ShouldEqual, 1)
+		So(s.LastError, ShouldContainSubstring, "503")
+		So(s.LastSuccess.IsZero(), ShouldBeTrue)
+
+		next := d.nextAttempt(err)
+		So(next, ShouldBeBetweenOrEqual, 30*time.Second, time.Minute)
+		So(d.Status().NextAttempt.IsZero(), ShouldBeFalse)
+
+		d.status.Failures = 3
+		So(d.nextAttempt(err), ShouldBeBetweenOrEqual, 2*time.Minute, 4*time.Minute)
+
+		d.status.Failures = 10
+		So(d.nextAttempt(err), ShouldBeBetweenOrEqual, 2*time.Minute, 4*time.Minute)
+
+		mirror, err := url.Parse(ts.URL + "/mirror/hosts")
+		So(err, ShouldBeNil)
+		d.Mirrors = []*url.URL{down, mirror}
+
+		updated, err := d.Update()
+		So(err, ShouldBeNil)
+		So(updated, ShouldBeTrue)
+
+		s = d.Status()
+		So(s.Failures, ShouldEqual, 0)
+		So(s.LastSource, ShouldEqual, mirror.String())
+		So(s.LastSuccess.IsZero(), ShouldBeFalse)
+		So(d.nextAttempt(nil), ShouldEqual, DefaultUpdateInterval)
+
+		// the file is named after the url, not the mirror
+		_, err = os.Stat(FileName(u, dir))
+		So(err, ShouldBeNil)
+	})
+	Convey("compressed files should be stored decompressed", t, func() {
+		const hosts = "0.0.0.0 a.example.com\n0.0.0.0 b.example.com\n"
+
+		var gz, xzb, zipb bytes.Buffer
+
+		gw := gzip.NewWriter(&gz)
+		_, _ = gw.Write([]byte(hosts))
+		So(gw.Close(), ShouldBeNil)
+
+		xw, err := xz.NewWriter(&xzb)
+		So(err, ShouldBeNil)
+		_, _ = xw.Write([]byte(hosts))
+		So(xw.Close(), ShouldBeNil)
+
+		zw := zip.NewWriter(&zipb)
+		for _, line := range strings.SplitAfter(hosts, "\n")[:2] {
+			w, err := zw.Create(strings.Fields(line)[1])
+			So(err, ShouldBeNil)
+			_, _ = w.Write([]byte(strings.TrimSpace(line)))
+		}
+		So(zw.Close(), ShouldBeNil)
+
+		bz2, err := base64.StdEncoding.DecodeString("QlpoOTFBWSZTWX2HFwYAAApZgAAQQAFAADoGwEAgADEA0ABVU0NP1TTeqadj1JHHiVjp8wqoqtvxdyRThQkH2HFwYA==")
+		So(err, ShouldBeNil)
+
+		files := map[string][]byte{
+			"/hosts.gz":  gz.Bytes(),
+			"/hosts.bz2": bz2,
+			"/hosts.xz":  xzb.Bytes(),
+			"/hosts.zip": zipb.Bytes(),
+			"/hosts":     []byte(hosts),
+			"/bad.gz":    []byte("<html>not found</html>\n"),
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := files[r.URL.Path]
+
+			if r.URL.Path == "/hosts" && r.Header.Get("Accept-Encoding") == "gzip" {
+				w.Header().Set("Content-Encoding", "gzip")
+				body = gz.Bytes()
+			}
+
+			_, _ = w.Write(body)
+		}))
+		defer ts.Close()
+
+		dir, err := ioutil.TempDir("", "dl")
+		So(err, ShouldBeNil)
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		for _, p := range []string{"/hosts.gz", "/hosts.bz2", "/hosts.xz", "/hosts.zip", "/hosts"} {
+			u, err := url.Parse(ts.URL + p)
+			So(err, ShouldBeNil)
+
+			d := New(u, dir)
+			So(d.Init(), ShouldBeNil)
+
+			updated, err := d.Update()
+			So(err, ShouldBeNil)
+			So(updated, ShouldBeTrue)
+
+			b, err := ioutil.ReadFile(d.fileName)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, hosts)
+		}
+
+		u, err := url.Parse(ts.URL + "/bad.gz")
+		So(err, ShouldBeNil)
+
+		d := New(u, dir)
+		So(d.Init(), ShouldBeNil)
+
+		_, err = d.Update()
+		So(err, ShouldNotBeNil)
+	})
 }
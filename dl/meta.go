@@ -0,0 +1,116 @@
+package dl
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// meta is what is known about the last download of a file, so that the next
+// one can be made conditional
+type meta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Expires      time.Time `json:"expires,omitempty"`
+}
+
+// metaFileName returns the name of the hidden file, next to fileName, that its
+// metadata is kept in
+func metaFileName(fileName string) string {
+	dir, file := path.Split(fileName)
+	return path.Join(dir, "."+file+".meta")
+}
+
+func readMeta(fileName string) (*meta, error) {
+	f, err := os.Open(metaFileName(fileName))
+	if os.IsNotExist(err) {
+		return &meta{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var ret meta
+	if err = json.NewDecoder(f).Decode(&ret); err != nil {
+		// start over rather than never downloading the file again
+		return &meta{}, nil
+	}
+
+	return &ret, nil
+}
+
+func (m *meta) write(fileName string) error {
+	f, err := os.Create(metaFileName(fileName))
+	if err != nil {
+		return err
+	}
+
+	if err = json.NewEncoder(f).Encode(m); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// setRequest makes req conditional on the file having changed
+func (m *meta) setRequest(req *http.Request) {
+	if len(m.ETag) > 0 {
+		req.Header.Set("If-None-Match", m.ETag)
+	}
+
+	if len(m.LastModified) > 0 {
+		req.Header.Set("If-Modified-Since", m.LastModified)
+	}
+}
+
+// maxAgeIntervals is how many update intervals a max-age can hold off updates
+// for, so that a misconfigured or hostile server can't stop them for good
+const maxAgeIntervals = 4
+
+// update records the validators and freshness lifetime of res, which is at most
+// maxAgeIntervals times interval. Validators are kept from earlier responses
+// that 304 responses omit.
+func (m *meta) update(res *http.Response, now time.Time, interval time.Duration) {
+	if v := res.Header.Get("ETag"); len(v) > 0 || res.StatusCode == http.StatusOK {
+		m.ETag = v
+	}
+
+	if v := res.Header.Get("Last-Modified"); len(v) > 0 || res.StatusCode == http.StatusOK {
+		m.LastModified = v
+	}
+
+	m.Expires = time.Time{}
+	if maxAge := maxAge(res.Header.Get("Cache-Control")); maxAge > 0 {
+		if max := maxAgeIntervals * interval; maxAge > max {
+			maxAge = max
+		}
+		m.Expires = now.Add(maxAge)
+	}
+}
+
+// maxAge returns the max-age directive of a Cache-Control header
+func maxAge(cc string) time.Duration {
+	for _, directive := range strings.Split(cc, ",") {
+		directive = strings.TrimSpace(directive)
+
+		i := strings.IndexByte(directive, '=')
+		if i < 0 || !strings.EqualFold(directive[:i], "max-age") {
+			continue
+		}
+
+		secs, err := strconv.ParseInt(strings.Trim(directive[i+1:], `"`), 10, 64)
+		if err != nil || secs <= 0 {
+			return 0
+		}
+
+		return time.Duration(secs) * time.Second
+	}
+
+	return 0
+}
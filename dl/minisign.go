@@ -0,0 +1,132 @@
+package dl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign signatures are either of the file itself ("Ed", legacy) or of its
+// blake2b-512 hash ("ED", the default since minisign 0.8)
+const (
+	minisignLegacy   = "Ed"
+	minisignPrehash  = "ED"
+	minisignKeyIDLen = 8
+	trustedPrefix    = "trusted comment: "
+)
+
+// MinisignKey is a minisign public key
+type MinisignKey struct {
+	ID  [minisignKeyIDLen]byte
+	Key ed25519.PublicKey
+}
+
+// ParseMinisignKey parses the base64 encoded public key on the second line of
+// minisign.pub files
+func ParseMinisignKey(s string) (*MinisignKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid minisign public key")
+	}
+
+	if len(b) != 2+minisignKeyIDLen+ed25519.PublicKeySize || string(b[:2]) != minisignLegacy {
+		return nil, errors.New("invalid minisign public key")
+	}
+
+	ret := &MinisignKey{Key: ed25519.PublicKey(b[2+minisignKeyIDLen:])}
+	copy(ret.ID[:], b[2:])
+
+	return ret, nil
+}
+
+type minisignSig struct {
+	alg       string
+	keyID     [minisignKeyIDLen]byte
+	sig       []byte
+	trusted   string
+	globalSig []byte
+}
+
+func parseMinisignSig(r io.Reader) (*minisignSig, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() && len(lines) < 4 {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], trustedPrefix) {
+		return nil, errors.New("invalid minisign signature")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(b) != 2+minisignKeyIDLen+ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign signature")
+	}
+
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign trusted comment signature")
+	}
+
+	ret := &minisignSig{
+		alg:       string(b[:2]),
+		sig:       b[2+minisignKeyIDLen:],
+		trusted:   strings.TrimPrefix(lines[2], trustedPrefix),
+		globalSig: globalSig,
+	}
+	copy(ret.keyID[:], b[2:])
+
+	return ret, nil
+}
+
+// verify returns an error unless sig is a valid signature by k of the data in r
+func (k *MinisignKey) verify(r io.Reader, sig io.Reader) error {
+	s, err := parseMinisignSig(sig)
+	if err != nil {
+		return err
+	}
+
+	if s.keyID != k.ID {
+		return errors.New("minisign signature is by a different key")
+	}
+
+	var msg []byte
+
+	switch s.alg {
+	case minisignLegacy:
+		var buf bytes.Buffer
+		if _, err = io.Copy(&buf, r); err != nil {
+			return err
+		}
+		msg = buf.Bytes()
+	case minisignPrehash:
+		h, _ := blake2b.New512(nil)
+		if _, err = io.Copy(h, r); err != nil {
+			return err
+		}
+		msg = h.Sum(nil)
+	default:
+		return errors.Errorf("unsupported minisign signature algorithm: %s", s.alg)
+	}
+
+	if !ed25519.Verify(k.Key, msg, s.sig) {
+		return errors.New("invalid minisign signature")
+	}
+
+	if !ed25519.Verify(k.Key, append(append([]byte{}, s.sig...), s.trusted...), s.globalSig) {
+		return errors.New("invalid minisign trusted comment signature")
+	}
+
+	return nil
+}
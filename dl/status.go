@@ -0,0 +1,121 @@
+package dl
+
+import (
+	"math/rand"
+	"net/url"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lastSuccess = prom.NewGaugeVec(
+		prom.GaugeOpts{
+			Namespace: "blamedns",
+			Subsystem: "dl",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Time the file was last successfully updated or found to be current, by url.",
+		},
+		[]string{"url"},
+	)
+
+	failures = prom.NewGaugeVec(
+		prom.GaugeOpts{
+			Namespace: "blamedns",
+			Subsystem: "dl",
+			Name:      "consecutive_failures",
+			Help:      "Number of consecutive failed attempts to update the file, by url.",
+		},
+		[]string{"url"},
+	)
+
+	nextAttempt = prom.NewGaugeVec(
+		prom.GaugeOpts{
+			Namespace: "blamedns",
+			Subsystem: "dl",
+			Name:      "next_attempt_timestamp_seconds",
+			Help:      "Time of the next attempt to update the file, by url.",
+		},
+		[]string{"url"},
+	)
+)
+
+func init() {
+	prom.MustRegister(lastSuccess, failures, nextAttempt)
+}
+
+// Status is the state of the updates of a downloaded file
+type Status struct {
+	URL         string    `json:"url"`
+	File        string    `json:"file"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastSource  string    `json:"last_source,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+	Failures    int       `json:"failures"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+}
+
+// Status returns the state of the updates of the file
+func (d *DL) Status() Status {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+	return d.status
+}
+
+func (d *DL) succeeded(source *url.URL, t time.Time) {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+
+	d.status.LastSuccess = t
+	d.status.LastSource = source.String()
+	d.status.Failures = 0
+
+	lastSuccess.WithLabelValues(d.status.URL).Set(float64(t.Unix()))
+	failures.WithLabelValues(d.status.URL).Set(0)
+}
+
+func (d *DL) failed(err error) {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+
+	d.status.LastError = err.Error()
+	d.status.LastErrorAt = time.Now()
+	d.status.Failures++
+
+	failures.WithLabelValues(d.status.URL).Set(float64(d.status.Failures))
+}
+
+// nextAttempt records and returns how long to wait before the next update,
+// given the result of the last one. Failed updates are retried with jittered
+// exponential backoff between RetryMin and RetryMax.
+func (d *DL) nextAttempt(err error) time.Duration {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+
+	wait := d.UpdateInterval
+
+	if err != nil {
+		wait = d.RetryMin
+		for i := 1; i < d.status.Failures && wait < d.RetryMax; i++ {
+			wait *= 2
+		}
+
+		if wait > d.RetryMax {
+			wait = d.RetryMax
+		}
+
+		if wait > d.UpdateInterval {
+			wait = d.UpdateInterval
+		}
+
+		// wait between half and all of the backoff so that sources that
+		// failed together don't all retry together
+		wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+	}
+
+	d.status.NextAttempt = time.Now().Add(wait)
+	nextAttempt.WithLabelValues(d.status.URL).Set(float64(d.status.NextAttempt.Unix()))
+
+	return wait
+}
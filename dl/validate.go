@@ -0,0 +1,280 @@
+package dl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"jrubin.io/blamedns/parser"
+)
+
+// Validation is what downloads must pass before they replace the file that is
+// already there
+type Validation struct {
+	// MinLines is the minimum number of lines that aren't empty or comments
+	MinLines int
+
+	// MaxSize is the maximum size of the download in bytes, both before and
+	// after it is decompressed, unlimited if 0
+	MaxSize int64
+
+	// MinValidRatio is the minimum ratio of lines that aren't empty or
+	// comments that Parser must accept. Parser must not have side effects,
+	// e.g. by using parser.Discard.
+	MinValidRatio float64
+	Parser        parser.Parser
+
+	// Checksum requires the download, before it is decompressed, to match
+	// the sha256 sum at the url of the file with ".sha256" appended. The sum
+	// is never fetched from a mirror, which could otherwise vouch for its own
+	// download.
+	Checksum bool
+
+	// MinisignKey, if set, requires the download, before it is
+	// decompressed, to be signed by it, with the signature at the url it was
+	// downloaded from with ".minisig" appended
+	MinisignKey *MinisignKey
+}
+
+// maxSigSize limits the size of checksum and signature downloads
+const maxSigSize = 64 * 1024
+
+// tempFile returns a new hidden temporary file next to d.fileName
+func (d *DL) tempFile() (*os.File, error) {
+	return ioutil.TempFile(d.BaseDir, "."+d.base()+".")
+}
+
+func (d *DL) maxSize() int64 {
+	if d.Validation == nil {
+		return 0
+	}
+	return d.Validation.MaxSize
+}
+
+// copyMax copies src to dst and fails if src is larger than max bytes, unless
+// max is 0
+func copyMax(dst io.Writer, src io.Reader, max int64) (int64, error) {
+	if max > 0 {
+		src = io.LimitReader(src, max+1)
+	}
+
+	n, err := io.Copy(dst, src)
+	if err == nil && max > 0 && n > max {
+		err = errors.Errorf("file is larger than %d bytes", max)
+	}
+
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// download writes the body of res, without any content encoding, to a
+// temporary file and returns its name
+func (d *DL) download(res *http.Response) (string, error) {
+	f, err := d.tempFile()
+	if err != nil {
+		return "", err
+	}
+
+	wire := &countingReader{Reader: res.Body}
+	body := io.Reader(wire)
+
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(wire); err == nil {
+			body = gz
+		}
+	}
+
+	if err == nil {
+		_, err = copyMax(f, body, d.maxSize())
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil && res.ContentLength >= 0 && wire.n != res.ContentLength {
+		err = errors.Errorf("file is truncated, got %d of %d bytes", wire.n, res.ContentLength)
+	}
+
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// verify returns an error if the file downloaded from u doesn't match its
+// published checksum or signature. Only signatures are fetched from u, which
+// may be a mirror.
+func (d *DL) verify(u *url.URL, file string) error {
+	v := d.Validation
+	if v == nil {
+		return nil
+	}
+
+	if v.Checksum {
+		if err := d.checkSum(d.URL, file); err != nil {
+			return err
+		}
+	}
+
+	if v.MinisignKey != nil {
+		if err := d.checkSignature(u, file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error if the contents of the decompressed download
+// don't pass d.Validation
+func (d *DL) validate(file string) error {
+	v := d.Validation
+	if v == nil {
+		return nil
+	}
+
+	if v.MinLines > 0 || (v.MinValidRatio > 0 && v.Parser != nil) {
+		return v.checkLines(d.fileName, file)
+	}
+
+	return nil
+}
+
+func (v *Validation) checkLines(fileName, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	var lines, valid int
+
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+
+		lines++
+
+		if v.Parser != nil && v.Parser.Parse(fileName, i, text) {
+			valid++
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	if lines < v.MinLines {
+		return errors.Errorf("file has %d lines, less than %d", lines, v.MinLines)
+	}
+
+	if v.Parser != nil && v.MinValidRatio > 0 && lines > 0 {
+		if ratio := float64(valid) / float64(lines); ratio < v.MinValidRatio {
+			return errors.Errorf("only %.0f%% of the lines of the file are valid", ratio*100)
+		}
+	}
+
+	return nil
+}
+
+// fetch returns the body of the file at base with suffix appended
+func (d *DL) fetch(base *url.URL, suffix string) ([]byte, error) {
+	u := *base
+	u.Path += suffix
+
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", d.AppName, d.AppVersion))
+	d.debugRequestOut(req, false)
+
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	d.debugResponse(res, false)
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Wrapf(NewErrStatusCode(res.StatusCode), "error downloading %s", u.String())
+	}
+
+	return ioutil.ReadAll(io.LimitReader(res.Body, maxSigSize))
+}
+
+func (d *DL) checkSum(u *url.URL, file string) error {
+	b, err := d.fetch(u, ".sha256")
+	if err != nil {
+		return err
+	}
+
+	// sha256sum output is the hex encoded sum followed by the file name
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return errors.New("empty sha256 sum")
+	}
+
+	want, err := hex.DecodeString(fields[0])
+	if err != nil || len(want) != sha256.Size {
+		return errors.Errorf("invalid sha256 sum: %s", fields[0])
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(h.Sum(nil), want) {
+		return errors.New("sha256 sum does not match")
+	}
+
+	return nil
+}
+
+func (d *DL) checkSignature(u *url.URL, file string) error {
+	sig, err := d.fetch(u, ".minisig")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	return d.Validation.MinisignKey.verify(f, bytes.NewReader(sig))
+}
@@ -142,6 +142,32 @@ func (c *Memory) Purge() {
 	c.cache.Purge()
 }
 
+// RemoveFunc removes everything cached for the names that remove returns true
+// for and returns the number of entries removed
+func (c *Memory) RemoveFunc(remove func(name string) bool) int {
+	var n int
+
+	for _, k := range c.cache.Keys() {
+		var name string
+
+		switch k := k.(type) {
+		case key:
+			name = k.Host
+		case string:
+			name = k
+		default:
+			continue
+		}
+
+		if remove(name) {
+			c.cache.Remove(k)
+			n++
+		}
+	}
+
+	return n
+}
+
 func (c *Memory) Set(resp *dns.Msg) int {
 	if resp == nil || len(resp.Question) == 0 {
 		return 0
@@ -169,7 +195,9 @@ func (c *Memory) Set(resp *dns.Msg) int {
 	for _, s := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
 		for _, rr := range s {
 			if rr.Header().Class == dns.ClassINET {
-				c.add(NewRR(rr))
+				r := NewRR(rr)
+				r.Authenticated = resp.AuthenticatedData
+				c.add(r)
 				n++
 			}
 		}
@@ -206,6 +234,7 @@ func (c *Memory) get(ctx context.Context, q dns.Question, resp *dns.Msg, field m
 	if elem, ok := c.cache.Get(key{Host: q.Name, Type: q.Qtype}); ok {
 		if set, ok := elem.(*RRSet); ok {
 			if data := appendResponseField(resp, field, set.RR()); len(data) > 0 {
+				authenticated(resp, field, set)
 				return true
 			}
 		}
@@ -222,6 +251,7 @@ func (c *Memory) get(ctx context.Context, q dns.Question, resp *dns.Msg, field m
 	if elem, ok := c.cache.Get(key{Host: q.Name, Type: dns.TypeCNAME}); ok {
 		if set, ok := elem.(*RRSet); ok {
 			newValues := appendResponseField(resp, field, set.RR())
+			authenticated(resp, field, set)
 
 			var completed bool
 			for _, value := range newValues {
@@ -266,12 +296,24 @@ func (c *Memory) cacheFn() []cacheFn {
 	}}
 }
 
+// authenticated clears the AD bit of resp unless set, added to field, was
+// validated with dnssec. Additional records don't affect it, RFC 4035 §3.2.3.
+func authenticated(resp *dns.Msg, field msgField, set *RRSet) {
+	if field != fieldExtra && !set.Authenticated() {
+		resp.AuthenticatedData = false
+	}
+}
+
+// Get a response to req from the cache, or nil. The AD bit is set if every
+// record in the answer and authority sections was validated with dnssec when
+// it was cached.
 func (c *Memory) Get(ctx context.Context, req *dns.Msg) *dns.Msg {
 	if ctx == nil {
 		ctx = context.Background()
 	}
 
 	resp := &dns.Msg{}
+	resp.AuthenticatedData = true
 	if c.outerGet(ctx, req, resp) {
 		return resp
 	}
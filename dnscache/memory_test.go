@@ -243,11 +243,72 @@ func TestMemoryCache(t *testing.T) {
 
 		So(c.Len(), ShouldEqual, 4)
 		So(c.numEntries(), ShouldEqual, 4)
+
+		So(c.RemoveFunc(func(name string) bool { return name == "nothing.example.com" }), ShouldEqual, 0)
+		So(c.RemoveFunc(func(name string) bool { return name == "example.com" }), ShouldEqual, 2)
+		So(testGet(c, dns.TypeA, "example.com"), ShouldBeNil)
+
 		c.Purge()
 		So(c.Len(), ShouldEqual, 0)
 		So(c.numEntries(), ShouldEqual, 0)
 	})
 
+	Convey("validated responses should stay authenticated when cached", t, func() {
+		c := NewMemory(64, logger)
+
+		resp := &dns.Msg{}
+		resp.SetQuestion("secure.example.com.", dns.TypeA)
+		resp.Response = true
+		resp.AuthenticatedData = true
+		resp.Answer = []dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "secure.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: "www.example.com.",
+		}, &dns.A{
+			Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		}}
+		c.Set(resp)
+
+		So(testGet(c, dns.TypeA, "www.example.com.").AuthenticatedData, ShouldBeTrue)
+		So(testGet(c, dns.TypeA, "secure.example.com.").AuthenticatedData, ShouldBeTrue)
+
+		// a cname cached without validation taints the chain
+		resp = resp.Copy()
+		resp.Question[0].Name = "insecure.example.com."
+		resp.Answer[0].Header().Name = "insecure.example.com."
+		resp.Answer = resp.Answer[:1]
+		resp.AuthenticatedData = false
+		c.Set(resp)
+
+		So(testGet(c, dns.TypeA, "insecure.example.com.").AuthenticatedData, ShouldBeFalse)
+		So(testGet(c, dns.TypeA, "www.example.com.").AuthenticatedData, ShouldBeTrue)
+
+		// negative answers
+		nx := &dns.Msg{}
+		nx.SetQuestion("nope.example.com.", dns.TypeA)
+		nx.Response = true
+		nx.Rcode = dns.RcodeNameError
+		nx.AuthenticatedData = true
+		nx.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:     "ns.example.com.",
+			Mbox:   "admin.example.com.",
+			Minttl: 60,
+		}}
+		c.Set(nx)
+
+		got := testGet(c, dns.TypeA, "nope.example.com.")
+		So(got.Rcode, ShouldEqual, dns.RcodeNameError)
+		So(got.AuthenticatedData, ShouldBeTrue)
+
+		nx = nx.Copy()
+		nx.Question[0].Name = "other.example.com."
+		nx.AuthenticatedData = false
+		c.Set(nx)
+
+		So(testGet(c, dns.TypeA, "other.example.com.").AuthenticatedData, ShouldBeFalse)
+	})
+
 	Convey("test lru", t, func() {
 		Convey("lru should work", func() {
 			l := NewMemory(128, nil)
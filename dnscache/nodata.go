@@ -82,8 +82,9 @@ func (c *Memory) setNoData(resp *dns.Msg) {
 	}
 
 	e := &negativeEntry{
-		SOA:     soa.Header().Name,
-		Expires: expires,
+		SOA:           soa.Header().Name,
+		Expires:       expires,
+		Authenticated: resp.AuthenticatedData,
 	}
 
 	c.cache.Add(k, e)
@@ -118,6 +119,7 @@ func (c *Memory) buildNegativeReply(rcode int) func(context.Context, *dns.Msg, *
 
 		if c.get(ctx, q, resp, fieldNs) {
 			resp.SetRcode(req, rcode)
+			resp.AuthenticatedData = resp.AuthenticatedData && e.Authenticated
 			return true
 		}
 
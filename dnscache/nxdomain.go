@@ -7,8 +7,9 @@ import (
 )
 
 type negativeEntry struct {
-	SOA     string
-	Expires time.Time
+	SOA           string
+	Expires       time.Time
+	Authenticated bool
 }
 
 func (e negativeEntry) TTL() TTL {
@@ -58,8 +59,9 @@ func (c *Memory) setNxDomain(resp *dns.Msg) {
 	}
 
 	e := &negativeEntry{
-		SOA:     soa.Header().Name,
-		Expires: expires,
+		SOA:           soa.Header().Name,
+		Expires:       expires,
+		Authenticated: resp.AuthenticatedData,
 	}
 
 	c.cache.Add(q.Name, e)
@@ -9,6 +9,9 @@ import (
 type RR struct {
 	rr      dns.RR
 	Expires time.Time
+
+	// Authenticated is set when rr was validated with dnssec
+	Authenticated bool
 }
 
 func (m *RR) Header() *dns.RR_Header {
@@ -35,10 +35,12 @@ func (rs *RRSet) Add(r *RR) {
 		added = true
 
 		// found equal rr already in cache
-		// keep only the one with the lower ttl
+		// keep only the one with the lower ttl, and the latest validation
 
 		if r.Expires.Before(t.Expires) {
 			rs.setNoLock(j, r)
+		} else {
+			t.Authenticated = r.Authenticated
 		}
 	}
 
@@ -87,6 +89,21 @@ func (rs *RRSet) RR() []dns.RR {
 	return ret
 }
 
+// Authenticated returns whether every rr in the set was validated with
+// dnssec
+func (rs *RRSet) Authenticated() bool {
+	rs.Lock()
+	defer rs.Unlock()
+
+	for _, rr := range rs.data {
+		if !rr.Expired() && !rr.Authenticated {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (rs *RRSet) pruneNoLock(i int) (*RR, bool) {
 	rr := rs.getNoLock(i)
 	if rr.Expired() {
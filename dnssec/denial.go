@@ -0,0 +1,361 @@
+package dnssec
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// maxNSEC3Iterations is the most iterations of NSEC3 hashing that are
+// validated, more are treated as insecure, RFC 9276 §3.2
+const maxNSEC3Iterations = 150
+
+// signedFor returns the records in ns that were signed by a zone containing
+// name. Others, though validly signed, can't prove anything about name.
+func signedFor(name string, ns []dns.RR) []dns.RR {
+	var ret []dns.RR
+
+	for _, rr := range ns {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			continue
+		}
+
+		ss := sigs([]dns.RR{rr}, ns)
+		if len(ss) > 0 && dns.IsSubDomain(ss[0].SignerName, name) {
+			ret = append(ret, rr)
+		}
+	}
+
+	return ret
+}
+
+// denialRecords returns the NSEC and NSEC3 records in ns that can prove
+// something about name
+func denialRecords(name string, ns []dns.RR) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+
+	for _, rr := range signedFor(name, ns) {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, r)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, r)
+		}
+	}
+
+	return nsecs, nsec3s
+}
+
+// hasType returns whether types includes t
+func hasType(types []uint16, t uint16) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// noData returns whether the type bitmap of a record owned by name proves
+// that name has no records of qtype. Records from the parent side of a
+// delegation only prove anything about DS records, RFC 6840 §4.1.
+func noData(types []uint16, qtype uint16) bool {
+	if hasType(types, qtype) || hasType(types, dns.TypeCNAME) {
+		return false
+	}
+
+	if qtype != dns.TypeDS && hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA) {
+		return false
+	}
+
+	return true
+}
+
+// delegation returns whether a record with the type bitmap types is from the
+// parent side of a zone cut, or a DNAME, neither of which can prove anything
+// about names below it
+func delegation(types []uint16) bool {
+	return hasType(types, dns.TypeDNAME) || (hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA))
+}
+
+// covers returns whether r proves that name doesn't exist
+func covers(r *dns.NSEC, name string) bool {
+	if !nsecCovers(r, name) {
+		return false
+	}
+
+	return !(dns.IsSubDomain(r.Hdr.Name, name) && delegation(r.TypeBitMap))
+}
+
+// commonAncestor returns the longest name that a and b are both in
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+	return ancestor(a, n)
+}
+
+// ancestor returns the last n labels of name
+func ancestor(name string, n int) string {
+	idx := dns.Split(name)
+	if n >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+func wildcard(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// proveNegative checks that ns, the validated authority section of a
+// response, proves that name doesn't exist if nxdomain, or otherwise that it
+// has no records of qtype
+func proveNegative(name string, qtype uint16, nxdomain bool, ns []dns.RR) (Result, error) {
+	nsecs, nsec3s := denialRecords(name, ns)
+
+	switch {
+	case len(nsecs) > 0:
+		if nxdomain {
+			return nsecNameError(name, nsecs)
+		}
+		return nsecNoData(name, qtype, nsecs)
+	case len(nsec3s) > 0:
+		if !supportedNSEC3(nsec3s) {
+			return Insecure, nil
+		}
+		if nxdomain {
+			return nsec3NameError(name, nsec3s)
+		}
+		return nsec3NoData(name, qtype, nsec3s)
+	}
+
+	return Bogus, errors.Errorf("no denial of existence for %s", name)
+}
+
+// proveWildcard checks that ns proves that name, which was answered by a
+// wildcard expanded from its ancestor with labels labels, doesn't exist
+// itself, RFC 4035 §5.3.4
+func proveWildcard(name string, labels int, ns []dns.RR) (Result, error) {
+	nsecs, nsec3s := denialRecords(name, ns)
+
+	for _, r := range nsecs {
+		if covers(r, name) {
+			return Secure, nil
+		}
+	}
+
+	if len(nsec3s) > 0 {
+		if !supportedNSEC3(nsec3s) {
+			return Insecure, nil
+		}
+
+		// the name one label longer than the wildcard's closest encloser
+		if r := nsec3Covering(nsec3s, ancestor(name, labels+1)); r != nil {
+			if r.Flags&1 == 1 {
+				return Insecure, nil
+			}
+			return Secure, nil
+		}
+	}
+
+	return Bogus, errors.Errorf("no proof that wildcard answer for %s is not a closer match", name)
+}
+
+// nsecNameError proves that name doesn't exist, and that there is no wildcard
+// that could have answered it, with nsecs
+func nsecNameError(name string, nsecs []*dns.NSEC) (Result, error) {
+	var cover *dns.NSEC
+
+	for _, r := range nsecs {
+		if strings.EqualFold(r.Hdr.Name, name) {
+			return Bogus, errors.Errorf("nsec proves that %s exists", name)
+		}
+
+		if covers(r, name) {
+			cover = r
+		}
+	}
+
+	if cover == nil {
+		return Bogus, errors.Errorf("no nsec covers %s", name)
+	}
+
+	// the closest encloser is the longest ancestor of name at either end of
+	// the covering record
+	ce := commonAncestor(name, cover.Hdr.Name)
+	if next := commonAncestor(name, cover.NextDomain); dns.CountLabel(next) > dns.CountLabel(ce) {
+		ce = next
+	}
+
+	wc := wildcard(ce)
+
+	for _, r := range nsecs {
+		if strings.EqualFold(r.Hdr.Name, wc) {
+			return Bogus, errors.Errorf("nsec proves that wildcard %s exists", wc)
+		}
+
+		if covers(r, wc) {
+			return Secure, nil
+		}
+	}
+
+	return Bogus, errors.Errorf("no nsec covers wildcard %s", wc)
+}
+
+// nsecNoData proves that name has no records of qtype with nsecs, RFC 4035
+// §5.4
+func nsecNoData(name string, qtype uint16, nsecs []*dns.NSEC) (Result, error) {
+	for _, r := range nsecs {
+		if strings.EqualFold(r.Hdr.Name, name) {
+			if noData(r.TypeBitMap, qtype) {
+				return Secure, nil
+			}
+			return Bogus, errors.Errorf("nsec for %s has %s", name, dns.TypeToString[qtype])
+		}
+	}
+
+	for _, r := range nsecs {
+		if !covers(r, name) {
+			continue
+		}
+
+		// an empty non-terminal, which only has names below it
+		if dns.IsSubDomain(name, strings.ToLower(r.NextDomain)) {
+			return Secure, nil
+		}
+
+		// a wildcard matched name, but doesn't have qtype
+		ce := commonAncestor(name, r.Hdr.Name)
+		if next := commonAncestor(name, r.NextDomain); dns.CountLabel(next) > dns.CountLabel(ce) {
+			ce = next
+		}
+
+		wc := wildcard(ce)
+		for _, w := range nsecs {
+			if strings.EqualFold(w.Hdr.Name, wc) && noData(w.TypeBitMap, qtype) {
+				return Secure, nil
+			}
+		}
+	}
+
+	return Bogus, errors.Errorf("no nsec proves that %s has no %s", name, dns.TypeToString[qtype])
+}
+
+// supportedNSEC3 returns whether nsec3s can be validated
+func supportedNSEC3(nsec3s []*dns.NSEC3) bool {
+	for _, r := range nsec3s {
+		if r.Hash != dns.SHA1 || r.Iterations > maxNSEC3Iterations {
+			return false
+		}
+	}
+	return true
+}
+
+func nsec3Matching(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, r := range nsec3s {
+		if r.Match(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+func nsec3Covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, r := range nsec3s {
+		if nsec3Covers(r, name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// closestEncloser finds the longest existing ancestor of name, proven by a
+// matching NSEC3, and the NSEC3 that covers the next closer name, one label
+// longer, proving that it doesn't exist, RFC 5155 §8.3
+func closestEncloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3) {
+	labels := dns.CountLabel(name)
+
+	for n := labels - 1; n >= 0; n-- {
+		ce := ancestor(name, n)
+		if n == 0 {
+			ce = "."
+		}
+
+		m := nsec3Matching(nsec3s, ce)
+		if m == nil {
+			continue
+		}
+
+		if delegation(m.TypeBitMap) {
+			return "", nil
+		}
+
+		if r := nsec3Covering(nsec3s, ancestor(name, n+1)); r != nil {
+			return ce, r
+		}
+
+		return "", nil
+	}
+
+	return "", nil
+}
+
+// nsec3NameError proves that name doesn't exist, and that there is no
+// wildcard that could have answered it, with nsec3s, RFC 5155 §8.4
+func nsec3NameError(name string, nsec3s []*dns.NSEC3) (Result, error) {
+	if nsec3Matching(nsec3s, name) != nil {
+		return Bogus, errors.Errorf("nsec3 proves that %s exists", name)
+	}
+
+	ce, next := closestEncloser(nsec3s, name)
+	if next == nil {
+		return Bogus, errors.Errorf("no closest encloser proof for %s", name)
+	}
+
+	wc := wildcard(ce)
+	if nsec3Covering(nsec3s, wc) == nil {
+		return Bogus, errors.Errorf("no nsec3 covers wildcard %s", wc)
+	}
+
+	// names covered by opt-out records may be unsigned delegations
+	if next.Flags&1 == 1 {
+		return Insecure, nil
+	}
+
+	return Secure, nil
+}
+
+// nsec3NoData proves that name has no records of qtype with nsec3s, RFC 5155
+// §8.5-8.7
+func nsec3NoData(name string, qtype uint16, nsec3s []*dns.NSEC3) (Result, error) {
+	if r := nsec3Matching(nsec3s, name); r != nil {
+		if noData(r.TypeBitMap, qtype) {
+			return Secure, nil
+		}
+		return Bogus, errors.Errorf("nsec3 for %s has %s", name, dns.TypeToString[qtype])
+	}
+
+	ce, next := closestEncloser(nsec3s, name)
+	if next == nil {
+		return Bogus, errors.Errorf("no closest encloser proof for %s", name)
+	}
+
+	// a DS query for an unsigned delegation in an opt-out span
+	if qtype == dns.TypeDS && next.Flags&1 == 1 {
+		return Insecure, nil
+	}
+
+	// a wildcard matched name, but doesn't have qtype
+	if r := nsec3Matching(nsec3s, wildcard(ce)); r != nil && noData(r.TypeBitMap, qtype) {
+		return Secure, nil
+	}
+
+	return Bogus, errors.Errorf("no nsec3 proves that %s has no %s", name, dns.TypeToString[qtype])
+}
@@ -0,0 +1,754 @@
+// Package dnssec validates dns responses by following the chain of trust from
+// a trust anchor down to the signer of each record set.
+package dnssec
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"jrubin.io/blamedns/dnscache"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// A Result is the security status of a response, RFC 4035 §4.3
+type Result int
+
+const (
+	// Insecure responses are not signed and are provably not required to be
+	Insecure Result = iota
+
+	// Secure responses have a valid chain of trust to a trust anchor
+	Secure
+
+	// Bogus responses should have been signed, but validation failed
+	Bogus
+)
+
+func (r Result) String() string {
+	switch r {
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+	return "insecure"
+}
+
+// RootAnchors are the DS records of the root zone key signing keys
+var RootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// ParseAnchors parses trust anchors in DS presentation format
+func ParseAnchors(values []string) ([]*dns.DS, error) {
+	ret := make([]*dns.DS, 0, len(values))
+
+	for _, value := range values {
+		rr, err := dns.NewRR(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trust anchor: %s", value)
+		}
+
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, errors.Errorf("trust anchor is not a DS record: %s", value)
+		}
+
+		ret = append(ret, ds)
+	}
+
+	return ret, nil
+}
+
+// An Exchanger sends req upstream and returns the response, or nil on
+// failure
+type Exchanger func(ctx context.Context, req *dns.Msg) *dns.Msg
+
+// maxProofTTL caps how long a proof that a name is not a signed zone is
+// remembered
+const maxProofTTL = time.Hour
+
+type proof struct {
+	result  result
+	expires time.Time
+}
+
+// Validator validates responses against Anchors. Validated DNSKEY and DS
+// record sets are cached in Keys. Names at or below a NegativeAnchor are
+// always Insecure, RFC 7646.
+type Validator struct {
+	Anchors         []*dns.DS
+	NegativeAnchors []string
+	Keys            dnscache.Cache
+	mu              sync.Mutex
+	proofs          map[string]proof
+}
+
+// Validate resp, using exchange to look up any DNSKEY and DS records required
+// to establish the chain of trust. Negative responses, and answers expanded
+// from wildcards, are only Secure if the NSEC or NSEC3 records in the
+// authority section prove that the name, or the type asked for, doesn't
+// exist. Responses with nothing signed are only Insecure if there is an
+// unsigned delegation above the name.
+func (v *Validator) Validate(ctx context.Context, exchange Exchanger, resp *dns.Msg) (Result, error) {
+	if len(resp.Question) == 0 {
+		return Bogus, errors.New("response has no question")
+	}
+
+	q := resp.Question[0]
+	if v.negativeAnchor(q.Name) {
+		return Insecure, nil
+	}
+
+	ret := Secure
+
+	// names answered by wildcards, and the number of labels in the wildcard
+	wildcards := map[string]int{}
+
+	for _, set := range rrsets(resp.Answer) {
+		res, err := v.validateRRSet(ctx, exchange, set, resp.Answer)
+		if res == Bogus {
+			return Bogus, err
+		}
+
+		if res == Insecure {
+			ret = Insecure
+			continue
+		}
+
+		name := set[0].Header().Name
+		if strings.HasPrefix(name, "*.") {
+			continue
+		}
+
+		if ss := sigs(set, resp.Answer); int(ss[0].Labels) < dns.CountLabel(name) {
+			wildcards[name] = int(ss[0].Labels)
+		}
+	}
+
+	target, answered := chain(q, resp.Answer)
+	if answered && len(wildcards) == 0 {
+		return ret, nil
+	}
+
+	sets := rrsets(resp.Ns)
+	if len(sets) == 0 {
+		if ret == Insecure {
+			return Insecure, nil
+		}
+
+		// with no proof, the name must not be in a signed zone
+		return v.unsigned(ctx, exchange, target)
+	}
+
+	for _, set := range sets {
+		res, err := v.validateRRSet(ctx, exchange, set, resp.Ns)
+		if res == Bogus {
+			return Bogus, err
+		}
+
+		if res == Insecure {
+			ret = Insecure
+		}
+	}
+
+	// nothing can be proven with unsigned records
+	if ret == Insecure {
+		return Insecure, nil
+	}
+
+	for name, labels := range wildcards {
+		if res, err := proveWildcard(name, labels, resp.Ns); res != Secure {
+			return res, err
+		}
+	}
+
+	if answered {
+		return Secure, nil
+	}
+
+	return proveNegative(target, q.Qtype, resp.Rcode == dns.RcodeNameError, resp.Ns)
+}
+
+// chain follows the CNAME records in answer from the question name and
+// returns the name at the end of the chain and whether answer has records of
+// the type asked for there
+func chain(q dns.Question, answer []dns.RR) (string, bool) {
+	name := q.Name
+
+	// bounded, in case of loops
+	for i := 0; i <= len(answer); i++ {
+		var next string
+
+		for _, rr := range answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+
+			if h.Rrtype == q.Qtype {
+				return name, true
+			}
+
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		name = next
+	}
+
+	return name, false
+}
+
+func (v *Validator) negativeAnchor(name string) bool {
+	name = strings.ToLower(name)
+	for _, nta := range v.NegativeAnchors {
+		if dns.IsSubDomain(strings.ToLower(dns.Fqdn(nta)), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rrsets groups rrs, other than signatures, into record sets
+func rrsets(rrs []dns.RR) [][]dns.RR {
+	type key struct {
+		name  string
+		rtype uint16
+	}
+
+	var keys []key
+	sets := map[key][]dns.RR{}
+
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		k := key{strings.ToLower(h.Name), h.Rrtype}
+		if _, ok := sets[k]; !ok {
+			keys = append(keys, k)
+		}
+
+		sets[k] = append(sets[k], rr)
+	}
+
+	ret := make([][]dns.RR, len(keys))
+	for i, k := range keys {
+		ret[i] = sets[k]
+	}
+
+	return ret
+}
+
+// sigs returns the signatures in rrs covering set
+func sigs(set, rrs []dns.RR) []*dns.RRSIG {
+	var ret []*dns.RRSIG
+
+	h := set[0].Header()
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == h.Rrtype && strings.EqualFold(sig.Hdr.Name, h.Name) {
+			ret = append(ret, sig)
+		}
+	}
+
+	return ret
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384:
+		return true
+	}
+	return false
+}
+
+func supportedDigest(t uint8) bool {
+	switch t {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+// verify returns whether any of sigs is a currently valid signature of set by
+// one of keys
+func verify(set []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) bool {
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(time.Time{}) {
+			continue
+		}
+
+		for _, key := range keys {
+			if sig.KeyTag == key.KeyTag() && sig.Verify(key, set) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *Validator) validateRRSet(ctx context.Context, exchange Exchanger, set, section []dns.RR) (Result, error) {
+	name := set[0].Header().Name
+
+	if v.negativeAnchor(name) {
+		return Insecure, nil
+	}
+
+	ss := sigs(set, section)
+	if len(ss) == 0 {
+		return v.unsigned(ctx, exchange, name)
+	}
+
+	signer := ss[0].SignerName
+	if !dns.IsSubDomain(signer, name) {
+		return Bogus, errors.Errorf("%s signed by unrelated zone %s", name, signer)
+	}
+
+	keys, res, err := v.keys(ctx, exchange, signer)
+	if res != Secure {
+		return res, err
+	}
+
+	if !verify(set, ss, keys) {
+		return Bogus, errors.Errorf("invalid signature for %s %s", name, dns.TypeToString[set[0].Header().Rrtype])
+	}
+
+	return Secure, nil
+}
+
+func (v *Validator) query(ctx context.Context, exchange Exchanger, name string, qtype uint16) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	req.CheckingDisabled = true
+
+	return exchange(ctx, req)
+}
+
+func (v *Validator) cached(ctx context.Context, name string, qtype uint16) []dns.RR {
+	if v.Keys == nil {
+		return nil
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+
+	resp := v.Keys.Get(ctx, req)
+	if resp == nil {
+		return nil
+	}
+
+	var ret []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype {
+			ret = append(ret, rr)
+		}
+	}
+
+	return ret
+}
+
+func (v *Validator) cache(set []dns.RR, sigs []*dns.RRSIG) {
+	if v.Keys == nil {
+		return
+	}
+
+	resp := &dns.Msg{}
+	resp.SetQuestion(set[0].Header().Name, set[0].Header().Rrtype)
+	resp.Response = true
+	resp.Answer = append(resp.Answer, set...)
+	for _, sig := range sigs {
+		resp.Answer = append(resp.Answer, sig)
+	}
+
+	v.Keys.Set(resp)
+}
+
+// keys returns the validated DNSKEYs of zone
+func (v *Validator) keys(ctx context.Context, exchange Exchanger, zone string) ([]*dns.DNSKEY, Result, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+
+	if v.negativeAnchor(zone) {
+		return nil, Insecure, nil
+	}
+
+	if cached := v.cached(ctx, zone, dns.TypeDNSKEY); len(cached) > 0 {
+		return dnskeys(cached), Secure, nil
+	}
+
+	var ds []*dns.DS
+
+	if zone == "." {
+		ds = v.Anchors
+	} else {
+		var res Result
+		var err error
+		if ds, res, err = v.ds(ctx, exchange, zone); res != Secure {
+			return nil, res, err
+		}
+	}
+
+	resp := v.query(ctx, exchange, zone, dns.TypeDNSKEY)
+	if resp == nil {
+		return nil, Bogus, errors.Errorf("could not get DNSKEY for %s", zone)
+	}
+
+	var set []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeDNSKEY && strings.EqualFold(rr.Header().Name, zone) {
+			set = append(set, rr)
+		}
+	}
+
+	if len(set) == 0 {
+		return nil, Bogus, errors.Errorf("no DNSKEY for %s", zone)
+	}
+
+	keys := dnskeys(set)
+
+	var supported bool
+	var anchored []*dns.DNSKEY
+
+	for _, d := range ds {
+		if !supportedAlgorithm(d.Algorithm) || !supportedDigest(d.DigestType) {
+			continue
+		}
+
+		supported = true
+
+		for _, key := range keys {
+			if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+				continue
+			}
+
+			if kds := key.ToDS(d.DigestType); kds != nil && strings.EqualFold(kds.Digest, d.Digest) {
+				anchored = append(anchored, key)
+			}
+		}
+	}
+
+	// zones only signed with unsupported algorithms are treated as unsigned,
+	// RFC 4035 §5.2
+	if !supported {
+		return nil, Insecure, nil
+	}
+
+	ss := sigs(set, resp.Answer)
+	if !verify(set, ss, anchored) {
+		return nil, Bogus, errors.Errorf("DNSKEY for %s not signed by a trusted key", zone)
+	}
+
+	v.cache(set, ss)
+
+	return keys, Secure, nil
+}
+
+func dnskeys(rrs []dns.RR) []*dns.DNSKEY {
+	var ret []*dns.DNSKEY
+	for _, rr := range rrs {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
+
+// result extends Result for internal use
+type result int
+
+const (
+	resultInsecure = result(Insecure)
+	resultSecure   = result(Secure)
+	resultBogus    = result(Bogus)
+
+	// resultNotCut means the name is not a zone cut, and so is part of its
+	// parent zone
+	resultNotCut result = -1
+)
+
+// ds returns the validated DS records of zone, the result is only Secure if
+// zone is a signed delegation
+func (v *Validator) ds(ctx context.Context, exchange Exchanger, zone string) ([]*dns.DS, Result, error) {
+	ds, res, err := v.delegation(ctx, exchange, zone)
+	if res == resultNotCut {
+		// the DNSKEY's signer must be a zone
+		return nil, Bogus, errors.Errorf("%s is not a zone", zone)
+	}
+	return ds, Result(res), err
+}
+
+func (v *Validator) proof(name string) (result, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	p, ok := v.proofs[name]
+	if !ok || time.Now().After(p.expires) {
+		return 0, false
+	}
+
+	return p.result, true
+}
+
+func (v *Validator) setProof(name string, res result, ttl time.Duration) {
+	if ttl > maxProofTTL {
+		ttl = maxProofTTL
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.proofs == nil {
+		v.proofs = map[string]proof{}
+	}
+
+	v.proofs[name] = proof{result: res, expires: time.Now().Add(ttl)}
+}
+
+// delegation determines whether name is a signed delegation (resultSecure
+// with its DS records), an unsigned delegation (resultInsecure), or not a
+// zone cut at all (resultNotCut)
+func (v *Validator) delegation(ctx context.Context, exchange Exchanger, name string) ([]*dns.DS, result, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	if cached := v.cached(ctx, name, dns.TypeDS); len(cached) > 0 {
+		var ret []*dns.DS
+		for _, rr := range cached {
+			ret = append(ret, rr.(*dns.DS))
+		}
+		return ret, resultSecure, nil
+	}
+
+	if res, ok := v.proof(name); ok {
+		return nil, res, nil
+	}
+
+	resp := v.query(ctx, exchange, name, dns.TypeDS)
+	if resp == nil {
+		return nil, resultBogus, errors.Errorf("could not get DS for %s", name)
+	}
+
+	var set []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeDS && strings.EqualFold(rr.Header().Name, name) {
+			set = append(set, rr)
+		}
+	}
+
+	if len(set) > 0 {
+		ss := sigs(set, resp.Answer)
+		if len(ss) == 0 {
+			return nil, resultBogus, errors.Errorf("unsigned DS for %s", name)
+		}
+
+		signer := ss[0].SignerName
+		if !dns.IsSubDomain(signer, name) || strings.EqualFold(signer, name) {
+			return nil, resultBogus, errors.Errorf("DS for %s signed by %s", name, signer)
+		}
+
+		keys, res, err := v.keys(ctx, exchange, signer)
+		if res != Secure {
+			return nil, result(res), err
+		}
+
+		if !verify(set, ss, keys) {
+			return nil, resultBogus, errors.Errorf("invalid signature for %s DS", name)
+		}
+
+		v.cache(set, ss)
+
+		var ret []*dns.DS
+		for _, rr := range set {
+			ret = append(ret, rr.(*dns.DS))
+		}
+
+		return ret, resultSecure, nil
+	}
+
+	res, err := v.noDS(ctx, exchange, name, resp)
+	return nil, res, err
+}
+
+// noDS determines what a response without DS records for name proves
+func (v *Validator) noDS(ctx context.Context, exchange Exchanger, name string, resp *dns.Msg) (result, error) {
+	var soa *dns.SOA
+	for _, rr := range resp.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+		}
+	}
+
+	if soa == nil {
+		return resultBogus, errors.Errorf("no SOA in response to DS for %s", name)
+	}
+
+	// DS records are served by the parent zone
+	if strings.EqualFold(soa.Hdr.Name, name) {
+		return resultBogus, errors.Errorf("DS for %s answered by the zone itself", name)
+	}
+
+	ttl := time.Duration(soa.Minttl) * time.Second
+	if hdrTTL := time.Duration(soa.Hdr.Ttl) * time.Second; hdrTTL < ttl {
+		ttl = hdrTTL
+	}
+
+	// the authority section is that of the zone containing name, which must
+	// itself be validated
+	for _, set := range rrsets(resp.Ns) {
+		res, err := v.validateRRSet(ctx, exchange, set, resp.Ns)
+		if res == Insecure {
+			v.setProof(name, resultInsecure, ttl)
+			return resultInsecure, nil
+		}
+
+		if res == Bogus {
+			return resultBogus, err
+		}
+	}
+
+	res := denial(name, resp.Rcode == dns.RcodeNameError, signedFor(name, resp.Ns))
+	if res == resultBogus {
+		return resultBogus, errors.Errorf("no proof that %s has no DS", name)
+	}
+
+	v.setProof(name, res, ttl)
+
+	return res, nil
+}
+
+// denial checks the NSEC or NSEC3 records in ns that prove that name has no
+// DS records. If name has NS records it is an unsigned delegation, otherwise,
+// it is not a zone cut.
+func denial(name string, nxdomain bool, ns []dns.RR) result {
+	for _, rr := range ns {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(r.Hdr.Name, name) {
+				return bitmapDenial(r.TypeBitMap)
+			}
+
+			if nsecCovers(r, name) {
+				// name doesn't exist, so it can't be a zone cut
+				return resultNotCut
+			}
+		case *dns.NSEC3:
+			if r.Match(name) {
+				return bitmapDenial(r.TypeBitMap)
+			}
+
+			if !nsec3Covers(r, name) {
+				continue
+			}
+
+			if r.Flags&1 == 1 {
+				// opt-out, only unsigned delegations may be covered, RFC
+				// 5155 §6
+				return resultInsecure
+			}
+
+			if nxdomain {
+				return resultNotCut
+			}
+		}
+	}
+
+	return resultBogus
+}
+
+func bitmapDenial(types []uint16) result {
+	var hasNS bool
+
+	for _, t := range types {
+		switch t {
+		case dns.TypeDS:
+			return resultBogus
+		case dns.TypeNS:
+			hasNS = true
+		case dns.TypeSOA:
+			// the apex of a zone, the DS would be in the parent
+			return resultBogus
+		}
+	}
+
+	if hasNS {
+		return resultInsecure
+	}
+
+	return resultNotCut
+}
+
+// nsecCovers returns whether name falls between the owner and next name of
+// r in canonical order
+func nsecCovers(r *dns.NSEC, name string) bool {
+	return between(canonical(r.Hdr.Name), canonical(r.NextDomain), canonical(name))
+}
+
+// nsec3Covers returns whether the hash of name falls between the owner and
+// next hash of r
+func nsec3Covers(r *dns.NSEC3, name string) bool {
+	labels := dns.SplitDomainName(r.Hdr.Name)
+	if len(labels) == 0 {
+		return false
+	}
+
+	owner := strings.ToUpper(labels[0])
+	next := strings.ToUpper(r.NextDomain)
+	hash := dns.HashName(name, r.Hash, r.Iterations, r.Salt)
+
+	return between(owner, next, hash)
+}
+
+// between returns whether from < value < to, accounting for the last record
+// in the chain wrapping around to the first
+func between(from, to, value string) bool {
+	if from < to {
+		return from < value && value < to
+	}
+	return value > from || value < to
+}
+
+// canonical returns a key for name that sorts in canonical dns order, RFC
+// 4034 §6.1
+func canonical(name string) string {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, "\x00")
+}
+
+// unsigned determines whether the unsigned record set owned by name is
+// Insecure, by finding an unsigned delegation above it, or Bogus
+func (v *Validator) unsigned(ctx context.Context, exchange Exchanger, name string) (Result, error) {
+	labels := dns.SplitDomainName(name)
+
+	// walk down from the top level domain
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		if v.negativeAnchor(zone) {
+			return Insecure, nil
+		}
+
+		_, res, err := v.delegation(ctx, exchange, zone)
+		switch res {
+		case resultInsecure:
+			return Insecure, nil
+		case resultBogus:
+			return Bogus, err
+		}
+	}
+
+	return Bogus, errors.Errorf("missing signature for %s", name)
+}
@@ -0,0 +1,327 @@
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"jrubin.io/blamedns/dnscache"
+
+	"github.com/miekg/dns"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	if err != nil {
+		panic(err)
+	}
+
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(set ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: set[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+	}
+
+	if err := sig.Sign(z.priv, set); err != nil {
+		panic(err)
+	}
+
+	return append(set, sig)
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// testServer answers queries from a signed root zone with a signed
+// delegation to "example." and an unsigned one to "insecure."
+type testServer struct {
+	root, example *testZone
+	queries       int
+}
+
+func (s *testServer) soa(zone string) dns.RR {
+	return mustRR(zone + " 300 IN SOA ns.example. admin.example. 1 3600 600 86400 300")
+}
+
+func (s *testServer) exchange(ctx context.Context, req *dns.Msg) *dns.Msg {
+	s.queries++
+
+	q := req.Question[0]
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+
+	switch {
+	case q.Qtype == dns.TypeDNSKEY && q.Name == ".":
+		resp.Answer = s.root.sign(s.root.key)
+	case q.Qtype == dns.TypeDNSKEY && q.Name == "example.":
+		resp.Answer = s.example.sign(s.example.key)
+	case q.Qtype == dns.TypeDS && q.Name == "example.":
+		resp.Answer = s.root.sign(s.example.key.ToDS(dns.SHA256))
+	case q.Qtype == dns.TypeDS && q.Name == "insecure.":
+		resp.Ns = append(s.root.sign(s.soa(".")), s.root.sign(&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "insecure.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: "zzz.",
+			TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+		})...)
+	case q.Qtype == dns.TypeDS && q.Name == "www.example.":
+		resp.Ns = append(s.example.sign(s.soa("example.")), s.example.sign(&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: "example.",
+			TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+		})...)
+	default:
+		return nil
+	}
+
+	return resp
+}
+
+func aResp(name, ip string) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetQuestion(name, dns.TypeA)
+	resp.Response = true
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP(ip),
+	}}
+	return resp
+}
+
+func TestValidator(t *testing.T) {
+	Convey("dnssec validation should work", t, func() {
+		s := &testServer{
+			root:    newTestZone("."),
+			example: newTestZone("example."),
+		}
+
+		v := &Validator{
+			Anchors: []*dns.DS{s.root.key.ToDS(dns.SHA256)},
+			Keys:    dnscache.NewMemory(128, nil),
+		}
+
+		ctx := context.Background()
+
+		anchors, err := ParseAnchors(RootAnchors)
+		So(err, ShouldBeNil)
+		So(len(anchors), ShouldEqual, 2)
+		So(anchors[0].KeyTag, ShouldEqual, 20326)
+
+		_, err = ParseAnchors([]string{". IN A 127.0.0.1"})
+		So(err, ShouldNotBeNil)
+
+		resp := aResp("www.example.", "192.0.2.1")
+		resp.Answer = s.example.sign(resp.Answer...)
+
+		res, err := v.Validate(ctx, s.exchange, resp)
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, Secure)
+
+		// validated keys are cached
+		n := s.queries
+		res, _ = v.Validate(ctx, s.exchange, resp)
+		So(res, ShouldEqual, Secure)
+		So(s.queries, ShouldEqual, n)
+
+		// tampered answers are bogus
+		resp.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.2")
+		res, err = v.Validate(ctx, s.exchange, resp)
+		So(err, ShouldNotBeNil)
+		So(res, ShouldEqual, Bogus)
+
+		// as are unsigned answers from signed zones
+		res, err = v.Validate(ctx, s.exchange, aResp("www.example.", "192.0.2.1"))
+		So(err, ShouldNotBeNil)
+		So(res, ShouldEqual, Bogus)
+
+		// unsigned answers below unsigned delegations are insecure
+		res, err = v.Validate(ctx, s.exchange, aResp("www.insecure.", "192.0.2.1"))
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, Insecure)
+
+		// signatures from keys that aren't trusted are bogus
+		other := newTestZone("example.")
+		resp = aResp("www.example.", "192.0.2.1")
+		resp.Answer = other.sign(resp.Answer...)
+		res, _ = v.Validate(ctx, s.exchange, resp)
+		So(res, ShouldEqual, Bogus)
+
+		// unless there is a negative trust anchor
+		v.NegativeAnchors = []string{"Example"}
+		res, err = v.Validate(ctx, s.exchange, resp)
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, Insecure)
+	})
+
+	Convey("denial of existence should be proven", t, func() {
+		s := &testServer{
+			root:    newTestZone("."),
+			example: newTestZone("example."),
+		}
+
+		v := &Validator{
+			Anchors: []*dns.DS{s.root.key.ToDS(dns.SHA256)},
+			Keys:    dnscache.NewMemory(128, nil),
+		}
+
+		ctx := context.Background()
+
+		nsec := func(z *testZone, name, next string, types ...uint16) []dns.RR {
+			return z.sign(&dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: next,
+				TypeBitMap: types,
+			})
+		}
+
+		negative := func(name string, qtype uint16, rcode int, ns ...[]dns.RR) *dns.Msg {
+			resp := &dns.Msg{}
+			resp.SetQuestion(name, qtype)
+			resp.Response = true
+			resp.Rcode = rcode
+			for _, rrs := range ns {
+				resp.Ns = append(resp.Ns, rrs...)
+			}
+			return resp
+		}
+
+		soa := s.example.sign(s.soa("example."))
+		apex := nsec(s.example, "example.", "www.example.", dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY)
+		www := nsec(s.example, "www.example.", "example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)
+
+		// nxdomain, the nsec covers both the name and the wildcard
+		res, err := v.Validate(ctx, s.exchange, negative("nope.example.", dns.TypeA, dns.RcodeNameError, soa, apex))
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, Secure)
+
+		// without anything covering the name
+		res, err = v.Validate(ctx, s.exchange, negative("nope.example.", dns.TypeA, dns.RcodeNameError, soa, www))
+		So(err, ShouldNotBeNil)
+		So(res, ShouldEqual, Bogus)
+
+		// the name that is proven to exist
+		res, _ = v.Validate(ctx, s.exchange, negative("www.example.", dns.TypeA, dns.RcodeNameError, soa, www))
+		So(res, ShouldEqual, Bogus)
+
+		// with the signatures stripped
+		res, _ = v.Validate(ctx, s.exchange, negative("nope.example.", dns.TypeA, dns.RcodeNameError, soa[:1], apex[:1]))
+		So(res, ShouldEqual, Bogus)
+
+		// the parent's nsec for a delegation proves nothing below it
+		parent := nsec(s.root, "example.", "insecure.", dns.TypeNS, dns.TypeDS, dns.TypeRRSIG, dns.TypeNSEC)
+		res, _ = v.Validate(ctx, s.exchange, negative("nope.example.", dns.TypeA, dns.RcodeNameError, s.root.sign(s.soa(".")), parent))
+		So(res, ShouldEqual, Bogus)
+
+		// nodata
+		res, err = v.Validate(ctx, s.exchange, negative("www.example.", dns.TypeAAAA, dns.RcodeSuccess, soa, www))
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, Secure)
+
+		res, _ = v.Validate(ctx, s.exchange, negative("www.example.", dns.TypeA, dns.RcodeSuccess, soa, www))
+		So(res, ShouldEqual, Bogus)
+
+		// empty responses are only insecure outside of signed zones
+		res, _ = v.Validate(ctx, s.exchange, negative("www.example.", dns.TypeAAAA, dns.RcodeSuccess))
+		So(res, ShouldEqual, Bogus)
+
+		res, err = v.Validate(ctx, s.exchange, negative("www.insecure.", dns.TypeAAAA, dns.RcodeSuccess))
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, Insecure)
+
+		// nsec3 in a zone with only the apex
+		hash := dns.HashName("example.", dns.SHA1, 0, "")
+		nsec3 := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			NextDomain: hash,
+			TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY},
+		}
+
+		res, err = v.Validate(ctx, s.exchange, negative("nope.example.", dns.TypeA, dns.RcodeNameError, soa, s.example.sign(nsec3)))
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, Secure)
+
+		res, _ = v.Validate(ctx, s.exchange, negative("example.", dns.TypeSOA, dns.RcodeSuccess, soa, s.example.sign(nsec3)))
+		So(res, ShouldEqual, Bogus)
+
+		// opt-out
+		nsec3 = dns.Copy(nsec3).(*dns.NSEC3)
+		nsec3.Flags = 1
+		res, err = v.Validate(ctx, s.exchange, negative("nope.example.", dns.TypeA, dns.RcodeNameError, soa, s.example.sign(nsec3)))
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, Insecure)
+
+		// answers expanded from a wildcard need proof that the name doesn't
+		// exist
+		resp := aResp("*.example.", "192.0.2.1")
+		resp.Answer = s.example.sign(resp.Answer...)
+		for _, rr := range resp.Answer {
+			rr.Header().Name = "a.b.example."
+		}
+		resp.Question[0].Name = "a.b.example."
+
+		res, _ = v.Validate(ctx, s.exchange, resp)
+		So(res, ShouldEqual, Bogus)
+
+		resp.Ns = nsec(s.example, "*.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)
+		res, err = v.Validate(ctx, s.exchange, resp)
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, Secure)
+	})
+
+	Convey("nsec coverage should work", t, func() {
+		nsec := &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "a.example."},
+			NextDomain: "c.example.",
+		}
+		So(nsecCovers(nsec, "b.example."), ShouldBeTrue)
+		So(nsecCovers(nsec, "x.b.example."), ShouldBeTrue)
+		So(nsecCovers(nsec, "d.example."), ShouldBeFalse)
+
+		// the last nsec wraps around to the apex
+		nsec = &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "z.example."},
+			NextDomain: "example.",
+		}
+		So(nsecCovers(nsec, "zz.example."), ShouldBeTrue)
+		So(nsecCovers(nsec, "b.example."), ShouldBeFalse)
+
+		nsec3 := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.Repeat("0", 32) + ".example."},
+			Hash:       dns.SHA1,
+			Flags:      1,
+			NextDomain: strings.Repeat("V", 32),
+		}
+		So(nsec3Covers(nsec3, "insecure.example."), ShouldBeTrue)
+		So(denial("insecure.example.", false, []dns.RR{nsec3}), ShouldEqual, resultInsecure)
+	})
+}
@@ -0,0 +1,194 @@
+package dnsserver
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"jrubin.io/slog"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var aclDenied = prom.NewCounterVec(
+	prom.CounterOpts{
+		Namespace: "blamedns",
+		Subsystem: "dns",
+		Name:      "acl_denied_total",
+		Help:      "Number of queries denied by a listener's access control list.",
+	},
+	[]string{"listen", "action"},
+)
+
+func init() {
+	prom.MustRegister(aclDenied)
+}
+
+// An ACLAction is what is done with queries from clients that are not allowed
+type ACLAction string
+
+const (
+	// ACLRefuse answers with REFUSED
+	ACLRefuse ACLAction = "refuse"
+
+	// ACLDrop doesn't answer at all
+	ACLDrop ACLAction = "drop"
+)
+
+// ParseACLAction returns the ACLAction named by s. An empty string is
+// ACLRefuse.
+func ParseACLAction(s string) (ACLAction, error) {
+	switch ACLAction(s) {
+	case "":
+		return ACLRefuse, nil
+	case ACLRefuse, ACLDrop:
+		return ACLAction(s), nil
+	}
+
+	return "", errors.Errorf("invalid acl action: %s", s)
+}
+
+// An ACL decides which clients a listener answers. Clients in Deny are never
+// answered, otherwise clients in Allow are. An empty Allow allows every client
+// that isn't denied. A nil ACL allows everyone.
+type ACL struct {
+	Allow  []*net.IPNet
+	Deny   []*net.IPNet
+	Action ACLAction
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns whether ip may query the listener
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	if contains(a.Deny, ip) {
+		return false
+	}
+
+	return len(a.Allow) == 0 || contains(a.Allow, ip)
+}
+
+// listenerACL returns the ACL of the listener at u. The allow, deny and
+// acl-action query parameters of the listen url override those of d.ACL, e.g.
+// udp://[::]:53?allow=192.0.2.0/24,2001:db8::/32&acl-action=drop.
+func (d *DNSServer) listenerACL(u *url.URL) (*ACL, error) {
+	q := u.Query()
+
+	if len(q.Get("allow")) == 0 && len(q.Get("deny")) == 0 && len(q.Get("acl-action")) == 0 {
+		return d.ACL, nil
+	}
+
+	ret := &ACL{Action: ACLRefuse}
+	if d.ACL != nil {
+		*ret = *d.ACL
+	}
+
+	var err error
+
+	if v := q.Get("allow"); len(v) > 0 {
+		if ret.Allow, err = ParseCIDRs(strings.Split(v, ",")); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := q.Get("deny"); len(v) > 0 {
+		if ret.Deny, err = ParseCIDRs(strings.Split(v, ",")); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := q.Get("acl-action"); len(v) > 0 {
+		if ret.Action, err = ParseACLAction(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// aclHandler returns h, only for the clients allowed by acl
+func (d *DNSServer) aclHandler(listen string, acl *ACL, h dns.Handler) dns.Handler {
+	if acl == nil {
+		return h
+	}
+
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		ip := clientIP(w.RemoteAddr())
+
+		if acl.Allowed(ip) {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		action := acl.Action
+		if len(action) == 0 {
+			action = ACLRefuse
+		}
+
+		aclDenied.WithLabelValues(listen, string(action)).Inc()
+
+		d.Logger.WithFields(slog.Fields{
+			"client": ip,
+			"listen": listen,
+			"action": action,
+		}).Debug("denied query")
+
+		if action == ACLDrop {
+			return
+		}
+
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeRefused)
+
+		if err := w.WriteMsg(resp); err != nil {
+			d.Logger.WithError(err).Error("error writing response")
+		}
+	})
+}
+
+// ParseCIDRs parses networks in CIDR notation. Plain ip addresses are treated
+// as networks containing only that address.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network: %s", value)
+		}
+
+		ret = append(ret, n)
+	}
+
+	return ret, nil
+}
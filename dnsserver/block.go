@@ -18,12 +18,19 @@ type Passer interface {
 	Pass(host string) bool
 }
 
+// A SourceBlocker is a Blocker that can tell which sources block a host
+type SourceBlocker interface {
+	BlockSources(host string) []string
+}
+
 type Block struct {
 	IPv4, IPv6 net.IP
 	TTL        time.Duration
 	Blocker    Blocker
 	Passer     Passer
 	Logger     slog.Interface
+	Schedules  []*ScheduledBlock
+	Pause      *Pause
 }
 
 func unfqdn(s string) string {
@@ -42,7 +49,8 @@ func newHdr(name string, qtype uint16, ttl uint32) dns.RR_Header {
 	}
 }
 
-func (b Block) Should(req *dns.Msg) bool {
+// Should returns whether req, from client, should be blocked
+func (b Block) Should(req *dns.Msg, client net.IP) bool {
 	q := req.Question[0]
 
 	switch q.Qtype {
@@ -52,22 +60,147 @@ func (b Block) Should(req *dns.Msg) bool {
 		return false
 	}
 
+	now := time.Now()
+
+	if b.Pause.Paused(now, client) {
+		return false
+	}
+
 	host := strings.ToLower(unfqdn(q.Name))
 
 	if b.Passer.Pass(host) {
 		return false
 	}
 
+	if b.blocks(now, host, client) {
+		return true
+	}
+
+	for _, sb := range b.Schedules {
+		if sb.hasDomain(host) && sb.applies(now, client) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b Block) scheduledSources() bool {
+	for _, sb := range b.Schedules {
+		if len(sb.Sources) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// blocks returns whether any source blocks host for client at t
+func (b Block) blocks(t time.Time, host string, client net.IP) bool {
+	sb, ok := b.Blocker.(SourceBlocker)
+	if !ok || !b.scheduledSources() {
+		return b.Blocker.Block(host)
+	}
+
+	for _, source := range sb.BlockSources(host) {
+		scheduled := false
+
+		for _, s := range b.Schedules {
+			if !s.hasSource(source) {
+				continue
+			}
+
+			if s.applies(t, client) {
+				return true
+			}
+
+			scheduled = true
+		}
+
+		if !scheduled {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Blocked returns whether name is blocked for any client at any time
+func (b Block) Blocked(name string) bool {
+	host := strings.ToLower(unfqdn(name))
+
 	if b.Blocker.Block(host) {
 		return true
 	}
 
+	for _, s := range b.Schedules {
+		if s.hasDomain(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Scheduled returns whether blocking name depends on a schedule
+func (b Block) Scheduled(name string) bool {
+	if len(b.Schedules) == 0 {
+		return false
+	}
+
+	host := strings.ToLower(unfqdn(name))
+
+	for _, s := range b.Schedules {
+		if s.hasDomain(host) {
+			return true
+		}
+	}
+
+	sb, ok := b.Blocker.(SourceBlocker)
+	if !ok || !b.scheduledSources() {
+		return false
+	}
+
+	for _, source := range sb.BlockSources(host) {
+		for _, s := range b.Schedules {
+			if s.hasSource(source) {
+				return true
+			}
+		}
+	}
+
 	return false
 }
 
+// NextChange returns the first time after t at which any schedule starts or
+// ends, or the zero time if none ever do
+func (b Block) NextChange(t time.Time) time.Time {
+	var ret time.Time
+
+	for _, sb := range b.Schedules {
+		if next := sb.Schedule.Next(t); !next.IsZero() && (ret.IsZero() || next.Before(ret)) {
+			ret = next
+		}
+	}
+
+	return ret
+}
+
+// ttl returns b.TTL, but no longer than until the next schedule change so that
+// clients don't cache blocked answers past it
+func (b Block) ttl() uint32 {
+	ttl := b.TTL
+
+	now := time.Now()
+	if next := b.NextChange(now); !next.IsZero() && next.Sub(now) < ttl {
+		ttl = next.Sub(now) + time.Second
+	}
+
+	return uint32(ttl.Seconds())
+}
+
 func (b Block) NewReply(req *dns.Msg) *dns.Msg {
 	q := req.Question[0]
-	hdr := newHdr(q.Name, q.Qtype, uint32(b.TTL.Seconds()))
+	hdr := newHdr(q.Name, q.Qtype, b.ttl())
 
 	var rr dns.RR
 	switch q.Qtype {
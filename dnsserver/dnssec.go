@@ -0,0 +1,63 @@
+package dnsserver
+
+import (
+	"context"
+
+	"jrubin.io/blamedns/dnssec"
+	"jrubin.io/slog"
+
+	"github.com/miekg/dns"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var dnssecResults = prom.NewCounterVec(
+	prom.CounterOpts{
+		Namespace: "blamedns",
+		Subsystem: "dns",
+		Name:      "dnssec_results_total",
+		Help:      "Number of upstream responses validated, by result.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prom.MustRegister(dnssecResults)
+}
+
+// validating returns whether responses to req should be validated by
+// d.DNSSEC. Clients that set CD do their own validation.
+func (d *DNSServer) validating(req *dns.Msg) bool {
+	return d.DNSSEC != nil && !req.CheckingDisabled
+}
+
+// validate resp, the upstream response to req, with d.DNSSEC. Secure
+// responses have the AD bit set and bogus ones are replaced with SERVFAIL.
+// Any queries needed to follow the chain of trust are sent with exchange, to
+// the same upstream as req.
+func (d *DNSServer) validate(ctx context.Context, net string, exchange dnssec.Exchanger, req, resp *dns.Msg) *dns.Msg {
+	if resp == nil || !d.validating(req) {
+		return resp
+	}
+
+	res, err := d.DNSSEC.Validate(ctx, exchange, resp)
+	dnssecResults.WithLabelValues(res.String()).Inc()
+
+	switch res {
+	case dnssec.Secure:
+		resp.AuthenticatedData = true
+	case dnssec.Bogus:
+		d.Logger.WithFields(slog.Fields{
+			"name": req.Question[0].Name,
+			"type": dns.TypeToString[req.Question[0].Qtype],
+			"net":  net,
+		}).WithError(err).Warn("dnssec validation failed")
+
+		ret := &dns.Msg{}
+		ret.SetRcode(req, dns.RcodeServerFailure)
+		return ret
+	default:
+		resp.AuthenticatedData = false
+	}
+
+	return resp
+}
@@ -8,9 +8,13 @@ import (
 	"time"
 
 	"jrubin.io/blamedns/dnscache"
+	"jrubin.io/blamedns/dnssec"
+	"jrubin.io/blamedns/recursor"
+	"jrubin.io/blamedns/rpz"
 	"jrubin.io/slog"
 
 	"github.com/miekg/dns"
+	"github.com/pkg/errors"
 )
 
 type Overrider interface {
@@ -23,15 +27,25 @@ type DNSServer struct {
 	Block             Block
 	Override          Overrider
 	OverrideTTL       time.Duration
+	LocalHosts        LocalResolver
+	LocalHostsTTL     time.Duration
 	Logger            slog.Interface
 	ClientTimeout     time.Duration
 	ServerTimeout     time.Duration
 	DialTimeout       time.Duration
 	LookupInterval    time.Duration
+	UDPSize           uint16
+	EDNS              EDNS
 	Cache             dnscache.Cache
 	NotifyStartedFunc func() error
-	Zones             map[string][]string
+	Zones             []Zone
 	HTTP              DNSHTTP
+	Health            *Health
+	DNSSEC            *dnssec.Validator
+	Recursor          *recursor.Resolver
+	RateLimit         *RateLimit
+	ACL               *ACL
+	RPZ               *rpz.Engine
 }
 
 const DefaultPort = 53
@@ -65,10 +79,30 @@ func (d *DNSServer) parseDNSServer(val string, startCh chan<- struct{}) (*dns.Se
 		return nil, err
 	}
 
-	mux := dns.NewServeMux()
+	acl, err := d.listenerACL(u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listener %s", val)
+	}
 
-	for pattern, addr := range d.Zones {
-		addr, err := addDefaultPort(addr)
+	r := newRouter()
+	r.restricted = d.RestrictedHandler(u.Scheme)
+
+	for _, zone := range d.Zones {
+		if zone.Recursive {
+			if d.Recursor == nil {
+				return nil, errors.Errorf("zone %s is recursive, but there is no recursor", zone.Name)
+			}
+
+			r.add(zone, d.zoneHandler(u.Scheme, zone))
+
+			d.Logger.WithFields(slog.Fields{
+				"zone": zone.Name,
+				"net":  u.Scheme,
+			}).Info("added recursive zone")
+			continue
+		}
+
+		addr, err := addDefaultPort(zone.Addr)
 		if err != nil {
 			return nil, err
 		}
@@ -79,19 +113,29 @@ func (d *DNSServer) parseDNSServer(val string, startCh chan<- struct{}) (*dns.Se
 			}
 		}
 
-		mux.Handle(pattern, d.Handler(u.Scheme, addr))
+		d.registerHealth(u.Scheme, addr)
+
+		zone.Addr = addr
+		r.add(zone, d.zoneHandler(u.Scheme, zone))
+
+		clients := make([]string, len(zone.Clients))
+		for i, c := range zone.Clients {
+			clients[i] = c.String()
+		}
 
 		d.Logger.WithFields(slog.Fields{
-			"zone": pattern,
-			"addr": strings.Join(addr, ","),
-			"net":  u.Scheme,
+			"zone":     zone.Name,
+			"addr":     strings.Join(addr, ","),
+			"clients":  strings.Join(clients, ","),
+			"strategy": zone.Strategy,
+			"net":      u.Scheme,
 		}).Info("added zone")
 	}
 
 	return &dns.Server{
 		Addr:              u.Host,
 		Net:               u.Scheme,
-		Handler:           mux,
+		Handler:           d.aclHandler(u.Scheme+"://"+u.Host, acl, d.rateLimitHandler(u.Scheme, r)),
 		NotifyStartedFunc: func() { startCh <- struct{}{} },
 		ReadTimeout:       d.ServerTimeout,
 		WriteTimeout:      d.ServerTimeout,
@@ -1,12 +1,1091 @@
 package dnsserver
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"jrubin.io/blamedns/dnscache"
+	"jrubin.io/blamedns/dnssec"
+	"jrubin.io/blamedns/rpz"
+	"jrubin.io/slog"
+	"jrubin.io/slog/handlers/text"
+
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+type testHandler string
+
+func (h testHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
 func TestDNSServer(t *testing.T) {
 	Convey("dnsserver should work", t, func() {
 	})
+
+	Convey("arpaToIP should work", t, func() {
+		So(arpaToIP("5.1.168.192.in-addr.arpa.").Equal(net.ParseIP("192.168.1.5")), ShouldBeTrue)
+		So(arpaToIP("1.168.192.in-addr.arpa."), ShouldBeNil)
+		So(arpaToIP("256.1.168.192.in-addr.arpa."), ShouldBeNil)
+		So(arpaToIP("www.example.com."), ShouldBeNil)
+
+		name := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."
+		So(arpaToIP(name).Equal(net.ParseIP("fd00::1")), ShouldBeTrue)
+		So(arpaToIP("0.d.f.ip6.arpa."), ShouldBeNil)
+	})
+
+	Convey("local hosts should not be cached", t, func() {
+		local := testResolver{"nas.lan": {net.ParseIP("192.168.1.10")}}
+
+		d := &DNSServer{
+			Logger:        text.Logger(slog.ErrorLevel),
+			ClientTimeout: time.Second,
+			Cache:         dnscache.NewMemory(64, nil),
+			LocalHosts:    local,
+			LocalHostsTTL: time.Hour,
+			Block: Block{
+				Blocker: testBlocker{},
+				Passer:  testBlocker{},
+			},
+		}
+
+		h := d.handler("udp", source{
+			exchange: func(ctx context.Context, req *dns.Msg) *dns.Msg {
+				resp := &dns.Msg{}
+				resp.SetReply(req)
+				resp.Answer = []dns.RR{mustRR(req.Question[0].Name + " 300 IN A 198.51.100.1")}
+				return resp
+			},
+		})
+
+		serve := func() string {
+			req := &dns.Msg{}
+			req.SetQuestion("nas.lan.", dns.TypeA)
+
+			w := &testWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5353}}
+			h.ServeDNS(w, req)
+
+			// responses are cached in the background
+			time.Sleep(10 * time.Millisecond)
+
+			return w.msg.Answer[0].(*dns.A).A.String()
+		}
+
+		So(serve(), ShouldEqual, "192.168.1.10")
+
+		delete(local, "nas.lan")
+		So(serve(), ShouldEqual, "198.51.100.1")
+	})
+}
+
+// testResolver resolves the hosts it maps to addresses
+type testResolver map[string][]net.IP
+
+func (r testResolver) Lookup(host string) ([]net.IP, time.Duration) { return r[host], 0 }
+
+func (r testResolver) LookupAddr(ip net.IP) ([]string, time.Duration) {
+	var ret []string
+	for host, ips := range r {
+		for _, v := range ips {
+			if v.Equal(ip) {
+				ret = append(ret, host)
+			}
+		}
+	}
+	return ret, 0
+}
+
+func TestRouter(t *testing.T) {
+	Convey("router should work", t, func() {
+		r := newRouter()
+		r.restricted = testHandler("restricted")
+
+		vpn := []*net.IPNet{mustParseCIDR("10.8.0.0/24")}
+
+		r.add(Zone{Name: "corp.example.com", Clients: vpn}, testHandler("corp"))
+		r.add(Zone{Name: "example.com"}, testHandler("example"))
+		r.add(Zone{Name: ".", Clients: vpn}, testHandler("vpn"))
+		r.add(Zone{Name: "."}, testHandler("default"))
+
+		vpnClient := net.ParseIP("10.8.0.5")
+		lanClient := net.ParseIP("192.168.1.5")
+
+		So(r.handler("www.corp.example.com.", dns.TypeA, vpnClient), ShouldEqual, testHandler("corp"))
+		So(r.handler("WWW.Corp.Example.com.", dns.TypeA, vpnClient), ShouldEqual, testHandler("corp"))
+		So(r.handler("www.corp.example.com.", dns.TypeA, lanClient), ShouldEqual, testHandler("restricted"))
+		So(r.handler("www.corp.example.com.", dns.TypeA, nil), ShouldEqual, testHandler("restricted"))
+
+		So(r.handler("corp.example.com.", dns.TypeDS, lanClient), ShouldEqual, testHandler("example"))
+		So(r.handler("www.example.com.", dns.TypeA, lanClient), ShouldEqual, testHandler("example"))
+
+		So(r.handler("www.example.org.", dns.TypeA, vpnClient), ShouldEqual, testHandler("vpn"))
+		So(r.handler("www.example.org.", dns.TypeA, lanClient), ShouldEqual, testHandler("default"))
+
+		r = newRouter()
+		r.add(Zone{Name: "example.com"}, testHandler("example"))
+		So(r.handler("www.example.org.", dns.TypeA, lanClient), ShouldBeNil)
+
+		// zones restricted to some clients don't share the cache
+		d := &DNSServer{
+			Logger:        text.Logger(slog.ErrorLevel),
+			ClientTimeout: time.Second,
+			Cache:         dnscache.NewMemory(64, nil),
+			Block: Block{
+				Blocker: testBlocker{},
+				Passer:  testBlocker{},
+			},
+		}
+
+		handler := func(ip string, private bool) dns.Handler {
+			return d.handler("udp", source{
+				exchange: func(ctx context.Context, req *dns.Msg) *dns.Msg {
+					resp := &dns.Msg{}
+					resp.SetReply(req)
+					resp.Answer = []dns.RR{mustRR(req.Question[0].Name + " 300 IN A " + ip)}
+					return resp
+				},
+				private: private,
+			})
+		}
+
+		serve := func(h dns.Handler) string {
+			req := &dns.Msg{}
+			req.SetQuestion("www.corp.example.com.", dns.TypeA)
+
+			w := &testWriter{addr: &net.UDPAddr{IP: vpnClient, Port: 5353}}
+			h.ServeDNS(w, req)
+
+			// responses are cached in the background
+			time.Sleep(10 * time.Millisecond)
+
+			return w.msg.Answer[0].(*dns.A).A.String()
+		}
+
+		corp, public := handler("10.8.0.1", true), handler("192.0.2.1", false)
+		So(serve(corp), ShouldEqual, "10.8.0.1")
+		So(serve(public), ShouldEqual, "192.0.2.1")
+		So(serve(corp), ShouldEqual, "10.8.0.1")
+		So(serve(public), ShouldEqual, "192.0.2.1")
+	})
+}
+
+func TestHealth(t *testing.T) {
+	Convey("upstream health should work", t, func() {
+		var nilHealth *Health
+		addr := []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"}
+		So(nilHealth.Order("udp", addr), ShouldResemble, addr)
+
+		h := &Health{Window: 4}
+		So(h.Order("udp", addr), ShouldResemble, addr)
+
+		// failures don't count until there are enough samples
+		h.Record("udp", addr[0], 0, false)
+		h.Record("udp", addr[0], 0, false)
+		So(h.Healthy("udp", addr[0]), ShouldBeTrue)
+
+		h.Record("udp", addr[0], 0, false)
+		So(h.Healthy("udp", addr[0]), ShouldBeFalse)
+		So(h.Healthy("tcp", addr[0]), ShouldBeTrue)
+		So(h.Order("udp", addr), ShouldResemble, []string{addr[1], addr[2], addr[0]})
+
+		// successes age out failures from the window
+		h.Record("udp", addr[0], 10*time.Millisecond, true)
+		So(h.Healthy("udp", addr[0]), ShouldBeFalse)
+		h.Record("udp", addr[0], 20*time.Millisecond, true)
+		So(h.Healthy("udp", addr[0]), ShouldBeTrue)
+		So(h.Order("udp", addr), ShouldResemble, addr)
+
+		status := h.Status()
+		So(len(status), ShouldEqual, 1)
+		So(status[0].Net, ShouldEqual, "udp")
+		So(status[0].Addr, ShouldEqual, addr[0])
+		So(status[0].Samples, ShouldEqual, 4)
+		So(status[0].SuccessRate, ShouldEqual, 0.5)
+		So(status[0].Latency, ShouldEqual, 13*time.Millisecond)
+	})
+}
+
+func TestStrategy(t *testing.T) {
+	Convey("upstream strategies should work", t, func() {
+		addr := []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"}
+
+		s, err := ParseStrategy("")
+		So(err, ShouldBeNil)
+		So(s, ShouldEqual, StrategyOrdered)
+
+		_, err = ParseStrategy("fastest")
+		So(err, ShouldNotBeNil)
+
+		So(newSelector(StrategyOrdered).order(nil, "udp", addr), ShouldResemble, addr)
+
+		rr := newSelector(StrategyRoundRobin)
+		So(rr.order(nil, "udp", addr), ShouldResemble, addr)
+		So(rr.order(nil, "udp", addr), ShouldResemble, []string{addr[1], addr[2], addr[0]})
+		So(rr.order(nil, "udp", addr), ShouldResemble, []string{addr[2], addr[0], addr[1]})
+		So(rr.order(nil, "udp", addr), ShouldResemble, addr)
+
+		So(len(newSelector(StrategyRandom).order(nil, "udp", addr)), ShouldEqual, len(addr))
+
+		h := &Health{}
+		h.Record("udp", addr[0], 30*time.Millisecond, true)
+		h.Record("udp", addr[1], 10*time.Millisecond, true)
+		h.Record("tcp", addr[2], 5*time.Millisecond, true)
+		h.Record("udp", addr[2], 20*time.Millisecond, true)
+		So(newSelector(StrategyLowestLatency).order(h, "udp", addr), ShouldResemble, []string{addr[1], addr[2], addr[0]})
+		So(newSelector(StrategyLowestLatency).order(h, "tcp", addr), ShouldResemble, []string{addr[0], addr[1], addr[2]})
+
+		So(newSelector(StrategyParallel).interval(time.Second), ShouldEqual, 0)
+		So(newSelector(StrategyOrdered).interval(time.Second), ShouldEqual, time.Second)
+
+		Convey("parallel lookups should return the first response", func() {
+			resp := raceLookups(context.Background(), addr, 0, func(nameserver string, respCh chan<- *dns.Msg) {
+				if nameserver != addr[2] {
+					time.Sleep(time.Second)
+					respCh <- nil
+					return
+				}
+				respCh <- &dns.Msg{Compress: true}
+			})
+			So(resp, ShouldNotBeNil)
+		})
+	})
+}
+
+func txtRR(name string, n int) dns.RR {
+	rr, err := dns.NewRR(fmt.Sprintf("%s 300 IN TXT \"%s\"", name, strings.Repeat("x", n)))
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// startUpstream starts a fake nameserver that answers with 10 large TXT
+// records over tcp but only ever sends truncated responses over udp
+func startUpstream() (string, func(), error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		return "", nil, err
+	}
+
+	handler := func(truncated bool) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+
+			if truncated {
+				resp.Truncated = true
+			} else {
+				for i := 0; i < 10; i++ {
+					resp.Answer = append(resp.Answer, txtRR(req.Question[0].Name, 200))
+				}
+			}
+
+			_ = w.WriteMsg(resp)
+		})
+	}
+
+	udp := &dns.Server{PacketConn: pc, Handler: handler(true)}
+	tcp := &dns.Server{Listener: l, Handler: handler(false)}
+
+	go func() { _ = udp.ActivateAndServe() }()
+	go func() { _ = tcp.ActivateAndServe() }()
+
+	return pc.LocalAddr().String(), func() {
+		_ = udp.Shutdown()
+		_ = tcp.Shutdown()
+	}, nil
+}
+
+func TestEDNS(t *testing.T) {
+	Convey("edns0 and truncation should work", t, func() {
+		d := &DNSServer{UDPSize: 4096}
+
+		req := &dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeTXT)
+
+		ureq := d.upstreamRequest("udp", "10.0.0.1:53", req)
+		So(req.IsEdns0(), ShouldBeNil)
+		So(ureq.IsEdns0().UDPSize(), ShouldEqual, 4096)
+		So(ureq.IsEdns0().Do(), ShouldBeFalse)
+		So(findOption(ureq.IsEdns0(), dns.EDNS0SUBNET), ShouldBeNil)
+
+		cookie, ok := findOption(ureq.IsEdns0(), dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+		So(ok, ShouldBeTrue)
+		So(cookie.Cookie, ShouldEqual, d.EDNS.clientCookie("10.0.0.1:53"))
+
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		for i := 0; i < 10; i++ {
+			resp.Answer = append(resp.Answer, txtRR("example.com.", 200))
+		}
+		resp.Extra = append(resp.Extra, txtRR("extra.example.com.", 10))
+		resp.SetEdns0(4096, false)
+
+		// tcp responses are never truncated, but the OPT is removed
+		sized := d.clientResponse("tcp", nil, req, resp)
+		So(sized.Truncated, ShouldBeFalse)
+		So(len(sized.Answer), ShouldEqual, 10)
+		So(sized.IsEdns0(), ShouldBeNil)
+		So(resp.IsEdns0(), ShouldNotBeNil)
+
+		// clients without edns0 get at most 512 bytes
+		sized = d.clientResponse("udp", nil, req, resp)
+		So(sized.Truncated, ShouldBeTrue)
+		So(sized.Len(), ShouldBeLessThanOrEqualTo, dns.MinMsgSize)
+		So(len(sized.Answer), ShouldEqual, 2)
+		So(len(sized.Extra), ShouldEqual, 0)
+		So(len(resp.Answer), ShouldEqual, 10)
+
+		// clients advertising a large enough buffer get everything
+		req.SetEdns0(4096, false)
+		sized = d.clientResponse("udp", nil, req, resp)
+		So(sized.Truncated, ShouldBeFalse)
+		So(len(sized.Answer), ShouldEqual, 10)
+		So(len(sized.Extra), ShouldEqual, 2)
+
+		Convey("the ad bit should only be passed on when validated", func() {
+			req := &dns.Msg{}
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.AuthenticatedData = true
+
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+			resp.AuthenticatedData = true
+
+			// upstreams can't be trusted when we don't validate
+			So(d.clientResponse("udp", nil, req, resp).AuthenticatedData, ShouldBeFalse)
+
+			anchors, err := dnssec.ParseAnchors(dnssec.RootAnchors)
+			So(err, ShouldBeNil)
+			d.DNSSEC = &dnssec.Validator{Anchors: anchors}
+
+			So(d.clientResponse("udp", nil, req, resp).AuthenticatedData, ShouldBeTrue)
+
+			req.AuthenticatedData = false
+			So(d.clientResponse("udp", nil, req, resp).AuthenticatedData, ShouldBeFalse)
+
+			req.SetEdns0(1232, true)
+			So(d.clientResponse("udp", nil, req, resp).AuthenticatedData, ShouldBeTrue)
+
+			// clients that disable checking don't get answers validated
+			req.CheckingDisabled = true
+			So(d.clientResponse("udp", nil, req, resp).AuthenticatedData, ShouldBeFalse)
+		})
+
+		Convey("edns0 options should be handled", func() {
+			d.EDNS.ECS = ECSPass
+
+			req := &dns.Msg{}
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.SetEdns0(1232, true)
+
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP("192.0.2.0").To4(),
+			}, &dns.EDNS0_COOKIE{
+				Code:   dns.EDNS0COOKIE,
+				Cookie: "0102030405060708",
+			})
+
+			ureq := d.upstreamRequest("udp", "10.0.0.1:53", req)
+			So(ureq.IsEdns0().Do(), ShouldBeTrue)
+			So(findOption(ureq.IsEdns0(), dns.EDNS0SUBNET), ShouldNotBeNil)
+			So(d.EDNS.httpsECS(req), ShouldEqual, "192.0.2.0/24")
+
+			d.EDNS.ECS = ECSStrip
+			So(findOption(d.upstreamRequest("udp", "10.0.0.1:53", req).IsEdns0(), dns.EDNS0SUBNET), ShouldBeNil)
+			So(d.EDNS.httpsECS(req), ShouldEqual, "0.0.0.0/0")
+
+			d.EDNS.ECS = ECSReplace
+			d.EDNS.ECSSubnet = mustParseCIDR("198.51.100.0/24")
+			So(d.EDNS.httpsECS(req), ShouldEqual, "198.51.100.0/24")
+
+			// answers tailored to the subnet aren't cached
+			So(d.EDNS.httpsScope(req, "198.51.100.0/0"), ShouldBeNil)
+			scoped := &dns.Msg{}
+			scoped.SetReply(req)
+			So(ecsScoped(scoped), ShouldBeFalse)
+			scoped.SetEdns0(1232, false)
+			So(ecsScoped(scoped), ShouldBeFalse)
+			scope := d.EDNS.httpsScope(req, "198.51.100.0/20")
+			So(scope.SourceNetmask, ShouldEqual, 24)
+			So(scope.SourceScope, ShouldEqual, 20)
+			scoped.IsEdns0().Option = append(scoped.IsEdns0().Option, scope)
+			So(ecsScoped(scoped), ShouldBeTrue)
+
+			// upstream server cookies are remembered
+			uresp := &dns.Msg{}
+			uresp.SetReply(ureq)
+			uresp.SetEdns0(1232, false)
+			uresp.IsEdns0().Option = append(uresp.IsEdns0().Option, &dns.EDNS0_COOKIE{
+				Code:   dns.EDNS0COOKIE,
+				Cookie: d.EDNS.clientCookie("10.0.0.1:53") + "1112131415161718",
+			})
+			d.EDNS.setServerCookie("10.0.0.1:53", uresp)
+			So(d.EDNS.upstreamCookie("10.0.0.1:53").Cookie, ShouldEndWith, "1112131415161718")
+
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("192.0.2.1"),
+			}, &dns.RRSIG{
+				Hdr:         dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+				TypeCovered: dns.TypeA,
+				SignerName:  "example.com.",
+				Signature:   "AAAA",
+			})
+
+			addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 5353}
+
+			cresp := d.clientResponse("udp", addr, req, resp)
+			copt := cresp.IsEdns0()
+			So(copt, ShouldNotBeNil)
+			So(copt.Do(), ShouldBeTrue)
+			So(len(cresp.Answer), ShouldEqual, 2)
+
+			s, ok := findOption(copt, dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET)
+			So(ok, ShouldBeTrue)
+			So(s.SourceScope, ShouldEqual, 0)
+
+			c, ok := findOption(copt, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+			So(ok, ShouldBeTrue)
+			So(c.Cookie, ShouldEqual, "0102030405060708"+d.EDNS.serverCookie("0102030405060708", addr.IP))
+
+			// dnssec records are only returned to clients that set DO
+			opt.Hdr.Ttl = 0
+			So(len(d.clientResponse("udp", addr, req, resp).Answer), ShouldEqual, 1)
+
+			opt.Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102"}}
+			So(checkEDNS(req).Rcode, ShouldEqual, dns.RcodeFormatError)
+
+			opt.Option = nil
+			So(checkEDNS(req), ShouldBeNil)
+
+			opt.Hdr.Ttl = 1 << 16
+			bad := checkEDNS(req)
+			So(bad.Rcode, ShouldEqual, dns.RcodeBadVers)
+
+			data, err := d.clientResponse("udp", addr, req, bad).Pack()
+			So(err, ShouldBeNil)
+
+			unpacked := &dns.Msg{}
+			So(unpacked.Unpack(data), ShouldBeNil)
+			So(unpacked.IsEdns0().ExtendedRcode(), ShouldEqual, dns.RcodeBadVers)
+		})
+
+		Convey("padding should fill a block", func() {
+			m := &dns.Msg{}
+			m.SetQuestion("example.com.", dns.TypeA)
+			m.SetEdns0(1232, false)
+			pad(m, queryPaddingBlock)
+
+			data, err := m.Pack()
+			So(err, ShouldBeNil)
+			So(len(data)%queryPaddingBlock, ShouldEqual, 0)
+		})
+
+		Convey("truncated upstream responses should be retried over tcp", func() {
+			addr, stop, err := startUpstream()
+			So(err, ShouldBeNil)
+			defer stop()
+
+			d := &DNSServer{
+				UDPSize:       4096,
+				Logger:        text.Logger(slog.ErrorLevel),
+				DialTimeout:   time.Second,
+				ClientTimeout: time.Second,
+				Health:        &Health{},
+			}
+
+			respCh := make(chan *dns.Msg, 1)
+			d.lookup("udp", addr, req, respCh)
+
+			resp := <-respCh
+			So(resp, ShouldNotBeNil)
+			So(resp.Truncated, ShouldBeFalse)
+			So(len(resp.Answer), ShouldEqual, 10)
+
+			// each attempt is recorded under its own net
+			status := d.Health.Status()
+			So(len(status), ShouldEqual, 2)
+			So(status[0].Net, ShouldEqual, "tcp")
+			So(status[0].Samples, ShouldEqual, 1)
+			So(status[1].Net, ShouldEqual, "udp")
+			So(status[1].Samples, ShouldEqual, 1)
+		})
+
+		Convey("unsigned responses from the signed root should be bogus", func() {
+			addr, stop, err := startUpstream()
+			So(err, ShouldBeNil)
+			defer stop()
+
+			anchors, err := dnssec.ParseAnchors(dnssec.RootAnchors)
+			So(err, ShouldBeNil)
+
+			d := &DNSServer{
+				Logger:        text.Logger(slog.ErrorLevel),
+				DialTimeout:   time.Second,
+				ClientTimeout: time.Second,
+				DNSSEC:        &dnssec.Validator{Anchors: anchors},
+			}
+
+			ureq := d.upstreamRequest("udp", addr, req)
+			So(ureq.IsEdns0().Do(), ShouldBeTrue)
+			So(ureq.CheckingDisabled, ShouldBeTrue)
+			So(req.CheckingDisabled, ShouldBeFalse)
+
+			sel := newSelector(StrategyOrdered)
+			resp := d.fastLookup(context.Background(), "udp", []string{addr}, sel, req)
+			So(resp, ShouldNotBeNil)
+			So(d.clientResponse("tcp", nil, req, resp).CheckingDisabled, ShouldBeFalse)
+
+			exchange := func(ctx context.Context, q *dns.Msg) *dns.Msg {
+				return d.fastLookup(ctx, "udp", []string{addr}, sel, q)
+			}
+
+			vresp := d.validate(context.Background(), "udp", exchange, req, resp)
+			So(vresp.Rcode, ShouldEqual, dns.RcodeServerFailure)
+
+			// unless the client disabled checking
+			req.CheckingDisabled = true
+			vresp = d.validate(context.Background(), "udp", exchange, req, resp)
+			So(vresp, ShouldEqual, resp)
+		})
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	Convey("rate limiting should work", t, func() {
+		l := &RateLimit{
+			QPS:         1,
+			Burst:       2,
+			GlobalQPS:   10,
+			IPv4Prefix:  24,
+			Exempt:      []*net.IPNet{mustParseCIDR("192.0.2.53/32")},
+			ResponseQPS: 1,
+			Slip:        2,
+		}
+
+		now := time.Now()
+		a, b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+
+		So(l.allowQuery(now, a), ShouldEqual, "")
+		So(l.allowQuery(now, a), ShouldEqual, "")
+
+		// clients in the same prefix share a bucket
+		So(l.allowQuery(now, b), ShouldEqual, "client")
+		So(l.allowQuery(now, net.ParseIP("198.51.100.1")), ShouldEqual, "")
+
+		// tokens are refilled at qps
+		So(l.allowQuery(now.Add(time.Second), a), ShouldEqual, "")
+		So(l.allowQuery(now.Add(time.Second), a), ShouldEqual, "client")
+
+		// 9 global tokens are left
+		for i := 0; i < 9; i++ {
+			So(l.allowQuery(now.Add(time.Second), net.IPv4(10, 0, byte(i), 1)), ShouldEqual, "")
+		}
+		So(l.allowQuery(now.Add(time.Second), net.ParseIP("203.0.113.1")), ShouldEqual, "global")
+
+		// but the client keeps its tokens for when the global ones refill
+		later := now.Add(1200 * time.Millisecond)
+		So(l.allowQuery(later, net.ParseIP("203.0.113.1")), ShouldEqual, "")
+		So(l.allowQuery(later, net.ParseIP("203.0.113.1")), ShouldEqual, "")
+
+		// exempt clients are never limited
+		for i := 0; i < 20; i++ {
+			So(l.allowQuery(now, net.ParseIP("192.0.2.53")), ShouldEqual, "")
+		}
+
+		var nl *RateLimit
+		So(nl.allowQuery(now, a), ShouldEqual, "")
+
+		resp := &dns.Msg{}
+		resp.SetQuestion("example.com.", dns.TypeA)
+
+		So(l.allowResponse(now, "udp", a, resp), ShouldEqual, "")
+		So(l.allowResponse(now, "udp", a, resp), ShouldEqual, RateLimitDrop)
+		So(l.allowResponse(now, "udp", a, resp), ShouldEqual, RateLimitTruncate)
+
+		// different responses and tcp aren't limited
+		resp.SetQuestion("www.example.com.", dns.TypeA)
+		So(l.allowResponse(now, "udp", a, resp), ShouldEqual, "")
+		So(l.allowResponse(now, "tcp", a, resp), ShouldEqual, "")
+
+		_, err := ParseRateLimitMode("bogus")
+		So(err, ShouldNotBeNil)
+
+		mode, err := ParseRateLimitMode("")
+		So(err, ShouldBeNil)
+		So(mode, ShouldEqual, RateLimitRefuse)
+
+		// buckets are capped and pruned once they refill
+		bs := newBuckets(1, 1)
+		for i := 0; i < maxRateLimitBuckets+10; i++ {
+			bs.take(now, strconv.Itoa(i))
+		}
+		So(bs.data.Len(), ShouldEqual, maxRateLimitBuckets)
+		So(bs.data.Contains("0"), ShouldBeFalse)
+
+		So(bs.take(now.Add(time.Second), "10"), ShouldBeTrue)
+		So(bs.data.Len(), ShouldEqual, maxRateLimitBuckets)
+
+		So(bs.take(now.Add(rateLimitPruneInterval), "new"), ShouldBeTrue)
+		So(bs.data.Len(), ShouldEqual, 1)
+	})
+}
+
+type testWriter struct {
+	addr net.Addr
+	msg  *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr         { return nil }
+func (w *testWriter) RemoteAddr() net.Addr        { return w.addr }
+func (w *testWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+func TestACL(t *testing.T) {
+	Convey("access control lists should work", t, func() {
+		allow, err := ParseCIDRs([]string{"192.168.0.0/16", "::1"})
+		So(err, ShouldBeNil)
+
+		deny, err := ParseCIDRs([]string{"192.168.1.1"})
+		So(err, ShouldBeNil)
+
+		_, err = ParseCIDRs([]string{"192.168.0.0/33"})
+		So(err, ShouldNotBeNil)
+
+		d := &DNSServer{
+			Logger: text.Logger(slog.ErrorLevel),
+			ACL:    &ACL{Allow: allow, Deny: deny, Action: ACLRefuse},
+		}
+
+		So(d.ACL.Allowed(net.ParseIP("192.168.2.1")), ShouldBeTrue)
+		So(d.ACL.Allowed(net.ParseIP("::ffff:192.168.2.1")), ShouldBeTrue)
+		So(d.ACL.Allowed(net.ParseIP("::1")), ShouldBeTrue)
+		So(d.ACL.Allowed(net.ParseIP("192.168.1.1")), ShouldBeFalse)
+		So(d.ACL.Allowed(net.ParseIP("203.0.113.1")), ShouldBeFalse)
+		So(d.ACL.Allowed(nil), ShouldBeFalse)
+
+		var nacl *ACL
+		So(nacl.Allowed(net.ParseIP("203.0.113.1")), ShouldBeTrue)
+
+		// listen urls can override the defaults
+		u, _ := url.Parse("udp://[::]:53")
+		acl, err := d.listenerACL(u)
+		So(err, ShouldBeNil)
+		So(acl, ShouldEqual, d.ACL)
+
+		u, _ = url.Parse("udp://[::]:53?allow=203.0.113.0/24&acl-action=drop")
+		acl, err = d.listenerACL(u)
+		So(err, ShouldBeNil)
+		So(acl.Allowed(net.ParseIP("203.0.113.1")), ShouldBeTrue)
+		So(acl.Allowed(net.ParseIP("192.168.2.1")), ShouldBeFalse)
+		So(acl.Action, ShouldEqual, ACLDrop)
+		So(len(d.ACL.Allow), ShouldEqual, 2)
+
+		u, _ = url.Parse("udp://[::]:53?acl-action=bogus")
+		_, err = d.listenerACL(u)
+		So(err, ShouldNotBeNil)
+
+		var served bool
+		h := d.aclHandler("udp://[::]:53", d.ACL, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			served = true
+		}))
+
+		req := &dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		w := &testWriter{addr: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 5353}}
+		h.ServeDNS(w, req)
+		So(served, ShouldBeFalse)
+		So(w.msg.Rcode, ShouldEqual, dns.RcodeRefused)
+
+		w = &testWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.168.2.1"), Port: 5353}}
+		h.ServeDNS(w, req)
+		So(served, ShouldBeTrue)
+		So(w.msg, ShouldBeNil)
+
+		// dropped queries aren't answered at all
+		h = d.aclHandler("udp://[::]:53", acl, h)
+		w = &testWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+		h.ServeDNS(w, req)
+		So(w.msg, ShouldBeNil)
+	})
+}
+
+// testBlocker blocks the hosts set to true and passes none
+type testBlocker map[string]bool
+
+func (b testBlocker) Block(host string) bool { return b[host] }
+func (b testBlocker) Pass(host string) bool  { return false }
+
+func TestRPZ(t *testing.T) {
+	Convey("response policy zones should be applied", t, func() {
+		z := &rpz.Zone{Name: "rpz.example."}
+		err := z.Load([]dns.RR{
+			mustRR("bad.example.com.rpz.example. 300 IN CNAME ."),
+			mustRR("drop.example.com.rpz.example. 300 IN CNAME rpz-drop."),
+			mustRR("tcp.example.com.rpz.example. 300 IN CNAME rpz-tcp-only."),
+			mustRR("alias.example.com.rpz.example. 300 IN CNAME www.example.com."),
+			mustRR("new.example.com.rpz.example. 300 IN CNAME fresh.example.com."),
+			mustRR("evil.example.com.rpz.example. 300 IN CNAME blocked.example.com."),
+			mustRR("twice.example.com.rpz.example. 300 IN CNAME alias.example.com."),
+			mustRR("loop1.example.com.rpz.example. 300 IN CNAME loop2.example.com."),
+			mustRR("loop2.example.com.rpz.example. 300 IN CNAME loop1.example.com."),
+			mustRR("ok.example.com.rpz.example. 300 IN CNAME rpz-passthru."),
+			mustRR("24.0.2.0.192.rpz-ip.rpz.example. 300 IN CNAME *."),
+		})
+		So(err, ShouldBeNil)
+
+		d := &DNSServer{
+			Logger:        text.Logger(slog.ErrorLevel),
+			ClientTimeout: time.Second,
+			Cache:         dnscache.NewMemory(64, nil),
+			RPZ:           &rpz.Engine{Zones: []*rpz.Zone{z}},
+		}
+
+		blocker := testBlocker{"ok.example.com": true, "blocked.example.com": true}
+		d.Block = Block{
+			IPv4:    net.ParseIP("127.0.0.1"),
+			Blocker: blocker,
+			Passer:  blocker,
+		}
+
+		var queries []string
+		h := d.handler("udp", source{
+			exchange: func(ctx context.Context, req *dns.Msg) *dns.Msg {
+				queries = append(queries, req.Question[0].Name)
+
+				resp := &dns.Msg{}
+				resp.SetReply(req)
+
+				ip := "198.51.100.1"
+				if req.Question[0].Name == "other.example.com." {
+					ip = "192.0.2.1"
+				}
+				resp.Answer = []dns.RR{mustRR(req.Question[0].Name + " 300 IN A " + ip)}
+				return resp
+			},
+		})
+
+		serve := func(name string) *dns.Msg {
+			req := &dns.Msg{}
+			req.SetQuestion(name, dns.TypeA)
+
+			w := &testWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5353}}
+			h.ServeDNS(w, req)
+
+			// responses are cached in the background
+			time.Sleep(10 * time.Millisecond)
+
+			return w.msg
+		}
+
+		resp := serve("www.example.com.")
+		So(resp.Rcode, ShouldEqual, dns.RcodeSuccess)
+		So(len(resp.Answer), ShouldEqual, 1)
+
+		resp = serve("bad.example.com.")
+		So(resp.Rcode, ShouldEqual, dns.RcodeNameError)
+
+		// passthru exempts queries from blocking
+		So(serve("blocked.example.com.").Answer[0].(*dns.A).A.String(), ShouldEqual, "127.0.0.1")
+		So(serve("ok.example.com.").Answer[0].(*dns.A).A.String(), ShouldEqual, "198.51.100.1")
+
+		So(serve("drop.example.com."), ShouldBeNil)
+		So(serve("tcp.example.com.").Truncated, ShouldBeTrue)
+
+		// local data cnames are followed like any other request, through the
+		// cache
+		queries = nil
+		resp = serve("new.example.com.")
+		So(len(resp.Answer), ShouldEqual, 2)
+		So(queries, ShouldResemble, []string{"fresh.example.com."})
+
+		resp = serve("alias.example.com.")
+		So(len(resp.Answer), ShouldEqual, 2)
+		So(resp.Answer[1].(*dns.A).A.String(), ShouldEqual, "198.51.100.1")
+		So(queries, ShouldResemble, []string{"fresh.example.com."})
+
+		// blocking
+		resp = serve("evil.example.com.")
+		So(len(resp.Answer), ShouldEqual, 2)
+		So(resp.Answer[1].(*dns.A).A.String(), ShouldEqual, "127.0.0.1")
+		So(queries, ShouldResemble, []string{"fresh.example.com."})
+
+		// and other policies
+		resp = serve("twice.example.com.")
+		So(len(resp.Answer), ShouldEqual, 3)
+		So(resp.Answer[2].(*dns.A).A.String(), ShouldEqual, "198.51.100.1")
+
+		resp = serve("loop1.example.com.")
+		So(len(resp.Answer), ShouldEqual, maxChase+1)
+		So(queries, ShouldResemble, []string{"fresh.example.com."})
+
+		// responses are checked too
+		resp = serve("other.example.com.")
+		So(resp.Rcode, ShouldEqual, dns.RcodeSuccess)
+		So(resp.Answer, ShouldBeEmpty)
+	})
+}
+
+// testSourceBlocker blocks hosts for the sources they map to
+type testSourceBlocker map[string][]string
+
+func (b testSourceBlocker) Block(host string) bool            { return len(b[host]) > 0 }
+func (b testSourceBlocker) BlockSources(host string) []string { return b[host] }
+func (b testSourceBlocker) Pass(host string) bool             { return false }
+
+func TestSchedule(t *testing.T) {
+	Convey("schedules should work", t, func() {
+		_, err := ParseSchedule([]string{"someday"}, "", "", "")
+		So(err, ShouldNotBeNil)
+
+		_, err = ParseSchedule(nil, "25:00", "", "")
+		So(err, ShouldNotBeNil)
+
+		_, err = ParseSchedule(nil, "", "", "Nowhere/Special")
+		So(err, ShouldNotBeNil)
+
+		s, err := ParseSchedule([]string{"weekdays"}, "21:00", "07:00", "America/New_York")
+		So(err, ShouldBeNil)
+		So(len(s.Days), ShouldEqual, 5)
+
+		at := func(value string) time.Time {
+			t, err := time.ParseInLocation("2006-01-02 15:04", value, s.Location)
+			if err != nil {
+				panic(err)
+			}
+			return t
+		}
+
+		// 2017-01-02 is a monday
+		So(s.Active(at("2017-01-02 20:59")), ShouldBeFalse)
+		So(s.Active(at("2017-01-02 21:00")), ShouldBeTrue)
+		So(s.Active(at("2017-01-03 06:59")), ShouldBeTrue)
+		So(s.Active(at("2017-01-03 07:00")), ShouldBeFalse)
+		So(s.Active(at("2017-01-02 03:00")), ShouldBeFalse) // sunday night
+		So(s.Active(at("2017-01-07 03:00")), ShouldBeTrue)  // friday night
+		So(s.Active(at("2017-01-07 21:00")), ShouldBeFalse) // saturday
+		So(s.Active(at("2017-01-03 02:00").UTC()), ShouldBeTrue)
+
+		So(s.Next(at("2017-01-02 12:00")).Equal(at("2017-01-02 21:00")), ShouldBeTrue)
+		So(s.Next(at("2017-01-02 21:00")).Equal(at("2017-01-03 07:00")), ShouldBeTrue)
+		So(s.Next(at("2017-01-06 08:00")).Equal(at("2017-01-06 21:00")), ShouldBeTrue)
+		So(s.Next(at("2017-01-07 07:00")).Equal(at("2017-01-09 21:00")), ShouldBeTrue)
+
+		all, err := ParseSchedule([]string{"sat", "Sunday"}, "", "", "")
+		So(err, ShouldBeNil)
+		So(all.Active(time.Date(2017, 1, 7, 12, 0, 0, 0, time.UTC)), ShouldBeTrue)
+		So(all.Active(time.Date(2017, 1, 9, 12, 0, 0, 0, time.UTC)), ShouldBeFalse)
+		So(all.Next(time.Date(2017, 1, 7, 12, 0, 0, 0, time.UTC)), ShouldResemble, time.Date(2017, 1, 9, 0, 0, 0, 0, time.UTC))
+
+		always := &Schedule{}
+		So(always.Active(time.Now()), ShouldBeTrue)
+		So(always.Next(time.Now()).IsZero(), ShouldBeTrue)
+
+		// blocking on a schedule
+		blocker := testSourceBlocker{
+			"ads.example.com":    {"ads"},
+			"games.example.com":  {"games"},
+			"shared.example.com": {"ads", "games"},
+		}
+
+		kids := mustParseCIDR("192.168.1.64/27")
+		on := &Schedule{}
+		off := &Schedule{Days: []time.Weekday{(time.Now().UTC().Weekday() + 3) % 7}}
+
+		b := Block{
+			IPv4:    net.ParseIP("127.0.0.1"),
+			TTL:     time.Hour,
+			Blocker: blocker,
+			Passer:  blocker,
+			Schedules: []*ScheduledBlock{{
+				Schedule: on,
+				Clients:  []*net.IPNet{kids},
+				Domains:  []string{"youtube.com"},
+				Sources:  []string{"games"},
+			}},
+		}
+
+		should := func(name, client string) bool {
+			req := &dns.Msg{}
+			req.SetQuestion(name, dns.TypeA)
+			return b.Should(req, net.ParseIP(client))
+		}
+
+		So(should("ads.example.com.", "192.168.1.2"), ShouldBeTrue)
+		So(should("shared.example.com.", "192.168.1.2"), ShouldBeTrue)
+		So(should("games.example.com.", "192.168.1.2"), ShouldBeFalse)
+		So(should("games.example.com.", "192.168.1.65"), ShouldBeTrue)
+		So(should("www.youtube.com.", "192.168.1.65"), ShouldBeTrue)
+		So(should("youtube.com.", "192.168.1.2"), ShouldBeFalse)
+
+		So(b.Scheduled("WWW.youtube.com."), ShouldBeTrue)
+		So(b.Scheduled("games.example.com."), ShouldBeTrue)
+		So(b.Scheduled("shared.example.com."), ShouldBeTrue)
+		So(b.Scheduled("ads.example.com."), ShouldBeFalse)
+
+		// sources that are directories contain the files in them
+		So(b.Schedules[0].hasSource("games/consoles.txt"), ShouldBeTrue)
+		So(b.Schedules[0].hasSource("gamesmore"), ShouldBeFalse)
+
+		// outside the schedule
+		b.Schedules[0].Schedule = off
+		So(should("games.example.com.", "192.168.1.65"), ShouldBeFalse)
+		So(should("www.youtube.com.", "192.168.1.65"), ShouldBeFalse)
+		So(should("shared.example.com.", "192.168.1.65"), ShouldBeTrue)
+
+		// blocked answers don't outlive the schedule
+		b.Schedules[0].Schedule = &Schedule{Start: 0, End: 24*time.Hour - time.Minute}
+		req := &dns.Msg{}
+		req.SetQuestion("ads.example.com.", dns.TypeA)
+		So(b.NewReply(req).Answer[0].Header().Ttl, ShouldBeLessThanOrEqualTo, 3600)
+		So(b.NewReply(req).Answer[0].Header().Ttl, ShouldBeGreaterThan, 0)
+
+		// answers blocked for some clients aren't cached for the others
+		b.Schedules[0].Schedule = on
+		d := &DNSServer{
+			Logger:        text.Logger(slog.ErrorLevel),
+			ClientTimeout: time.Second,
+			Block:         b,
+			Cache:         dnscache.NewMemory(64, nil),
+		}
+
+		h := d.handler("udp", source{
+			exchange: func(ctx context.Context, req *dns.Msg) *dns.Msg {
+				resp := &dns.Msg{}
+				resp.SetReply(req)
+				resp.Answer = []dns.RR{mustRR(req.Question[0].Name + " 300 IN A 192.0.2.1")}
+				return resp
+			},
+		})
+
+		serve := func(name, client string) string {
+			req := &dns.Msg{}
+			req.SetQuestion(name, dns.TypeA)
+
+			w := &testWriter{addr: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+			h.ServeDNS(w, req)
+
+			// responses are cached in the background
+			time.Sleep(10 * time.Millisecond)
+
+			return w.msg.Answer[0].(*dns.A).A.String()
+		}
+
+		So(serve("games.example.com.", "192.168.1.65"), ShouldEqual, "127.0.0.1")
+		So(serve("games.example.com.", "192.168.1.2"), ShouldEqual, "192.0.2.1")
+		So(serve("www.youtube.com.", "192.168.1.65"), ShouldEqual, "127.0.0.1")
+		So(serve("www.youtube.com.", "192.168.1.2"), ShouldEqual, "192.0.2.1")
+	})
+}
+
+func pausedUntilValue(client string) float64 {
+	var m dto.Metric
+	if err := pausedUntil.WithLabelValues(client).Write(&m); err != nil {
+		panic(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestPause(t *testing.T) {
+	Convey("pausing blocking should work", t, func() {
+		var np *Pause
+		So(np.Paused(time.Now(), nil), ShouldBeFalse)
+		So(np.PausedClient(time.Now(), nil), ShouldBeFalse)
+
+		all, clients := np.Status(time.Now())
+		So(all, ShouldBeNil)
+		So(clients, ShouldBeNil)
+
+		p := &Pause{}
+		a, b := net.ParseIP("192.168.1.2"), net.ParseIP("192.168.1.3")
+
+		// a single client
+		until := p.Pause(a, time.Minute)
+		now := time.Now()
+		So(p.Paused(now, a), ShouldBeTrue)
+		So(p.PausedClient(now, a), ShouldBeTrue)
+		So(p.Paused(now, b), ShouldBeFalse)
+		So(p.Paused(now, nil), ShouldBeFalse)
+		So(pausedUntilValue(a.String()), ShouldEqual, float64(until.Unix()))
+
+		all, clients = p.Status(now)
+		So(all, ShouldBeNil)
+		So(len(clients), ShouldEqual, 1)
+		So(clients[a.String()].Until, ShouldResemble, until)
+		So(clients[a.String()].Remaining, ShouldBeBetweenOrEqual, 59, 60)
+
+		// pauses end on their own
+		So(p.Paused(until, a), ShouldBeFalse)
+		_, clients = p.Status(until)
+		So(clients, ShouldBeEmpty)
+
+		p.Pause(a, time.Minute)
+		p.Resume(a)
+		So(p.Paused(time.Now(), a), ShouldBeFalse)
+
+		// everyone
+		p.Pause(b, time.Minute)
+		until = p.Pause(nil, time.Hour)
+		now = time.Now()
+		So(p.Paused(now, a), ShouldBeTrue)
+		So(p.Paused(now, nil), ShouldBeTrue)
+		So(p.PausedClient(now, b), ShouldBeFalse)
+		So(pausedUntilValue("all"), ShouldEqual, float64(until.Unix()))
+
+		all, clients = p.Status(now)
+		So(all, ShouldNotBeNil)
+		So(all.Until, ShouldResemble, until)
+		So(len(clients), ShouldEqual, 1)
+
+		// resuming everyone ends the pauses of single clients too
+		p.Resume(nil)
+		now = time.Now()
+		So(p.Paused(now, a), ShouldBeFalse)
+		So(p.Paused(now, b), ShouldBeFalse)
+
+		all, clients = p.Status(now)
+		So(all, ShouldBeNil)
+		So(clients, ShouldBeEmpty)
+	})
 }
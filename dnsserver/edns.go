@@ -0,0 +1,520 @@
+package dnsserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// DefaultUDPSize is the edns0 buffer size advertised to upstream nameservers.
+// It avoids ip fragmentation on practically all networks.
+const DefaultUDPSize = 1232
+
+const (
+	// edns0Padding is the option code for padding, RFC 7830
+	edns0Padding = 12
+
+	// block sizes recommended by RFC 8467
+	queryPaddingBlock    = 128
+	responsePaddingBlock = 468
+
+	cookieLen = 8
+)
+
+// ECSPolicy determines what edns client subnet, if any, is sent to upstream
+// nameservers
+type ECSPolicy string
+
+const (
+	// ECSStrip never sends a client subnet upstream
+	ECSStrip ECSPolicy = "strip"
+
+	// ECSPass forwards the client subnet sent by the client, if any
+	ECSPass ECSPolicy = "pass"
+
+	// ECSReplace always sends the configured subnet
+	ECSReplace ECSPolicy = "replace"
+)
+
+// ParseECSPolicy returns the ECSPolicy named by s. An empty string is
+// ECSStrip.
+func ParseECSPolicy(s string) (ECSPolicy, error) {
+	switch ECSPolicy(s) {
+	case "":
+		return ECSStrip, nil
+	case ECSStrip, ECSPass, ECSReplace:
+		return ECSPolicy(s), nil
+	}
+
+	return "", errors.Errorf("invalid edns client subnet policy: %s", s)
+}
+
+// EDNS configures how edns0 options are forwarded upstream and answered
+type EDNS struct {
+	ECS           ECSPolicy
+	ECSSubnet     *net.IPNet
+	NoCookies     bool
+	secretOnce    sync.Once
+	secret        []byte
+	mu            sync.RWMutex
+	serverCookies map[string]string
+}
+
+func (e *EDNS) mac(data ...[]byte) []byte {
+	e.secretOnce.Do(func() {
+		e.secret = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, e.secret); err != nil {
+			panic(err)
+		}
+	})
+
+	h := hmac.New(sha256.New, e.secret)
+	for _, d := range data {
+		_, _ = h.Write(d)
+	}
+
+	return h.Sum(nil)[:cookieLen]
+}
+
+// clientCookie returns the client cookie sent to nameserver, RFC 7873 §4.1
+func (e *EDNS) clientCookie(nameserver string) string {
+	return hex.EncodeToString(e.mac([]byte("client"), []byte(nameserver)))
+}
+
+// serverCookie returns the server cookie for a client, RFC 7873 §4.2
+func (e *EDNS) serverCookie(clientCookie string, ip net.IP) string {
+	cc, _ := hex.DecodeString(clientCookie)
+	return hex.EncodeToString(e.mac([]byte("server"), cc, ip))
+}
+
+// upstreamCookie returns the cookie option to send to nameserver, including
+// the server cookie it last returned
+func (e *EDNS) upstreamCookie(nameserver string) *dns.EDNS0_COOKIE {
+	e.mu.RLock()
+	sc := e.serverCookies[nameserver]
+	e.mu.RUnlock()
+
+	return &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: e.clientCookie(nameserver) + sc,
+	}
+}
+
+// setServerCookie remembers the server cookie returned by nameserver
+func (e *EDNS) setServerCookie(nameserver string, resp *dns.Msg) {
+	if e.NoCookies || resp == nil {
+		return
+	}
+
+	c, ok := findOption(resp.IsEdns0(), dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	if !ok || !validCookie(c.Cookie) || len(c.Cookie) == 2*cookieLen {
+		return
+	}
+
+	// ignore responses to some other client cookie
+	if c.Cookie[:2*cookieLen] != e.clientCookie(nameserver) {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.serverCookies == nil {
+		e.serverCookies = map[string]string{}
+	}
+
+	e.serverCookies[nameserver] = c.Cookie[2*cookieLen:]
+}
+
+// validCookie returns whether the hex encoded cookie option is well formed,
+// RFC 7873 §5.2.2
+func validCookie(cookie string) bool {
+	data, err := hex.DecodeString(cookie)
+	if err != nil {
+		return false
+	}
+
+	return len(data) == cookieLen || (len(data) >= 2*cookieLen && len(data) <= 40)
+}
+
+func ecsOption(n *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := n.Mask.Size()
+
+	ret := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        2,
+		SourceNetmask: uint8(ones),
+		Address:       n.IP,
+	}
+
+	if ip4 := n.IP.To4(); ip4 != nil {
+		ret.Family = 1
+		ret.Address = ip4
+	}
+
+	return ret
+}
+
+// upstreamECS returns the client subnet option to send upstream for req
+func (e *EDNS) upstreamECS(req *dns.Msg) *dns.EDNS0_SUBNET {
+	switch e.ECS {
+	case ECSPass:
+		if s, ok := findOption(req.IsEdns0(), dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET); ok {
+			return s
+		}
+	case ECSReplace:
+		if e.ECSSubnet != nil {
+			return ecsOption(e.ECSSubnet)
+		}
+	}
+
+	return nil
+}
+
+// ecsScoped returns whether resp was tailored to the client subnet sent
+// upstream, in which case it must not be cached for other clients, RFC 7871
+// §7.3.1
+func ecsScoped(resp *dns.Msg) bool {
+	if resp == nil {
+		return false
+	}
+
+	s, ok := findOption(resp.IsEdns0(), dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET)
+	return ok && s.SourceScope > 0
+}
+
+// httpsECS returns the edns_client_subnet parameter for dns-over-https
+// requests. Stripping the subnet requires explicitly sending 0.0.0.0/0 since
+// otherwise one is derived from our own address.
+func (e *EDNS) httpsECS(req *dns.Msg) string {
+	if s := e.upstreamECS(req); s != nil {
+		return fmt.Sprintf("%s/%d", s.Address, s.SourceNetmask)
+	}
+
+	if e.ECS == ECSPass {
+		return ""
+	}
+
+	return "0.0.0.0/0"
+}
+
+// httpsScope returns the client subnet option for the edns_client_subnet
+// value of a dns-over-https response to req, or nil if the response wasn't
+// tailored to the subnet we sent
+func (e *EDNS) httpsScope(req *dns.Msg, value string) *dns.EDNS0_SUBNET {
+	s := e.upstreamECS(req)
+	if s == nil || value == "" {
+		return nil
+	}
+
+	_, n, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil
+	}
+
+	scope, _ := n.Mask.Size()
+	if scope == 0 {
+		return nil
+	}
+
+	ret := *s
+	ret.SourceScope = uint8(scope)
+
+	return &ret
+}
+
+// responseOptions returns the options to include in the OPT record of the
+// response to a client at ip that sent reqOpt
+func (e *EDNS) responseOptions(ip net.IP, reqOpt, upstreamOpt *dns.OPT) []dns.EDNS0 {
+	var ret []dns.EDNS0
+
+	if s, ok := findOption(reqOpt, dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET); ok {
+		if us, ok := findOption(upstreamOpt, dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET); ok && e.ECS == ECSPass {
+			ret = append(ret, us)
+		} else {
+			// the answer was not tailored to the client's subnet, RFC 7871
+			// §7.2.1
+			ret = append(ret, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        s.Family,
+				SourceNetmask: s.SourceNetmask,
+				Address:       s.Address,
+			})
+		}
+	}
+
+	if c, ok := findOption(reqOpt, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE); ok && !e.NoCookies && validCookie(c.Cookie) {
+		cc := c.Cookie[:2*cookieLen]
+		ret = append(ret, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: cc + e.serverCookie(cc, ip),
+		})
+	}
+
+	return ret
+}
+
+func findOption(opt *dns.OPT, code uint16) dns.EDNS0 {
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return o
+		}
+	}
+
+	return nil
+}
+
+func newOPT(size uint16, do bool) *dns.OPT {
+	ret := &dns.OPT{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeOPT,
+		},
+	}
+
+	ret.SetUDPSize(size)
+	if do {
+		ret.SetDo()
+	}
+
+	return ret
+}
+
+func dnssecOK(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// checkEDNS returns an error response if the OPT record of req is invalid
+func checkEDNS(req *dns.Msg) *dns.Msg {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	resp := &dns.Msg{}
+
+	if opt.Version() != 0 {
+		resp.SetRcode(req, dns.RcodeBadVers)
+		return resp
+	}
+
+	if c, ok := findOption(opt, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE); ok && !validCookie(c.Cookie) {
+		resp.SetRcode(req, dns.RcodeFormatError)
+		return resp
+	}
+
+	return nil
+}
+
+func (d *DNSServer) udpSize() uint16 {
+	if d.UDPSize >= dns.MinMsgSize {
+		return d.UDPSize
+	}
+	return DefaultUDPSize
+}
+
+// upstreamRequest returns a copy of req to send to nameserver over net. The
+// client's OPT record is replaced with one that advertises a udp buffer of
+// d.UDPSize, forwards the DO bit, and carries the client subnet allowed by
+// d.EDNS.ECS and our own cookie. When d.DNSSEC is validating, DO and CD are
+// always set so that the signatures, and bogus data, can be checked locally.
+func (d *DNSServer) upstreamRequest(net, nameserver string, req *dns.Msg) *dns.Msg {
+	ret := req.Copy()
+	ret.Extra = removeOPT(ret.Extra)
+
+	do := dnssecOK(req)
+	if d.DNSSEC != nil {
+		do = true
+		ret.CheckingDisabled = true
+	}
+
+	opt := newOPT(d.udpSize(), do)
+
+	if ecs := d.EDNS.upstreamECS(req); ecs != nil {
+		opt.Option = append(opt.Option, ecs)
+	}
+
+	if !d.EDNS.NoCookies {
+		opt.Option = append(opt.Option, d.EDNS.upstreamCookie(nameserver))
+	}
+
+	ret.Extra = append(ret.Extra, opt)
+
+	if isTLS(net) {
+		pad(ret, queryPaddingBlock)
+	}
+
+	return ret
+}
+
+// isUDP returns whether messages sent over net are subject to udp message
+// size limits. Like dns.Client, an empty net is udp.
+func isUDP(net string) bool {
+	return net == "" || strings.HasPrefix(net, "udp")
+}
+
+// isTLS returns whether messages sent over net are encrypted
+func isTLS(net string) bool {
+	return strings.HasSuffix(net, "-tls")
+}
+
+// tcpNet returns the tcp equivalent of the udp network net
+func tcpNet(net string) string {
+	return "tcp" + strings.TrimPrefix(net, "udp")
+}
+
+// clientResponse returns resp as it should be sent to the client at addr that
+// sent req over net. Any upstream OPT record is replaced with our own if the
+// client sent one, dnssec records are removed unless the client set the DO
+// bit, and udp responses are truncated to fit the buffer size the client
+// advertised. resp is copied rather than modified, since it may also be
+// cached.
+func (d *DNSServer) clientResponse(net string, addr net.Addr, req, resp *dns.Msg) *dns.Msg {
+	reqOpt := req.IsEdns0()
+
+	ret := resp.Copy()
+	upstreamOpt := ret.IsEdns0()
+	ret.Extra = removeOPT(ret.Extra)
+
+	// we may have set CD upstream for our own validation
+	ret.CheckingDisabled = req.CheckingDisabled
+
+	// AD is only passed on when we validated the answer ourselves, and then
+	// only to clients that asked for it
+	if !d.validating(req) || !(req.AuthenticatedData || dnssecOK(req)) {
+		ret.AuthenticatedData = false
+	}
+
+	if !dnssecOK(req) {
+		stripDNSSEC(ret)
+	}
+
+	if reqOpt != nil {
+		opt := newOPT(d.udpSize(), reqOpt.Do())
+		opt.Option = d.EDNS.responseOptions(clientIP(addr), reqOpt, upstreamOpt)
+
+		// OPT.SetExtendedRcode ignores values below 16, so set the upper
+		// bits of extended rcodes like BADVERS directly
+		if ret.Rcode > 0xF {
+			opt.Hdr.Ttl = opt.Hdr.Ttl&0x00FFFFFF | uint32(ret.Rcode>>4)<<24
+			ret.Rcode &= 0xF
+		}
+
+		ret.Extra = append(ret.Extra, opt)
+	}
+
+	if isUDP(net) {
+		size := dns.MinMsgSize
+		if reqOpt != nil && int(reqOpt.UDPSize()) > size {
+			size = int(reqOpt.UDPSize())
+		}
+
+		truncate(ret, size)
+	}
+
+	if isTLS(net) && findOption(reqOpt, edns0Padding) != nil {
+		pad(ret, responsePaddingBlock)
+	}
+
+	return ret
+}
+
+func removeOPT(rrs []dns.RR) []dns.RR {
+	var ret []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			ret = append(ret, rr)
+		}
+	}
+	return ret
+}
+
+func isDNSSECType(t uint16) bool {
+	switch t {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+// stripDNSSEC removes dnssec records that weren't explicitly requested, RFC
+// 4035 §3.2.1
+func stripDNSSEC(resp *dns.Msg) {
+	var qtype uint16
+	if len(resp.Question) > 0 {
+		qtype = resp.Question[0].Qtype
+	}
+
+	for _, rrs := range []*[]dns.RR{&resp.Answer, &resp.Ns, &resp.Extra} {
+		var keep []dns.RR
+		for _, rr := range *rrs {
+			if t := rr.Header().Rrtype; !isDNSSECType(t) || t == qtype {
+				keep = append(keep, rr)
+			}
+		}
+		*rrs = keep
+	}
+}
+
+// pad m with a padding option so that its length is a multiple of block
+func pad(m *dns.Msg, block int) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	// Len overestimates by one byte, but the option header adds four
+	l := m.Len() - 1 + 4
+	n := (block - l%block) % block
+
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: edns0Padding,
+		Data: make([]byte, n),
+	})
+}
+
+// truncate resp so that it is no more than size bytes. Additional records are
+// removed first since they are optional. If that isn't enough, the TC bit is
+// set and authority and then answer records are removed until it fits.
+func truncate(resp *dns.Msg, size int) {
+	resp.Compress = true
+	if resp.Len() <= size {
+		return
+	}
+
+	var extra []dns.RR
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+
+	resp.Extra = extra
+	if resp.Len() <= size {
+		return
+	}
+
+	resp.Truncated = true
+
+	for len(resp.Ns) > 0 && resp.Len() > size {
+		resp.Ns = resp.Ns[:len(resp.Ns)-1]
+	}
+
+	for len(resp.Answer) > 0 && resp.Len() > size {
+		resp.Answer = resp.Answer[:len(resp.Answer)-1]
+	}
+}
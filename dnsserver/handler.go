@@ -8,6 +8,8 @@ import (
 	"strings"
 	"time"
 
+	"jrubin.io/blamedns/idn"
+	"jrubin.io/blamedns/rpz"
 	"jrubin.io/slog"
 
 	"github.com/miekg/dns"
@@ -50,6 +52,40 @@ func (d *DNSServer) respond(net string, w dns.ResponseWriter, req *dns.Msg, dur
 		"duration": dur,
 	})
 
+	if name := idn.ToUnicode(req.Question[0].Name); name != req.Question[0].Name {
+		ctxLog = ctxLog.WithField("name_unicode", name)
+	}
+
+	if r.policy != nil {
+		ctxLog = ctxLog.WithFields(slog.Fields{
+			"rpz_zone":    r.policy.Zone,
+			"rpz_trigger": r.policy.Trigger,
+			"rpz_rule":    r.policy.Rule,
+			"rpz_action":  r.policy.Action,
+		})
+	}
+
+	if r.drop {
+		ctxLog.Warn("dropped")
+		return r
+	}
+
+	ip := clientIP(w.RemoteAddr())
+
+	switch action := d.RateLimit.allowResponse(time.Now(), net, ip, r.resp); action {
+	case RateLimitDrop, RateLimitTruncate:
+		rateLimited.WithLabelValues("response", string(action)).Inc()
+		ctxLog.WithField("action", action).Debug("rate limited response")
+
+		if action == RateLimitTruncate {
+			if err := w.WriteMsg(truncated(req)); err != nil {
+				ctxLog.WithError(err).Error("error writing response")
+			}
+		}
+
+		return r
+	}
+
 	go func() {
 		if r.resp.Rcode == dns.RcodeServerFailure {
 			ctxLog.Error("responded with error")
@@ -62,7 +98,7 @@ func (d *DNSServer) respond(net string, w dns.ResponseWriter, req *dns.Msg, dur
 		}
 	}()
 
-	if err := w.WriteMsg(r.resp); err != nil {
+	if err := w.WriteMsg(d.clientResponse(net, w.RemoteAddr(), req, r.resp)); err != nil {
 		ctxLog.WithError(err).Error("error writing response")
 	}
 
@@ -99,6 +135,19 @@ type hresp struct {
 	resp    *dns.Msg
 	blocked bool
 	cache   cacheStatus
+
+	// responses that must not be cached for other clients: unvalidated ones,
+	// requested with CD while validating, those tailored to a client subnet,
+	// those from zones restricted to some clients, local hosts, those of
+	// response policies, those blocked on a schedule and those to clients
+	// with blocking paused
+	nocache bool
+
+	// the response policy that applied, if any
+	policy *rpz.Policy
+
+	// don't respond at all
+	drop bool
 }
 
 func (d *DNSServer) getOverride(req *dns.Msg) []net.IP {
@@ -117,8 +166,11 @@ func (d *DNSServer) getOverride(req *dns.Msg) []net.IP {
 }
 
 func (d *DNSServer) overrideReply(req *dns.Msg, ips []net.IP) *dns.Msg {
+	return d.ipsReply(req, ips, uint32(d.OverrideTTL/time.Second))
+}
+
+func (d *DNSServer) ipsReply(req *dns.Msg, ips []net.IP, ttl uint32) *dns.Msg {
 	q := req.Question[0]
-	ttl := uint32(d.OverrideTTL / time.Second)
 	resp := &dns.Msg{}
 	resp.SetReply(req)
 
@@ -145,7 +197,15 @@ func (d *DNSServer) overrideReply(req *dns.Msg, ips []net.IP) *dns.Msg {
 	return resp
 }
 
-func (d *DNSServer) bgHandler(ctx context.Context, net string, addr []string, req *dns.Msg, respCh chan<- *hresp) {
+func (d *DNSServer) bgHandler(ctx context.Context, net string, client net.IP, src source, req *dns.Msg, respCh chan<- *hresp) {
+	if resp := checkEDNS(req); resp != nil {
+		respCh <- &hresp{
+			resp:  resp,
+			cache: cacheHit,
+		}
+		return
+	}
+
 	// refuse "any" and "rrsig" requests
 	switch req.Question[0].Qtype {
 	case dns.TypeANY, dns.TypeRRSIG:
@@ -164,21 +224,45 @@ func (d *DNSServer) bgHandler(ctx context.Context, net string, addr []string, re
 		}
 	}
 
-	if d.Block.Should(req) {
+	// local hosts and leases can go away at any time, so their answers
+	// aren't cached
+	if resp := d.localHostsReply(req); resp != nil {
+		respCh <- &hresp{
+			resp:    resp,
+			cache:   cacheHit,
+			nocache: true,
+		}
+		return
+	}
+
+	qp := d.RPZ.QName(req.Question[0].Name)
+	if r := d.policyResponse(ctx, net, client, src, req, qp); r != nil {
+		respCh <- r
+		return
+	}
+
+	// rules that let the query through also exempt it from blocking
+	// schedules may only block for some clients, or for some of the time
+	if qp == nil && d.Block.Should(req, client) {
 		respCh <- &hresp{
 			resp:    d.Block.NewReply(req),
 			blocked: true,
 			cache:   cacheHit,
+			nocache: d.Block.Scheduled(req.Question[0].Name),
 		}
 		return
 	}
 
-	if d.Cache != nil {
+	// answers blocked for other clients may be cached, so clients with
+	// blocking paused just for them don't use the cache
+	paused := d.Block.Pause.PausedClient(time.Now(), client)
+
+	if d.Cache != nil && !paused && !src.private {
 		if resp := d.Cache.Get(ctx, req); resp != nil {
-			respCh <- &hresp{
+			respCh <- d.responsePolicy(ctx, net, client, src, req, qp, &hresp{
 				resp:  resp,
 				cache: cacheHit,
-			}
+			})
 			return
 		}
 	}
@@ -188,48 +272,118 @@ func (d *DNSServer) bgHandler(ctx context.Context, net string, addr []string, re
 		return
 	}
 
+	resp := src.exchange(ctx, req)
+	if src.validate {
+		resp = d.validate(ctx, net, src.exchange, req, resp)
+	}
+
+	respCh <- d.responsePolicy(ctx, net, client, src, req, qp, &hresp{
+		resp:    resp,
+		cache:   cacheMiss,
+		nocache: paused || src.private || ecsScoped(resp) || (src.validate && d.DNSSEC != nil && !d.validating(req)),
+	})
+}
+
+// source is where requests that can't be answered locally are sent
+type source struct {
+	exchange func(ctx context.Context, req *dns.Msg) *dns.Msg
+
+	// validate responses with d.DNSSEC
+	validate bool
+
+	// answers are only for some clients, so d.Cache, which is shared by
+	// every zone, is neither used nor updated
+	private bool
+}
+
+// Handler returns a dns.Handler that forwards requests to the nameservers in
+// addr, queried according to strategy.
+func (d *DNSServer) Handler(net string, addr []string, strategy Strategy) dns.Handler {
+	return d.handler(net, d.forwardSource(net, addr, strategy))
+}
+
+func (d *DNSServer) forwardSource(net string, addr []string, strategy Strategy) source {
+	sel := newSelector(strategy)
+
 	if len(addr) == 1 && strings.Index(addr[0], "https://") == 0 {
-		respCh <- &hresp{
-			resp:  d.fastHTTPSLookup(ctx, addr[0], req),
-			cache: cacheMiss,
-		}
-	} else {
-		respCh <- &hresp{
-			resp:  d.fastLookup(ctx, net, addr, req),
-			cache: cacheMiss,
+		return source{
+			exchange: func(ctx context.Context, req *dns.Msg) *dns.Msg {
+				return d.fastHTTPSLookup(ctx, addr[0], sel, req)
+			},
 		}
 	}
+
+	return source{
+		exchange: func(ctx context.Context, req *dns.Msg) *dns.Msg {
+			return d.fastLookup(ctx, net, addr, sel, req)
+		},
+		validate: true,
+	}
 }
 
-func (d *DNSServer) Handler(net string, addr []string) dns.Handler {
+// RecursiveHandler returns a dns.Handler that resolves requests iteratively
+// with d.Recursor
+func (d *DNSServer) RecursiveHandler(net string) dns.Handler {
+	return d.handler(net, d.recursiveSource())
+}
+
+func (d *DNSServer) recursiveSource() source {
+	return source{
+		exchange: d.recurse,
+		validate: true,
+	}
+}
+
+// zoneHandler returns the dns.Handler for requests to zone over net. Zones
+// restricted to some clients don't share the cache with the others.
+func (d *DNSServer) zoneHandler(net string, zone Zone) dns.Handler {
+	src := d.recursiveSource()
+	if !zone.Recursive {
+		src = d.forwardSource(net, zone.Addr, zone.Strategy)
+	}
+
+	src.private = len(zone.Clients) > 0
+
+	return d.handler(net, src)
+}
+
+func (d *DNSServer) handler(net string, src source) dns.Handler {
 	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
 		begin := time.Now()
 
 		ctx, cancel := context.WithTimeout(context.Background(), d.DialTimeout+2*d.ClientTimeout)
 		respCh := make(chan *hresp, 1)
 
-		go d.bgHandler(ctx, net, addr, req, respCh)
+		go d.bgHandler(ctx, net, clientIP(w.RemoteAddr()), src, req, respCh)
 
 		var r *hresp
 
 		select {
 		case <-ctx.Done():
 		case r = <-respCh:
-			if d.Cache != nil {
-				go d.Cache.Set(r.resp)
-			}
+			d.store(r)
 		}
 
 		cancel()
 		dur := time.Since(begin)
 		r = d.respond(net, w, req, dur, r)
-
-		handlerDuration.
-			WithLabelValues(
-				dns.RcodeToString[r.resp.Rcode],
-				fmt.Sprintf("%v", r.blocked),
-				r.cache.String(),
-			).
-			Observe(float64(dur))
+		observe(r, dur)
 	})
 }
+
+// store caches the response of r in the background, unless it mustn't be
+func (d *DNSServer) store(r *hresp) {
+	if d.Cache != nil && !r.nocache {
+		go d.Cache.Set(r.resp)
+	}
+}
+
+func observe(r *hresp, dur time.Duration) {
+	handlerDuration.
+		WithLabelValues(
+			dns.RcodeToString[r.resp.Rcode],
+			fmt.Sprintf("%v", r.blocked),
+			r.cache.String(),
+		).
+		Observe(float64(dur))
+}
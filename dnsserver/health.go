@@ -0,0 +1,424 @@
+package dnsserver
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"jrubin.io/slog"
+
+	"github.com/miekg/dns"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	upstreamHealthy = prom.NewGaugeVec(
+		prom.GaugeOpts{
+			Namespace: "blamedns",
+			Subsystem: "dns",
+			Name:      "upstream_healthy",
+			Help:      "Whether the upstream nameserver is considered healthy (1) or not (0).",
+		},
+		[]string{"net", "addr"},
+	)
+
+	upstreamSuccessRate = prom.NewGaugeVec(
+		prom.GaugeOpts{
+			Namespace: "blamedns",
+			Subsystem: "dns",
+			Name:      "upstream_success_rate",
+			Help:      "Rolling rate of successful queries to the upstream nameserver.",
+		},
+		[]string{"net", "addr"},
+	)
+
+	upstreamLatency = prom.NewGaugeVec(
+		prom.GaugeOpts{
+			Namespace: "blamedns",
+			Subsystem: "dns",
+			Name:      "upstream_latency_nanoseconds",
+			Help:      "Moving average of the response time of the upstream nameserver.",
+		},
+		[]string{"net", "addr"},
+	)
+)
+
+func init() {
+	prom.MustRegister(upstreamHealthy)
+	prom.MustRegister(upstreamSuccessRate)
+	prom.MustRegister(upstreamLatency)
+}
+
+const (
+	DefaultHealthWindow         = 20
+	DefaultHealthMinSuccessRate = 0.5
+
+	// an upstream isn't judged until it has at least this many results
+	healthMinSamples = 3
+
+	// weight given to each new latency sample
+	latencyAlpha = 0.3
+)
+
+type upstreamKey struct {
+	Net  string
+	Addr string
+}
+
+type upstream struct {
+	mu       sync.Mutex
+	key      upstreamKey
+	results  []bool
+	next     int
+	latency  time.Duration
+	lastUsed time.Time
+	probe    func()
+}
+
+func (u *upstream) record(window int, rtt time.Duration, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.results) < window {
+		u.results = append(u.results, ok)
+	} else {
+		u.results[u.next] = ok
+		u.next = (u.next + 1) % window
+	}
+
+	if ok {
+		if u.latency == 0 {
+			u.latency = rtt
+		} else {
+			u.latency = time.Duration(latencyAlpha*float64(rtt) + (1-latencyAlpha)*float64(u.latency))
+		}
+	}
+
+	u.lastUsed = time.Now()
+}
+
+func (u *upstream) successRate() float64 {
+	if len(u.results) == 0 {
+		return 1
+	}
+
+	var n int
+	for _, ok := range u.results {
+		if ok {
+			n++
+		}
+	}
+
+	return float64(n) / float64(len(u.results))
+}
+
+func (u *upstream) healthy(minSuccessRate float64) bool {
+	return len(u.results) < healthMinSamples || u.successRate() >= minSuccessRate
+}
+
+// UpstreamStatus describes the health of an upstream nameserver
+type UpstreamStatus struct {
+	Net         string        `json:"net"`
+	Addr        string        `json:"addr"`
+	Healthy     bool          `json:"healthy"`
+	SuccessRate float64       `json:"success_rate"`
+	Samples     int           `json:"samples"`
+	Latency     time.Duration `json:"latency"`
+	LastUsed    time.Time     `json:"last_used"`
+}
+
+// Health tracks the success rate and latency of each upstream nameserver so
+// that unhealthy ones are tried last. Unhealthy (and idle) upstreams are
+// periodically probed so that they can recover. A nil Health considers every
+// upstream healthy.
+type Health struct {
+	Window         int
+	MinSuccessRate float64
+	ProbeInterval  time.Duration
+	ProbeName      string
+	Logger         slog.Interface
+	mu             sync.RWMutex
+	upstreams      map[upstreamKey]*upstream
+	stopCh         chan struct{}
+}
+
+func (h *Health) window() int {
+	if h.Window > 0 {
+		return h.Window
+	}
+	return DefaultHealthWindow
+}
+
+func (h *Health) minSuccessRate() float64 {
+	if h.MinSuccessRate > 0 {
+		return h.MinSuccessRate
+	}
+	return DefaultHealthMinSuccessRate
+}
+
+func (h *Health) get(net, addr string) *upstream {
+	key := upstreamKey{Net: net, Addr: addr}
+
+	h.mu.RLock()
+	u, ok := h.upstreams[key]
+	h.mu.RUnlock()
+
+	if ok {
+		return u
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.upstreams == nil {
+		h.upstreams = map[upstreamKey]*upstream{}
+	}
+
+	if u, ok = h.upstreams[key]; !ok {
+		u = &upstream{key: key}
+		h.upstreams[key] = u
+	}
+
+	return u
+}
+
+// Register adds an upstream so that it is probed with probe when it is
+// unhealthy or idle.
+func (h *Health) Register(net, addr string, probe func()) {
+	if h == nil {
+		return
+	}
+
+	u := h.get(net, addr)
+
+	u.mu.Lock()
+	u.probe = probe
+	u.mu.Unlock()
+}
+
+// Record the result of a query to an upstream
+func (h *Health) Record(net, addr string, rtt time.Duration, ok bool) {
+	if h == nil {
+		return
+	}
+
+	u := h.get(net, addr)
+	u.record(h.window(), rtt, ok)
+
+	u.mu.Lock()
+	healthy := u.healthy(h.minSuccessRate())
+	rate := u.successRate()
+	latency := u.latency
+	u.mu.Unlock()
+
+	var v float64
+	if healthy {
+		v = 1
+	}
+
+	upstreamHealthy.WithLabelValues(net, addr).Set(v)
+	upstreamSuccessRate.WithLabelValues(net, addr).Set(rate)
+	upstreamLatency.WithLabelValues(net, addr).Set(float64(latency))
+}
+
+// Healthy returns whether the upstream is considered healthy
+func (h *Health) Healthy(net, addr string) bool {
+	if h == nil {
+		return true
+	}
+
+	h.mu.RLock()
+	u, ok := h.upstreams[upstreamKey{Net: net, Addr: addr}]
+	h.mu.RUnlock()
+
+	if !ok {
+		return true
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.healthy(h.minSuccessRate())
+}
+
+// Latency returns the moving average response time of the upstream, or zero
+// if it is not known
+func (h *Health) Latency(net, addr string) time.Duration {
+	if h == nil {
+		return 0
+	}
+
+	h.mu.RLock()
+	u, ok := h.upstreams[upstreamKey{Net: net, Addr: addr}]
+	h.mu.RUnlock()
+
+	if !ok {
+		return 0
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.latency
+}
+
+// Order returns addr with the healthy upstreams first, otherwise preserving
+// the original order. Unhealthy upstreams are not removed so that there is
+// always something to try.
+func (h *Health) Order(net string, addr []string) []string {
+	if h == nil {
+		return addr
+	}
+
+	ret := make([]string, 0, len(addr))
+	var unhealthy []string
+
+	for _, a := range addr {
+		if h.Healthy(net, a) {
+			ret = append(ret, a)
+		} else {
+			unhealthy = append(unhealthy, a)
+		}
+	}
+
+	return append(ret, unhealthy...)
+}
+
+// Status returns the current state of every known upstream
+func (h *Health) Status() []UpstreamStatus {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ret := make([]UpstreamStatus, 0, len(h.upstreams))
+	for _, u := range h.upstreams {
+		u.mu.Lock()
+		ret = append(ret, UpstreamStatus{
+			Net:         u.key.Net,
+			Addr:        u.key.Addr,
+			Healthy:     u.healthy(h.minSuccessRate()),
+			SuccessRate: u.successRate(),
+			Samples:     len(u.results),
+			Latency:     u.latency,
+			LastUsed:    u.lastUsed,
+		})
+		u.mu.Unlock()
+	}
+
+	sort.Sort(upstreamStatuses(ret))
+
+	return ret
+}
+
+type upstreamStatuses []UpstreamStatus
+
+func (s upstreamStatuses) Len() int      { return len(s) }
+func (s upstreamStatuses) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s upstreamStatuses) Less(i, j int) bool {
+	if s[i].Net != s[j].Net {
+		return s[i].Net < s[j].Net
+	}
+	return s[i].Addr < s[j].Addr
+}
+
+// probeAll probes every upstream that is either unhealthy or hasn't been used
+// since the last probe interval
+func (h *Health) probeAll() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	idle := time.Now().Add(-h.ProbeInterval)
+
+	for _, u := range h.upstreams {
+		u.mu.Lock()
+		probe := u.probe
+		need := !u.healthy(h.minSuccessRate()) || u.lastUsed.Before(idle)
+		u.mu.Unlock()
+
+		if probe != nil && need {
+			go probe()
+		}
+	}
+}
+
+// Start probing upstreams every ProbeInterval
+func (h *Health) Start() {
+	if h == nil || h.ProbeInterval <= 0 || h.stopCh != nil {
+		return
+	}
+
+	h.stopCh = make(chan struct{})
+	ticker := time.NewTicker(h.ProbeInterval)
+
+	if h.Logger != nil {
+		h.Logger.WithField("interval", h.ProbeInterval).Info("started upstream health probes")
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				h.probeAll()
+			case <-h.stopCh:
+				ticker.Stop()
+				close(h.stopCh)
+				return
+			}
+		}
+	}()
+}
+
+func (h *Health) Stop() {
+	if h == nil || h.stopCh == nil {
+		return
+	}
+
+	h.stopCh <- struct{}{}
+	<-h.stopCh
+	h.stopCh = nil
+}
+
+func (d *DNSServer) probeRequest() *dns.Msg {
+	name := "."
+	if d.Health != nil && len(d.Health.ProbeName) > 0 {
+		name = dns.Fqdn(d.Health.ProbeName)
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(name, dns.TypeNS)
+	return req
+}
+
+// registerHealth registers the nameservers in addr with d.Health so that
+// they can be probed. The result of a probe is recorded just like that of any
+// other lookup.
+func (d *DNSServer) registerHealth(net string, addr []string) {
+	if d.Health == nil {
+		return
+	}
+
+	if len(addr) == 1 && strings.Index(addr[0], "https://") == 0 {
+		t := d.HTTP.transport[addr[0]]
+		for _, urlStr := range t.urls {
+			urlStr := urlStr
+			d.Health.Register(httpsNet, urlStr, func() {
+				ctx, cancel := context.WithTimeout(context.Background(), d.ClientTimeout)
+				defer cancel()
+				d.httpsLookup(ctx, t.transport, urlStr, d.probeRequest(), nil)
+			})
+		}
+		return
+	}
+
+	for _, nameserver := range addr {
+		nameserver := nameserver
+		d.Health.Register(net, nameserver, func() {
+			d.lookup(net, nameserver, d.probeRequest(), nil)
+		})
+	}
+}
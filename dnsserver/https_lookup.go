@@ -42,7 +42,6 @@ type DNSHTTP struct {
 	TLSHandshakeTimeout   time.Duration
 	ExpectContinueTimeout time.Duration
 	NoDNSSEC              bool
-	EDNSClientSubnet      string
 	NoRandomPadding       bool
 	transport             map[string]*transport
 }
@@ -168,7 +167,12 @@ func (d *DNSServer) initHTTPTransport(addr string) error {
 	return nil
 }
 
-const queryLen = 512
+const (
+	queryLen = 512
+
+	// httpsNet is used to identify dns-over-https upstreams
+	httpsNet = "https"
+)
 
 func randString(size int) (string, error) {
 	if size < 0 {
@@ -184,36 +188,13 @@ func randString(size int) (string, error) {
 	return hex.EncodeToString(buf.Bytes())[:size], nil
 }
 
-func (d *DNSServer) fastHTTPSLookup(ctx context.Context, addr string, req *dns.Msg) *dns.Msg {
-	respCh := make(chan *dns.Msg)
-
-	ticker := time.NewTicker(d.LookupInterval)
-	defer ticker.Stop()
-	var nresponses int
-
+func (d *DNSServer) fastHTTPSLookup(ctx context.Context, addr string, sel *selector, req *dns.Msg) *dns.Msg {
 	t := d.HTTP.transport[addr]
+	urls := sel.order(d.Health, httpsNet, t.urls)
 
-	// start lookup on each nameserver top-down, every LookupInterval
-	for _, nameserver := range t.urls {
-		go d.httpsLookup(ctx, t.transport, nameserver, req, respCh)
-
-		// but exit early, if we have an answer
-		if resp, responded, canceled := getResult(ctx, ticker, respCh); resp != nil || canceled {
-			return resp
-		} else if responded {
-			nresponses++
-		}
-	}
-
-	ticker.Stop()
-
-	for i := nresponses; i < len(addr); i++ {
-		if resp, _, canceled := getResult(ctx, ticker, respCh); resp != nil || canceled {
-			return resp
-		}
-	}
-
-	return nil
+	return raceLookups(ctx, urls, sel.interval(d.LookupInterval), func(nameserver string, respCh chan<- *dns.Msg) {
+		d.httpsLookup(ctx, t.transport, nameserver, req, respCh)
+	})
 }
 
 func (d *DNSServer) httpsLookup(ctx context.Context, t *http.Transport, urlStr string, req *dns.Msg, respCh chan<- *dns.Msg) {
@@ -224,7 +205,11 @@ func (d *DNSServer) httpsLookup(ctx context.Context, t *http.Transport, urlStr s
 		"https_url":  urlStr,
 	})
 
+	begin := time.Now()
+
 	sendResponse := func(resp *dns.Msg) {
+		d.Health.Record(httpsNet, urlStr, time.Since(begin), resp != nil)
+
 		select {
 		case respCh <- resp:
 		default:
@@ -242,12 +227,16 @@ func (d *DNSServer) httpsLookup(ctx context.Context, t *http.Transport, urlStr s
 	query.Set("name", req.Question[0].Name)
 	query.Set("type", fmt.Sprintf("%d", req.Question[0].Qtype))
 
-	if d.HTTP.NoDNSSEC {
+	if d.HTTP.NoDNSSEC || req.CheckingDisabled {
 		query.Set("cd", "1") // disable dnssec checking
 	}
 
-	if len(d.HTTP.EDNSClientSubnet) > 0 {
-		query.Set("edns_client_subnet", "")
+	if dnssecOK(req) {
+		query.Set("do", "1")
+	}
+
+	if ecs := d.EDNS.httpsECS(req); len(ecs) > 0 {
+		query.Set("edns_client_subnet", ecs)
 	}
 
 	if !d.HTTP.NoRandomPadding {
@@ -309,9 +298,10 @@ func (d *DNSServer) httpsLookup(ctx context.Context, t *http.Transport, urlStr s
 	resp.Truncated = dresp.TC
 	resp.RecursionDesired = dresp.RD
 	resp.RecursionAvailable = dresp.RA
-	resp.AuthenticatedData = dresp.AD
 	resp.CheckingDisabled = dresp.CD
 
+	// dresp.AD isn't copied, AD is only set by our own validation
+
 	for _, s := range []struct {
 		HTTPRRs []HTTPSRR
 		DNSRRs  *[]dns.RR
@@ -336,6 +326,12 @@ func (d *DNSServer) httpsLookup(ctx context.Context, t *http.Transport, urlStr s
 		}
 	}
 
+	if ecs := d.EDNS.httpsScope(req, dresp.EDNSClientSubnet); ecs != nil {
+		opt := newOPT(d.udpSize(), dnssecOK(req))
+		opt.Option = append(opt.Option, ecs)
+		resp.Extra = append(resp.Extra, opt)
+	}
+
 	sendResponse(&resp)
 }
 
@@ -0,0 +1,127 @@
+package dnsserver
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// LocalResolver resolves hostnames and addresses known locally. Along with the
+// results, each method returns the time until the first of them expires, or 0
+// if none of them expire.
+type LocalResolver interface {
+	Lookup(host string) ([]net.IP, time.Duration)
+	LookupAddr(ip net.IP) ([]string, time.Duration)
+}
+
+const (
+	ipv4ArpaSuffix = ".in-addr.arpa."
+	ipv6ArpaSuffix = ".ip6.arpa."
+)
+
+// arpaToIP converts a reverse lookup name (e.g. 5.1.168.192.in-addr.arpa.) to
+// the ip address it represents. It returns nil if name is not a complete
+// reverse lookup name.
+func arpaToIP(name string) net.IP {
+	name = strings.ToLower(name)
+
+	if strings.HasSuffix(name, ipv4ArpaSuffix) {
+		labels := strings.Split(name[:len(name)-len(ipv4ArpaSuffix)], ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			b, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(b)
+		}
+
+		return ip.To16()
+	}
+
+	if strings.HasSuffix(name, ipv6ArpaSuffix) {
+		labels := strings.Split(name[:len(name)-len(ipv6ArpaSuffix)], ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+
+			j := 2*net.IPv6len - 1 - i
+			if j%2 == 0 {
+				ip[j/2] |= byte(n) << 4
+			} else {
+				ip[j/2] |= byte(n)
+			}
+		}
+
+		return ip
+	}
+
+	return nil
+}
+
+// localHostsTTL returns LocalHostsTTL, limited to expires if it is set
+func (d *DNSServer) localHostsTTL(expires time.Duration) uint32 {
+	ttl := d.LocalHostsTTL
+	if expires > 0 && expires < ttl {
+		ttl = expires
+	}
+	return uint32(ttl / time.Second)
+}
+
+func (d *DNSServer) localHostsReply(req *dns.Msg) *dns.Msg {
+	if d.LocalHosts == nil {
+		return nil
+	}
+
+	q := req.Question[0]
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		ips, expires := d.LocalHosts.Lookup(strings.ToLower(unfqdn(q.Name)))
+		if len(ips) == 0 {
+			return nil
+		}
+
+		// the name is known locally, so even if there are no addresses of the
+		// requested type, respond with an empty answer rather than forwarding
+		return d.ipsReply(req, ips, d.localHostsTTL(expires))
+	case dns.TypePTR:
+		ip := arpaToIP(q.Name)
+		if ip == nil {
+			return nil
+		}
+
+		names, expires := d.LocalHosts.LookupAddr(ip)
+		if len(names) == 0 {
+			return nil
+		}
+
+		ttl := d.localHostsTTL(expires)
+
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Authoritative = true
+		resp.Answer = []dns.RR{&dns.PTR{
+			Hdr: newHdr(q.Name, dns.TypePTR, ttl),
+			Ptr: dns.Fqdn(names[0]),
+		}}
+
+		return resp
+	}
+
+	return nil
+}
@@ -10,25 +10,13 @@ import (
 	"github.com/miekg/dns"
 )
 
-func getResult(ctx context.Context, ticker *time.Ticker, respCh <-chan *dns.Msg) (resp *dns.Msg, responded, canceled bool) {
-	select {
-	case <-ctx.Done():
-		canceled = true
-	case resp = <-respCh:
-		responded = true
-	case <-ticker.C:
-	}
-
-	return
-}
-
 func (d *DNSServer) easyLookup(ctx context.Context, host string, addr ...string) []net.IP {
 	var ret []net.IP
 
 	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
 		var req dns.Msg
 		req.SetQuestion(host, t)
-		resp := d.fastLookup(ctx, "", addr, &req)
+		resp := d.fastLookup(ctx, "", addr, newSelector(StrategyOrdered), &req)
 
 		if resp == nil {
 			return nil
@@ -48,45 +36,79 @@ func (d *DNSServer) easyLookup(ctx context.Context, host string, addr ...string)
 	return ret
 }
 
-func (d *DNSServer) fastLookup(ctx context.Context, net string, addr []string, req *dns.Msg) *dns.Msg {
-	respCh := make(chan *dns.Msg)
+// raceLookups starts lookup on each nameserver in addr, in order, every
+// interval, and returns the first successful response. An interval of zero
+// starts all of the lookups at once.
+func raceLookups(ctx context.Context, addr []string, interval time.Duration, lookup func(nameserver string, respCh chan<- *dns.Msg)) *dns.Msg {
+	// buffered so that no response is dropped while waiting on the ticker
+	respCh := make(chan *dns.Msg, len(addr))
+
+	var tickCh <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tickCh = ticker.C
+	}
 
-	ticker := time.NewTicker(d.LookupInterval)
-	defer ticker.Stop()
 	var nresponses int
 
-	// start lookup on each nameserver top-down, every LookupInterval
 	for _, nameserver := range addr {
-		go d.lookup(net, nameserver, req, respCh)
+		go lookup(nameserver, respCh)
+
+		if interval <= 0 {
+			continue
+		}
 
 		// but exit early, if we have an answer
-		if resp, responded, canceled := getResult(ctx, ticker, respCh); resp != nil || canceled {
-			return resp
-		} else if responded {
+		select {
+		case <-ctx.Done():
+			return nil
+		case resp := <-respCh:
+			if resp != nil {
+				return resp
+			}
 			nresponses++
+		case <-tickCh:
 		}
 	}
 
-	ticker.Stop()
-
 	for i := nresponses; i < len(addr); i++ {
-		if resp, _, canceled := getResult(ctx, ticker, respCh); resp != nil || canceled {
-			return resp
+		select {
+		case <-ctx.Done():
+			return nil
+		case resp := <-respCh:
+			if resp != nil {
+				return resp
+			}
 		}
 	}
 
 	return nil
 }
 
+func (d *DNSServer) fastLookup(ctx context.Context, net string, addr []string, sel *selector, req *dns.Msg) *dns.Msg {
+	addr = sel.order(d.Health, net, addr)
+
+	return raceLookups(ctx, addr, sel.interval(d.LookupInterval), func(nameserver string, respCh chan<- *dns.Msg) {
+		d.lookup(net, nameserver, req, respCh)
+	})
+}
+
 func (d *DNSServer) lookup(net, nameserver string, req *dns.Msg, respCh chan<- *dns.Msg) {
 	c := &dns.Client{
 		Net:          net,
+		UDPSize:      d.udpSize(),
 		DialTimeout:  d.DialTimeout,
 		ReadTimeout:  d.ClientTimeout,
 		WriteTimeout: d.ClientTimeout,
 	}
 
+	begin := time.Now()
+
+	// results are recorded under the net of the last attempt
 	sendResponse := func(resp *dns.Msg) {
+		d.Health.Record(c.Net, nameserver, time.Since(begin), resp != nil)
+
 		select {
 		case respCh <- resp:
 		default:
@@ -100,20 +122,30 @@ func (d *DNSServer) lookup(net, nameserver string, req *dns.Msg, respCh chan<- *
 		"nameserver": nameserver,
 	})
 
-	// TODO(jrubin)
-	// Exchange does not retry a failed query, nor will it fall back to TCP in
-	// case of truncation.
-	// It is up to the caller to create a message that allows for larger responses to be
-	// returned. Specifically this means adding an EDNS0 OPT RR that will advertise a larger
-	// buffer, see SetEdns0. Messsages without an OPT RR will fallback to the historic limit
-	// of 512 bytes.
-	resp, _, err := c.Exchange(req, nameserver)
+	ureq := d.upstreamRequest(net, nameserver, req)
+
+	// Exchange returns dns.ErrTruncated along with the message when the TC
+	// bit is set
+	resp, _, err := c.Exchange(ureq, nameserver)
+	if (err == nil || err == dns.ErrTruncated) && resp != nil && resp.Truncated && isUDP(c.Net) {
+		ctxLog.Debug("truncated response, retrying over tcp")
+
+		// the udp attempt did get an answer, just not all of it
+		d.Health.Record(c.Net, nameserver, time.Since(begin), true)
+
+		c.Net = tcpNet(c.Net)
+		begin = time.Now()
+		resp, _, err = c.Exchange(ureq, nameserver)
+	}
+
 	if err != nil {
 		ctxLog.WithError(err).Warn("socket error")
 		sendResponse(nil)
 		return
 	}
 
+	d.EDNS.setServerCookie(nameserver, resp)
+
 	if resp != nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
 		ctxLog.Warn("failed to get a valid answer")
 		if resp.Rcode == dns.RcodeServerFailure {
@@ -124,3 +156,18 @@ func (d *DNSServer) lookup(net, nameserver string, req *dns.Msg, respCh chan<- *
 
 	sendResponse(resp)
 }
+
+// recurse resolves req iteratively with d.Recursor. It returns nil on
+// failure.
+func (d *DNSServer) recurse(ctx context.Context, req *dns.Msg) *dns.Msg {
+	resp, err := d.Recursor.Resolve(ctx, req)
+	if err != nil {
+		d.Logger.WithFields(slog.Fields{
+			"name": req.Question[0].Name,
+			"type": dns.TypeToString[req.Question[0].Qtype],
+		}).WithError(err).Warn("recursive resolution failed")
+		return nil
+	}
+
+	return resp
+}
@@ -0,0 +1,166 @@
+package dnsserver
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var pausedUntil = prom.NewGaugeVec(
+	prom.GaugeOpts{
+		Namespace: "blamedns",
+		Subsystem: "dns",
+		Name:      "block_paused_until_timestamp_seconds",
+		Help:      "Time blocking resumes, for all clients (client=\"all\") or a single one.",
+	},
+	[]string{"client"},
+)
+
+func init() {
+	prom.MustRegister(pausedUntil)
+}
+
+// pauseLabel is the client label of pausedUntil for client
+func pauseLabel(client net.IP) string {
+	if client == nil {
+		return "all"
+	}
+	return client.String()
+}
+
+// Pause temporarily disables blocking, for every client or for single ones.
+// Blocking resumes automatically once the pause is over. A nil Pause never
+// pauses anything.
+type Pause struct {
+	mu      sync.Mutex
+	all     time.Time
+	clients map[string]time.Time
+}
+
+// PauseStatus is how long blocking remains paused
+type PauseStatus struct {
+	Until     time.Time `json:"until,omitempty"`
+	Remaining float64   `json:"remaining_seconds"`
+}
+
+func newPauseStatus(t, until time.Time) PauseStatus {
+	return PauseStatus{
+		Until:     until,
+		Remaining: until.Sub(t).Seconds(),
+	}
+}
+
+// Pause disables blocking for client, or everyone if client is nil, for d and
+// returns when blocking will resume
+func (p *Pause) Pause(client net.IP, d time.Duration) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	until := time.Now().Add(d)
+	pausedUntil.WithLabelValues(pauseLabel(client)).Set(float64(until.Unix()))
+
+	if client == nil {
+		p.all = until
+		return until
+	}
+
+	if p.clients == nil {
+		p.clients = map[string]time.Time{}
+	}
+
+	p.clients[client.String()] = until
+
+	return until
+}
+
+// Resume blocking for client, or everyone if client is nil. Resuming for
+// everyone also ends the pauses of single clients.
+func (p *Pause) Resume(client net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if client != nil {
+		delete(p.clients, client.String())
+		pausedUntil.DeleteLabelValues(pauseLabel(client))
+		return
+	}
+
+	p.all = time.Time{}
+	p.clients = nil
+	pausedUntil.Reset()
+}
+
+// Paused returns whether blocking is paused for client at t
+func (p *Pause) Paused(t time.Time, client net.IP) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return t.Before(p.all) || p.pausedClient(t, client)
+}
+
+// PausedClient returns whether blocking is paused for just client at t, and
+// not for everyone
+func (p *Pause) PausedClient(t time.Time, client net.IP) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return !t.Before(p.all) && p.pausedClient(t, client)
+}
+
+func (p *Pause) pausedClient(t time.Time, client net.IP) bool {
+	if client == nil {
+		return false
+	}
+
+	until, ok := p.clients[client.String()]
+	if !ok {
+		return false
+	}
+
+	if !t.Before(until) {
+		delete(p.clients, client.String())
+		pausedUntil.DeleteLabelValues(client.String())
+		return false
+	}
+
+	return true
+}
+
+// Status returns the pause for all clients, if any, and those of single
+// clients at t
+func (p *Pause) Status(t time.Time) (*PauseStatus, map[string]PauseStatus) {
+	if p == nil {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var all *PauseStatus
+	if t.Before(p.all) {
+		s := newPauseStatus(t, p.all)
+		all = &s
+	}
+
+	clients := map[string]PauseStatus{}
+	for client, until := range p.clients {
+		if !t.Before(until) {
+			delete(p.clients, client)
+			pausedUntil.DeleteLabelValues(client)
+			continue
+		}
+		clients[client] = newPauseStatus(t, until)
+	}
+
+	return all, clients
+}
@@ -0,0 +1,365 @@
+package dnsserver
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jrubin.io/slog"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var rateLimited = prom.NewCounterVec(
+	prom.CounterOpts{
+		Namespace: "blamedns",
+		Subsystem: "dns",
+		Name:      "rate_limited_total",
+		Help:      "Number of queries and responses limited, by which limit was hit and what was done.",
+	},
+	[]string{"limit", "action"},
+)
+
+func init() {
+	prom.MustRegister(rateLimited)
+}
+
+// A RateLimitMode is how queries over the rate limit are answered
+type RateLimitMode string
+
+const (
+	// RateLimitDrop doesn't answer at all
+	RateLimitDrop RateLimitMode = "drop"
+
+	// RateLimitRefuse answers with REFUSED
+	RateLimitRefuse RateLimitMode = "refuse"
+
+	// RateLimitTruncate answers udp queries with an empty, truncated
+	// response so that legitimate clients retry over tcp, which can't be
+	// spoofed. Queries over other networks are refused.
+	RateLimitTruncate RateLimitMode = "truncate"
+)
+
+// ParseRateLimitMode returns the RateLimitMode named by s. An empty string is
+// RateLimitRefuse.
+func ParseRateLimitMode(s string) (RateLimitMode, error) {
+	switch RateLimitMode(s) {
+	case "":
+		return RateLimitRefuse, nil
+	case RateLimitDrop, RateLimitRefuse, RateLimitTruncate:
+		return RateLimitMode(s), nil
+	}
+
+	return "", errors.Errorf("invalid rate limit mode: %s", s)
+}
+
+const (
+	DefaultRateLimitIPv4Prefix = 32
+	DefaultRateLimitIPv6Prefix = 56
+
+	// at most this many buckets are tracked, the least recently used are
+	// removed to make room for new ones
+	maxRateLimitBuckets = 65536
+
+	// how often buckets that have refilled are removed
+	rateLimitPruneInterval = time.Minute
+)
+
+// bucket is a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(now time.Time, qps float64, burst int) bool {
+	switch {
+	case b.last.IsZero():
+		b.tokens = float64(burst)
+		b.last = now
+	case now.After(b.last):
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*qps)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// full returns whether the bucket would have refilled by now, in which case
+// there is no reason to keep it
+func (b *bucket) full(now time.Time, qps float64, burst int) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*qps >= float64(burst)
+}
+
+// buckets are token buckets keyed by client, with the least recently used
+// removed once there are maxRateLimitBuckets of them
+type buckets struct {
+	qps    float64
+	burst  int
+	data   *simplelru.LRU
+	pruned time.Time
+}
+
+func newBuckets(qps float64, burst int) *buckets {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(qps)))
+	}
+
+	data, err := simplelru.NewLRU(maxRateLimitBuckets, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return &buckets{
+		qps:   qps,
+		burst: burst,
+		data:  data,
+	}
+}
+
+func (bs *buckets) take(now time.Time, key string) bool {
+	if bs == nil || bs.qps <= 0 {
+		return true
+	}
+
+	if now.Sub(bs.pruned) >= rateLimitPruneInterval {
+		bs.prune(now)
+	}
+
+	var b *bucket
+	if value, ok := bs.data.Get(key); ok {
+		b = value.(*bucket)
+	} else {
+		b = &bucket{}
+		bs.data.Add(key, b)
+	}
+
+	return b.take(now, bs.qps, bs.burst)
+}
+
+// refund returns the token that was just taken from the bucket for key
+func (bs *buckets) refund(key string) {
+	if bs == nil || bs.qps <= 0 {
+		return
+	}
+
+	if value, ok := bs.data.Peek(key); ok {
+		b := value.(*bucket)
+		b.tokens = math.Min(float64(bs.burst), b.tokens+1)
+	}
+}
+
+// prune removes the buckets, starting from the least recently used, that
+// have refilled
+func (bs *buckets) prune(now time.Time) {
+	bs.pruned = now
+
+	for {
+		_, value, ok := bs.data.GetOldest()
+		if !ok || !value.(*bucket).full(now, bs.qps, bs.burst) {
+			return
+		}
+
+		bs.data.RemoveOldest()
+	}
+}
+
+// RateLimit limits the rate of queries from each client, identified by its
+// address masked to IPv4Prefix or IPv6Prefix bits, and from all clients
+// together. Separately, response rate limiting (RRL) limits how often the same
+// response is sent to the same client over udp to keep blamedns from being
+// used in reflection attacks. A nil RateLimit doesn't limit anything.
+type RateLimit struct {
+	QPS         float64
+	Burst       int
+	GlobalQPS   float64
+	GlobalBurst int
+	IPv4Prefix  int
+	IPv6Prefix  int
+	Mode        RateLimitMode
+
+	// Exempt clients are never limited
+	Exempt []*net.IPNet
+
+	ResponseQPS   float64
+	ResponseBurst int
+
+	// every Slip-th rate limited response is sent truncated instead of
+	// being dropped so that legitimate clients can retry over tcp. 0 drops
+	// all of them.
+	Slip int
+
+	once      sync.Once
+	mu        sync.Mutex
+	clients   *buckets
+	global    *buckets
+	responses *buckets
+	slipped   int
+}
+
+func (l *RateLimit) init() {
+	l.once.Do(func() {
+		l.clients = newBuckets(l.QPS, l.Burst)
+		l.global = newBuckets(l.GlobalQPS, l.GlobalBurst)
+		l.responses = newBuckets(l.ResponseQPS, l.ResponseBurst)
+	})
+}
+
+func (l *RateLimit) exempt(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+
+	for _, n := range l.Exempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prefix returns the network of ip that is limited as a single client
+func (l *RateLimit) prefix(ip net.IP) string {
+	bits, prefix := 8*net.IPv6len, l.IPv6Prefix
+	if prefix <= 0 {
+		prefix = DefaultRateLimitIPv6Prefix
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits, prefix = 8*net.IPv4len, l.IPv4Prefix
+		if prefix <= 0 {
+			prefix = DefaultRateLimitIPv4Prefix
+		}
+	}
+
+	if prefix > bits {
+		prefix = bits
+	}
+
+	return ip.Mask(net.CIDRMask(prefix, bits)).String()
+}
+
+// allowQuery returns which limit, if any, a query from ip exceeds
+func (l *RateLimit) allowQuery(now time.Time, ip net.IP) string {
+	if l == nil || l.exempt(ip) {
+		return ""
+	}
+
+	l.init()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := l.prefix(ip)
+	if !l.clients.take(now, key) {
+		return "client"
+	}
+
+	// clients aren't charged for queries that they didn't get to make
+	if !l.global.take(now, "") {
+		l.clients.refund(key)
+		return "global"
+	}
+
+	return ""
+}
+
+// allowResponse returns what to do with resp, to ip over net: send it (""),
+// drop it or send a truncated response in its place
+func (l *RateLimit) allowResponse(now time.Time, net string, ip net.IP, resp *dns.Msg) RateLimitMode {
+	if l == nil || l.ResponseQPS <= 0 || !isUDP(net) || l.exempt(ip) || len(resp.Question) == 0 {
+		return ""
+	}
+
+	l.init()
+
+	q := resp.Question[0]
+	key := strings.Join([]string{
+		l.prefix(ip),
+		strconv.Itoa(resp.Rcode),
+		strings.ToLower(q.Name),
+		strconv.Itoa(int(q.Qtype)),
+	}, "/")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.responses.take(now, key) {
+		return ""
+	}
+
+	if l.Slip > 0 {
+		l.slipped++
+		if l.slipped%l.Slip == 0 {
+			return RateLimitTruncate
+		}
+	}
+
+	return RateLimitDrop
+}
+
+func truncated(req *dns.Msg) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Truncated = true
+	return resp
+}
+
+// rateLimitHandler returns h, limited by d.RateLimit
+func (d *DNSServer) rateLimitHandler(net string, h dns.Handler) dns.Handler {
+	if d.RateLimit == nil {
+		return h
+	}
+
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		ip := clientIP(w.RemoteAddr())
+
+		limit := d.RateLimit.allowQuery(time.Now(), ip)
+		if len(limit) == 0 {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		mode := d.RateLimit.Mode
+		if mode == RateLimitTruncate && !isUDP(net) {
+			mode = RateLimitRefuse
+		}
+
+		rateLimited.WithLabelValues(limit, string(mode)).Inc()
+
+		d.Logger.WithFields(slog.Fields{
+			"client": ip,
+			"limit":  limit,
+			"action": mode,
+			"net":    net,
+		}).Debug("rate limited query")
+
+		var resp *dns.Msg
+
+		switch mode {
+		case RateLimitDrop:
+			return
+		case RateLimitTruncate:
+			resp = truncated(req)
+		default:
+			resp = &dns.Msg{}
+			resp.SetRcode(req, dns.RcodeRefused)
+		}
+
+		if err := w.WriteMsg(resp); err != nil {
+			d.Logger.WithError(err).Error("error writing response")
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package dnsserver
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A Zone routes requests for Name (and its subdomains) to the nameservers in
+// Addr, queried according to Strategy. If Clients is not empty, the zone only
+// applies to requests from clients within those networks.
+type Zone struct {
+	Name      string
+	Clients   []*net.IPNet
+	Addr      []string
+	Strategy  Strategy
+	Recursive bool
+}
+
+func (z Zone) matchClient(ip net.IP) bool {
+	if len(z.Clients) == 0 {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range z.Clients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type route struct {
+	zone    Zone
+	handler dns.Handler
+}
+
+// router selects the handler for a request based on both the query name and
+// the address of the client.
+type router struct {
+	zones      map[string][]route
+	restricted dns.Handler
+}
+
+func newRouter() *router {
+	return &router{
+		zones: map[string][]route{},
+	}
+}
+
+func (r *router) add(zone Zone, handler dns.Handler) {
+	name := strings.ToLower(dns.Fqdn(zone.Name))
+	r.zones[name] = append(r.zones[name], route{
+		zone:    zone,
+		handler: handler,
+	})
+}
+
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// match finds the most specific zone that contains qname. DS records are
+// served by the parent zone, so for them, a zone exactly matching qname is
+// skipped. It returns nil if no zone matches.
+func (r *router) match(qname string, qtype uint16) []route {
+	name := strings.ToLower(dns.Fqdn(qname))
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if off == 0 && qtype == dns.TypeDS && name != "." {
+			continue
+		}
+
+		if routes, ok := r.zones[name[off:]]; ok {
+			return routes
+		}
+	}
+
+	return r.zones["."]
+}
+
+// handler returns the handler for the first route of the most specific
+// matching zone that applies to client. If the zone matches but none of its
+// routes apply to the client, the restricted handler is returned. If no zone
+// matches, nil is returned.
+func (r *router) handler(qname string, qtype uint16, client net.IP) dns.Handler {
+	routes := r.match(qname, qtype)
+	if routes == nil {
+		return nil
+	}
+
+	for _, rt := range routes {
+		if rt.zone.matchClient(client) {
+			return rt.handler
+		}
+	}
+
+	return r.restricted
+}
+
+func (r *router) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) == 0 {
+		dns.HandleFailed(w, req)
+		return
+	}
+
+	q := req.Question[0]
+
+	h := r.handler(q.Name, q.Qtype, clientIP(w.RemoteAddr()))
+	if h == nil {
+		dns.HandleFailed(w, req)
+		return
+	}
+
+	h.ServeDNS(w, req)
+}
+
+// RestrictedHandler responds with NXDOMAIN to requests for zones that are
+// restricted to clients other than the requester.
+func (d *DNSServer) RestrictedHandler(net string) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		begin := time.Now()
+
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeNameError)
+
+		r := d.respond(net, w, req, time.Since(begin), &hresp{
+			resp:  resp,
+			cache: cacheHit,
+		})
+
+		observe(r, time.Since(begin))
+	})
+}
@@ -0,0 +1,120 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+
+	"jrubin.io/blamedns/rpz"
+
+	"github.com/miekg/dns"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var rpzHits = prom.NewCounterVec(
+	prom.CounterOpts{
+		Namespace: "blamedns",
+		Subsystem: "dns",
+		Name:      "rpz_hits_total",
+		Help:      "Number of queries response policy zone rules applied to, by zone, trigger and action.",
+	},
+	[]string{"zone", "trigger", "action"},
+)
+
+func init() {
+	prom.MustRegister(rpzHits)
+}
+
+// maxChase is how many local data cnames are followed for a single request, so
+// that policies rewriting names to each other can't loop forever
+const maxChase = 8
+
+// chaseKey is the context key of how many cnames have been followed
+type chaseKey struct{}
+
+// policyResponse returns the response to req that p calls for, or nil if req
+// should be answered as usual
+func (d *DNSServer) policyResponse(ctx context.Context, net string, client net.IP, src source, req *dns.Msg, p *rpz.Policy) *hresp {
+	if p == nil {
+		return nil
+	}
+
+	rpzHits.WithLabelValues(p.Zone, p.Trigger, p.Action.String()).Inc()
+
+	r := &hresp{
+		blocked: true,
+		cache:   cacheHit,
+		nocache: true,
+		policy:  p,
+	}
+
+	switch p.Action {
+	case rpz.Passthru:
+		return nil
+	case rpz.TCPOnly:
+		if !isUDP(net) {
+			return nil
+		}
+		r.resp = truncated(req)
+	case rpz.Drop:
+		r.resp = &dns.Msg{}
+		r.resp.SetReply(req)
+		r.drop = true
+	default:
+		r.resp = p.Reply(req)
+		d.chase(ctx, net, client, src, req, r.resp)
+	}
+
+	return r
+}
+
+// responsePolicy returns r, or the response that the policy for r.resp calls
+// for. Responses to queries that a query name policy let through are not
+// checked again.
+func (d *DNSServer) responsePolicy(ctx context.Context, net string, client net.IP, src source, req *dns.Msg, qp *rpz.Policy, r *hresp) *hresp {
+	if qp != nil || r.resp == nil {
+		return r
+	}
+
+	if ret := d.policyResponse(ctx, net, client, src, req, d.RPZ.Response(r.resp)); ret != nil {
+		ret.cache = r.cache
+		return ret
+	}
+
+	return r
+}
+
+// chase resolves the target of the cname that local data rewrote req to, so
+// that clients get the records they asked for. The target is handled like any
+// other request from client, so it may be blocked, answered from the cache or
+// rewritten by policies itself.
+func (d *DNSServer) chase(ctx context.Context, net string, client net.IP, src source, req, resp *dns.Msg) {
+	if len(resp.Answer) != 1 || req.Question[0].Qtype == dns.TypeCNAME || !req.RecursionDesired {
+		return
+	}
+
+	cname, ok := resp.Answer[0].(*dns.CNAME)
+	if !ok {
+		return
+	}
+
+	depth, _ := ctx.Value(chaseKey{}).(int)
+	if depth >= maxChase {
+		return
+	}
+
+	sub := req.Copy()
+	sub.Question[0].Name = cname.Target
+
+	respCh := make(chan *hresp, 1)
+	d.bgHandler(context.WithValue(ctx, chaseKey{}, depth+1), net, client, src, sub, respCh)
+
+	ret := <-respCh
+	if ret.drop || ret.resp == nil {
+		return
+	}
+
+	d.store(ret)
+
+	resp.Answer = append(resp.Answer, ret.resp.Answer...)
+	resp.Rcode = ret.resp.Rcode
+}
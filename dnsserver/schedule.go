@@ -0,0 +1,191 @@
+package dnsserver
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Schedule is a weekly time range in a time zone, e.g. weekdays from 21:00
+// to 07:00. Ranges that end before they start span midnight and belong to the
+// day they start on. Ranges that start when they end last all day.
+type Schedule struct {
+	Days     []time.Weekday // every day if empty
+	Start    time.Duration  // since midnight
+	End      time.Duration  // since midnight
+	Location *time.Location // UTC if nil
+}
+
+var scheduleDays = map[string][]time.Weekday{
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		scheduleDays[name] = []time.Weekday{d}
+		scheduleDays[name[:3]] = []time.Weekday{d}
+	}
+}
+
+func parseClock(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid time of day: %s", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseSchedule returns the schedule for days (e.g. mon, tuesday, weekdays or
+// weekends), between start and end (e.g. 21:00 and 07:00) in the time zone
+// named tz (e.g. America/Los_Angeles or Local)
+func ParseSchedule(days []string, start, end, tz string) (*Schedule, error) {
+	ret := &Schedule{}
+
+	for _, day := range days {
+		d, ok := scheduleDays[strings.ToLower(strings.TrimSpace(day))]
+		if !ok {
+			return nil, errors.Errorf("invalid day: %s", day)
+		}
+		ret.Days = append(ret.Days, d...)
+	}
+
+	var err error
+
+	if ret.Start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+
+	if ret.End, err = parseClock(end); err != nil {
+		return nil, err
+	}
+
+	if len(tz) > 0 {
+		if ret.Location, err = time.LoadLocation(tz); err != nil {
+			return nil, errors.Wrapf(err, "invalid time zone: %s", tz)
+		}
+	}
+
+	return ret, nil
+}
+
+func (s *Schedule) location() *time.Location {
+	if s.Location == nil {
+		return time.UTC
+	}
+	return s.Location
+}
+
+func (s *Schedule) onDay(d time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+
+	for _, day := range s.Days {
+		if day == d {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Active returns whether t is within s
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.location())
+	day := t.Weekday()
+
+	h, m, sec := t.Clock()
+	off := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+
+	switch {
+	case s.Start == s.End:
+		return s.onDay(day)
+	case s.Start < s.End:
+		return s.onDay(day) && off >= s.Start && off < s.End
+	case off >= s.Start:
+		return s.onDay(day)
+	case off < s.End:
+		return s.onDay((day + 6) % 7)
+	}
+
+	return false
+}
+
+// Next returns the first time after t at which s starts or ends. It returns
+// the zero time if s never changes.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.In(s.location())
+	y, m, d := t.Date()
+
+	// every boundary is at midnight, s.Start or s.End of one of the next
+	// week's days
+	for i := 0; i <= 8; i++ {
+		var ret time.Time
+
+		for _, off := range []time.Duration{0, s.Start, s.End} {
+			b := time.Date(y, m, d+i, int(off/time.Hour), int(off%time.Hour/time.Minute), 0, 0, t.Location())
+			if !b.After(t) || s.Active(b) == s.Active(b.Add(-time.Second)) {
+				continue
+			}
+
+			if ret.IsZero() || b.Before(ret) {
+				ret = b
+			}
+		}
+
+		if !ret.IsZero() {
+			return ret
+		}
+	}
+
+	return time.Time{}
+}
+
+// A ScheduledBlock blocks Domains (and their subdomains) and the hosts of the
+// blocklist Sources only while Schedule is active, and only for Clients, or
+// every client if empty. Sources of any ScheduledBlock never block outside of
+// their schedules.
+type ScheduledBlock struct {
+	Name     string
+	Schedule *Schedule
+	Clients  []*net.IPNet
+	Domains  []string
+	Sources  []string
+}
+
+func (sb *ScheduledBlock) applies(t time.Time, client net.IP) bool {
+	if !sb.Schedule.Active(t) {
+		return false
+	}
+
+	return len(sb.Clients) == 0 || (client != nil && contains(sb.Clients, client))
+}
+
+func (sb *ScheduledBlock) hasDomain(host string) bool {
+	for _, d := range sb.Domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSource returns whether source is one of sb.Sources, or a file in one of
+// them that is a directory
+func (sb *ScheduledBlock) hasSource(source string) bool {
+	for _, s := range sb.Sources {
+		if s == source || strings.HasPrefix(source, s+"/") {
+			return true
+		}
+	}
+	return false
+}
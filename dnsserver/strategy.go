@@ -0,0 +1,116 @@
+package dnsserver
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Strategy determines the order in which the nameservers of a zone are
+// queried
+type Strategy string
+
+const (
+	// StrategyOrdered queries nameservers in the configured order
+	StrategyOrdered Strategy = "ordered"
+
+	// StrategyRoundRobin starts with the next nameserver on each request
+	StrategyRoundRobin Strategy = "round-robin"
+
+	// StrategyRandom queries nameservers in a random order
+	StrategyRandom Strategy = "random"
+
+	// StrategyLowestLatency queries nameservers with the lowest moving average
+	// response time first. Nameservers without a known latency are queried
+	// before all others so that they can be measured. Latency is measured by
+	// Health, without which every nameserver is unknown and they are queried
+	// in the configured order.
+	StrategyLowestLatency Strategy = "lowest-latency"
+
+	// StrategyParallel queries all nameservers at once and uses the first
+	// response
+	StrategyParallel Strategy = "parallel"
+)
+
+// ParseStrategy returns the Strategy named by s. An empty string is
+// StrategyOrdered.
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case "":
+		return StrategyOrdered, nil
+	case StrategyOrdered, StrategyRoundRobin, StrategyRandom, StrategyLowestLatency, StrategyParallel:
+		return Strategy(s), nil
+	}
+
+	return "", errors.Errorf("invalid upstream strategy: %s", s)
+}
+
+// selector holds the state of a Strategy for a single zone
+type selector struct {
+	strategy Strategy
+	next     uint32
+}
+
+func newSelector(strategy Strategy) *selector {
+	return &selector{strategy: strategy}
+}
+
+// order returns addr in the order it should be queried. Regardless of
+// strategy, unhealthy nameservers are always queried last.
+func (s *selector) order(h *Health, net string, addr []string) []string {
+	if len(addr) < 2 {
+		return addr
+	}
+
+	ret := make([]string, len(addr))
+
+	switch s.strategy {
+	case StrategyRoundRobin:
+		n := int((atomic.AddUint32(&s.next, 1) - 1) % uint32(len(addr)))
+		copy(ret, addr[n:])
+		copy(ret[len(addr)-n:], addr[:n])
+	case StrategyRandom:
+		for i, j := range rand.Perm(len(addr)) {
+			ret[i] = addr[j]
+		}
+	case StrategyLowestLatency:
+		copy(ret, addr)
+		bl := byLatency{addr: ret, latency: make([]time.Duration, len(ret))}
+		for i, a := range ret {
+			bl.latency[i] = h.Latency(net, a)
+		}
+		sort.Stable(bl)
+	default:
+		copy(ret, addr)
+	}
+
+	return h.Order(net, ret)
+}
+
+// interval returns how long to wait for a response before querying the next
+// nameserver
+func (s *selector) interval(d time.Duration) time.Duration {
+	if s.strategy == StrategyParallel {
+		return 0
+	}
+	return d
+}
+
+type byLatency struct {
+	addr    []string
+	latency []time.Duration
+}
+
+func (b byLatency) Len() int { return len(b.addr) }
+
+func (b byLatency) Swap(i, j int) {
+	b.addr[i], b.addr[j] = b.addr[j], b.addr[i]
+	b.latency[i], b.latency[j] = b.latency[j], b.latency[i]
+}
+
+func (b byLatency) Less(i, j int) bool {
+	return b.latency[i] < b.latency[j]
+}
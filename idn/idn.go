@@ -0,0 +1,53 @@
+// Package idn converts internationalized domain names between their unicode
+// form and the ascii form, made of A-labels ("xn--..."), used in dns messages
+package idn
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// profile maps names as UTS #46 does for lookups, but unlike idna.Lookup
+// allows underscores since they are common in block lists
+var profile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.StrictDomainName(false),
+	idna.BidiRule(),
+)
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// ToASCII returns host with each unicode label mapped and converted to an
+// A-label. Ascii hosts are returned unchanged.
+func ToASCII(host string) (string, error) {
+	if isASCII(host) {
+		return host, nil
+	}
+
+	return profile.ToASCII(host)
+}
+
+// ToUnicode returns host with each A-label converted to unicode, for display.
+// host is returned unchanged if it has no valid A-labels.
+func ToUnicode(host string) string {
+	if !strings.Contains(strings.ToLower(host), "xn--") {
+		return host
+	}
+
+	ret, err := profile.ToUnicode(host)
+	if err != nil {
+		return host
+	}
+
+	return ret
+}
@@ -0,0 +1,33 @@
+package idn
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIDN(t *testing.T) {
+	Convey("idn should work", t, func() {
+		for _, test := range []struct {
+			Unicode, ASCII string
+		}{
+			{"example.com", "example.com"},
+			{"bücher.example", "xn--bcher-kva.example"},
+			{"BÜCHER.example", "xn--bcher-kva.example"},
+			{"faß.de", "xn--fa-hia.de"},
+			{"пример.испытание", "xn--e1afmkfd.xn--80akhbyknj4f"},
+			{"_dmarc.bücher.example", "_dmarc.xn--bcher-kva.example"},
+		} {
+			ascii, err := ToASCII(test.Unicode)
+			So(err, ShouldBeNil)
+			So(ascii, ShouldEqual, test.ASCII)
+		}
+
+		So(ToUnicode("xn--bcher-kva.example"), ShouldEqual, "bücher.example")
+		So(ToUnicode("example.com"), ShouldEqual, "example.com")
+		So(ToUnicode("xn--invalid-.example"), ShouldEqual, "xn--invalid-.example")
+
+		_, err := ToASCII("bücher.xn--a")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,222 @@
+package localhosts
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	Host    string
+	IP      net.IP
+	Source  string
+	Expires time.Time
+}
+
+func (e entry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !e.Expires.After(now)
+}
+
+// LocalHosts stores hostname to ip address mappings, each attributed to the
+// source it was read from, and answers forward and reverse lookups against
+// them.
+type LocalHosts struct {
+	mu    sync.RWMutex
+	names map[string][]*entry
+	addrs map[string][]*entry
+}
+
+func New() *LocalHosts {
+	return &LocalHosts{
+		names: map[string][]*entry{},
+		addrs: map[string][]*entry{},
+	}
+}
+
+func copyIP(ip net.IP) net.IP {
+	ret := make(net.IP, len(ip))
+	copy(ret, ip)
+	return ret
+}
+
+func hasEntry(entries []*entry, e *entry) bool {
+	for _, o := range entries {
+		if o.Source == e.Source && o.Host == e.Host && o.IP.Equal(e.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *LocalHosts) AddLocalHost(source, host string, ip net.IP) {
+	if ip == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.add(&entry{
+		Host:   strings.ToLower(host),
+		IP:     copyIP(ip),
+		Source: source,
+	})
+}
+
+// AddLease adds host as resolving to ip until expires. A zero expires never
+// expires. Any hostnames previously leased ip by source are replaced. If host
+// is empty, the lease for ip is only removed.
+func (h *LocalHosts) AddLease(source, host string, ip net.IP, expires time.Time) {
+	if ip == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	addr := ip.String()
+	for _, e := range h.addrs[addr] {
+		if e.Source == source {
+			h.remove(e)
+		}
+	}
+
+	if len(host) == 0 {
+		return
+	}
+
+	h.add(&entry{
+		Host:    strings.ToLower(host),
+		IP:      copyIP(ip),
+		Source:  source,
+		Expires: expires,
+	})
+}
+
+func (h *LocalHosts) add(e *entry) {
+	if hasEntry(h.names[e.Host], e) {
+		return
+	}
+
+	h.names[e.Host] = append(h.names[e.Host], e)
+
+	addr := e.IP.String()
+	h.addrs[addr] = append(h.addrs[addr], e)
+}
+
+func removeEntry(m map[string][]*entry, key string, e *entry) {
+	var keep []*entry
+	for _, o := range m[key] {
+		if o != e {
+			keep = append(keep, o)
+		}
+	}
+
+	if len(keep) == 0 {
+		delete(m, key)
+		return
+	}
+
+	m[key] = keep
+}
+
+func (h *LocalHosts) remove(e *entry) {
+	removeEntry(h.names, e.Host, e)
+	removeEntry(h.addrs, e.IP.String(), e)
+}
+
+func removeSource(m map[string][]*entry, source string) {
+	for key, entries := range m {
+		var keep []*entry
+		for _, e := range entries {
+			if e.Source != source {
+				keep = append(keep, e)
+			}
+		}
+
+		if len(keep) == 0 {
+			delete(m, key)
+			continue
+		}
+
+		m[key] = keep
+	}
+}
+
+func (h *LocalHosts) Reset(source string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	removeSource(h.names, source)
+	removeSource(h.addrs, source)
+}
+
+// ttl returns the time until the first of entries expires. It returns 0 if
+// none of them expire.
+func ttl(entries []*entry, now time.Time) time.Duration {
+	var ret time.Duration
+	for _, e := range entries {
+		if e.Expires.IsZero() {
+			continue
+		}
+
+		if d := e.Expires.Sub(now); ret == 0 || d < ret {
+			ret = d
+		}
+	}
+	return ret
+}
+
+func unexpired(entries []*entry, now time.Time) []*entry {
+	var ret []*entry
+	for _, e := range entries {
+		if !e.Expired(now) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// Lookup returns all of the ip addresses, both ipv4 and ipv6, that host
+// resolves to and the time until the first of them expires (0 if none of them
+// expire). It returns nil if host is not known.
+func (h *LocalHosts) Lookup(host string) ([]net.IP, time.Duration) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	now := time.Now()
+	entries := unexpired(h.names[strings.ToLower(host)], now)
+
+	var ret []net.IP
+	for _, e := range entries {
+		ret = append(ret, copyIP(e.IP))
+	}
+
+	return ret, ttl(entries, now)
+}
+
+// LookupAddr returns the hostnames that ip resolves to, in the order they were
+// added, and the time until the first of them expires (0 if none of them
+// expire).
+func (h *LocalHosts) LookupAddr(ip net.IP) ([]string, time.Duration) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	now := time.Now()
+	entries := unexpired(h.addrs[ip.String()], now)
+
+	var ret []string
+	for _, e := range entries {
+		ret = append(ret, e.Host)
+	}
+
+	return ret, ttl(entries, now)
+}
+
+func (h *LocalHosts) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.names)
+}
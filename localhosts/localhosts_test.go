@@ -0,0 +1,78 @@
+package localhosts
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLocalHosts(t *testing.T) {
+	Convey("localhosts should work", t, func() {
+		h := New()
+		So(h.Len(), ShouldEqual, 0)
+
+		h.AddLocalHost("/etc/hosts", "nas", net.ParseIP("192.168.1.5"))
+		h.AddLocalHost("/etc/hosts", "nas.lan", net.ParseIP("192.168.1.5"))
+		h.AddLocalHost("/etc/hosts", "nas", net.ParseIP("fd00::5"))
+		h.AddLocalHost("other", "NAS", net.ParseIP("192.168.1.6"))
+		So(h.Len(), ShouldEqual, 2)
+
+		ips, ttl := h.Lookup("nas")
+		So(ttl, ShouldEqual, 0)
+		So(len(ips), ShouldEqual, 3)
+		So(ips[0].Equal(net.ParseIP("192.168.1.5")), ShouldBeTrue)
+		So(ips[1].Equal(net.ParseIP("fd00::5")), ShouldBeTrue)
+		So(ips[2].Equal(net.ParseIP("192.168.1.6")), ShouldBeTrue)
+
+		names, _ := h.LookupAddr(net.ParseIP("192.168.1.5"))
+		So(names, ShouldResemble, []string{"nas", "nas.lan"})
+
+		names, _ = h.LookupAddr(net.ParseIP("10.0.0.1"))
+		So(names, ShouldBeNil)
+
+		h.Reset("/etc/hosts")
+		So(h.Len(), ShouldEqual, 1)
+
+		ips, _ = h.Lookup("nas.lan")
+		So(ips, ShouldBeNil)
+
+		ips, _ = h.Lookup("nas")
+		So(len(ips), ShouldEqual, 1)
+
+		names, _ = h.LookupAddr(net.ParseIP("192.168.1.5"))
+		So(names, ShouldBeNil)
+	})
+
+	Convey("leases should work", t, func() {
+		h := New()
+		ip := net.ParseIP("192.168.1.100")
+
+		h.AddLease("leases", "laptop.lan", ip, time.Now().Add(time.Hour))
+
+		ips, ttl := h.Lookup("laptop.lan")
+		So(len(ips), ShouldEqual, 1)
+		So(ttl, ShouldBeGreaterThan, 59*time.Minute)
+		So(ttl, ShouldBeLessThanOrEqualTo, time.Hour)
+
+		// a new lease for the same ip replaces the old one
+		h.AddLease("leases", "phone.lan", ip, time.Time{})
+		ips, _ = h.Lookup("laptop.lan")
+		So(ips, ShouldBeNil)
+
+		names, ttl := h.LookupAddr(ip)
+		So(names, ShouldResemble, []string{"phone.lan"})
+		So(ttl, ShouldEqual, 0)
+
+		// expired leases are not returned
+		h.AddLease("leases", "phone.lan", ip, time.Now().Add(-time.Minute))
+		ips, _ = h.Lookup("phone.lan")
+		So(ips, ShouldBeNil)
+
+		// leases without a hostname just remove the existing one
+		h.AddLease("leases", "tablet.lan", ip, time.Time{})
+		h.AddLease("leases", "", ip, time.Time{})
+		So(h.Len(), ShouldEqual, 0)
+	})
+}
@@ -2,9 +2,15 @@ package main // import "jrubin.io/blamedns"
 
 import (
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"jrubin.io/blamedns/config"
 	"jrubin.io/blamedns/context"
@@ -12,6 +18,7 @@ import (
 	"jrubin.io/slog/handlers/text"
 
 	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
 	"gopkg.in/urfave/cli.v1"
 	"gopkg.in/urfave/cli.v1/altsrc"
 )
@@ -63,6 +70,25 @@ func init() {
 				Value:  os.Stdout.Name(),
 			},
 		},
+	}, cli.Command{
+		Name:   "pause",
+		Usage:  "pause blocking on the running server",
+		Action: pause,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "for",
+				Usage: "how long to pause blocking for",
+				Value: 5 * time.Minute,
+			},
+			cli.StringFlag{
+				Name:  "client",
+				Usage: "ip address of the only client to pause blocking for",
+			},
+			cli.BoolFlag{
+				Name:  "resume",
+				Usage: "resume blocking instead of pausing it",
+			},
+		},
 	})
 }
 
@@ -115,3 +141,55 @@ func writeConfig(c *cli.Context) error {
 	enc.Indent = ""
 	return enc.Encode(cfg)
 }
+
+// apiURL returns the url of path on the running api server
+func apiURL(path string) (string, error) {
+	host, port, err := net.SplitHostPort(cfg.ListenAPIServer)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid listen-apiserver: %s", cfg.ListenAPIServer)
+	}
+
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	return "http://" + net.JoinHostPort(host, port) + path, nil
+}
+
+func pause(c *cli.Context) error {
+	u, err := apiURL("/dns/pause")
+	if err != nil {
+		return err
+	}
+
+	values := url.Values{}
+	if client := c.String("client"); len(client) > 0 {
+		values.Set("client", client)
+	}
+
+	method := http.MethodPost
+	if c.Bool("resume") {
+		method = http.MethodDelete
+	} else {
+		values.Set("for", c.Duration("for").String())
+	}
+
+	req, err := http.NewRequest(method, u+"?"+values.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	_, err = io.Copy(os.Stdout, res.Body)
+	return err
+}
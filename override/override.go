@@ -4,6 +4,7 @@ import (
 	"net"
 
 	"github.com/armon/go-radix"
+	"jrubin.io/blamedns/idn"
 	"jrubin.io/blamedns/parser"
 )
 
@@ -49,6 +50,11 @@ func New(data map[string][]net.IP) *Override {
 	}
 
 	for host, ips := range data {
+		// queries are for A-labels, so unicode hosts have to be converted
+		if h, err := idn.ToASCII(host); err == nil {
+			host = h
+		}
+
 		key := parser.ReverseHostName(host)
 		ret.data.Insert(key, copyIPs(ips))
 	}
@@ -27,7 +27,8 @@ func TestOverride(t *testing.T) {
 		So(ipsEqual(ips, "127.0.0.1", "127.0.0.2"), ShouldBeTrue)
 
 		list := map[string][]net.IP{
-			"example.com": ips,
+			"example.com":    ips,
+			"bücher.example": ips,
 		}
 
 		o := New(list)
@@ -38,5 +39,8 @@ func TestOverride(t *testing.T) {
 
 		v = o.Override("example.com")
 		So(ipsEqual(v, "127.0.0.1", "127.0.0.2"), ShouldBeTrue)
+
+		v = o.Override("xn--bcher-kva.example")
+		So(ipsEqual(v, "127.0.0.1", "127.0.0.2"), ShouldBeTrue)
 	})
 }
@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+
+	"jrubin.io/slog"
+)
+
+var bindZoneRe = regexp.MustCompile(`^zone\s+"([^"]+)"`)
+
+// BindParser parses BIND zone statements, e.g.
+// `zone "example.com" { type master; file "/etc/bind/db.empty"; };`, that
+// make the server authoritative for domains so that they, and all of their
+// subdomains, are blocked by the zone file
+type BindParser struct {
+	HostAdder DomainAdder
+	Stats     *FileStats
+	Logger    slog.Interface
+}
+
+func (b BindParser) Reset(fileName string) {
+	b.HostAdder.Reset(fileName)
+	b.Stats.reset(fileName)
+}
+
+func (b BindParser) Parse(fileName string, lineNum int, text string) bool {
+	for _, c := range []string{"//", "#"} {
+		if i := strings.Index(text, c); i != -1 {
+			text = text[:i]
+		}
+	}
+
+	text = strings.TrimSpace(text)
+	if len(text) == 0 || strings.HasPrefix(text, "/*") || strings.HasPrefix(text, "*") {
+		return false
+	}
+
+	if m := bindZoneRe.FindStringSubmatch(text); m != nil {
+		return addDomain(b.HostAdder, b.Stats, b.Logger, fileName, lineNum, m[1])
+	}
+
+	// the rest of a zone statement that spans several lines
+	if strings.HasSuffix(text, ";") || strings.HasSuffix(text, "{") {
+		return true
+	}
+
+	b.Logger.WithFields(slog.Fields{
+		"file": fileName,
+		"line": lineNum,
+		"text": text,
+	}).Warn("invalid bind zone statement")
+	b.Stats.reject(fileName)
+
+	return false
+}
+
+// Finish logs the statistics of fileName
+func (b BindParser) Finish(fileName string) {
+	logStats(b.Logger, fileName, b.Stats)
+}
@@ -0,0 +1,45 @@
+package parser
+
+import (
+	"testing"
+
+	"jrubin.io/slog"
+	"jrubin.io/slog/handlers/text"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBindParser(t *testing.T) {
+	Convey("bind parser should work", t, func() {
+		var adder testDomainAdder
+		p := BindParser{
+			HostAdder: &adder,
+			Stats:     &FileStats{},
+			Logger:    text.Logger(slog.ErrorLevel),
+		}
+
+		So(p.Parse("bind", 1, "// blocked zones"), ShouldBeFalse)
+		So(p.Parse("bind", 2, "/* more"), ShouldBeFalse)
+		So(p.Parse("bind", 3, " * comments */"), ShouldBeFalse)
+		So(p.Parse("bind", 4, "<html>"), ShouldBeFalse)
+
+		So(p.Parse("bind", 5, `zone "a.com" { type master; file "/etc/bind/db.empty"; };`), ShouldBeTrue)
+		So(p.Parse("bind", 6, `zone "B.com." IN {`), ShouldBeTrue)
+		So(p.Parse("bind", 7, `	type master;`), ShouldBeTrue)
+		So(p.Parse("bind", 8, `	file "/etc/bind/db.empty"; // sink`), ShouldBeTrue)
+		So(p.Parse("bind", 9, `};`), ShouldBeTrue)
+		So(p.Parse("bind", 10, `zone "a.com" {type master; file "db.empty";};`), ShouldBeTrue)
+
+		So(adder.testHostAdder, ShouldResemble, testHostAdder{
+			"*.a.com",
+			"*.b.com",
+		})
+
+		stats, _ := p.Stats.Get("bind")
+		So(stats, ShouldResemble, Stats{
+			Accepted:   2,
+			Rejected:   1,
+			Duplicates: 1,
+		})
+	})
+}
@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"net"
+	"strings"
+
+	"jrubin.io/slog"
+)
+
+// DnsmasqParser parses dnsmasq configuration files. Domains of lines like
+// "address=/example.com/0.0.0.0", "address=/example.com/",
+// "server=/example.com/" or "local=/example.com/", which dnsmasq answers itself
+// without a real address, are blocked with all of their subdomains.
+type DnsmasqParser struct {
+	HostAdder DomainAdder
+	Stats     *FileStats
+	Logger    slog.Interface
+}
+
+func (d DnsmasqParser) Reset(fileName string) {
+	d.HostAdder.Reset(fileName)
+	d.Stats.reset(fileName)
+}
+
+// dnsmasqBlocks returns whether target, the value after the domains of an
+// option, stops the domains from resolving
+func dnsmasqBlocks(option, target string) bool {
+	switch option {
+	case "address":
+		if target == "" || target == "#" {
+			return true
+		}
+
+		ip := net.ParseIP(target)
+		return ip != nil && isSink(ip)
+	case "server", "local":
+		return target == ""
+	}
+
+	return false
+}
+
+func (d DnsmasqParser) Parse(fileName string, lineNum int, text string) bool {
+	// comments have to start the line since "#" is a valid target
+	text = strings.TrimSpace(text)
+	if len(text) == 0 || text[0] == '#' {
+		return false
+	}
+
+	var option, value string
+	if i := strings.Index(text, "="); i != -1 {
+		option, value = strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:])
+	}
+
+	i := strings.LastIndex(value, "/")
+
+	if (option != "address" && option != "server" && option != "local") ||
+		!strings.HasPrefix(value, "/") || i == 0 {
+		d.Logger.WithFields(slog.Fields{
+			"file": fileName,
+			"line": lineNum,
+			"text": text,
+		}).Warn("invalid dnsmasq option")
+		d.Stats.reject(fileName)
+		return false
+	}
+
+	domains, target := strings.Split(value[1:i], "/"), value[i+1:]
+	block := dnsmasqBlocks(option, target)
+
+	ret := false
+
+	for _, domain := range domains {
+		// "#" matches every domain, which is never blocked
+		if !block || domain == "#" {
+			d.Stats.ignore(fileName)
+			ret = true
+			continue
+		}
+
+		if addDomain(d.HostAdder, d.Stats, d.Logger, fileName, lineNum, domain) {
+			ret = true
+		}
+	}
+
+	return ret
+}
+
+// Finish logs the statistics of fileName
+func (d DnsmasqParser) Finish(fileName string) {
+	logStats(d.Logger, fileName, d.Stats)
+}
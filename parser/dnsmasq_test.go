@@ -0,0 +1,55 @@
+package parser
+
+import (
+	"testing"
+
+	"jrubin.io/slog"
+	"jrubin.io/slog/handlers/text"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDnsmasqParser(t *testing.T) {
+	Convey("dnsmasq parser should work", t, func() {
+		var adder testDomainAdder
+		p := DnsmasqParser{
+			HostAdder: &adder,
+			Stats:     &FileStats{},
+			Logger:    text.Logger(slog.ErrorLevel),
+		}
+
+		So(p.Parse("dnsmasq", 1, "# address=/comment.com/0.0.0.0"), ShouldBeFalse)
+		So(p.Parse("dnsmasq", 2, "cache-size=1000"), ShouldBeFalse)
+		So(p.Parse("dnsmasq", 3, "address=example.com"), ShouldBeFalse)
+		So(p.Parse("dnsmasq", 4, "address=/"), ShouldBeFalse)
+
+		So(p.Parse("dnsmasq", 5, "address=/a.com/b.com./0.0.0.0"), ShouldBeTrue)
+		So(p.Parse("dnsmasq", 6, "address=/c.com/"), ShouldBeTrue)
+		So(p.Parse("dnsmasq", 7, "address=/D.com/#"), ShouldBeTrue)
+		So(p.Parse("dnsmasq", 8, "address=/e.com/::"), ShouldBeTrue)
+		So(p.Parse("dnsmasq", 9, "server=/f.com/"), ShouldBeTrue)
+		So(p.Parse("dnsmasq", 10, "local=/g.com/"), ShouldBeTrue)
+
+		So(p.Parse("dnsmasq", 11, "address=/nas.lan/192.168.1.5"), ShouldBeTrue)
+		So(p.Parse("dnsmasq", 12, "server=/corp.com/10.0.0.1"), ShouldBeTrue)
+		So(p.Parse("dnsmasq", 13, "address=/#/0.0.0.0"), ShouldBeTrue)
+		So(p.Parse("dnsmasq", 14, "address=/bad..com/0.0.0.0"), ShouldBeFalse)
+
+		So(adder.testHostAdder, ShouldResemble, testHostAdder{
+			"*.a.com",
+			"*.b.com",
+			"*.c.com",
+			"*.d.com",
+			"*.e.com",
+			"*.f.com",
+			"*.g.com",
+		})
+
+		stats, _ := p.Stats.Get("dnsmasq")
+		So(stats, ShouldResemble, Stats{
+			Accepted: 7,
+			Rejected: 4,
+			Ignored:  3,
+		})
+	})
+}
@@ -0,0 +1,65 @@
+package parser
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"jrubin.io/slog"
+)
+
+// DnsmasqLeasesParser parses dnsmasq lease files (dnsmasq.leases). Each line
+// has the format:
+//
+//	<expiry> <mac address or iaid> <ip address> <hostname> <client id>
+//
+// An expiry of 0 indicates an infinite lease.
+type DnsmasqLeasesParser struct {
+	HostAdder LeaseAdder
+	Domain    string
+	Logger    slog.Interface
+}
+
+func (p DnsmasqLeasesParser) Reset(fileName string) {
+	p.HostAdder.Reset(fileName)
+}
+
+func (p DnsmasqLeasesParser) Parse(fileName string, lineNum int, text string) bool {
+	fields := strings.Fields(text)
+	if len(fields) < 4 {
+		// this also skips the "duid" line in files with dhcpv6 leases
+		return false
+	}
+
+	ctxLog := p.Logger.WithFields(slog.Fields{
+		"file": fileName,
+		"line": lineNum,
+	})
+
+	expiry, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		ctxLog.WithError(err).Warn("invalid lease expiry")
+		return false
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		ctxLog.WithField("ip", fields[2]).Warn("invalid ip address")
+		return false
+	}
+
+	host := LeaseHost(p.Logger, fileName, lineNum, fields[3], p.Domain)
+	if len(host) == 0 {
+		return false
+	}
+
+	var expires time.Time
+	if expiry != 0 {
+		expires = time.Unix(expiry, 0)
+	}
+
+	p.HostAdder.AddLease(fileName, host, ip, expires)
+
+	return true
+}
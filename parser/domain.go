@@ -7,19 +7,70 @@ import (
 
 type DomainParser struct {
 	HostAdder HostAdder
+	Stats     *FileStats
 	Logger    slog.Interface
 }
 
 func (d DomainParser) Reset(fileName string) {
 	d.HostAdder.Reset(fileName)
+	d.Stats.reset(fileName)
 }
 
 func (d DomainParser) Parse(fileName string, lineNum int, text string) (ret bool) {
-	textmodifier.New(&text).StripComments().TrimSpace().ToLower().UnFQDN().StripPort()
+	textmodifier.New(&text).StripComments().TrimSpace().ToLower().UnFQDN().StripPort().ToASCII()
 
-	if ret = ValidateHost(d.Logger, fileName, lineNum, text); ret {
+	if len(text) == 0 {
+		return false
+	}
+
+	if ret = ValidateHost(d.Logger, fileName, lineNum, text); !ret {
+		d.Stats.reject(fileName)
+		return
+	}
+
+	if d.Stats.accept(fileName, text) {
 		d.HostAdder.AddHost(fileName, text)
 	}
 
 	return
 }
+
+// Finish logs the statistics of fileName
+func (d DomainParser) Finish(fileName string) {
+	logStats(d.Logger, fileName, d.Stats)
+}
+
+// addDomain adds domain, and so all of its subdomains, from fileName. It
+// returns false if domain isn't valid.
+func addDomain(adder DomainAdder, stats *FileStats, logger slog.Interface, fileName string, lineNum int, domain string) bool {
+	textmodifier.New(&domain).TrimSpace().ToLower().UnFQDN().ToASCII()
+
+	if !ValidateHost(logger, fileName, lineNum, domain) {
+		stats.reject(fileName)
+		return false
+	}
+
+	// domains are distinguished from hosts of the same name, which they
+	// include
+	if stats.accept(fileName, "."+domain) {
+		adder.AddDomain(fileName, domain)
+	}
+
+	return true
+}
+
+// addHost is like addDomain but only adds host itself
+func addHost(adder HostAdder, stats *FileStats, logger slog.Interface, fileName string, lineNum int, host string) bool {
+	textmodifier.New(&host).TrimSpace().ToLower().UnFQDN().ToASCII()
+
+	if !ValidateHost(logger, fileName, lineNum, host) {
+		stats.reject(fileName)
+		return false
+	}
+
+	if stats.accept(fileName, host) {
+		adder.AddHost(fileName, host)
+	}
+
+	return true
+}
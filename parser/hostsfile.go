@@ -1,25 +1,177 @@
 package parser
 
 import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+
 	"jrubin.io/blamedns/textmodifier"
 	"jrubin.io/slog"
 )
 
+// NonSink is what to do with hosts on lines of hosts files whose ip address
+// isn't a sink, i.e. unspecified (0.0.0.0 or ::) or loopback (127.0.0.1 or
+// ::1), as in a real "/etc/hosts"
+type NonSink int
+
+const (
+	NonSinkIgnore   NonSink = iota // they are ignored
+	NonSinkBlock                   // they are blocked like any other host
+	NonSinkOverride                // they resolve to the ip address
+)
+
+var nonSinkNames = map[NonSink]string{
+	NonSinkIgnore:   "ignore",
+	NonSinkBlock:    "block",
+	NonSinkOverride: "override",
+}
+
+func (n NonSink) String() string {
+	return nonSinkNames[n]
+}
+
+// ParseNonSink returns the NonSink named s
+func ParseNonSink(s string) (NonSink, error) {
+	for n, name := range nonSinkNames {
+		if strings.EqualFold(s, name) {
+			return n, nil
+		}
+	}
+	return NonSinkIgnore, errors.Errorf("invalid non-sink action: %s", s)
+}
+
+// localNames are the hostnames of the machine itself that hosts files
+// commonly include, which are never blocked
+var localNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// HostsFileParser parses files in "/etc/hosts" format and blocks every
+// hostname and alias on each line whose ip address is a sink. Hosts on other
+// lines are handled as NonSink says, with LocalHostAdder used for overrides.
 type HostsFileParser struct {
-	HostAdder HostAdder
-	Logger    slog.Interface
+	HostAdder      HostAdder
+	LocalHostAdder LocalHostAdder
+	NonSink        NonSink
+	Stats          *FileStats
+	Logger         slog.Interface
 }
 
 func (h HostsFileParser) Reset(fileName string) {
 	h.HostAdder.Reset(fileName)
+
+	if h.LocalHostAdder != nil {
+		h.LocalHostAdder.Reset(fileName)
+	}
+
+	h.Stats.reset(fileName)
+}
+
+func isSink(ip net.IP) bool {
+	return ip.IsUnspecified() || ip.IsLoopback()
+}
+
+func (h HostsFileParser) Parse(fileName string, lineNum int, text string) bool {
+	textmodifier.New(&text).StripComments().TrimSpace()
+
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return false
+	}
+
+	if len(fields) < 2 {
+		h.Stats.reject(fileName)
+		return false
+	}
+
+	addr := fields[0]
+
+	// strip any ipv6 zone (e.g. fe80::1%lo0)
+	if i := strings.Index(addr, "%"); i != -1 {
+		addr = addr[:i]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		h.Logger.WithFields(slog.Fields{
+			"file": fileName,
+			"line": lineNum,
+			"ip":   fields[0],
+		}).Warn("invalid ip address")
+		h.Stats.reject(fileName)
+		return false
+	}
+
+	sink := isSink(ip)
+	action := NonSinkBlock
+	if !sink {
+		action = h.NonSink
+	}
+
+	if action == NonSinkOverride && h.LocalHostAdder == nil {
+		action = NonSinkIgnore
+	}
+
+	ret := false
+
+	for _, host := range fields[1:] {
+		textmodifier.New(&host).ToLower().UnFQDN().StripPort().ToASCII()
+
+		if !ValidateHost(h.Logger, fileName, lineNum, host) {
+			h.Stats.reject(fileName)
+			continue
+		}
+
+		ret = true
+
+		if (sink && localNames[host]) || action == NonSinkIgnore {
+			h.Stats.ignore(fileName)
+			continue
+		}
+
+		if !h.Stats.accept(fileName, host) {
+			continue
+		}
+
+		if action == NonSinkOverride {
+			h.LocalHostAdder.AddLocalHost(fileName, host, ip)
+			continue
+		}
+
+		h.HostAdder.AddHost(fileName, host)
+	}
+
+	return ret
 }
 
-func (h HostsFileParser) Parse(fileName string, lineNum int, text string) (ret bool) {
-	textmodifier.New(&text).StripComments().ExtractField(1).ToLower().UnFQDN().StripPort()
+// Finish logs the statistics of fileName
+func (h HostsFileParser) Finish(fileName string) {
+	logStats(h.Logger, fileName, h.Stats)
+}
 
-	if ret = ValidateHost(h.Logger, fileName, lineNum, text); ret {
-		h.HostAdder.AddHost(fileName, text)
+func logStats(logger slog.Interface, fileName string, fs *FileStats) {
+	if fs == nil {
+		return
 	}
 
-	return
+	s := fs.finish(fileName)
+
+	logger.WithFields(slog.Fields{
+		"file":       fileName,
+		"accepted":   s.Accepted,
+		"rejected":   s.Rejected,
+		"duplicates": s.Duplicates,
+		"ignored":    s.Ignored,
+	}).Debug("parse statistics")
 }
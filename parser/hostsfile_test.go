@@ -0,0 +1,147 @@
+package parser
+
+import (
+	"testing"
+
+	"jrubin.io/slog"
+	"jrubin.io/slog/handlers/text"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testHostAdder []string
+
+func (a *testHostAdder) AddHost(source, host string) {
+	*a = append(*a, host)
+}
+
+func (a *testHostAdder) Reset(source string) {
+	*a = nil
+}
+
+// testDomainAdder records domains with a leading "*."
+type testDomainAdder struct {
+	testHostAdder
+}
+
+func (a *testDomainAdder) AddDomain(source, domain string) {
+	a.AddHost(source, "*."+domain)
+}
+
+func TestHostsFileParser(t *testing.T) {
+	Convey("hosts file parser should work", t, func() {
+		var blocked testHostAdder
+		var local testLocalHostAdder
+
+		p := HostsFileParser{
+			HostAdder:      &blocked,
+			LocalHostAdder: &local,
+			Stats:          &FileStats{},
+			Logger:         text.Logger(slog.ErrorLevel),
+		}
+
+		parse := func(lines ...string) {
+			p.Reset("hosts")
+			for i, line := range lines {
+				p.Parse("hosts", i+1, line)
+			}
+			p.Finish("hosts")
+		}
+
+		lines := []string{
+			"# comment",
+			"127.0.0.1 localhost",
+			"::1 localhost ip6-localhost ip6-loopback",
+			"0.0.0.0 ads.a.com ADS.B.COM. # trackers",
+			"127.0.0.1 ads.c.com:80",
+			"::\tads.d.com bücher.example",
+			"0.0.0.0 ads.a.com bad..host",
+			"not.an.ip ads.e.com",
+			"0.0.0.0",
+			"192.168.1.5 nas nas.lan",
+		}
+
+		Convey("all hostnames on sink lines are blocked", func() {
+			parse(lines...)
+
+			So(blocked, ShouldResemble, testHostAdder{
+				"ads.a.com",
+				"ads.b.com",
+				"ads.c.com",
+				"ads.d.com",
+				"xn--bcher-kva.example",
+			})
+			So(len(local), ShouldEqual, 0)
+
+			stats, ok := p.Stats.Get("hosts")
+			So(ok, ShouldBeTrue)
+			So(stats, ShouldResemble, Stats{
+				Accepted:   5,
+				Rejected:   3,
+				Duplicates: 1,
+				Ignored:    6,
+			})
+		})
+
+		Convey("non-sink lines can be blocked", func() {
+			p.NonSink = NonSinkBlock
+			parse(lines...)
+
+			So(blocked[len(blocked)-2:], ShouldResemble, testHostAdder{"nas", "nas.lan"})
+			So(len(local), ShouldEqual, 0)
+		})
+
+		Convey("non-sink lines can be overridden", func() {
+			p.NonSink = NonSinkOverride
+			parse(lines...)
+
+			So(len(blocked), ShouldEqual, 5)
+			So(local, ShouldResemble, testLocalHostAdder{
+				{Host: "nas", IP: "192.168.1.5"},
+				{Host: "nas.lan", IP: "192.168.1.5"},
+			})
+
+			p.Reset("hosts")
+			So(len(blocked), ShouldEqual, 0)
+			So(len(local), ShouldEqual, 0)
+
+			_, ok := p.Stats.Get("hosts")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("non-sink lines are ignored without a local host adder", func() {
+			p.NonSink = NonSinkOverride
+			p.LocalHostAdder = nil
+			parse(lines...)
+
+			So(len(blocked), ShouldEqual, 5)
+			So(len(local), ShouldEqual, 0)
+		})
+
+		Convey("duplicates are only counted within a parse", func() {
+			parse("0.0.0.0 ads.a.com ads.a.com")
+			parse("0.0.0.0 ads.a.com")
+
+			stats, _ := p.Stats.Get("hosts")
+			So(stats, ShouldResemble, Stats{Accepted: 1})
+			So(p.Stats.Files(), ShouldResemble, []string{"hosts"})
+		})
+	})
+}
+
+func TestParseNonSink(t *testing.T) {
+	Convey("non-sink actions should parse", t, func() {
+		for _, n := range []NonSink{NonSinkIgnore, NonSinkBlock, NonSinkOverride} {
+			v, err := ParseNonSink(n.String())
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, n)
+		}
+
+		v, err := ParseNonSink("Override")
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, NonSinkOverride)
+
+		_, err = ParseNonSink("drop")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,157 @@
+package parser
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jrubin.io/slog"
+)
+
+type iscLease struct {
+	IP      net.IP
+	Host    string
+	Ends    time.Time
+	Active  bool
+	LineNum int
+}
+
+// ISCLeasesParser parses ISC dhcpd lease files (dhcpd.leases). Since leases
+// span multiple lines, the parser keeps the lease currently being parsed for
+// each file and must be used as a pointer.
+//
+// dhcpd appends a new lease declaration each time a lease changes, so later
+// declarations for an ip address replace earlier ones.
+type ISCLeasesParser struct {
+	HostAdder LeaseAdder
+	Domain    string
+	Logger    slog.Interface
+	mu        sync.Mutex
+	leases    map[string]*iscLease
+}
+
+const iscTimeFormat = "2006/01/02 15:04:05"
+
+func (p *ISCLeasesParser) Reset(fileName string) {
+	p.mu.Lock()
+	delete(p.leases, fileName)
+	p.mu.Unlock()
+
+	p.HostAdder.Reset(fileName)
+}
+
+// parseISCTime parses the value of a "starts" or "ends" statement. They have
+// one of the following forms:
+//
+//	4 2016/09/22 20:00:00
+//	epoch 1474574400
+//	never
+//
+// A zero time is returned for "never".
+func parseISCTime(fields []string) (time.Time, error) {
+	if len(fields) == 1 && fields[0] == "never" {
+		return time.Time{}, nil
+	}
+
+	if len(fields) == 2 && fields[0] == "epoch" {
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(sec, 0), nil
+	}
+
+	if len(fields) != 3 {
+		return time.Time{}, &time.ParseError{Value: strings.Join(fields, " ")}
+	}
+
+	// the first field is the day of the week, which is redundant
+	return time.Parse(iscTimeFormat, fields[1]+" "+fields[2])
+}
+
+func (p *ISCLeasesParser) Parse(fileName string, lineNum int, text string) bool {
+	// everything after '#' is a comment
+	if i := strings.Index(text, "#"); i != -1 {
+		text = text[:i]
+	}
+
+	text = strings.TrimSuffix(strings.TrimSpace(text), ";")
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return false
+	}
+
+	ctxLog := p.Logger.WithFields(slog.Fields{
+		"file": fileName,
+		"line": lineNum,
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.leases == nil {
+		p.leases = map[string]*iscLease{}
+	}
+
+	lease := p.leases[fileName]
+
+	if fields[0] == "lease" && len(fields) == 3 && fields[2] == "{" {
+		ip := net.ParseIP(fields[1])
+		if ip == nil {
+			ctxLog.WithField("ip", fields[1]).Warn("invalid ip address")
+			return false
+		}
+
+		p.leases[fileName] = &iscLease{
+			IP: ip,
+			// leases without a binding state (older versions of dhcpd) are
+			// active until they end
+			Active:  true,
+			LineNum: lineNum,
+		}
+		return false
+	}
+
+	if lease == nil {
+		// not within a lease declaration
+		return false
+	}
+
+	switch fields[0] {
+	case "}":
+		delete(p.leases, fileName)
+		return p.addLease(fileName, lease)
+	case "ends":
+		ends, err := parseISCTime(fields[1:])
+		if err != nil {
+			ctxLog.WithError(err).Warn("invalid lease end time")
+			return false
+		}
+		lease.Ends = ends
+	case "binding":
+		if len(fields) == 3 && fields[1] == "state" {
+			lease.Active = fields[2] == "active"
+		}
+	case "client-hostname":
+		if len(fields) == 2 {
+			lease.Host = strings.Trim(fields[1], `"`)
+		}
+	}
+
+	return false
+}
+
+func (p *ISCLeasesParser) addLease(fileName string, lease *iscLease) bool {
+	var host string
+	if lease.Active {
+		host = LeaseHost(p.Logger, fileName, lease.LineNum, lease.Host, p.Domain)
+	}
+
+	// inactive leases, and those without a hostname, still need to be added
+	// so that they replace any earlier declarations for the ip address
+	p.HostAdder.AddLease(fileName, host, lease.IP, lease.Ends)
+
+	return len(host) > 0
+}
@@ -0,0 +1,35 @@
+package parser
+
+import (
+	"strings"
+
+	"jrubin.io/blamedns/textmodifier"
+	"jrubin.io/slog"
+)
+
+// LeaseHost normalizes a hostname provided by a dhcp client and places it
+// under domain, unless the client already used a name in it. It is shared by
+// the lease file parsers and the dhcp server. It returns an empty string if the
+// client didn't provide a valid hostname.
+func LeaseHost(logger slog.Interface, fileName string, lineNum int, host, domain string) string {
+	if host == "*" {
+		// dnsmasq uses "*" when the client did not provide a hostname
+		return ""
+	}
+
+	textmodifier.New(&host).TrimSpace().ToLower().UnFQDN().ToASCII()
+
+	if len(domain) > 0 && len(host) > 0 {
+		domain = strings.Trim(domain, ".")
+		textmodifier.New(&domain).ToLower().ToASCII()
+
+		domain = "." + domain
+		host = strings.TrimSuffix(host, domain) + domain
+	}
+
+	if !ValidateHost(logger, fileName, lineNum, host) {
+		return ""
+	}
+
+	return host
+}
@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"jrubin.io/slog"
+	"jrubin.io/slog/handlers/text"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type lease struct {
+	Host    string
+	IP      string
+	Expires time.Time
+}
+
+type testLeaseAdder []lease
+
+func (a *testLeaseAdder) AddLease(source, host string, ip net.IP, expires time.Time) {
+	*a = append(*a, lease{Host: host, IP: ip.String(), Expires: expires})
+}
+
+func (a *testLeaseAdder) Reset(source string) {
+	*a = nil
+}
+
+func parseLines(p Parser, file, data string) int {
+	var n int
+	for i, line := range strings.Split(data, "\n") {
+		if p.Parse(file, i+1, line) {
+			n++
+		}
+	}
+	return n
+}
+
+const dnsmasqLeases = `1474574400 00:11:22:33:44:55 192.168.1.100 laptop 01:00:11:22:33:44:55
+0 00:11:22:33:44:66 192.168.1.101 * *
+0 00:11:22:33:44:77 192.168.1.102 Phone *
+duid 00:01:00:01:1f:2e:3d:4c:00:11:22:33:44:55
+1474574400 1234 fd00::100 laptop 00:01:00:01:1f:2e:3d:4c:00:11:22:33:44:55`
+
+const iscLeases = `# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.1.100 {
+  starts 4 2016/09/22 18:00:00;
+  ends 4 2016/09/22 20:00:00;
+  binding state active;
+  next binding state free;
+  hardware ethernet 00:11:22:33:44:55;
+  client-hostname "laptop";
+}
+lease 192.168.1.101 {
+  starts 4 2016/09/22 18:00:00;
+  ends never;
+  binding state free;
+  client-hostname "phone";
+}
+lease 192.168.1.102 {
+  ends epoch 1474574400; # Thu Sep 22 20:00:00 2016
+  client-hostname "Tablet";
+}
+lease 192.168.1.103 {
+  ends never;
+}`
+
+func TestLeases(t *testing.T) {
+	Convey("dnsmasq leases parser should work", t, func() {
+		var adder testLeaseAdder
+		p := DnsmasqLeasesParser{
+			HostAdder: &adder,
+			Domain:    "lan",
+			Logger:    text.Logger(slog.ErrorLevel),
+		}
+
+		So(parseLines(p, "dnsmasq.leases", dnsmasqLeases), ShouldEqual, 3)
+		So(adder, ShouldResemble, testLeaseAdder{
+			{Host: "laptop.lan", IP: "192.168.1.100", Expires: time.Unix(1474574400, 0)},
+			{Host: "phone.lan", IP: "192.168.1.102"},
+			{Host: "laptop.lan", IP: "fd00::100", Expires: time.Unix(1474574400, 0)},
+		})
+	})
+
+	Convey("hostnames already in the domain should not be qualified again", t, func() {
+		logger := text.Logger(slog.ErrorLevel)
+
+		So(LeaseHost(logger, "leases", 1, "laptop.lan", "lan"), ShouldEqual, "laptop.lan")
+		So(LeaseHost(logger, "leases", 1, "Laptop.LAN.", ".Lan."), ShouldEqual, "laptop.lan")
+		So(LeaseHost(logger, "leases", 1, "laptop.home.lan", "home.lan"), ShouldEqual, "laptop.home.lan")
+		So(LeaseHost(logger, "leases", 1, "laptop.other", "lan"), ShouldEqual, "laptop.other.lan")
+		So(LeaseHost(logger, "leases", 1, "laptoplan", "lan"), ShouldEqual, "laptoplan.lan")
+		So(LeaseHost(logger, "leases", 1, "Büro.Bücher.lan", "bücher.lan"), ShouldEqual, "xn--bro-hoa.xn--bcher-kva.lan")
+	})
+
+	Convey("isc leases parser should work", t, func() {
+		var adder testLeaseAdder
+		p := &ISCLeasesParser{
+			HostAdder: &adder,
+			Logger:    text.Logger(slog.ErrorLevel),
+		}
+
+		So(parseLines(p, "dhcpd.leases", iscLeases), ShouldEqual, 2)
+		So(adder, ShouldResemble, testLeaseAdder{
+			{Host: "laptop", IP: "192.168.1.100", Expires: time.Date(2016, 9, 22, 20, 0, 0, 0, time.UTC)},
+			{Host: "", IP: "192.168.1.101"},
+			{Host: "tablet", IP: "192.168.1.102", Expires: time.Unix(1474574400, 0)},
+			{Host: "", IP: "192.168.1.103"},
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package parser
+
+import (
+	"net"
+	"strings"
+
+	"jrubin.io/blamedns/textmodifier"
+	"jrubin.io/slog"
+)
+
+// LocalHostsParser parses files in "/etc/hosts" format and adds every hostname
+// and alias on each line as resolving to the ip address on that line.
+type LocalHostsParser struct {
+	HostAdder LocalHostAdder
+	Logger    slog.Interface
+}
+
+func (h LocalHostsParser) Reset(fileName string) {
+	h.HostAdder.Reset(fileName)
+}
+
+func (h LocalHostsParser) Parse(fileName string, lineNum int, text string) (ret bool) {
+	textmodifier.New(&text).StripComments().TrimSpace()
+
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return false
+	}
+
+	addr := fields[0]
+
+	// strip any ipv6 zone (e.g. fe80::1%lo0)
+	if i := strings.Index(addr, "%"); i != -1 {
+		addr = addr[:i]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		h.Logger.WithFields(slog.Fields{
+			"file": fileName,
+			"line": lineNum,
+			"ip":   fields[0],
+		}).Warn("invalid ip address")
+		return false
+	}
+
+	for _, host := range fields[1:] {
+		textmodifier.New(&host).ToLower().UnFQDN().ToASCII()
+
+		if ValidateHost(h.Logger, fileName, lineNum, host) {
+			h.HostAdder.AddLocalHost(fileName, host, ip)
+			ret = true
+		}
+	}
+
+	return
+}
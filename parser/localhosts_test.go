@@ -0,0 +1,52 @@
+package parser
+
+import (
+	"net"
+	"testing"
+
+	"jrubin.io/slog"
+	"jrubin.io/slog/handlers/text"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type localHost struct {
+	Host string
+	IP   string
+}
+
+type testLocalHostAdder []localHost
+
+func (a *testLocalHostAdder) AddLocalHost(source, host string, ip net.IP) {
+	*a = append(*a, localHost{Host: host, IP: ip.String()})
+}
+
+func (a *testLocalHostAdder) Reset(source string) {
+	*a = nil
+}
+
+func TestLocalHostsParser(t *testing.T) {
+	Convey("local hosts parser should work", t, func() {
+		var adder testLocalHostAdder
+		p := LocalHostsParser{
+			HostAdder: &adder,
+			Logger:    text.Logger(slog.ErrorLevel),
+		}
+
+		So(p.Parse("hosts", 1, "# comment"), ShouldBeFalse)
+		So(p.Parse("hosts", 2, "127.0.0.1"), ShouldBeFalse)
+		So(p.Parse("hosts", 3, "not.an.ip nas"), ShouldBeFalse)
+		So(len(adder), ShouldEqual, 0)
+
+		So(p.Parse("hosts", 4, "192.168.1.5	NAS nas.lan. # storage"), ShouldBeTrue)
+		So(p.Parse("hosts", 5, "fe80::1%lo0 localhost"), ShouldBeTrue)
+		So(adder, ShouldResemble, testLocalHostAdder{
+			{Host: "nas", IP: "192.168.1.5"},
+			{Host: "nas.lan", IP: "192.168.1.5"},
+			{Host: "localhost", IP: "fe80::1"},
+		})
+
+		p.Reset("hosts")
+		So(len(adder), ShouldEqual, 0)
+	})
+}
@@ -1,10 +1,42 @@
 package parser
 
+import (
+	"net"
+	"time"
+)
+
 type HostAdder interface {
 	AddHost(source, host string)
 	Reset(source string)
 }
 
+// DomainAdder is a HostAdder that can also add domains, which include all of
+// their subdomains
+type DomainAdder interface {
+	HostAdder
+	AddDomain(source, domain string)
+}
+
+// Discard is a DomainAdder that ignores hosts, for parsers that are only used
+// to check whether lines are valid
+var Discard DomainAdder = discard{}
+
+type discard struct{}
+
+func (discard) AddHost(source, host string)     {}
+func (discard) AddDomain(source, domain string) {}
+func (discard) Reset(source string)             {}
+
+type LocalHostAdder interface {
+	AddLocalHost(source, host string, ip net.IP)
+	Reset(source string)
+}
+
+type LeaseAdder interface {
+	AddLease(source, host string, ip net.IP, expires time.Time)
+	Reset(source string)
+}
+
 type Parser interface {
 	Parse(fileName string, lineNum int, line string) bool
 	Reset(fileName string)
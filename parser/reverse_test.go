@@ -9,6 +9,9 @@ import (
 var (
 	_ Parser = HostsFileParser{}
 	_ Parser = DomainParser{}
+	_ Parser = LocalHostsParser{}
+	_ Parser = DnsmasqLeasesParser{}
+	_ Parser = &ISCLeasesParser{}
 )
 
 func TestReverse(t *testing.T) {
@@ -0,0 +1,159 @@
+package parser
+
+import "sync"
+
+// Stats counts how the hosts in a file were handled
+type Stats struct {
+	Accepted   int `json:"accepted"`
+	Rejected   int `json:"rejected"`
+	Duplicates int `json:"duplicates"`
+	Ignored    int `json:"ignored"`
+}
+
+// Add adds the counts of o to s
+func (s *Stats) Add(o Stats) {
+	s.Accepted += o.Accepted
+	s.Rejected += o.Rejected
+	s.Duplicates += o.Duplicates
+	s.Ignored += o.Ignored
+}
+
+// A Finisher is a Parser that is told when a file has been completely parsed
+type Finisher interface {
+	Finish(fileName string)
+}
+
+// FileStats keeps the Stats of each parsed file. Hosts that were already
+// accepted from a file are counted as duplicates until it has been completely
+// parsed. A nil FileStats doesn't keep anything.
+type FileStats struct {
+	mu    sync.Mutex
+	stats map[string]*Stats
+	seen  map[string]map[string]bool
+}
+
+func (s *FileStats) reset(fileName string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.stats, fileName)
+	delete(s.seen, fileName)
+}
+
+func (s *FileStats) get(fileName string) *Stats {
+	if s.stats == nil {
+		s.stats = map[string]*Stats{}
+	}
+
+	ret, ok := s.stats[fileName]
+	if !ok {
+		ret = &Stats{}
+		s.stats[fileName] = ret
+	}
+
+	return ret
+}
+
+// accept returns false if host was already accepted from fileName
+func (s *FileStats) accept(fileName, host string) bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seen == nil {
+		s.seen = map[string]map[string]bool{}
+	}
+
+	seen, ok := s.seen[fileName]
+	if !ok {
+		seen = map[string]bool{}
+		s.seen[fileName] = seen
+	}
+
+	if seen[host] {
+		s.get(fileName).Duplicates++
+		return false
+	}
+
+	seen[host] = true
+	s.get(fileName).Accepted++
+
+	return true
+}
+
+func (s *FileStats) reject(fileName string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.get(fileName).Rejected++
+}
+
+func (s *FileStats) ignore(fileName string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.get(fileName).Ignored++
+}
+
+// finish forgets the hosts accepted from fileName and returns its Stats
+func (s *FileStats) finish(fileName string) Stats {
+	if s == nil {
+		return Stats{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.seen, fileName)
+
+	return *s.get(fileName)
+}
+
+// Get returns the Stats of fileName
+func (s *FileStats) Get(fileName string) (Stats, bool) {
+	if s == nil {
+		return Stats{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret, ok := s.stats[fileName]
+	if !ok {
+		return Stats{}, false
+	}
+
+	return *ret, true
+}
+
+// Files returns the names of the files that have Stats
+func (s *FileStats) Files() []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]string, 0, len(s.stats))
+	for name := range s.stats {
+		ret = append(ret, name)
+	}
+
+	return ret
+}
@@ -0,0 +1,121 @@
+package parser
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"jrubin.io/blamedns/textmodifier"
+	"jrubin.io/slog"
+)
+
+// unboundZoneTypes are the types of unbound local zones and whether they stop
+// names in the zone from resolving
+var unboundZoneTypes = map[string]bool{
+	"deny":               true,
+	"refuse":             true,
+	"static":             true,
+	"redirect":           true,
+	"inform_deny":        true,
+	"inform_redirect":    true,
+	"always_refuse":      true,
+	"always_nxdomain":    true,
+	"always_null":        true,
+	"always_deny":        true,
+	"transparent":        false,
+	"typetransparent":    false,
+	"inform":             false,
+	"always_transparent": false,
+	"nodefault":          false,
+	"noview":             false,
+}
+
+// UnboundParser parses unbound configuration files. Domains of local zones that
+// don't resolve, e.g. `local-zone: "example.com" always_nxdomain`, are blocked
+// with all of their subdomains. Hosts of local data with sink addresses, e.g.
+// `local-data: "ads.example.com A 0.0.0.0"`, are blocked.
+type UnboundParser struct {
+	HostAdder DomainAdder
+	Stats     *FileStats
+	Logger    slog.Interface
+}
+
+func (u UnboundParser) Reset(fileName string) {
+	u.HostAdder.Reset(fileName)
+	u.Stats.reset(fileName)
+}
+
+func (u UnboundParser) Parse(fileName string, lineNum int, text string) bool {
+	textmodifier.New(&text).StripComments().TrimSpace()
+
+	// clauses, e.g. "server:", don't have values
+	if len(text) == 0 || strings.HasSuffix(text, ":") {
+		return false
+	}
+
+	ctxLog := u.Logger.WithFields(slog.Fields{
+		"file": fileName,
+		"line": lineNum,
+		"text": text,
+	})
+
+	var option, value string
+	if i := strings.Index(text, ":"); i != -1 {
+		option, value = strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:])
+	}
+
+	switch option {
+	case "local-zone":
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			break
+		}
+
+		block, ok := unboundZoneTypes[strings.ToLower(fields[1])]
+		if !ok {
+			ctxLog.Warn("invalid unbound local-zone type")
+			u.Stats.reject(fileName)
+			return false
+		}
+
+		if !block {
+			u.Stats.ignore(fileName)
+			return true
+		}
+
+		return addDomain(u.HostAdder, u.Stats, u.Logger, fileName, lineNum, strings.Trim(fields[0], `"`))
+	case "local-data":
+		rr, err := dns.NewRR(strings.Trim(value, `"'`))
+		if err != nil || rr == nil {
+			ctxLog.Warn("invalid unbound local-data")
+			u.Stats.reject(fileName)
+			return false
+		}
+
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		}
+
+		if ip == nil || !isSink(ip) {
+			u.Stats.ignore(fileName)
+			return true
+		}
+
+		return addHost(u.HostAdder, u.Stats, u.Logger, fileName, lineNum, rr.Header().Name)
+	}
+
+	ctxLog.Warn("invalid unbound option")
+	u.Stats.reject(fileName)
+
+	return false
+}
+
+// Finish logs the statistics of fileName
+func (u UnboundParser) Finish(fileName string) {
+	logStats(u.Logger, fileName, u.Stats)
+}
@@ -0,0 +1,52 @@
+package parser
+
+import (
+	"testing"
+
+	"jrubin.io/slog"
+	"jrubin.io/slog/handlers/text"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUnboundParser(t *testing.T) {
+	Convey("unbound parser should work", t, func() {
+		var adder testDomainAdder
+		p := UnboundParser{
+			HostAdder: &adder,
+			Stats:     &FileStats{},
+			Logger:    text.Logger(slog.ErrorLevel),
+		}
+
+		So(p.Parse("unbound", 1, "server:"), ShouldBeFalse)
+		So(p.Parse("unbound", 2, "# local-zone: \"comment.com\" static"), ShouldBeFalse)
+		So(p.Parse("unbound", 3, "verbosity: 1"), ShouldBeFalse)
+		So(p.Parse("unbound", 4, "local-zone: \"a.com\" unknown"), ShouldBeFalse)
+		So(p.Parse("unbound", 5, "local-data: \"not a record\""), ShouldBeFalse)
+
+		So(p.Parse("unbound", 6, "  local-zone: \"a.com\" always_nxdomain"), ShouldBeTrue)
+		So(p.Parse("unbound", 7, "local-zone: \"B.com.\" static # ads"), ShouldBeTrue)
+		So(p.Parse("unbound", 8, "local-zone: \"c.com\" redirect"), ShouldBeTrue)
+		So(p.Parse("unbound", 9, "local-data: \"c.com A 0.0.0.0\""), ShouldBeTrue)
+		So(p.Parse("unbound", 10, "local-data: \"ads.d.com. IN AAAA ::1\""), ShouldBeTrue)
+
+		So(p.Parse("unbound", 11, "local-zone: \"lan\" transparent"), ShouldBeTrue)
+		So(p.Parse("unbound", 12, "local-data: \"nas.lan A 192.168.1.5\""), ShouldBeTrue)
+		So(p.Parse("unbound", 13, "local-data: \"lan TXT hello\""), ShouldBeTrue)
+
+		So(adder.testHostAdder, ShouldResemble, testHostAdder{
+			"*.a.com",
+			"*.b.com",
+			"*.c.com",
+			"c.com",
+			"ads.d.com",
+		})
+
+		stats, _ := p.Stats.Get("unbound")
+		So(stats, ShouldResemble, Stats{
+			Accepted: 5,
+			Rejected: 3,
+			Ignored:  3,
+		})
+	})
+}
@@ -0,0 +1,720 @@
+// Package recursor resolves queries iteratively, starting at the root
+// servers and following referrals down to an authoritative answer, rather
+// than forwarding them to another recursive server.
+package recursor
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"jrubin.io/blamedns/dnscache"
+	"jrubin.io/slog"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// RootHints are the root zone nameservers and their addresses, from
+// https://www.internic.net/domain/named.root
+var RootHints = []string{
+	". 3600000 IN NS a.root-servers.net.",
+	". 3600000 IN NS b.root-servers.net.",
+	". 3600000 IN NS c.root-servers.net.",
+	". 3600000 IN NS d.root-servers.net.",
+	". 3600000 IN NS e.root-servers.net.",
+	". 3600000 IN NS f.root-servers.net.",
+	". 3600000 IN NS g.root-servers.net.",
+	". 3600000 IN NS h.root-servers.net.",
+	". 3600000 IN NS i.root-servers.net.",
+	". 3600000 IN NS j.root-servers.net.",
+	". 3600000 IN NS k.root-servers.net.",
+	". 3600000 IN NS l.root-servers.net.",
+	". 3600000 IN NS m.root-servers.net.",
+	"a.root-servers.net. 3600000 IN A 198.41.0.4",
+	"b.root-servers.net. 3600000 IN A 170.247.170.2",
+	"c.root-servers.net. 3600000 IN A 192.33.4.12",
+	"d.root-servers.net. 3600000 IN A 199.7.91.13",
+	"e.root-servers.net. 3600000 IN A 192.203.230.10",
+	"f.root-servers.net. 3600000 IN A 192.5.5.241",
+	"g.root-servers.net. 3600000 IN A 192.112.36.4",
+	"h.root-servers.net. 3600000 IN A 198.97.190.53",
+	"i.root-servers.net. 3600000 IN A 192.36.148.17",
+	"j.root-servers.net. 3600000 IN A 192.58.128.30",
+	"k.root-servers.net. 3600000 IN A 193.0.14.129",
+	"l.root-servers.net. 3600000 IN A 199.7.83.42",
+	"m.root-servers.net. 3600000 IN A 202.12.27.33",
+	"a.root-servers.net. 3600000 IN AAAA 2001:503:ba3e::2:30",
+	"b.root-servers.net. 3600000 IN AAAA 2801:1b8:10::b",
+	"c.root-servers.net. 3600000 IN AAAA 2001:500:2::c",
+	"d.root-servers.net. 3600000 IN AAAA 2001:500:2d::d",
+	"e.root-servers.net. 3600000 IN AAAA 2001:500:a8::e",
+	"f.root-servers.net. 3600000 IN AAAA 2001:500:2f::f",
+	"g.root-servers.net. 3600000 IN AAAA 2001:500:12::d0d",
+	"h.root-servers.net. 3600000 IN AAAA 2001:500:1::53",
+	"i.root-servers.net. 3600000 IN AAAA 2001:7fe::53",
+	"j.root-servers.net. 3600000 IN AAAA 2001:503:c27::2:30",
+	"k.root-servers.net. 3600000 IN AAAA 2001:7fd::1",
+	"l.root-servers.net. 3600000 IN AAAA 2001:500:9f::42",
+	"m.root-servers.net. 3600000 IN AAAA 2001:dc3::35",
+}
+
+// ParseHints parses root hints in zone file format. Only NS records for the
+// root and A and AAAA records for the nameservers are allowed.
+func ParseHints(values []string) ([]dns.RR, error) {
+	ret := make([]dns.RR, 0, len(values))
+
+	for _, value := range values {
+		rr, err := dns.NewRR(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid root hint: %s", value)
+		}
+
+		switch rr.(type) {
+		case *dns.NS:
+			if rr.Header().Name != "." {
+				return nil, errors.Errorf("root hint is not for the root zone: %s", value)
+			}
+		case *dns.A, *dns.AAAA:
+		default:
+			return nil, errors.Errorf("root hint is not an NS, A or AAAA record: %s", value)
+		}
+
+		ret = append(ret, rr)
+	}
+
+	return ret, nil
+}
+
+// An Exchanger sends req to the nameserver at addr and returns its response
+type Exchanger func(ctx context.Context, addr string, req *dns.Msg) (*dns.Msg, error)
+
+const (
+	DefaultTimeout = 2 * time.Second
+	DefaultUDPSize = 1232
+
+	// limits to keep misconfigured or malicious zones from sending us around
+	// in circles
+	maxReferrals = 32
+	maxCNAMEs    = 8
+	maxDepth     = 6
+
+	// how long a nameserver that failed to answer for a zone is tried last
+	lameTTL = 15 * time.Minute
+)
+
+// A Resolver resolves queries iteratively from Hints. Delegations, the NS
+// records and addresses of each zone's nameservers, are kept in Cache so that
+// later queries can start at the closest known zone.
+type Resolver struct {
+	Hints []dns.RR
+	Cache dnscache.Cache
+
+	// Exchange defaults to udp, retried over tcp when truncated, to port 53
+	Exchange Exchanger
+
+	// NoMinimise disables QNAME minimisation (RFC 7816), which otherwise only
+	// sends each nameserver as much of the name as it needs to find the next
+	// zone cut
+	NoMinimise bool
+
+	// DNSSECOK sets the DO bit so that authoritative servers include their
+	// signatures
+	DNSSECOK bool
+
+	Timeout time.Duration
+	UDPSize uint16
+	Logger  slog.Interface
+	mu      sync.Mutex
+	lame    map[string]time.Time
+}
+
+// delegation is a zone and the nameservers that serve it
+type delegation struct {
+	zone string
+
+	// addresses of the nameservers that are already known
+	addrs []string
+
+	// names of nameservers whose addresses must be looked up before use
+	unresolved []string
+}
+
+// Resolve req iteratively. The response is not authoritative and has the
+// question of req.
+func (r *Resolver) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+
+	resp, err := r.resolve(ctx, strings.ToLower(dns.Fqdn(q.Name)), q.Qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &dns.Msg{}
+	ret.SetRcode(req, resp.Rcode)
+	ret.Answer = resp.Answer
+	ret.Ns = resp.Ns
+	ret.Extra = removeOPT(resp.Extra)
+
+	return ret, nil
+}
+
+// resolve name, following any CNAME chain that does not end with a record of
+// qtype
+func (r *Resolver) resolve(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > maxDepth {
+		return nil, errors.Errorf("too many nested lookups resolving %s", name)
+	}
+
+	var answer []dns.RR
+
+	for i := 0; i <= maxCNAMEs; i++ {
+		resp, err := r.query(ctx, name, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		answer = append(answer, resp.Answer...)
+
+		target := cnameTarget(resp.Answer, name, qtype)
+		if len(target) == 0 {
+			resp.Answer = answer
+			return resp, nil
+		}
+
+		name = target
+	}
+
+	return nil, errors.Errorf("too many cnames resolving %s", name)
+}
+
+// cnameTarget returns the end of the chain of CNAMEs in rrs that starts at
+// name, if that chain does not already end with a record of qtype
+func cnameTarget(rrs []dns.RR, name string, qtype uint16) string {
+	if qtype == dns.TypeCNAME {
+		return ""
+	}
+
+	target := name
+	seen := map[string]bool{name: true}
+
+	for {
+		var next string
+
+		for _, rr := range rrs {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, target) {
+				continue
+			}
+
+			if h.Rrtype == qtype {
+				return ""
+			}
+
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = strings.ToLower(cname.Target)
+			}
+		}
+
+		if len(next) == 0 {
+			break
+		}
+
+		// a loop will never resolve
+		if seen[next] {
+			return ""
+		}
+		seen[next] = true
+
+		target = next
+	}
+
+	if target == name {
+		return ""
+	}
+
+	return target
+}
+
+// query finds the nameservers for name by following referrals from the
+// closest known delegation, and returns their response
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	// DS records are served by the parent zone
+	start := name
+	if qtype == dns.TypeDS && name != "." {
+		start = "."
+		if off, end := dns.NextLabel(name, 0); !end {
+			start = name[off:]
+		}
+	}
+
+	d := r.closest(ctx, start)
+
+	labels := dns.CountLabel(name)
+	n := dns.CountLabel(d.zone) + 1
+
+	for i := 0; i < maxReferrals; i++ {
+		qname, qt := name, qtype
+
+		// RFC 9156 recommends A rather than NS queries when minimising since
+		// some servers mishandle the latter
+		if !r.NoMinimise && n < labels {
+			qname, qt = ancestor(name, n), dns.TypeA
+		}
+
+		resp, err := r.send(ctx, d, qname, qt, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		if ns := referral(resp, d.zone, qname); len(ns) > 0 {
+			d = r.delegate(ctx, d.zone, ns, resp.Extra)
+			n = dns.CountLabel(d.zone) + 1
+			continue
+		}
+
+		if qname == name {
+			bailiwick(resp, d.zone)
+			return resp, nil
+		}
+
+		// nothing exists below a name that doesn't exist, RFC 8020
+		if resp.Rcode == dns.RcodeNameError {
+			bailiwick(resp, d.zone)
+			resp.Question = []dns.Question{{Name: name, Qtype: qtype, Qclass: dns.ClassINET}}
+			resp.Answer = nil
+			return resp, nil
+		}
+
+		// qname isn't a zone cut, so ask the same nameservers for more of name
+		n++
+	}
+
+	return nil, errors.Errorf("too many referrals resolving %s", name)
+}
+
+// ancestor returns the last n labels of name
+func ancestor(name string, n int) string {
+	idx := dns.Split(name)
+	return name[idx[len(idx)-n]:]
+}
+
+// referral returns the NS records in resp that delegate qname, or one of its
+// ancestors, to a child of zone
+func referral(resp *dns.Msg, zone, qname string) []*dns.NS {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return nil
+	}
+
+	var child string
+	var ret []*dns.NS
+
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+
+		if len(child) == 0 {
+			child = owner
+		} else if owner != child {
+			continue
+		}
+
+		ret = append(ret, ns)
+	}
+
+	return ret
+}
+
+// inZone returns the records of rrs that zone is authoritative for. Anything
+// else, like the target of a CNAME in another zone, must be looked up from its
+// own nameservers.
+func inZone(rrs []dns.RR, zone string) []dns.RR {
+	var ret []dns.RR
+	for _, rr := range rrs {
+		if dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+			ret = append(ret, rr)
+		}
+	}
+	return ret
+}
+
+// bailiwick removes the records of resp that zone isn't authoritative for, so
+// that a nameserver can't have records of other zones cached
+func bailiwick(resp *dns.Msg, zone string) {
+	resp.Answer = inZone(resp.Answer, zone)
+	resp.Ns = inZone(resp.Ns, zone)
+	resp.Extra = inZone(removeOPT(resp.Extra), zone)
+}
+
+// usable returns whether resp, from a nameserver for zone, answers qname or
+// refers us closer to it. Anything else, including upward referrals, means
+// that the nameserver is lame.
+func usable(resp *dns.Msg, zone, qname string) bool {
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return false
+	}
+
+	if resp.Authoritative || len(resp.Answer) > 0 {
+		return true
+	}
+
+	return len(referral(resp, zone, qname)) > 0
+}
+
+// hints returns the delegation of the root zone from r.Hints
+func (r *Resolver) hints() *delegation {
+	ns, glue := splitNS(r.Hints)
+	return newDelegation(".", ns, glue)
+}
+
+func splitNS(rrs []dns.RR) ([]*dns.NS, []dns.RR) {
+	var ns []*dns.NS
+	var glue []dns.RR
+
+	for _, rr := range rrs {
+		switch t := rr.(type) {
+		case *dns.NS:
+			ns = append(ns, t)
+		case *dns.A, *dns.AAAA:
+			glue = append(glue, rr)
+		}
+	}
+
+	return ns, glue
+}
+
+func newDelegation(zone string, ns []*dns.NS, glue []dns.RR) *delegation {
+	d := &delegation{zone: zone}
+
+	for _, n := range ns {
+		target := strings.ToLower(n.Ns)
+
+		var found bool
+		for _, rr := range glue {
+			if !strings.EqualFold(rr.Header().Name, target) {
+				continue
+			}
+
+			switch t := rr.(type) {
+			case *dns.A:
+				d.addrs = append(d.addrs, net.JoinHostPort(t.A.String(), "53"))
+				found = true
+			case *dns.AAAA:
+				d.addrs = append(d.addrs, net.JoinHostPort(t.AAAA.String(), "53"))
+				found = true
+			}
+		}
+
+		if !found {
+			d.unresolved = append(d.unresolved, target)
+		}
+	}
+
+	return d
+}
+
+// closest returns the delegation of the closest ancestor of name that is in
+// the cache, or the root hints
+func (r *Resolver) closest(ctx context.Context, name string) *delegation {
+	if r.Cache == nil {
+		return r.hints()
+	}
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone := name[off:]
+
+		req := &dns.Msg{}
+		req.SetQuestion(zone, dns.TypeNS)
+
+		resp := r.Cache.Get(ctx, req)
+		if resp == nil {
+			continue
+		}
+
+		var ns []*dns.NS
+		for _, rr := range resp.Answer {
+			if t, ok := rr.(*dns.NS); ok && strings.EqualFold(t.Hdr.Name, zone) {
+				ns = append(ns, t)
+			}
+		}
+
+		if len(ns) > 0 {
+			return newDelegation(zone, ns, resp.Extra)
+		}
+	}
+
+	return r.hints()
+}
+
+// delegate returns the delegation from zone to the owner of ns. Only glue for
+// the nameservers in ns that zone is authoritative for is used. The delegation
+// is cached.
+func (r *Resolver) delegate(ctx context.Context, zone string, ns []*dns.NS, extra []dns.RR) *delegation {
+	child := strings.ToLower(ns[0].Hdr.Name)
+
+	targets := map[string]bool{}
+	for _, n := range ns {
+		targets[strings.ToLower(n.Ns)] = true
+	}
+
+	var glue []dns.RR
+	for _, rr := range extra {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			name := strings.ToLower(rr.Header().Name)
+			if targets[name] && dns.IsSubDomain(zone, name) {
+				glue = append(glue, rr)
+			}
+		}
+	}
+
+	if r.Cache != nil {
+		msg := &dns.Msg{}
+		msg.SetQuestion(child, dns.TypeNS)
+		msg.Response = true
+		for _, n := range ns {
+			msg.Answer = append(msg.Answer, n)
+		}
+		msg.Extra = glue
+
+		r.Cache.Set(msg)
+	}
+
+	return newDelegation(child, ns, glue)
+}
+
+// addrs looks up the addresses of the nameserver host
+func (r *Resolver) addrs(ctx context.Context, host string, depth int) []string {
+	var ret []string
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := r.resolve(ctx, host, qtype, depth)
+		if err != nil {
+			r.log().WithError(err).WithField("nameserver", host).Debug("could not resolve nameserver")
+			continue
+		}
+
+		// only the addresses are cached, not anything else the nameservers
+		// of host included
+		if r.Cache != nil {
+			msg := &dns.Msg{}
+			msg.SetQuestion(host, qtype)
+			msg.Response = true
+			msg.Answer = resp.Answer
+
+			r.Cache.Set(msg)
+		}
+
+		for _, rr := range resp.Answer {
+			switch t := rr.(type) {
+			case *dns.A:
+				ret = append(ret, net.JoinHostPort(t.A.String(), "53"))
+			case *dns.AAAA:
+				ret = append(ret, net.JoinHostPort(t.AAAA.String(), "53"))
+			}
+		}
+
+		if len(ret) > 0 {
+			break
+		}
+	}
+
+	return ret
+}
+
+// send qname to the nameservers of d until one of them gives a usable
+// response. Nameservers with known addresses are tried before looking up the
+// others.
+func (r *Resolver) send(ctx context.Context, d *delegation, qname string, qtype uint16, depth int) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(qname, qtype)
+	req.RecursionDesired = false
+	req.SetEdns0(r.udpSize(), r.DNSSECOK)
+
+	tried := map[string]bool{}
+
+	try := func(addrs []string) *dns.Msg {
+		for _, addr := range r.order(d.zone, addrs) {
+			if tried[addr] || ctx.Err() != nil {
+				continue
+			}
+			tried[addr] = true
+
+			resp, err := r.exchange(ctx, addr, req)
+			if err == nil && usable(resp, d.zone, qname) {
+				return resp
+			}
+
+			ctxLog := r.log().WithFields(slog.Fields{
+				"zone":       d.zone,
+				"name":       qname,
+				"nameserver": addr,
+			})
+			if err != nil {
+				ctxLog = ctxLog.WithError(err)
+			}
+			ctxLog.Debug("lame nameserver")
+
+			r.setLame(d.zone, addr)
+		}
+		return nil
+	}
+
+	if resp := try(d.addrs); resp != nil {
+		return resp, nil
+	}
+
+	for _, host := range d.unresolved {
+		// a nameserver inside the zone it serves can't be looked up without
+		// glue
+		if dns.IsSubDomain(d.zone, host) {
+			continue
+		}
+
+		if resp := try(r.addrs(ctx, host, depth+1)); resp != nil {
+			return resp, nil
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, errors.Errorf("no nameserver for %s answered %s", d.zone, qname)
+}
+
+func (r *Resolver) exchange(ctx context.Context, addr string, req *dns.Msg) (*dns.Msg, error) {
+	if r.Exchange != nil {
+		return r.Exchange(ctx, addr, req)
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := deadline.Sub(time.Now()); left < timeout {
+			timeout = left
+		}
+	}
+
+	c := &dns.Client{
+		UDPSize: r.udpSize(),
+		Timeout: timeout,
+	}
+
+	// Exchange returns dns.ErrTruncated along with the message when the TC
+	// bit is set
+	resp, _, err := c.Exchange(req, addr)
+	if (err == nil || err == dns.ErrTruncated) && resp != nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(req, addr)
+	}
+
+	return resp, err
+}
+
+func (r *Resolver) udpSize() uint16 {
+	if r.UDPSize >= dns.MinMsgSize {
+		return r.UDPSize
+	}
+	return DefaultUDPSize
+}
+
+func (r *Resolver) log() slog.Interface {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return slog.New()
+}
+
+func lameKey(zone, addr string) string {
+	return zone + " " + addr
+}
+
+func (r *Resolver) setLame(zone, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lame == nil {
+		r.lame = map[string]time.Time{}
+	}
+
+	r.lame[lameKey(zone, addr)] = time.Now().Add(lameTTL)
+}
+
+func (r *Resolver) isLame(zone, addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expires, ok := r.lame[lameKey(zone, addr)]
+	if ok && time.Now().After(expires) {
+		delete(r.lame, lameKey(zone, addr))
+		return false
+	}
+
+	return ok
+}
+
+// order returns addrs shuffled to spread the load between nameservers, but
+// with ipv4 before ipv6 and lame nameservers last
+func (r *Resolver) order(zone string, addrs []string) []string {
+	ret := make([]string, len(addrs))
+	for i, j := range rand.Perm(len(addrs)) {
+		ret[i] = addrs[j]
+	}
+
+	ba := byAddr{addrs: ret, rank: make([]int, len(ret))}
+	for i, addr := range ret {
+		if strings.HasPrefix(addr, "[") {
+			ba.rank[i]++
+		}
+		if r.isLame(zone, addr) {
+			ba.rank[i] += 2
+		}
+	}
+
+	sort.Stable(ba)
+
+	return ret
+}
+
+type byAddr struct {
+	addrs []string
+	rank  []int
+}
+
+func (b byAddr) Len() int { return len(b.addrs) }
+
+func (b byAddr) Swap(i, j int) {
+	b.addrs[i], b.addrs[j] = b.addrs[j], b.addrs[i]
+	b.rank[i], b.rank[j] = b.rank[j], b.rank[i]
+}
+
+func (b byAddr) Less(i, j int) bool {
+	return b.rank[i] < b.rank[j]
+}
+
+func removeOPT(rrs []dns.RR) []dns.RR {
+	var ret []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			ret = append(ret, rr)
+		}
+	}
+	return ret
+}
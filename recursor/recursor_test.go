@@ -0,0 +1,384 @@
+package recursor
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"jrubin.io/blamedns/dnscache"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func mustRRs(values ...string) []dns.RR {
+	ret := make([]dns.RR, len(values))
+	for i, value := range values {
+		ret[i] = mustRR(value)
+	}
+	return ret
+}
+
+// fakeServer is an in-process authoritative nameserver for zones
+type fakeServer struct {
+	zones   []string
+	records []dns.RR
+	lame    bool
+
+	// added to the authority and additional sections of every answer
+	poison []dns.RR
+}
+
+func (s *fakeServer) zone(name string) string {
+	var ret string
+	for _, zone := range s.zones {
+		if dns.IsSubDomain(zone, name) && len(zone) > len(ret) {
+			ret = zone
+		}
+	}
+	return ret
+}
+
+func (s *fakeServer) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+
+	zone := s.zone(name)
+	if s.lame || len(zone) == 0 {
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	}
+
+	// referrals to the closest delegated child of zone
+	for _, rr := range s.records {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeNS && h.Name != zone && dns.IsSubDomain(h.Name, name) {
+			for _, ns := range s.records {
+				if ns.Header().Rrtype == dns.TypeNS && ns.Header().Name == h.Name {
+					resp.Ns = append(resp.Ns, ns)
+					resp.Extra = append(resp.Extra, s.find(ns.(*dns.NS).Ns, dns.TypeA)...)
+					resp.Extra = append(resp.Extra, s.find(ns.(*dns.NS).Ns, dns.TypeAAAA)...)
+				}
+			}
+			return resp
+		}
+	}
+
+	resp.Authoritative = true
+
+	defer func() {
+		resp.Ns = append(resp.Ns, s.poison...)
+		resp.Extra = append(resp.Extra, s.poison...)
+	}()
+
+	for target := name; len(target) > 0; {
+		rrs := s.find(target, q.Qtype)
+		if len(rrs) == 0 && q.Qtype != dns.TypeCNAME {
+			rrs = s.find(target, dns.TypeCNAME)
+		}
+
+		resp.Answer = append(resp.Answer, rrs...)
+
+		target = ""
+		if len(rrs) > 0 {
+			if cname, ok := rrs[0].(*dns.CNAME); ok && s.zone(cname.Target) == zone {
+				target = cname.Target
+			}
+		}
+	}
+
+	if len(resp.Answer) > 0 {
+		return resp
+	}
+
+	resp.Ns = []dns.RR{mustRR(zone + " 300 IN SOA ns.invalid. admin.invalid. 1 3600 600 86400 300")}
+
+	for _, rr := range s.records {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			// NODATA
+			return resp
+		}
+	}
+
+	resp.Rcode = dns.RcodeNameError
+	return resp
+}
+
+func (s *fakeServer) find(name string, qtype uint16) []dns.RR {
+	var ret []dns.RR
+	for _, rr := range s.records {
+		if rr.Header().Name == name && rr.Header().Rrtype == qtype {
+			ret = append(ret, rr)
+		}
+	}
+	return ret
+}
+
+// fakeNetwork routes queries to fake servers by address and remembers the
+// names each of them was asked for
+type fakeNetwork struct {
+	mu      sync.Mutex
+	servers map[string]*fakeServer
+	queries map[string][]string
+}
+
+func (n *fakeNetwork) exchange(ctx context.Context, addr string, req *dns.Msg) (*dns.Msg, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := n.servers[host]
+	if !ok {
+		return nil, errors.Errorf("no route to %s", addr)
+	}
+
+	if req.RecursionDesired {
+		return nil, errors.New("recursion desired")
+	}
+
+	n.queries[host] = append(n.queries[host], req.Question[0].Name)
+
+	return s.answer(req), nil
+}
+
+func (n *fakeNetwork) reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.queries = map[string][]string{}
+}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{
+		queries: map[string][]string{},
+		servers: map[string]*fakeServer{
+			// root
+			"198.51.100.1": {
+				zones: []string{"."},
+				records: mustRRs(
+					"com. 300 IN NS a.gtld.com.",
+					"a.gtld.com. 300 IN A 198.51.100.2",
+					"net. 300 IN NS a.gtld.net.",
+					"a.gtld.net. 300 IN A 198.51.100.3",
+					"org. 300 IN NS a.org.",
+					"org. 300 IN NS b.org.",
+					"a.org. 300 IN A 198.51.100.9",
+					// ipv6, so always tried after the lame a.org.
+					"b.org. 300 IN AAAA 2001:db8::4",
+				),
+			},
+			"198.51.100.2": {
+				zones: []string{"com."},
+				records: mustRRs(
+					// out of bailiwick, so without glue
+					"example.com. 300 IN NS ns.example.net.",
+				),
+			},
+			"198.51.100.3": {
+				zones: []string{"net."},
+				records: mustRRs(
+					"example.net. 300 IN NS ns.example.net.",
+					"ns.example.net. 300 IN A 198.51.100.5",
+				),
+			},
+			"2001:db8::4": {
+				zones: []string{"org."},
+				records: mustRRs(
+					"www.example.org. 300 IN A 192.0.2.2",
+				),
+			},
+			"198.51.100.5": {
+				zones: []string{"example.com.", "example.net."},
+				records: mustRRs(
+					"www.example.com. 300 IN A 192.0.2.1",
+					"alias.example.com. 300 IN CNAME www.example.org.",
+					"ns.example.net. 300 IN A 198.51.100.5",
+				),
+			},
+			// lame for org.
+			"198.51.100.9": {lame: true},
+		},
+	}
+}
+
+func aRecords(resp *dns.Msg) []string {
+	var ret []string
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ret = append(ret, a.A.String())
+		}
+	}
+	return ret
+}
+
+func TestResolver(t *testing.T) {
+	Convey("iterative resolution should work", t, func() {
+		n := newFakeNetwork()
+
+		hints, err := ParseHints([]string{
+			". 3600 IN NS a.root.",
+			"a.root. 3600 IN A 198.51.100.1",
+		})
+		So(err, ShouldBeNil)
+
+		_, err = ParseHints([]string{"com. 3600 IN NS a.gtld.com."})
+		So(err, ShouldNotBeNil)
+
+		builtin, err := ParseHints(RootHints)
+		So(err, ShouldBeNil)
+		So(len(builtin), ShouldEqual, 39)
+
+		r := &Resolver{
+			Hints:    hints,
+			Cache:    dnscache.NewMemory(128, nil),
+			Exchange: n.exchange,
+		}
+
+		ctx := context.Background()
+
+		req := &dns.Msg{}
+		req.SetQuestion("WWW.example.com.", dns.TypeA)
+
+		resp, err := r.Resolve(ctx, req)
+		So(err, ShouldBeNil)
+		So(resp.Rcode, ShouldEqual, dns.RcodeSuccess)
+		So(resp.Authoritative, ShouldBeFalse)
+		So(resp.Question[0].Name, ShouldEqual, "WWW.example.com.")
+		So(aRecords(resp), ShouldResemble, []string{"192.0.2.1"})
+
+		// each server only saw as much of the name as it needed
+		So(n.queries["198.51.100.1"], ShouldResemble, []string{"com.", "net."})
+		So(n.queries["198.51.100.2"], ShouldResemble, []string{"example.com."})
+		So(n.queries["198.51.100.3"], ShouldResemble, []string{"example.net."})
+
+		// delegations are cached
+		n.reset()
+		resp, err = r.Resolve(ctx, req)
+		So(err, ShouldBeNil)
+		So(aRecords(resp), ShouldResemble, []string{"192.0.2.1"})
+		So(n.queries["198.51.100.1"], ShouldBeEmpty)
+		So(n.queries["198.51.100.2"], ShouldBeEmpty)
+		So(n.queries["198.51.100.5"], ShouldResemble, []string{"www.example.com."})
+
+		// cnames are followed into other zones, past lame nameservers
+		req.SetQuestion("alias.example.com.", dns.TypeA)
+		resp, err = r.Resolve(ctx, req)
+		So(err, ShouldBeNil)
+		So(len(resp.Answer), ShouldEqual, 2)
+		So(aRecords(resp), ShouldResemble, []string{"192.0.2.2"})
+		So(r.isLame("org.", "198.51.100.9:53"), ShouldBeTrue)
+
+		req.SetQuestion("missing.example.com.", dns.TypeA)
+		resp, err = r.Resolve(ctx, req)
+		So(err, ShouldBeNil)
+		So(resp.Rcode, ShouldEqual, dns.RcodeNameError)
+
+		// nxdomain for an ancestor ends the search early
+		req.SetQuestion("a.b.missing.org.", dns.TypeA)
+		resp, err = r.Resolve(ctx, req)
+		So(err, ShouldBeNil)
+		So(resp.Rcode, ShouldEqual, dns.RcodeNameError)
+		So(resp.Question[0].Name, ShouldEqual, "a.b.missing.org.")
+
+		// without minimisation, the full name is sent everywhere
+		n.reset()
+		r = &Resolver{
+			Hints:      hints,
+			Exchange:   n.exchange,
+			NoMinimise: true,
+		}
+
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		resp, err = r.Resolve(ctx, req)
+		So(err, ShouldBeNil)
+		So(aRecords(resp), ShouldResemble, []string{"192.0.2.1"})
+		So(n.queries["198.51.100.1"], ShouldResemble, []string{"www.example.com.", "ns.example.net."})
+
+		// unreachable nameservers are an error
+		r.Hints = mustRRs(". 3600 IN NS a.root.", "a.root. 3600 IN A 203.0.113.1")
+		_, err = r.Resolve(ctx, req)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("records out of bailiwick should not be returned or cached", t, func() {
+		n := newFakeNetwork()
+		n.servers["198.51.100.5"].poison = mustRRs(
+			"example.org. 300 IN NS ns.evil.example.",
+			"ns.evil.example. 300 IN A 203.0.113.66",
+			"www.example.org. 300 IN A 203.0.113.66",
+			"example.com. 300 IN NS ns.example.net.",
+		)
+
+		cache := dnscache.NewMemory(128, nil)
+		r := &Resolver{
+			Hints:    mustRRs(". 3600 IN NS a.root.", "a.root. 3600 IN A 198.51.100.1"),
+			Cache:    cache,
+			Exchange: n.exchange,
+		}
+
+		ctx := context.Background()
+
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+
+		resp, err := r.Resolve(ctx, req)
+		So(err, ShouldBeNil)
+		So(aRecords(resp), ShouldResemble, []string{"192.0.2.1"})
+
+		for _, rr := range append(resp.Ns, resp.Extra...) {
+			So(dns.IsSubDomain("example.com.", rr.Header().Name), ShouldBeTrue)
+		}
+
+		for _, q := range []dns.Question{
+			{Name: "example.org.", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
+			{Name: "ns.evil.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: "www.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		} {
+			req := &dns.Msg{Question: []dns.Question{q}}
+			So(cache.Get(ctx, req), ShouldBeNil)
+		}
+
+		// the poisoned delegation isn't used
+		req.SetQuestion("www.example.org.", dns.TypeA)
+		resp, err = r.Resolve(ctx, req)
+		So(err, ShouldBeNil)
+		So(aRecords(resp), ShouldResemble, []string{"192.0.2.2"})
+	})
+
+	Convey("cname chains should be followed", t, func() {
+		rrs := mustRRs(
+			"a.example. 300 IN CNAME b.example.",
+			"b.example. 300 IN CNAME c.example.",
+		)
+		So(cnameTarget(rrs, "a.example.", dns.TypeA), ShouldEqual, "c.example.")
+		So(cnameTarget(rrs, "a.example.", dns.TypeCNAME), ShouldEqual, "")
+
+		rrs = append(rrs, mustRR("c.example. 300 IN A 192.0.2.1"))
+		So(cnameTarget(rrs, "a.example.", dns.TypeA), ShouldEqual, "")
+
+		// loops end
+		rrs = mustRRs(
+			"a.example. 300 IN CNAME b.example.",
+			"b.example. 300 IN CNAME a.example.",
+		)
+		So(cnameTarget(rrs, "a.example.", dns.TypeA), ShouldEqual, "")
+	})
+}
@@ -0,0 +1,685 @@
+// Package rpz implements response policy zones (RPZ), dns firewall policies
+// that are published as ordinary zones. Each rule is a set of records whose
+// owner name, relative to the policy zone, is the trigger and whose data is
+// the action to take.
+//
+// Supported triggers are query names (including wildcards and the names that
+// cnames in responses lead to), response ip addresses (rpz-ip) and the names of
+// nameservers in responses (rpz-nsdname). Client ip and nameserver ip triggers
+// are ignored.
+package rpz
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jrubin.io/slog"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// An Action is what a rule does with the queries it matches
+type Action int
+
+const (
+	// None means that no rule matched
+	None Action = iota
+
+	// NXDOMAIN answers that the name doesn't exist (CNAME .)
+	NXDOMAIN
+
+	// NODATA answers that the name has no records of the requested type
+	// (CNAME *.)
+	NODATA
+
+	// Passthru answers as usual, without applying any other policy (CNAME
+	// rpz-passthru.)
+	Passthru
+
+	// Drop doesn't answer at all (CNAME rpz-drop.)
+	Drop
+
+	// TCPOnly answers udp queries with a truncated response so that the
+	// query is retried over tcp, where it is answered as usual (CNAME
+	// rpz-tcp-only.)
+	TCPOnly
+
+	// LocalData answers with the records of the rule
+	LocalData
+)
+
+func (a Action) String() string {
+	switch a {
+	case None:
+		return "none"
+	case NXDOMAIN:
+		return "nxdomain"
+	case NODATA:
+		return "nodata"
+	case Passthru:
+		return "passthru"
+	case Drop:
+		return "drop"
+	case TCPOnly:
+		return "tcp-only"
+	case LocalData:
+		return "local-data"
+	}
+	return strconv.Itoa(int(a))
+}
+
+// triggers
+const (
+	QName   = "qname"
+	IP      = "ip"
+	NSDName = "nsdname"
+)
+
+type rule struct {
+	name   string
+	action Action
+	data   []dns.RR
+}
+
+func (r *rule) add(rr dns.RR) {
+	if cname, ok := rr.(*dns.CNAME); ok {
+		switch strings.ToLower(cname.Target) {
+		case ".":
+			r.action = NXDOMAIN
+			return
+		case "*.":
+			r.action = NODATA
+			return
+		case "rpz-passthru.":
+			r.action = Passthru
+			return
+		case "rpz-drop.":
+			r.action = Drop
+			return
+		case "rpz-tcp-only.":
+			r.action = TCPOnly
+			return
+		}
+	}
+
+	if r.action == None {
+		r.action = LocalData
+	}
+
+	r.data = append(r.data, rr)
+}
+
+type ipRule struct {
+	net  *net.IPNet
+	rule *rule
+}
+
+// A Zone is a response policy zone, loaded from File or transferred (AXFR)
+// from Primary
+type Zone struct {
+	Name    string
+	File    string
+	Primary string
+	Timeout time.Duration
+
+	mu      sync.RWMutex
+	qname   map[string]*rule
+	nsdname map[string]*rule
+	ip      []ipRule
+	soa     *dns.SOA
+	modTime time.Time
+}
+
+// Parse returns the records of the zone file read from r
+func Parse(r io.Reader, origin, file string) ([]dns.RR, error) {
+	var ret []dns.RR
+
+	for t := range dns.ParseZone(r, dns.Fqdn(origin), file) {
+		if t.Error != nil {
+			return nil, t.Error
+		}
+		ret = append(ret, t.RR)
+	}
+
+	return ret, nil
+}
+
+// parseIP parses the trigger of an rpz-ip rule, e.g. 24.0.2.0.192 for
+// 192.0.2.0/24 or 48.zz.db8.2001 for 2001:db8::/48
+func parseIP(s string) (*net.IPNet, error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return nil, errors.Errorf("invalid rpz-ip trigger: %s", s)
+	}
+
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil || prefix < 1 {
+		return nil, errors.Errorf("invalid rpz-ip prefix: %s", s)
+	}
+
+	labels = labels[1:]
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	if len(labels) == net.IPv4len && prefix <= 8*net.IPv4len {
+		if ip := net.ParseIP(strings.Join(labels, ".")).To4(); ip != nil {
+			mask := net.CIDRMask(prefix, 8*net.IPv4len)
+			return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+		}
+	}
+
+	for i, label := range labels {
+		if label == "zz" {
+			labels[i] = ""
+		}
+	}
+
+	addr := strings.Join(labels, ":")
+	if strings.HasPrefix(addr, ":") {
+		addr = ":" + addr
+	}
+	if strings.HasSuffix(addr, ":") {
+		addr += ":"
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil || prefix > 8*net.IPv6len {
+		return nil, errors.Errorf("invalid rpz-ip trigger: %s", s)
+	}
+
+	mask := net.CIDRMask(prefix, 8*net.IPv6len)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+func addRule(rules map[string]*rule, key string, rr dns.RR) *rule {
+	r, ok := rules[key]
+	if !ok {
+		r = &rule{name: strings.ToLower(rr.Header().Name)}
+		rules[key] = r
+	}
+	r.add(rr)
+	return r
+}
+
+// Load replaces the rules of z with those in rrs
+func (z *Zone) Load(rrs []dns.RR) error {
+	origin := strings.ToLower(dns.Fqdn(z.Name))
+
+	qname := map[string]*rule{}
+	nsdname := map[string]*rule{}
+	ips := map[string]*rule{}
+	var ipKeys []string
+	var soa *dns.SOA
+
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM, dns.TypeDNSKEY:
+			continue
+		}
+
+		if name == origin {
+			if s, ok := rr.(*dns.SOA); ok {
+				soa = s
+			}
+			continue
+		}
+
+		if !dns.IsSubDomain(origin, name) {
+			continue
+		}
+
+		trigger := strings.TrimSuffix(name[:len(name)-len(origin)], ".")
+
+		switch {
+		case strings.HasSuffix(trigger, ".rpz-ip"):
+			key := strings.TrimSuffix(trigger, ".rpz-ip")
+			if _, ok := ips[key]; !ok {
+				ipKeys = append(ipKeys, key)
+			}
+			addRule(ips, key, rr)
+		case strings.HasSuffix(trigger, ".rpz-nsdname"):
+			addRule(nsdname, strings.TrimSuffix(trigger, "rpz-nsdname"), rr)
+		case strings.HasSuffix(trigger, ".rpz-client-ip"), strings.HasSuffix(trigger, ".rpz-nsip"):
+			// unsupported
+		default:
+			addRule(qname, trigger+".", rr)
+		}
+	}
+
+	ip := make([]ipRule, 0, len(ipKeys))
+	for _, key := range ipKeys {
+		n, err := parseIP(key)
+		if err != nil {
+			return errors.Wrapf(err, "rpz zone %s", z.Name)
+		}
+		ip = append(ip, ipRule{net: n, rule: ips[key]})
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	z.qname = qname
+	z.nsdname = nsdname
+	z.ip = ip
+	z.soa = soa
+
+	return nil
+}
+
+// Len returns the number of rules in z
+func (z *Zone) Len() int {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	return len(z.qname) + len(z.nsdname) + len(z.ip)
+}
+
+// Serial returns the serial of the loaded zone
+func (z *Zone) Serial() uint32 {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if z.soa == nil {
+		return 0
+	}
+	return z.soa.Serial
+}
+
+// Refresh reloads z if it has changed since it was last loaded and returns
+// whether it did
+func (z *Zone) Refresh() (bool, error) {
+	if len(z.File) > 0 {
+		return z.refreshFile()
+	}
+
+	if len(z.Primary) > 0 {
+		return z.refreshPrimary()
+	}
+
+	return false, errors.Errorf("rpz zone %s has neither a file nor a primary", z.Name)
+}
+
+func (z *Zone) refreshFile() (bool, error) {
+	fi, err := os.Stat(z.File)
+	if err != nil {
+		return false, err
+	}
+
+	z.mu.RLock()
+	unchanged := fi.ModTime().Equal(z.modTime)
+	z.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	f, err := os.Open(z.File)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	rrs, err := Parse(f, z.Name, z.File)
+	if err != nil {
+		return false, err
+	}
+
+	if err = z.Load(rrs); err != nil {
+		return false, err
+	}
+
+	z.mu.Lock()
+	z.modTime = fi.ModTime()
+	z.mu.Unlock()
+
+	return true, nil
+}
+
+func (z *Zone) refreshPrimary() (bool, error) {
+	addr := z.Primary
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	origin := dns.Fqdn(z.Name)
+
+	req := &dns.Msg{}
+	req.SetQuestion(origin, dns.TypeSOA)
+
+	c := &dns.Client{Timeout: z.Timeout}
+	resp, _, err := c.Exchange(req, addr)
+	if err != nil {
+		return false, errors.Wrapf(err, "rpz zone %s: soa query to %s failed", z.Name, addr)
+	}
+
+	var soa *dns.SOA
+	for _, rr := range resp.Answer {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+		}
+	}
+
+	if soa == nil {
+		return false, errors.Errorf("rpz zone %s: %s has no soa", z.Name, addr)
+	}
+
+	z.mu.RLock()
+	unchanged := z.soa != nil && z.soa.Serial == soa.Serial
+	z.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	t := &dns.Transfer{
+		DialTimeout: z.Timeout,
+		ReadTimeout: z.Timeout,
+	}
+
+	req.SetAxfr(origin)
+	env, err := t.In(req, addr)
+	if err != nil {
+		return false, errors.Wrapf(err, "rpz zone %s: transfer from %s failed", z.Name, addr)
+	}
+
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return false, errors.Wrapf(e.Error, "rpz zone %s: transfer from %s failed", z.Name, addr)
+		}
+		rrs = append(rrs, e.RR...)
+	}
+
+	if err = z.Load(rrs); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// match returns the rule for name, preferring an exact match to the most
+// specific wildcard
+func match(rules map[string]*rule, name string) *rule {
+	if r, ok := rules[name]; ok {
+		return r
+	}
+
+	for off, end := 0, false; !end; {
+		off, end = dns.NextLabel(name, off)
+		if r, ok := rules["*."+name[off:]]; ok {
+			return r
+		}
+	}
+
+	return nil
+}
+
+func (z *Zone) policy(trigger string, r *rule) *Policy {
+	return &Policy{
+		Zone:    z.Name,
+		Trigger: trigger,
+		Rule:    r.name,
+		Action:  r.action,
+		data:    r.data,
+		soa:     z.soa,
+	}
+}
+
+func (z *Zone) qnamePolicy(name string) *Policy {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if r := match(z.qname, name); r != nil {
+		return z.policy(QName, r)
+	}
+
+	return nil
+}
+
+func (z *Zone) responsePolicy(qname string, resp *dns.Msg) *Policy {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	// the names that cnames lead to
+	for _, rr := range resp.Answer {
+		name := strings.ToLower(rr.Header().Name)
+		if name == qname {
+			continue
+		}
+
+		if r := match(z.qname, name); r != nil {
+			return z.policy(QName, r)
+		}
+	}
+
+	// the longest matching prefix wins
+	var best *ipRule
+	for _, rr := range resp.Answer {
+		var ip net.IP
+
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		for i, ir := range z.ip {
+			if ir.net.Contains(ip) && (best == nil || prefixLen(ir.net) > prefixLen(best.net)) {
+				best = &z.ip[i]
+			}
+		}
+	}
+
+	if best != nil {
+		return z.policy(IP, best.rule)
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok {
+				if r := match(z.nsdname, strings.ToLower(ns.Ns)); r != nil {
+					return z.policy(NSDName, r)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func prefixLen(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+// A Policy is the rule of a response policy zone that applies to a query
+type Policy struct {
+	Zone    string
+	Trigger string
+	Rule    string
+	Action  Action
+
+	data []dns.RR
+	soa  *dns.SOA
+}
+
+// Reply returns the response to req that p calls for. Policies that don't
+// replace the response (Passthru, Drop and TCPOnly) return nil.
+func (p *Policy) Reply(req *dns.Msg) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+
+	switch p.Action {
+	case NXDOMAIN:
+		resp.Rcode = dns.RcodeNameError
+		resp.Ns = p.negative()
+	case NODATA:
+		resp.Ns = p.negative()
+	case LocalData:
+		if resp.Answer = p.answer(req.Question[0]); len(resp.Answer) == 0 {
+			resp.Ns = p.negative()
+		}
+	default:
+		return nil
+	}
+
+	return resp
+}
+
+// answer returns the local data of p for q, with q's name as owner
+func (p *Policy) answer(q dns.Question) []dns.RR {
+	var ret []dns.RR
+
+	for _, rr := range p.data {
+		switch rr.Header().Rrtype {
+		case dns.TypeCNAME:
+			// a cname is the only answer. targets starting with *. are
+			// relative to the query name.
+			cname := dns.Copy(rr).(*dns.CNAME)
+			cname.Hdr.Name = q.Name
+			if strings.HasPrefix(cname.Target, "*.") {
+				cname.Target = q.Name + cname.Target[2:]
+			}
+			return []dns.RR{cname}
+		case q.Qtype:
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			ret = append(ret, rr)
+		}
+	}
+
+	return ret
+}
+
+// negative returns the authority section of negative responses
+func (p *Policy) negative() []dns.RR {
+	if p.soa == nil {
+		return nil
+	}
+
+	soa := dns.Copy(p.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+
+	return []dns.RR{soa}
+}
+
+// An Engine applies the policies of its zones. Zones are consulted in order
+// and the first matching rule wins. Query name triggers are checked before the
+// query is answered, the others once there is a response.
+type Engine struct {
+	Zones   []*Zone
+	Refresh time.Duration
+	Logger  slog.Interface
+
+	stopCh chan struct{}
+}
+
+// QName returns the policy for queries for name, if any
+func (e *Engine) QName(name string) *Policy {
+	if e == nil {
+		return nil
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+
+	for _, z := range e.Zones {
+		if p := z.qnamePolicy(name); p != nil {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// Response returns the policy for resp, if any
+func (e *Engine) Response(resp *dns.Msg) *Policy {
+	if e == nil || resp == nil || len(resp.Question) == 0 {
+		return nil
+	}
+
+	qname := strings.ToLower(resp.Question[0].Name)
+
+	for _, z := range e.Zones {
+		if p := z.responsePolicy(qname, resp); p != nil {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) refresh() {
+	for _, z := range e.Zones {
+		ctxLog := e.Logger.WithField("zone", z.Name)
+
+		changed, err := z.Refresh()
+		if err != nil {
+			ctxLog.WithError(err).Error("error refreshing rpz zone")
+			continue
+		}
+
+		if changed {
+			ctxLog.WithFields(slog.Fields{
+				"serial": z.Serial(),
+				"rules":  z.Len(),
+			}).Info("loaded rpz zone")
+		}
+	}
+}
+
+// Start loads the zones and then refreshes them every e.Refresh
+func (e *Engine) Start() {
+	if e == nil || e.stopCh != nil {
+		return
+	}
+
+	e.stopCh = make(chan struct{})
+
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if e.Refresh > 0 {
+		ticker = time.NewTicker(e.Refresh)
+		tick = ticker.C
+	}
+
+	go func() {
+		e.refresh()
+
+		for {
+			select {
+			case <-tick:
+				e.refresh()
+			case <-e.stopCh:
+				if ticker != nil {
+					ticker.Stop()
+				}
+				close(e.stopCh)
+				return
+			}
+		}
+	}()
+}
+
+func (e *Engine) Stop() {
+	if e == nil || e.stopCh == nil {
+		return
+	}
+
+	e.stopCh <- struct{}{}
+	<-e.stopCh
+	e.stopCh = nil
+}
@@ -0,0 +1,265 @@
+package rpz
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testZone = `$ORIGIN rpz.example.
+$TTL 300
+@ IN SOA ns.rpz.example. admin.rpz.example. 7 3600 600 86400 60
+@ IN NS ns.rpz.example.
+
+bad.example.com CNAME .
+*.bad.example.com CNAME .
+empty.example.com CNAME *.
+ok.bad.example.com CNAME rpz-passthru.
+drop.example.com CNAME rpz-drop.
+tcp.example.com CNAME rpz-tcp-only.
+local.example.com A 192.0.2.10
+local.example.com AAAA 2001:db8::10
+alias.example.com CNAME safe.example.net.
+garden.example.com CNAME *.walled.example.net.
+
+24.0.2.0.192.rpz-ip CNAME .
+32.66.2.0.192.rpz-ip CNAME rpz-passthru.
+48.zz.db8.2001.rpz-ip CNAME *.
+
+ns.evil.example.rpz-nsdname CNAME .
+32.1.2.0.192.rpz-client-ip CNAME .
+`
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func response(name string, rrs ...string) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetQuestion(name, dns.TypeA)
+	for _, rr := range rrs {
+		resp.Answer = append(resp.Answer, mustRR(rr))
+	}
+	return resp
+}
+
+// startPrimary starts a nameserver that serves rrs, a zone starting with its
+// soa, over udp and tcp, including zone transfers
+func startPrimary(rrs []dns.RR) (string, func(), error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		return "", nil, err
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+
+		// packing a response writes to its records, so responses that are
+		// sent at the same time over udp and tcp mustn't share them
+		switch req.Question[0].Qtype {
+		case dns.TypeSOA:
+			resp.Answer = []dns.RR{dns.Copy(rrs[0])}
+		case dns.TypeAXFR:
+			for _, rr := range rrs {
+				resp.Answer = append(resp.Answer, dns.Copy(rr))
+			}
+			resp.Answer = append(resp.Answer, dns.Copy(rrs[0]))
+		}
+
+		_ = w.WriteMsg(resp)
+	})
+
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+
+	go func() { _ = udp.ActivateAndServe() }()
+	go func() { _ = tcp.ActivateAndServe() }()
+
+	return pc.LocalAddr().String(), func() {
+		_ = udp.Shutdown()
+		_ = tcp.Shutdown()
+	}, nil
+}
+
+func TestRPZ(t *testing.T) {
+	Convey("rpz-ip triggers should be parsed", t, func() {
+		n, err := parseIP("24.0.2.0.192")
+		So(err, ShouldBeNil)
+		So(n.String(), ShouldEqual, "192.0.2.0/24")
+
+		n, err = parseIP("128.1.zz.db8.2001")
+		So(err, ShouldBeNil)
+		So(n.String(), ShouldEqual, "2001:db8::1/128")
+
+		n, err = parseIP("16.zz.1")
+		So(err, ShouldBeNil)
+		So(n.String(), ShouldEqual, "1::/16")
+
+		for _, s := range []string{"192", "0.2.0.192", "33.1.2.0.192", "64.zz.bogus"} {
+			_, err = parseIP(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("policies should be loaded and applied", t, func() {
+		rrs, err := Parse(strings.NewReader(testZone), "rpz.example", "test")
+		So(err, ShouldBeNil)
+
+		z := &Zone{Name: "rpz.example"}
+		So(z.Load(rrs), ShouldBeNil)
+		So(z.Len(), ShouldEqual, 13)
+		So(z.Serial(), ShouldEqual, 7)
+
+		e := &Engine{Zones: []*Zone{z}}
+
+		var ne *Engine
+		So(ne.QName("bad.example.com."), ShouldBeNil)
+
+		So(e.QName("example.com."), ShouldBeNil)
+		So(e.QName("BAD.example.com").Action, ShouldEqual, NXDOMAIN)
+		So(e.QName("www.bad.example.com.").Action, ShouldEqual, NXDOMAIN)
+		So(e.QName("www.bad.example.com.").Rule, ShouldEqual, "*.bad.example.com.rpz.example.")
+		So(e.QName("ok.bad.example.com.").Action, ShouldEqual, Passthru)
+		So(e.QName("empty.example.com.").Action, ShouldEqual, NODATA)
+		So(e.QName("drop.example.com.").Action, ShouldEqual, Drop)
+		So(e.QName("tcp.example.com.").Action, ShouldEqual, TCPOnly)
+
+		req := &dns.Msg{}
+		req.SetQuestion("bad.example.com.", dns.TypeA)
+		resp := e.QName(req.Question[0].Name).Reply(req)
+		So(resp.Rcode, ShouldEqual, dns.RcodeNameError)
+		So(len(resp.Ns), ShouldEqual, 1)
+		So(resp.Ns[0].Header().Ttl, ShouldEqual, 60)
+
+		So(e.QName("drop.example.com.").Reply(req), ShouldBeNil)
+
+		// local data
+		req.SetQuestion("local.example.com.", dns.TypeAAAA)
+		resp = e.QName(req.Question[0].Name).Reply(req)
+		So(resp.Rcode, ShouldEqual, dns.RcodeSuccess)
+		So(len(resp.Answer), ShouldEqual, 1)
+		So(resp.Answer[0].(*dns.AAAA).AAAA.String(), ShouldEqual, "2001:db8::10")
+
+		req.SetQuestion("local.example.com.", dns.TypeMX)
+		resp = e.QName(req.Question[0].Name).Reply(req)
+		So(resp.Rcode, ShouldEqual, dns.RcodeSuccess)
+		So(resp.Answer, ShouldBeEmpty)
+
+		req.SetQuestion("alias.example.com.", dns.TypeA)
+		resp = e.QName(req.Question[0].Name).Reply(req)
+		So(resp.Answer[0].(*dns.CNAME).Target, ShouldEqual, "safe.example.net.")
+
+		req.SetQuestion("garden.example.com.", dns.TypeA)
+		resp = e.QName(req.Question[0].Name).Reply(req)
+		So(resp.Answer[0].Header().Name, ShouldEqual, "garden.example.com.")
+		So(resp.Answer[0].(*dns.CNAME).Target, ShouldEqual, "garden.example.com.walled.example.net.")
+
+		// response triggers
+		So(e.Response(response("www.example.org.", "www.example.org. 300 IN A 198.51.100.1")), ShouldBeNil)
+
+		p := e.Response(response("www.example.org.", "www.example.org. 300 IN A 192.0.2.1"))
+		So(p.Trigger, ShouldEqual, IP)
+		So(p.Action, ShouldEqual, NXDOMAIN)
+
+		// the longest prefix wins
+		p = e.Response(response("www.example.org.", "www.example.org. 300 IN A 192.0.2.66"))
+		So(p.Action, ShouldEqual, Passthru)
+
+		p = e.Response(response("www.example.org.", "www.example.org. 300 IN AAAA 2001:db8::1"))
+		So(p.Action, ShouldEqual, NODATA)
+
+		p = e.Response(response("www.example.org.",
+			"www.example.org. 300 IN CNAME www.bad.example.com.",
+			"www.bad.example.com. 300 IN A 198.51.100.1",
+		))
+		So(p.Trigger, ShouldEqual, QName)
+		So(p.Action, ShouldEqual, NXDOMAIN)
+
+		resp = response("www.example.org.", "www.example.org. 300 IN A 198.51.100.1")
+		resp.Ns = []dns.RR{mustRR("example.org. 300 IN NS ns.evil.example.")}
+		p = e.Response(resp)
+		So(p.Trigger, ShouldEqual, NSDName)
+
+		// earlier zones take precedence
+		first := &Zone{Name: "first.example"}
+		So(first.Load([]dns.RR{mustRR("bad.example.com.first.example. 300 IN CNAME rpz-passthru.")}), ShouldBeNil)
+		e.Zones = []*Zone{first, z}
+		So(e.QName("bad.example.com.").Action, ShouldEqual, Passthru)
+		So(e.QName("www.bad.example.com.").Action, ShouldEqual, NXDOMAIN)
+
+		// invalid rpz-ip triggers fail the load and keep the old rules
+		So(z.Load([]dns.RR{mustRR("99.1.rpz-ip.rpz.example. 300 IN CNAME .")}), ShouldNotBeNil)
+		So(z.Len(), ShouldEqual, 13)
+	})
+
+	Convey("zone files should be reloaded when they change", t, func() {
+		dir, err := ioutil.TempDir("", "rpz")
+		So(err, ShouldBeNil)
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		file := filepath.Join(dir, "rpz.example.zone")
+		So(ioutil.WriteFile(file, []byte(testZone), 0644), ShouldBeNil)
+
+		z := &Zone{Name: "rpz.example.", File: file}
+
+		changed, err := z.Refresh()
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+		So(z.Len(), ShouldEqual, 13)
+
+		changed, err = z.Refresh()
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeFalse)
+
+		So(ioutil.WriteFile(file, []byte("$ORIGIN rpz.example.\nbad.example.com 300 CNAME .\n"), 0644), ShouldBeNil)
+		So(os.Chtimes(file, z.modTime.Add(1), z.modTime.Add(1)), ShouldBeNil)
+
+		changed, err = z.Refresh()
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+		So(z.Len(), ShouldEqual, 1)
+
+		z = &Zone{Name: "missing.example."}
+		_, err = z.Refresh()
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("zones should be transferred from a primary when the serial changes", t, func() {
+		rrs, err := Parse(strings.NewReader(testZone), "rpz.example", "test")
+		So(err, ShouldBeNil)
+
+		addr, stop, err := startPrimary(rrs)
+		So(err, ShouldBeNil)
+		defer stop()
+
+		z := &Zone{Name: "rpz.example", Primary: addr}
+
+		changed, err := z.Refresh()
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+		So(z.Len(), ShouldEqual, 13)
+		So(z.Serial(), ShouldEqual, 7)
+
+		changed, err = z.Refresh()
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeFalse)
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/miekg/dns"
+	"jrubin.io/blamedns/idn"
 )
 
 type Modifier struct {
@@ -37,7 +38,7 @@ func (m *Modifier) StripComments() *Modifier {
 	}
 
 	if i != -1 {
-		*m.Text = (*m.Text)[:i-1]
+		*m.Text = (*m.Text)[:i]
 	}
 
 	return m
@@ -67,3 +68,12 @@ func (m *Modifier) ExtractField(num int) *Modifier {
 	}
 	return m
 }
+
+// ToASCII converts an internationalized domain name to A-labels. The text is
+// left unchanged if it can't be converted so that validation rejects it.
+func (m *Modifier) ToASCII() *Modifier {
+	if s, err := idn.ToASCII(*m.Text); err == nil {
+		*m.Text = s
+	}
+	return m
+}
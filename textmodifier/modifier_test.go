@@ -8,5 +8,10 @@ import (
 
 func TestTextModifier(t *testing.T) {
 	Convey("textmodifier should work", t, func() {
+		text := "0.0.0.0 example.com#comment"
+		So(New(&text).StripComments().String(), ShouldEqual, "0.0.0.0 example.com")
+
+		text = " Bücher.Example. "
+		So(New(&text).TrimSpace().ToLower().UnFQDN().ToASCII().String(), ShouldEqual, "xn--bcher-kva.example")
 	})
 }
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -16,11 +17,14 @@ import (
 
 type Watcher struct {
 	Dir        []string
+	Files      []string
 	Parser     parser.Parser
 	Logger     slog.Interface
 	watcher    *fsnotify.Watcher
 	stopCh     chan struct{}
 	parseTimer map[string]*time.Timer
+	parsed     map[string]bool
+	fileMu     map[string]*sync.Mutex
 	mu         sync.Mutex
 }
 
@@ -35,7 +39,7 @@ func New(l slog.Interface, p parser.Parser, dir ...string) (*Watcher, error) {
 			return nil, err
 		}
 
-		if err = w.Add(d); err != nil {
+		if err = addDir(w, d); err != nil {
 			return nil, err
 		}
 	}
@@ -52,14 +56,134 @@ func New(l slog.Interface, p parser.Parser, dir ...string) (*Watcher, error) {
 		Logger:     l,
 		watcher:    w,
 		parseTimer: map[string]*time.Timer{},
+		parsed:     map[string]bool{},
+	}, nil
+}
+
+// addDir watches dir and every directory in it that isn't hidden
+func addDir(w *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if name != dir && hidden(name) {
+			return filepath.SkipDir
+		}
+
+		return w.Add(name)
+	})
+}
+
+// NewFiles returns a Watcher that only parses the given files rather than
+// every file in a directory. The directory containing each file is watched
+// (instead of the file itself) so that files that are replaced, rather than
+// modified in place, continue to be picked up.
+func NewFiles(l slog.Interface, p parser.Parser, file ...string) (*Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, len(file))
+	watched := map[string]bool{}
+
+	for i, f := range file {
+		files[i] = path.Clean(f)
+
+		d := path.Dir(files[i])
+		if watched[d] {
+			continue
+		}
+
+		if err = w.Add(d); err != nil {
+			return nil, err
+		}
+
+		watched[d] = true
+	}
+
+	if l == nil {
+		l = text.Logger(slog.InfoLevel)
+	}
+
+	l.WithField("files", strings.Join(files, ", ")).Debug("watching files")
+
+	return &Watcher{
+		Files:      files,
+		Parser:     p,
+		Logger:     l,
+		watcher:    w,
+		parseTimer: map[string]*time.Timer{},
+		parsed:     map[string]bool{},
 	}, nil
 }
 
+// hidden returns whether file is a dotfile, such as the metadata that dl keeps
+// next to downloaded files, which are never parsed
+func hidden(file string) bool {
+	return strings.HasPrefix(path.Base(file), ".")
+}
+
+// watching returns whether events for file should be acted upon
+func (w *Watcher) watching(file string) bool {
+	if len(w.Files) == 0 {
+		return !hidden(file)
+	}
+
+	file = path.Clean(file)
+	for _, f := range w.Files {
+		if f == file {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileLock returns the lock that parses and removals of file hold, so that a
+// parse that was in flight when file was removed can't add its hosts back
+// after they were reset
+func (w *Watcher) fileLock(file string) *sync.Mutex {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.fileMu == nil {
+		w.fileMu = map[string]*sync.Mutex{}
+	}
+
+	l, ok := w.fileMu[file]
+	if !ok {
+		l = &sync.Mutex{}
+		w.fileMu[file] = l
+	}
+
+	return l
+}
+
 func (w *Watcher) parse(file string) {
 	w.mu.Lock()
 	delete(w.parseTimer, file)
 	w.mu.Unlock()
 
+	if info, err := os.Stat(file); err == nil && info.IsDir() {
+		return
+	}
+
+	l := w.fileLock(file)
+	l.Lock()
+	defer l.Unlock()
+
+	// marked before opening so that once file has been opened, its removal
+	// always resets it
+	w.mu.Lock()
+	w.parsed[file] = true
+	w.mu.Unlock()
+
 	f, err := os.Open(file)
 	if err != nil {
 		w.Logger.WithError(err).WithField("file", file).Warn("error opening file")
@@ -79,6 +203,10 @@ func (w *Watcher) parse(file string) {
 		}
 	}
 
+	if f, ok := w.Parser.(parser.Finisher); ok {
+		f.Finish(file)
+	}
+
 	if err := scanner.Err(); err != nil {
 		w.Logger.WithError(err).WithField("file", file).Warn("error scanning file")
 		return
@@ -109,25 +237,96 @@ func (w *Watcher) setParseTimer(file string) {
 }
 
 func (w *Watcher) parseAll() {
+	for _, f := range w.Files {
+		go w.parse(f)
+	}
+
 	for _, d := range w.Dir {
-		f, err := os.Open(d)
+		w.parseDir(d)
+	}
+}
+
+// parseDir parses every file in dir and the directories in it that aren't
+// hidden
+func (w *Watcher) parseDir(dir string) {
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
-			w.Logger.WithError(err).WithField("dir", d).Warn("error opening dir")
-			continue
+			return err
 		}
 
-		defer func() { _ = f.Close() }()
+		if name != dir && hidden(name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		fi, err := f.Readdir(-1)
-		if err != nil {
-			w.Logger.WithError(err).WithField("dir", d).Warn("error reading dir")
-			continue
+		if !info.IsDir() {
+			go w.parse(name)
 		}
 
-		for _, fd := range fi {
-			go w.parse(path.Join(d, fd.Name()))
+		return nil
+	})
+
+	if err != nil {
+		w.Logger.WithError(err).WithField("dir", dir).Warn("error reading dir")
+	}
+}
+
+// remove resets the hosts of name, or of every file in it if it was a
+// directory, since it was removed or renamed
+func (w *Watcher) remove(name string) {
+	w.mu.Lock()
+
+	var files []string
+	for file := range w.parsed {
+		if file == name || strings.HasPrefix(file, name+"/") {
+			files = append(files, file)
+			delete(w.parsed, file)
+
+			if t, ok := w.parseTimer[file]; ok {
+				t.Stop()
+				delete(w.parseTimer, file)
+			}
 		}
 	}
+
+	w.mu.Unlock()
+
+	for _, file := range files {
+		l := w.fileLock(file)
+		l.Lock()
+		w.Parser.Reset(file)
+		l.Unlock()
+
+		w.Logger.WithField("file", file).Debug("removed")
+	}
+}
+
+// created starts watching name if it is a new directory, and parses the files
+// in it
+func (w *Watcher) created(name string) bool {
+	if len(w.Files) > 0 {
+		return false
+	}
+
+	info, err := os.Stat(name)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+
+	if err = addDir(w.watcher, name); err != nil {
+		w.Logger.WithError(err).WithField("dir", name).Warn("error watching dir")
+	}
+
+	w.parseDir(name)
+
+	return true
+}
+
+// Refresh parses every watched file again
+func (w *Watcher) Refresh() {
+	w.parseAll()
 }
 
 func (w *Watcher) Start() {
@@ -144,6 +343,19 @@ func (w *Watcher) Start() {
 		for {
 			select {
 			case event := <-w.watcher.Events:
+				if !w.watching(event.Name) {
+					break
+				}
+
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) > 0 {
+					w.remove(event.Name)
+					break
+				}
+
+				if event.Op&fsnotify.Create > 0 && w.created(event.Name) {
+					break
+				}
+
 				if event.Op&fsnotify.Chmod > 0 {
 					go w.parse(event.Name)
 					break
@@ -177,5 +389,10 @@ func (w *Watcher) Stop() {
 	<-w.stopCh
 	w.stopCh = nil
 
+	if len(w.Files) > 0 {
+		w.Logger.WithField("files", strings.Join(w.Files, ", ")).Debug("stopped watching files")
+		return
+	}
+
 	w.Logger.WithField("directories", strings.Join(w.Dir, ", ")).Debug("stopped watching directories")
 }
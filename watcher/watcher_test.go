@@ -1,12 +1,161 @@
 package watcher
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"jrubin.io/slog"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// testParser records the lines of each file that has been parsed and not reset
+type testParser struct {
+	mu    sync.Mutex
+	lines map[string][]string
+}
+
+func (p *testParser) Parse(fileName string, lineNum int, line string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lines[fileName] = append(p.lines[fileName], line)
+	return true
+}
+
+func (p *testParser) Reset(fileName string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.lines, fileName)
+}
+
+func (p *testParser) has(fileName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.lines[fileName]
+	return ok
+}
+
+// eventually returns whether fn returns true within a few seconds
+func eventually(fn func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if fn() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
 func TestWatcher(t *testing.T) {
 	Convey("watcher should work", t, func() {
+		dir, err := ioutil.TempDir("", "watcher")
+		So(err, ShouldBeNil)
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		write := func(name string) string {
+			name = filepath.Join(dir, name)
+			So(os.MkdirAll(filepath.Dir(name), 0700), ShouldBeNil)
+			So(ioutil.WriteFile(name, []byte("example.com\n"), 0600), ShouldBeNil)
+			return name
+		}
+
+		top := write("top.txt")
+		sub := write("sub/sub.txt")
+		hidden := write(".hidden/hidden.txt")
+		meta := write(".top.txt.meta")
+
+		p := &testParser{lines: map[string][]string{}}
+
+		w, err := New(slog.New(), p, dir)
+		So(err, ShouldBeNil)
+
+		w.Start()
+		defer w.Stop()
+
+		// subdirectories are parsed, hidden files and directories aren't
+		So(eventually(func() bool { return p.has(top) && p.has(sub) }), ShouldBeTrue)
+		So(p.has(hidden), ShouldBeFalse)
+		So(p.has(meta), ShouldBeFalse)
+
+		// removed and renamed files are reset
+		So(os.Remove(top), ShouldBeNil)
+		So(eventually(func() bool { return !p.has(top) }), ShouldBeTrue)
+
+		So(os.Rename(sub, filepath.Join(dir, ".sub.txt")), ShouldBeNil)
+		So(eventually(func() bool { return !p.has(sub) }), ShouldBeTrue)
+
+		// new directories are watched
+		So(os.Mkdir(filepath.Join(dir, "new"), 0700), ShouldBeNil)
+		created := write("new/created.txt")
+		So(eventually(func() bool { return p.has(created) }), ShouldBeTrue)
+
+		// removing a directory resets the files in it
+		So(os.RemoveAll(filepath.Join(dir, "new")), ShouldBeNil)
+		So(eventually(func() bool { return !p.has(created) }), ShouldBeTrue)
+	})
+}
+
+// blockingParser signals started when it is first asked to parse a line and
+// then waits for release
+type blockingParser struct {
+	testParser
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingParser) Parse(fileName string, lineNum int, line string) bool {
+	p.once.Do(func() {
+		close(p.started)
+		<-p.release
+	})
+	return p.testParser.Parse(fileName, lineNum, line)
+}
+
+func TestWatcherRemoveDuringParse(t *testing.T) {
+	Convey("files removed while they are parsed should be reset", t, func() {
+		dir, err := ioutil.TempDir("", "watcher")
+		So(err, ShouldBeNil)
+		defer func() { _ = os.RemoveAll(dir) }()
+
+		name := filepath.Join(dir, "hosts")
+		So(ioutil.WriteFile(name, []byte("example.com\n"), 0600), ShouldBeNil)
+
+		p := &blockingParser{
+			testParser: testParser{lines: map[string][]string{}},
+			started:    make(chan struct{}),
+			release:    make(chan struct{}),
+		}
+
+		w, err := NewFiles(slog.New(), p, name)
+		So(err, ShouldBeNil)
+
+		parsed := make(chan struct{})
+		go func() {
+			w.parse(name)
+			close(parsed)
+		}()
+
+		<-p.started
+		So(os.Remove(name), ShouldBeNil)
+
+		removed := make(chan struct{})
+		go func() {
+			w.remove(name)
+			close(removed)
+		}()
+
+		// give the removal a chance to reset the file before the parse ends
+		time.Sleep(50 * time.Millisecond)
+		close(p.release)
+
+		<-parsed
+		<-removed
+
+		So(p.has(name), ShouldBeFalse)
 	})
 }
@@ -3,6 +3,7 @@ package whitelist
 import (
 	"github.com/armon/go-radix"
 	"jrubin.io/blamedns/dnsserver"
+	"jrubin.io/blamedns/idn"
 	"jrubin.io/blamedns/parser"
 )
 
@@ -24,6 +25,11 @@ func New(domains ...string) WhiteList {
 	}
 
 	for _, domain := range domains {
+		// queries are for A-labels, so unicode domains have to be converted
+		if d, err := idn.ToASCII(domain); err == nil {
+			domain = d
+		}
+
 		key := parser.ReverseHostName(domain)
 		ret.data.Insert(key, nil)
 	}
@@ -14,5 +14,8 @@ func TestWhiteList(t *testing.T) {
 		So(wl.Pass("www.example.com"), ShouldBeTrue)
 		So(wl.Pass("com"), ShouldBeFalse)
 		So(wl.Pass("srv.www.example.com"), ShouldBeFalse)
+
+		wl = New("bücher.example")
+		So(wl.Pass("xn--bcher-kva.example"), ShouldBeTrue)
 	})
 }